@@ -14,9 +14,18 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -32,6 +41,149 @@ import (
 	"github.com/prometheus/statsd_exporter/pkg/mapper"
 )
 
+// The metrics about the exporter itself, which the server registers, are
+// created unregistered for the tests.
+var (
+	eventStats = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_events_total",
+			Help: "The total number of StatsD events seen.",
+		},
+		[]string{"type"},
+	)
+	eventsFlushed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_event_queue_flushed_total",
+			Help: "Number of times events were flushed to exporter",
+		},
+	)
+	eventsUnmapped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_events_unmapped_total",
+			Help: "The total number of StatsD events no mapping was found for.",
+		},
+	)
+	udpPackets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_udp_packets_total",
+			Help: "The total number of StatsD packets received over UDP.",
+		},
+		[]string{"listener"},
+	)
+	tcpConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tcp_connections_total",
+			Help: "The total number of TCP connections handled.",
+		},
+		[]string{"listener"},
+	)
+	tcpErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tcp_connection_errors_total",
+			Help: "The number of errors encountered reading from TCP.",
+		},
+		[]string{"listener"},
+	)
+	tcpLineTooLong = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tcp_too_long_lines_total",
+			Help: "The number of lines discarded due to being too long.",
+		},
+		[]string{"listener"},
+	)
+	unixgramPackets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_unixgram_packets_total",
+			Help: "The total number of StatsD packets received over Unixgram.",
+		},
+		[]string{"listener"},
+	)
+	unixConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_unix_connections_total",
+			Help: "The total number of unix stream socket connections handled.",
+		},
+		[]string{"listener"},
+	)
+	unixErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_unix_connection_errors_total",
+			Help: "The number of errors encountered reading from unix stream sockets.",
+		},
+		[]string{"listener"},
+	)
+	unixLineTooLong = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_unix_too_long_lines_total",
+			Help: "The number of lines received over unix stream sockets discarded due to being too long.",
+		},
+		[]string{"listener"},
+	)
+	linesReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_lines_total",
+			Help: "The total number of StatsD lines received.",
+		},
+		[]string{"listener"},
+	)
+	samplesReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_samples_total",
+			Help: "The total number of StatsD samples received.",
+		},
+		[]string{"listener"},
+	)
+	sampleErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_sample_errors_total",
+			Help: "The total number of errors parsing StatsD samples.",
+		},
+		[]string{"reason", "listener"},
+	)
+	tagsReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tags_total",
+			Help: "The total number of DogStatsD tags processed.",
+		},
+		[]string{"listener"},
+	)
+	tagErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tag_errors_total",
+			Help: "The number of errors parsing DogStatsD tags.",
+		},
+		[]string{"listener"},
+	)
+	conflictingEventStats = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_events_conflict_total",
+			Help: "The total number of StatsD events with conflicting names.",
+		},
+		[]string{"type"},
+	)
+	errorEventStats = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_events_error_total",
+			Help: "The total number of StatsD events discarded due to errors.",
+		},
+		[]string{"reason"},
+	)
+	eventsActions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_events_actions_total",
+			Help: "The total number of StatsD events by action.",
+		},
+		[]string{"action"},
+	)
+	metricsCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_metrics_total",
+			Help: "The total number of metrics.",
+		},
+		[]string{"type"},
+	)
+)
+
 func TestHandlePacket(t *testing.T) {
 	scenarios := []struct {
 		name string
@@ -542,28 +694,41 @@ func TestHandlePacket(t *testing.T) {
 		EventHandler:    nil,
 		Logger:          log.NewNopLogger(),
 		LineParser:      parser,
-		UDPPackets:      udpPackets,
-		LinesReceived:   linesReceived,
+		UDPPackets:      udpPackets.WithLabelValues("test"),
+		LinesReceived:   linesReceived.WithLabelValues("test"),
 		EventsFlushed:   eventsFlushed,
-		SampleErrors:    *sampleErrors,
-		SamplesReceived: samplesReceived,
-		TagErrors:       tagErrors,
-		TagsReceived:    tagsReceived,
+		SampleErrors:    *sampleErrors.MustCurryWith(prometheus.Labels{"listener": "test"}),
+		SamplesReceived: samplesReceived.WithLabelValues("test"),
+		TagErrors:       tagErrors.WithLabelValues("test"),
+		TagsReceived:    tagsReceived.WithLabelValues("test"),
 	}, &mockStatsDTCPListener{listener.StatsDTCPListener{
 		Conn:            nil,
 		EventHandler:    nil,
 		Logger:          log.NewNopLogger(),
 		LineParser:      parser,
-		LinesReceived:   linesReceived,
+		LinesReceived:   linesReceived.WithLabelValues("test"),
 		EventsFlushed:   eventsFlushed,
-		SampleErrors:    *sampleErrors,
-		SamplesReceived: samplesReceived,
-		TagErrors:       tagErrors,
-		TagsReceived:    tagsReceived,
-		TCPConnections:  tcpConnections,
-		TCPErrors:       tcpErrors,
-		TCPLineTooLong:  tcpLineTooLong,
-	}, log.NewNopLogger()}} {
+		SampleErrors:    *sampleErrors.MustCurryWith(prometheus.Labels{"listener": "test"}),
+		SamplesReceived: samplesReceived.WithLabelValues("test"),
+		TagErrors:       tagErrors.WithLabelValues("test"),
+		TagsReceived:    tagsReceived.WithLabelValues("test"),
+		TCPConnections:  tcpConnections.WithLabelValues("test"),
+		TCPErrors:       tcpErrors.WithLabelValues("test"),
+		TCPLineTooLong:  tcpLineTooLong.WithLabelValues("test"),
+	}, log.NewNopLogger()}, &mockStatsDUnixListener{listener.StatsDUnixListener{
+		Conn:            nil,
+		EventHandler:    nil,
+		Logger:          log.NewNopLogger(),
+		LineParser:      parser,
+		LinesReceived:   linesReceived.WithLabelValues("test"),
+		SampleErrors:    *sampleErrors.MustCurryWith(prometheus.Labels{"listener": "test"}),
+		SamplesReceived: samplesReceived.WithLabelValues("test"),
+		TagErrors:       tagErrors.WithLabelValues("test"),
+		TagsReceived:    tagsReceived.WithLabelValues("test"),
+		UnixConnections: unixConnections.WithLabelValues("test"),
+		UnixErrors:      unixErrors.WithLabelValues("test"),
+		UnixLineTooLong: unixLineTooLong.WithLabelValues("test"),
+	}}} {
 		events := make(chan event.Events, 32)
 		l.SetEventHandler(&event.UnbufferedEventHandler{C: events})
 		for i, scenario := range scenarios {
@@ -630,6 +795,522 @@ func (ml *mockStatsDTCPListener) HandlePacket(packet []byte) {
 	ml.HandleConn(sc)
 }
 
+type mockStatsDUnixListener struct {
+	listener.StatsDUnixListener
+}
+
+func (ml *mockStatsDUnixListener) HandlePacket(packet []byte) {
+	dir, err := ioutil.TempDir("", "statsd_exporter")
+	if err != nil {
+		panic(fmt.Sprintf("mockStatsDUnixListener: creating directory failed: %v", err))
+	}
+	defer os.RemoveAll(dir)
+
+	addr := &net.UnixAddr{Net: "unix", Name: filepath.Join(dir, "statsd.sock")}
+	lc, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		panic(fmt.Sprintf("mockStatsDUnixListener: listen failed: %v", err))
+	}
+
+	defer lc.Close()
+
+	go func() {
+		cc, err := net.DialUnix("unix", nil, addr)
+		if err != nil {
+			panic(fmt.Sprintf("mockStatsDUnixListener: dial failed: %v", err))
+		}
+
+		defer cc.Close()
+
+		n, err := cc.Write(packet)
+		if err != nil || n != len(packet) {
+			panic(fmt.Sprintf("mockStatsDUnixListener: write failed: %v,%d", err, n))
+		}
+	}()
+
+	sc, err := lc.AcceptUnix()
+	if err != nil {
+		panic(fmt.Sprintf("mockStatsDUnixListener: accept failed: %v", err))
+	}
+	ml.HandleConn(sc)
+}
+
+func TestHandleGraphitePacket(t *testing.T) {
+	scenarios := []struct {
+		name string
+		in   string
+		out  event.Events
+	}{
+		{
+			name: "empty",
+			in:   "",
+			out:  event.Events{},
+		}, {
+			name: "simple line",
+			in:   "foo.bar 1.5 1600000000",
+			out: event.Events{
+				&event.GaugeEvent{
+					GMetricName: "foo.bar",
+					GValue:      1.5,
+					GTimestamp:  time.Unix(1600000000, 0),
+					GLabels:     map[string]string{},
+				},
+			},
+		}, {
+			name: "multiple lines with tags",
+			in:   "foo.bar;env=prod 1 1600000000\nfoo.baz 2 1600000000",
+			out: event.Events{
+				&event.GaugeEvent{
+					GMetricName: "foo.bar",
+					GValue:      1,
+					GTimestamp:  time.Unix(1600000000, 0),
+					GLabels:     map[string]string{"env": "prod"},
+				},
+				&event.GaugeEvent{
+					GMetricName: "foo.baz",
+					GValue:      2,
+					GTimestamp:  time.Unix(1600000000, 0),
+					GLabels:     map[string]string{},
+				},
+			},
+		}, {
+			name: "bad line",
+			in:   "foo.bar",
+			out:  event.Events{},
+		},
+	}
+
+	parser := line.NewParser()
+
+	for k, l := range []statsDPacketHandler{&listener.GraphiteUDPListener{
+		Conn:            nil,
+		EventHandler:    nil,
+		Logger:          log.NewNopLogger(),
+		LineParser:      parser,
+		UDPPackets:      udpPackets.WithLabelValues("test"),
+		LinesReceived:   linesReceived.WithLabelValues("test"),
+		SampleErrors:    *sampleErrors.MustCurryWith(prometheus.Labels{"listener": "test"}),
+		SamplesReceived: samplesReceived.WithLabelValues("test"),
+		TagErrors:       tagErrors.WithLabelValues("test"),
+		TagsReceived:    tagsReceived.WithLabelValues("test"),
+	}, &mockGraphiteTCPListener{listener.GraphiteTCPListener{
+		Conn:            nil,
+		EventHandler:    nil,
+		Logger:          log.NewNopLogger(),
+		LineParser:      parser,
+		LinesReceived:   linesReceived.WithLabelValues("test"),
+		SampleErrors:    *sampleErrors.MustCurryWith(prometheus.Labels{"listener": "test"}),
+		SamplesReceived: samplesReceived.WithLabelValues("test"),
+		TagErrors:       tagErrors.WithLabelValues("test"),
+		TagsReceived:    tagsReceived.WithLabelValues("test"),
+		TCPConnections:  tcpConnections.WithLabelValues("test"),
+		TCPErrors:       tcpErrors.WithLabelValues("test"),
+		TCPLineTooLong:  tcpLineTooLong.WithLabelValues("test"),
+	}}} {
+		events := make(chan event.Events, 32)
+		l.SetEventHandler(&event.UnbufferedEventHandler{C: events})
+		for i, scenario := range scenarios {
+			l.HandlePacket([]byte(scenario.in))
+
+			le := len(events)
+			// Flatten actual events.
+			actual := event.Events{}
+			for i := 0; i < le; i++ {
+				actual = append(actual, <-events...)
+			}
+
+			if len(actual) != len(scenario.out) {
+				t.Fatalf("%d.%d. Expected %d events, got %d in scenario '%s'", k, i, len(scenario.out), len(actual), scenario.name)
+			}
+
+			for j, expected := range scenario.out {
+				if !reflect.DeepEqual(&expected, &actual[j]) {
+					t.Fatalf("%d.%d.%d. Expected %#v, got %#v in scenario '%s'", k, i, j, expected, actual[j], scenario.name)
+				}
+			}
+		}
+	}
+}
+
+type mockGraphiteTCPListener struct {
+	listener.GraphiteTCPListener
+}
+
+func (ml *mockGraphiteTCPListener) HandlePacket(packet []byte) {
+	lc, err := net.ListenTCP("tcp4", nil)
+	if err != nil {
+		panic(fmt.Sprintf("mockGraphiteTCPListener: listen failed: %v", err))
+	}
+
+	defer lc.Close()
+
+	go func() {
+		cc, err := net.DialTCP("tcp", nil, lc.Addr().(*net.TCPAddr))
+		if err != nil {
+			panic(fmt.Sprintf("mockGraphiteTCPListener: dial failed: %v", err))
+		}
+
+		defer cc.Close()
+
+		n, err := cc.Write(packet)
+		if err != nil || n != len(packet) {
+			panic(fmt.Sprintf("mockGraphiteTCPListener: write failed: %v,%d", err, n))
+		}
+	}()
+
+	sc, err := lc.AcceptTCP()
+	if err != nil {
+		panic(fmt.Sprintf("mockGraphiteTCPListener: accept failed: %v", err))
+	}
+	ml.HandleConn(sc)
+}
+
+func TestHandleInfluxPacket(t *testing.T) {
+	scenarios := []struct {
+		name string
+		in   string
+		out  event.Events
+	}{
+		{
+			name: "empty",
+			in:   "",
+			out:  event.Events{},
+		}, {
+			name: "multiple fields",
+			in:   "cpu,host=web01 user=1.5,system=2i 1600000000000000000",
+			out: event.Events{
+				&event.GaugeEvent{
+					GMetricName: "cpu_user",
+					GValue:      1.5,
+					GTimestamp:  time.Unix(1600000000, 0),
+					GLabels:     map[string]string{"host": "web01"},
+				},
+				&event.GaugeEvent{
+					GMetricName: "cpu_system",
+					GValue:      2,
+					GTimestamp:  time.Unix(1600000000, 0),
+					GLabels:     map[string]string{"host": "web01"},
+				},
+			},
+		}, {
+			name: "multiple lines",
+			in:   "cpu value=1\nmem,env=prod used=2",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "cpu_value", GValue: 1, GLabels: map[string]string{}},
+				&event.GaugeEvent{GMetricName: "mem_used", GValue: 2, GLabels: map[string]string{"env": "prod"}},
+			},
+		}, {
+			name: "malformed line",
+			in:   "cpu",
+			out:  event.Events{},
+		},
+	}
+
+	parser := line.NewParser()
+
+	for k, l := range []statsDPacketHandler{&listener.InfluxUDPListener{
+		Conn:            nil,
+		EventHandler:    nil,
+		Logger:          log.NewNopLogger(),
+		LineParser:      parser,
+		UDPPackets:      udpPackets.WithLabelValues("test"),
+		LinesReceived:   linesReceived.WithLabelValues("test"),
+		SampleErrors:    *sampleErrors.MustCurryWith(prometheus.Labels{"listener": "test"}),
+		SamplesReceived: samplesReceived.WithLabelValues("test"),
+		TagErrors:       tagErrors.WithLabelValues("test"),
+		TagsReceived:    tagsReceived.WithLabelValues("test"),
+	}, &mockInfluxTCPListener{listener.InfluxTCPListener{
+		Conn:            nil,
+		EventHandler:    nil,
+		Logger:          log.NewNopLogger(),
+		LineParser:      parser,
+		LinesReceived:   linesReceived.WithLabelValues("test"),
+		SampleErrors:    *sampleErrors.MustCurryWith(prometheus.Labels{"listener": "test"}),
+		SamplesReceived: samplesReceived.WithLabelValues("test"),
+		TagErrors:       tagErrors.WithLabelValues("test"),
+		TagsReceived:    tagsReceived.WithLabelValues("test"),
+		TCPConnections:  tcpConnections.WithLabelValues("test"),
+		TCPErrors:       tcpErrors.WithLabelValues("test"),
+		TCPLineTooLong:  tcpLineTooLong.WithLabelValues("test"),
+	}}} {
+		events := make(chan event.Events, 32)
+		l.SetEventHandler(&event.UnbufferedEventHandler{C: events})
+		for i, scenario := range scenarios {
+			l.HandlePacket([]byte(scenario.in))
+
+			le := len(events)
+			// Flatten actual events.
+			actual := event.Events{}
+			for i := 0; i < le; i++ {
+				actual = append(actual, <-events...)
+			}
+
+			if len(actual) != len(scenario.out) {
+				t.Fatalf("%d.%d. Expected %d events, got %d in scenario '%s'", k, i, len(scenario.out), len(actual), scenario.name)
+			}
+
+			for j, expected := range scenario.out {
+				if !reflect.DeepEqual(&expected, &actual[j]) {
+					t.Fatalf("%d.%d.%d. Expected %#v, got %#v in scenario '%s'", k, i, j, expected, actual[j], scenario.name)
+				}
+			}
+		}
+	}
+}
+
+type mockInfluxTCPListener struct {
+	listener.InfluxTCPListener
+}
+
+func (ml *mockInfluxTCPListener) HandlePacket(packet []byte) {
+	lc, err := net.ListenTCP("tcp4", nil)
+	if err != nil {
+		panic(fmt.Sprintf("mockInfluxTCPListener: listen failed: %v", err))
+	}
+
+	defer lc.Close()
+
+	go func() {
+		cc, err := net.DialTCP("tcp", nil, lc.Addr().(*net.TCPAddr))
+		if err != nil {
+			panic(fmt.Sprintf("mockInfluxTCPListener: dial failed: %v", err))
+		}
+
+		defer cc.Close()
+
+		n, err := cc.Write(packet)
+		if err != nil || n != len(packet) {
+			panic(fmt.Sprintf("mockInfluxTCPListener: write failed: %v,%d", err, n))
+		}
+	}()
+
+	sc, err := lc.AcceptTCP()
+	if err != nil {
+		panic(fmt.Sprintf("mockInfluxTCPListener: accept failed: %v", err))
+	}
+	ml.HandleConn(sc)
+}
+
+func TestInfluxHTTPHandler(t *testing.T) {
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(s))
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	scenarios := []struct {
+		name      string
+		method    string
+		query     string
+		gzip      bool
+		in        string
+		code      int
+		expected  int
+		timestamp time.Time
+	}{
+		{
+			name:     "plain body",
+			method:   http.MethodPost,
+			in:       "cpu value=1\nmem used=2,free=3",
+			code:     http.StatusNoContent,
+			expected: 3,
+		}, {
+			name:      "gzip body with precision",
+			method:    http.MethodPost,
+			query:     "?db=telegraf&precision=s",
+			gzip:      true,
+			in:        "cpu value=1 1600000000",
+			code:      http.StatusNoContent,
+			expected:  1,
+			timestamp: time.Unix(1600000000, 0),
+		}, {
+			name:     "rejected line",
+			method:   http.MethodPost,
+			in:       "cpu value=1\nbroken",
+			code:     http.StatusBadRequest,
+			expected: 1,
+		}, {
+			name:   "bad precision",
+			method: http.MethodPost,
+			query:  "?precision=d",
+			in:     "cpu value=1",
+			code:   http.StatusBadRequest,
+		}, {
+			name:   "wrong method",
+			method: http.MethodGet,
+			code:   http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			events := make(chan event.Events, 32)
+			h := &listener.InfluxHTTPHandler{
+				EventHandler:    &event.UnbufferedEventHandler{C: events},
+				Logger:          log.NewNopLogger(),
+				LineParser:      line.NewParser(),
+				LinesReceived:   linesReceived.WithLabelValues("test"),
+				SampleErrors:    *sampleErrors.MustCurryWith(prometheus.Labels{"listener": "test"}),
+				SamplesReceived: samplesReceived.WithLabelValues("test"),
+				TagErrors:       tagErrors.WithLabelValues("test"),
+				TagsReceived:    tagsReceived.WithLabelValues("test"),
+			}
+
+			body := []byte(scenario.in)
+			if scenario.gzip {
+				body = gzipped(scenario.in)
+			}
+			req := httptest.NewRequest(scenario.method, "/write"+scenario.query, bytes.NewReader(body))
+			if scenario.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != scenario.code {
+				t.Fatalf("Expected status %d, got %d: %s", scenario.code, rec.Code, rec.Body.String())
+			}
+
+			actual := event.Events{}
+			for le := len(events); le > 0; le-- {
+				actual = append(actual, <-events...)
+			}
+			if len(actual) != scenario.expected {
+				t.Fatalf("Expected %d events, got %d: %#v", scenario.expected, len(actual), actual)
+			}
+			if !scenario.timestamp.IsZero() {
+				ts := actual[0].(*event.GaugeEvent).GTimestamp
+				if !ts.Equal(scenario.timestamp) {
+					t.Fatalf("Expected timestamp %v, got %v", scenario.timestamp, ts)
+				}
+			}
+		})
+	}
+}
+
+func TestStatsDHTTPHandler(t *testing.T) {
+	scenarios := []struct {
+		name        string
+		method      string
+		gzip        bool
+		in          string
+		maxBodySize int64
+		code        int
+		expected    listener.StatsDHTTPResponse
+	}{
+		{
+			name:   "plain body",
+			method: http.MethodPost,
+			in:     "foo:1|c\nbar:2|g|#tag:value\n\n",
+			code:   http.StatusOK,
+			expected: listener.StatsDHTTPResponse{
+				Lines:    2,
+				Accepted: 2,
+				Reasons:  map[string]int{},
+			},
+		}, {
+			name:   "gzip body with rejected lines",
+			method: http.MethodPost,
+			gzip:   true,
+			in:     "foo:1|c\nfoo\nbar:x|c\nbaz:1|c||#a:b",
+			code:   http.StatusOK,
+			expected: listener.StatsDHTTPResponse{
+				Lines:    4,
+				Accepted: 1,
+				Rejected: 3,
+				Reasons: map[string]int{
+					"malformed_line":      1,
+					"malformed_value":     1,
+					"malformed_component": 1,
+				},
+			},
+		}, {
+			name:        "body too large",
+			method:      http.MethodPost,
+			in:          "foo:1|c\nfoo:x|c\nfoo:3|c\n",
+			maxBodySize: 16,
+			code:        http.StatusRequestEntityTooLarge,
+			expected: listener.StatsDHTTPResponse{
+				Lines:    2,
+				Accepted: 1,
+				Rejected: 1,
+				Reasons:  map[string]int{"malformed_value": 1},
+				Error:    "error reading body: http: request body too large",
+			},
+		}, {
+			name:        "decompressed body too large",
+			method:      http.MethodPost,
+			gzip:        true,
+			in:          strings.Repeat("foo:1|c\n", 100),
+			maxBodySize: 80,
+			code:        http.StatusRequestEntityTooLarge,
+			expected: listener.StatsDHTTPResponse{
+				Lines:    10,
+				Accepted: 10,
+				Reasons:  map[string]int{},
+				Error:    "error reading body: http: request body too large",
+			},
+		}, {
+			name:   "wrong method",
+			method: http.MethodGet,
+			code:   http.StatusMethodNotAllowed,
+			expected: listener.StatsDHTTPResponse{
+				Reasons: map[string]int{},
+				Error:   "only POST is supported",
+			},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			events := make(chan event.Events, 32)
+			h := &listener.StatsDHTTPHandler{
+				EventHandler:    &event.UnbufferedEventHandler{C: events},
+				Logger:          log.NewNopLogger(),
+				LineParser:      line.NewParser(),
+				LinesReceived:   linesReceived.WithLabelValues("test"),
+				SampleErrors:    *sampleErrors.MustCurryWith(prometheus.Labels{"listener": "test"}),
+				SamplesReceived: samplesReceived.WithLabelValues("test"),
+				TagErrors:       tagErrors.WithLabelValues("test"),
+				TagsReceived:    tagsReceived.WithLabelValues("test"),
+				MaxBodySize:     scenario.maxBodySize,
+			}
+			h.LineParser.EnableDogstatsdParsing()
+
+			body := []byte(scenario.in)
+			if scenario.gzip {
+				var buf bytes.Buffer
+				gz := gzip.NewWriter(&buf)
+				gz.Write(body)
+				gz.Close()
+				body = buf.Bytes()
+			}
+			req := httptest.NewRequest(scenario.method, "/api/v1/statsd", bytes.NewReader(body))
+			if scenario.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != scenario.code {
+				t.Fatalf("Expected status %d, got %d: %s", scenario.code, rec.Code, rec.Body.String())
+			}
+			var actual listener.StatsDHTTPResponse
+			if err := json.NewDecoder(rec.Body).Decode(&actual); err != nil {
+				t.Fatalf("Invalid response: %v", err)
+			}
+			if !reflect.DeepEqual(actual, scenario.expected) {
+				t.Fatalf("Expected %#v, got %#v", scenario.expected, actual)
+			}
+			if len(events) != scenario.expected.Accepted {
+				t.Fatalf("Expected %d queued lines, got %d", scenario.expected.Accepted, len(events))
+			}
+		})
+	}
+}
+
 // TestTtlExpiration validates expiration of time series.
 // foobar metric without mapping should expire with default ttl of 1s
 // bazqux metric should expire with ttl of 2s
@@ -657,7 +1338,7 @@ mappings:
 	events := make(chan event.Events)
 	defer close(events)
 	go func() {
-		ex := exporter.NewExporter(testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex := exporter.NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 		ex.Listen(events)
 	}()
 
@@ -18,6 +18,7 @@ import (
 	"testing"
 
 	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/prometheus/statsd_exporter/pkg/event"
 	"github.com/prometheus/statsd_exporter/pkg/exporter"
@@ -68,10 +69,10 @@ func benchmarkUDPListener(times int, b *testing.B) {
 			EventHandler:    &event.UnbufferedEventHandler{C: events},
 			Logger:          logger,
 			LineParser:      parser,
-			UDPPackets:      udpPackets,
-			LinesReceived:   linesReceived,
-			SamplesReceived: samplesReceived,
-			TagsReceived:    tagsReceived,
+			UDPPackets:      udpPackets.WithLabelValues("test"),
+			LinesReceived:   linesReceived.WithLabelValues("test"),
+			SamplesReceived: samplesReceived.WithLabelValues("test"),
+			TagsReceived:    tagsReceived.WithLabelValues("test"),
 		}
 
 		// resume benchmark timer
@@ -171,7 +172,7 @@ mappings:
 		b.Fatalf("Config load error: %s %s", config, err)
 	}
 
-	ex := exporter.NewExporter(testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex := exporter.NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 
 	// reset benchmark timer to not measure startup costs
 	b.ResetTimer()
@@ -195,3 +196,48 @@ mappings:
 		ex.Listen(ec)
 	}
 }
+
+// benchmarkExporterShards measures how fast events for many different metrics
+// are handled by the given number of shards.
+func benchmarkExporterShards(b *testing.B, shards int) {
+	var events event.Events
+	for i := 0; i < 100; i++ {
+		events = append(events,
+			&event.CounterEvent{CMetricName: fmt.Sprintf("sharded_counter_%d", i), CValue: 1},
+			&event.ObserverEvent{OMetricName: fmt.Sprintf("sharded_timer_%d", i), OValue: 200},
+		)
+	}
+
+	testMapper := &mapper.MetricMapper{}
+	testMapper.InitCache(0)
+	ex := exporter.NewExporter(prometheus.DefaultRegisterer, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Shards = shards
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ec := make(chan event.Events, 100)
+		go func() {
+			for i := 0; i < 100; i++ {
+				ec <- events
+			}
+			close(ec)
+		}()
+
+		ex.Listen(ec)
+	}
+}
+
+func BenchmarkExporterShards1(b *testing.B) {
+	benchmarkExporterShards(b, 1)
+}
+func BenchmarkExporterShards2(b *testing.B) {
+	benchmarkExporterShards(b, 2)
+}
+func BenchmarkExporterShards4(b *testing.B) {
+	benchmarkExporterShards(b, 4)
+}
+func BenchmarkExporterShards8(b *testing.B) {
+	benchmarkExporterShards(b, 8)
+}
@@ -17,6 +17,7 @@ import (
 	"testing"
 
 	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/prometheus/statsd_exporter/pkg/line"
 )
@@ -55,7 +56,7 @@ func benchmarkLinesToEvents(times int, b *testing.B, input []string) {
 	for n := 0; n < b.N; n++ {
 		for i := 0; i < times; i++ {
 			for _, l := range input {
-				parser.LineToEvents(l, *sampleErrors, samplesReceived, tagErrors, tagsReceived, nopLogger)
+				parser.LineToEvents(l, *sampleErrors.MustCurryWith(prometheus.Labels{"listener": "test"}), samplesReceived.WithLabelValues("test"), tagErrors.WithLabelValues("test"), tagsReceived.WithLabelValues("test"), nopLogger)
 			}
 		}
 	}
@@ -98,7 +99,7 @@ func BenchmarkLineFormats(b *testing.B) {
 			// always report allocations since this is a hot path
 			b.ReportAllocs()
 			for n := 0; n < b.N; n++ {
-				parser.LineToEvents(l, *sampleErrors, samplesReceived, tagErrors, tagsReceived, nopLogger)
+				parser.LineToEvents(l, *sampleErrors.MustCurryWith(prometheus.Labels{"listener": "test"}), samplesReceived.WithLabelValues("test"), tagErrors.WithLabelValues("test"), tagsReceived.WithLabelValues("test"), nopLogger)
 			}
 		})
 	}
@@ -0,0 +1,187 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/line"
+	"github.com/prometheus/statsd_exporter/pkg/listener"
+)
+
+// countingEventHandler closes done once it has been queued target events,
+// and signals progress whenever events are queued.
+type countingEventHandler struct {
+	count    int64
+	target   int64
+	once     sync.Once
+	done     chan struct{}
+	progress chan struct{}
+}
+
+func (h *countingEventHandler) Queue(events event.Events) {
+	if atomic.AddInt64(&h.count, int64(len(events))) >= h.target {
+		h.once.Do(func() { close(h.done) })
+	}
+	select {
+	case h.progress <- struct{}{}:
+	default:
+	}
+}
+
+// benchmarkDatagramListener measures how fast a listener reads packets with
+// one line each from a socket that a client keeps sending to.
+func benchmarkDatagramListener(b *testing.B, network string, batchSize int) {
+	if batchSize > 1 && !listener.BatchReadsSupported {
+		b.Skip("batched reads are not supported on this platform")
+	}
+
+	handler := &countingEventHandler{
+		target:   int64(b.N),
+		done:     make(chan struct{}),
+		progress: make(chan struct{}, 1),
+	}
+	var (
+		l      interface{ Listen() }
+		conn   net.Conn
+		client net.Conn
+	)
+	switch network {
+	case "udp":
+		uconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn = uconn
+		l = &listener.StatsDUDPListener{
+			Conn:            uconn,
+			EventHandler:    handler,
+			Logger:          nopLogger,
+			LineParser:      line.NewParser(),
+			UDPPackets:      udpPackets.WithLabelValues("test"),
+			LinesReceived:   linesReceived.WithLabelValues("test"),
+			SampleErrors:    *sampleErrors.MustCurryWith(prometheus.Labels{"listener": "test"}),
+			SamplesReceived: samplesReceived.WithLabelValues("test"),
+			TagErrors:       tagErrors.WithLabelValues("test"),
+			TagsReceived:    tagsReceived.WithLabelValues("test"),
+			BatchSize:       batchSize,
+		}
+		client, err = net.Dial("udp", uconn.LocalAddr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+	case "unixgram":
+		dir, err := ioutil.TempDir("", "statsd_exporter_benchmark")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "statsd.sock")
+		uxgconn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram", Name: path})
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn = uxgconn
+		l = &listener.StatsDUnixgramListener{
+			Conn:            uxgconn,
+			EventHandler:    handler,
+			Logger:          nopLogger,
+			LineParser:      line.NewParser(),
+			UnixgramPackets: unixgramPackets.WithLabelValues("test"),
+			LinesReceived:   linesReceived.WithLabelValues("test"),
+			SampleErrors:    *sampleErrors.MustCurryWith(prometheus.Labels{"listener": "test"}),
+			SamplesReceived: samplesReceived.WithLabelValues("test"),
+			TagErrors:       tagErrors.WithLabelValues("test"),
+			TagsReceived:    tagsReceived.WithLabelValues("test"),
+			BatchSize:       batchSize,
+		}
+		client, err = net.Dial("unixgram", path)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	// The client keeps a window of packets in flight, so that it does not
+	// starve the listener. Packets that did not arrive after a while were
+	// dropped, and are no longer waited for.
+	stop := make(chan struct{})
+	go func() {
+		const window = 128
+		packet := []byte("foo:1|c")
+		timeout := time.NewTimer(time.Hour)
+		var sent int64
+		for {
+			received := atomic.LoadInt64(&handler.count)
+			if sent-received < window {
+				client.Write(packet)
+				sent++
+				continue
+			}
+			timeout.Reset(10 * time.Millisecond)
+			select {
+			case <-stop:
+				return
+			case <-handler.progress:
+			case <-timeout.C:
+				sent = received
+			}
+			if !timeout.Stop() {
+				select {
+				case <-timeout.C:
+				default:
+				}
+			}
+		}
+	}()
+	defer close(stop)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	go l.Listen()
+	<-handler.done
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "packets/s")
+}
+
+func BenchmarkUDPRead(b *testing.B) {
+	benchmarkDatagramListener(b, "udp", 1)
+}
+func BenchmarkUDPReadBatch8(b *testing.B) {
+	benchmarkDatagramListener(b, "udp", 8)
+}
+func BenchmarkUDPReadBatch64(b *testing.B) {
+	benchmarkDatagramListener(b, "udp", 64)
+}
+func BenchmarkUnixgramRead(b *testing.B) {
+	benchmarkDatagramListener(b, "unixgram", 1)
+}
+func BenchmarkUnixgramReadBatch8(b *testing.B) {
+	benchmarkDatagramListener(b, "unixgram", 8)
+}
+func BenchmarkUnixgramReadBatch64(b *testing.B) {
+	benchmarkDatagramListener(b, "unixgram", 64)
+}
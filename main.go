@@ -14,9 +14,7 @@
 package main
 
 import (
-	"bufio"
-	"net"
-	"net/http"
+	"context"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
@@ -25,225 +23,42 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
 	"gopkg.in/alecthomas/kingpin.v2"
 
-	"github.com/prometheus/statsd_exporter/pkg/address"
 	"github.com/prometheus/statsd_exporter/pkg/event"
-	"github.com/prometheus/statsd_exporter/pkg/exporter"
 	"github.com/prometheus/statsd_exporter/pkg/line"
 	"github.com/prometheus/statsd_exporter/pkg/listener"
-	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/server"
 )
 
-const (
-	defaultHelp = "Metric autogenerated by statsd_exporter."
-	regErrF     = "Failed to update metric"
-)
-
-var (
-	eventStats = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_total",
-			Help: "The total number of StatsD events seen.",
-		},
-		[]string{"type"},
-	)
-	eventsFlushed = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_event_queue_flushed_total",
-			Help: "Number of times events were flushed to exporter",
-		},
-	)
-	eventsUnmapped = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_unmapped_total",
-			Help: "The total number of StatsD events no mapping was found for.",
+// flagListeners returns a listener configuration for every address given on
+// the command line for listenerType. Empty addresses are skipped.
+func flagListeners(listenerType string, addresses []string) []listener.ListenerConfig {
+	var cfgs []listener.ListenerConfig
+	for _, addr := range addresses {
+		if addr == "" {
+			continue
+		}
+		cfgs = append(cfgs, listener.ListenerConfig{
+			Name:    listener.ListenerName(listenerType, addr),
+			Type:    listenerType,
+			Address: addr,
 		})
-	udpPackets = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_udp_packets_total",
-			Help: "The total number of StatsD packets received over UDP.",
-		},
-	)
-	tcpConnections = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_tcp_connections_total",
-			Help: "The total number of TCP connections handled.",
-		},
-	)
-	tcpErrors = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_tcp_connection_errors_total",
-			Help: "The number of errors encountered reading from TCP.",
-		},
-	)
-	tcpLineTooLong = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_tcp_too_long_lines_total",
-			Help: "The number of lines discarded due to being too long.",
-		},
-	)
-	unixgramPackets = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_unixgram_packets_total",
-			Help: "The total number of StatsD packets received over Unixgram.",
-		},
-	)
-	linesReceived = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_lines_total",
-			Help: "The total number of StatsD lines received.",
-		},
-	)
-	samplesReceived = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_samples_total",
-			Help: "The total number of StatsD samples received.",
-		},
-	)
-	sampleErrors = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_sample_errors_total",
-			Help: "The total number of errors parsing StatsD samples.",
-		},
-		[]string{"reason"},
-	)
-	tagsReceived = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_tags_total",
-			Help: "The total number of DogStatsD tags processed.",
-		},
-	)
-	tagErrors = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_tag_errors_total",
-			Help: "The number of errors parsing DogStatsD tags.",
-		},
-	)
-	configLoads = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_config_reloads_total",
-			Help: "The number of configuration reloads.",
-		},
-		[]string{"outcome"},
-	)
-	mappingsCount = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "statsd_exporter_loaded_mappings",
-		Help: "The current number of configured metric mappings.",
-	})
-	conflictingEventStats = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_conflict_total",
-			Help: "The total number of StatsD events with conflicting names.",
-		},
-		[]string{"type"},
-	)
-	errorEventStats = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_error_total",
-			Help: "The total number of StatsD events discarded due to errors.",
-		},
-		[]string{"reason"},
-	)
-	eventsActions = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "statsd_exporter_events_actions_total",
-			Help: "The total number of StatsD events by action.",
-		},
-		[]string{"action"},
-	)
-	metricsCount = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "statsd_exporter_metrics_total",
-			Help: "The total number of metrics.",
-		},
-		[]string{"type"},
-	)
-)
-
-func init() {
-	prometheus.MustRegister(version.NewCollector("statsd_exporter"))
-	prometheus.MustRegister(eventStats)
-	prometheus.MustRegister(eventsFlushed)
-	prometheus.MustRegister(eventsUnmapped)
-	prometheus.MustRegister(udpPackets)
-	prometheus.MustRegister(tcpConnections)
-	prometheus.MustRegister(tcpErrors)
-	prometheus.MustRegister(tcpLineTooLong)
-	prometheus.MustRegister(unixgramPackets)
-	prometheus.MustRegister(linesReceived)
-	prometheus.MustRegister(samplesReceived)
-	prometheus.MustRegister(sampleErrors)
-	prometheus.MustRegister(tagsReceived)
-	prometheus.MustRegister(tagErrors)
-	prometheus.MustRegister(configLoads)
-	prometheus.MustRegister(mappingsCount)
-	prometheus.MustRegister(conflictingEventStats)
-	prometheus.MustRegister(errorEventStats)
-	prometheus.MustRegister(eventsActions)
-	prometheus.MustRegister(metricsCount)
-}
-
-// uncheckedCollector wraps a Collector but its Describe method yields no Desc.
-// This allows incoming metrics to have inconsistent label sets
-type uncheckedCollector struct {
-	c prometheus.Collector
-}
-
-func (u uncheckedCollector) Describe(_ chan<- *prometheus.Desc) {}
-func (u uncheckedCollector) Collect(c chan<- prometheus.Metric) {
-	u.c.Collect(c)
-}
-
-func serveHTTP(mux http.Handler, listenAddress string, logger log.Logger) {
-	level.Error(logger).Log("msg", http.ListenAndServe(listenAddress, mux))
-	os.Exit(1)
+	}
+	return cfgs
 }
 
-func sighupConfigReloader(fileName string, mapper *mapper.MetricMapper, cacheSize int, logger log.Logger, option mapper.CacheOption) {
+func sighupConfigReloader(srv *server.Server, logger log.Logger) {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGHUP)
 
 	for s := range signals {
-		if fileName == "" {
-			level.Warn(logger).Log("msg", "Received signal but no mapping config to reload", "signal", s)
-			continue
-		}
-
 		level.Info(logger).Log("msg", "Received signal, attempting reload", "signal", s)
-
-		reloadConfig(fileName, mapper, cacheSize, logger, option)
-	}
-}
-
-func reloadConfig(fileName string, mapper *mapper.MetricMapper, cacheSize int, logger log.Logger, option mapper.CacheOption) {
-	err := mapper.InitFromFile(fileName, cacheSize, option)
-	if err != nil {
-		level.Info(logger).Log("msg", "Error reloading config", "error", err)
-		configLoads.WithLabelValues("failure").Inc()
-	} else {
-		level.Info(logger).Log("msg", "Config reloaded successfully")
-		configLoads.WithLabelValues("success").Inc()
-	}
-}
-
-func dumpFSM(mapper *mapper.MetricMapper, dumpFilename string, logger log.Logger) error {
-	f, err := os.Create(dumpFilename)
-	if err != nil {
-		return err
+		srv.Reload()
 	}
-	level.Info(logger).Log("msg", "Start dumping FSM", "file_name", dumpFilename)
-	w := bufio.NewWriter(f)
-	mapper.FSM.DumpFSM(w)
-	w.Flush()
-	f.Close()
-	level.Info(logger).Log("msg", "Finish dumping FSM")
-	return nil
 }
 
 func main() {
@@ -251,18 +66,44 @@ func main() {
 		listenAddress        = kingpin.Flag("web.listen-address", "The address on which to expose the web interface and generated Prometheus metrics.").Default(":9102").String()
 		enableLifecycle      = kingpin.Flag("web.enable-lifecycle", "Enable shutdown and reload via HTTP request.").Default("false").Bool()
 		metricsEndpoint      = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-		statsdListenUDP      = kingpin.Flag("statsd.listen-udp", "The UDP address on which to receive statsd metric lines. \"\" disables it.").Default(":9125").String()
-		statsdListenTCP      = kingpin.Flag("statsd.listen-tcp", "The TCP address on which to receive statsd metric lines. \"\" disables it.").Default(":9125").String()
-		statsdListenUnixgram = kingpin.Flag("statsd.listen-unixgram", "The Unixgram socket path to receive statsd metric lines in datagram. \"\" disables it.").Default("").String()
+		statsdListenUDP      = kingpin.Flag("statsd.listen-udp", "The UDP address on which to receive statsd metric lines. Can be repeated. \"\" disables it.").Default(":9125").Strings()
+		statsdListenTCP      = kingpin.Flag("statsd.listen-tcp", "The TCP address on which to receive statsd metric lines. Can be repeated. \"\" disables it.").Default(":9125").Strings()
+		statsdListenUnixgram = kingpin.Flag("statsd.listen-unixgram", "The Unixgram socket path to receive statsd metric lines in datagram. Can be repeated. \"\" disables it.").Strings()
+		statsdListenUnix     = kingpin.Flag("statsd.listen-unix", "The unix stream socket path to receive statsd metric lines. Can be repeated. \"\" disables it.").Strings()
+		unixPeerLabels       = kingpin.Flag("statsd.unix-peer-label", "Credentials of the sending process to add as labels to metrics received over the unix stream socket. Can be repeated. Only supported on Linux.").Enums(listener.PeerLabelPID, listener.PeerLabelUID, listener.PeerLabelGID, listener.PeerLabelUser)
+		unixUserNames        = kingpin.Flag("statsd.unix-user-name", "Value of the user label for a uid, as <uid>=<name>. Can be repeated. Other uids are used as is.").StringMap()
+		listenersConfig      = kingpin.Flag("statsd.listeners-config", "Path to a YAML file with additional listeners and their settings.").Default("").String()
+		tcpTLSConfigFile     = kingpin.Flag("statsd.tcp-tls-config", "Path to a YAML file with the TLS settings of the TCP listeners. Takes precedence over the other TLS flags and is reloaded together with the mapping config.").Default("").String()
+		tcpTLSCertFile       = kingpin.Flag("statsd.tcp-tls-cert-file", "Certificate file to serve TLS on the TCP listener. \"\" disables TLS.").Default("").String()
+		tcpTLSKeyFile        = kingpin.Flag("statsd.tcp-tls-key-file", "Key file for the TLS certificate of the TCP listener.").Default("").String()
+		tcpTLSClientCAFile   = kingpin.Flag("statsd.tcp-tls-client-ca-file", "CA certificates to verify TCP client certificates with. Client certificates are required if it is set.").Default("").String()
+		tcpTLSClientAuthType = kingpin.Flag("statsd.tcp-tls-client-auth-type", "Overrides the TLS client authentication policy of the TCP listener, e.g. \"VerifyClientCertIfGiven\".").Default("").String()
+		tcpTLSClientLabel    = kingpin.Flag("statsd.tcp-tls-client-label", "Name of the label to add the common name or subject alternative name of TLS client certificates as. \"\" disables it.").Default("").String()
+		graphiteListenUDP    = kingpin.Flag("graphite.listen-udp", "The UDP address on which to receive Graphite plaintext protocol lines. Can be repeated. \"\" disables it.").Strings()
+		graphiteListenTCP    = kingpin.Flag("graphite.listen-tcp", "The TCP address on which to receive Graphite plaintext protocol lines. Can be repeated. \"\" disables it.").Strings()
+		httpPushPath         = kingpin.Flag("statsd.http-push-path", "Path under which to accept StatsD lines in POST requests on the web interface, e.g. \"/api/v1/statsd\". \"\" disables it.").Default("").String()
+		influxdbListenUDP    = kingpin.Flag("influxdb.listen-udp", "The UDP address on which to receive InfluxDB line protocol. Can be repeated. \"\" disables it.").Strings()
+		influxdbListenTCP    = kingpin.Flag("influxdb.listen-tcp", "The TCP address on which to receive InfluxDB line protocol. Can be repeated. \"\" disables it.").Strings()
+		influxdbWritePath    = kingpin.Flag("influxdb.http-write-path", "Path under which to accept InfluxDB line protocol writes on the web interface, e.g. \"/write\". \"\" disables it.").Default("").String()
 		// not using Int here because flag displays default in decimal, 0755 will show as 493
 		statsdUnixSocketMode = kingpin.Flag("statsd.unixsocket-mode", "The permission mode of the unix socket.").Default("755").String()
 		mappingConfig        = kingpin.Flag("statsd.mapping-config", "Metric mapping configuration file name.").String()
+		tenantsConfig        = kingpin.Flag("statsd.tenants-config", "Path to a YAML file with tenants, whose metrics are exposed with their own mappings under <web.telemetry-path>/<tenant>.").Default("").String()
 		readBuffer           = kingpin.Flag("statsd.read-buffer", "Size (in bytes) of the operating system's transmit read buffer associated with the UDP or Unixgram connection. Please make sure the kernel parameters net.core.rmem_max is set to a value greater than the value specified.").Int()
+		udpSockets           = kingpin.Flag("statsd.udp-sockets", "Number of sockets to bind every UDP listener to with SO_REUSEPORT. The kernel distributes packets between them. Only supported on Linux.").Default("1").Int()
+		udpReaders           = kingpin.Flag("statsd.udp-readers", "Number of goroutines reading from every UDP socket.").Default("1").Int()
+		readBatchSize        = kingpin.Flag("statsd.read-batch-size", "Maximum number of packets the StatsD UDP and Unixgram listeners read with a single system call. Values above 1 use recvmmsg, which is only supported on Linux.").Default("1").Int()
+		parserWorkers        = kingpin.Flag("statsd.parser-workers", "Number of goroutines parsing the packets of every UDP and Unixgram listener. If 0, packets are parsed by the goroutines reading the sockets.").Default("0").Int()
+		packetQueueSize      = kingpin.Flag("statsd.packet-queue-size", "Maximum number of packets of a listener waiting for the parser workers. Further packets are dropped.").Default("10000").Int()
 		cacheSize            = kingpin.Flag("statsd.cache-size", "Maximum size of your metric mapping cache. Relies on least recently used replacement policy if max size is reached.").Default("1000").Int()
 		cacheType            = kingpin.Flag("statsd.cache-type", "Metric mapping cache type. Valid options are \"lru\" and \"random\"").Default("lru").Enum("lru", "random")
 		eventQueueSize       = kingpin.Flag("statsd.event-queue-size", "Size of internal queue for processing events").Default("10000").Int()
 		eventFlushThreshold  = kingpin.Flag("statsd.event-flush-threshold", "Number of events to hold in queue before flushing").Default("1000").Int()
 		eventFlushInterval   = kingpin.Flag("statsd.event-flush-interval", "Number of events to hold in queue before flushing").Default("200ms").Duration()
+		eventQueueOverflow   = kingpin.Flag("statsd.event-queue-overflow", "What to do with flushed events when the event queue is full. One of: [block, drop-newest, drop-oldest]").Default(string(event.OverflowBlock)).Enum(string(event.OverflowBlock), string(event.OverflowDropNewest), string(event.OverflowDropOldest))
+		shutdownTimeout      = kingpin.Flag("shutdown.timeout", "Maximum time to stop the listeners, process the queued events and serve the final scrape on shutdown.").Default("30s").Duration()
+		scrapeWindow         = kingpin.Flag("shutdown.scrape-window", "Maximum time to wait for a final scrape after the queued events have been processed on shutdown. 0 disables it.").Default("0s").Duration()
+		eventShards          = kingpin.Flag("statsd.event-shards", "Number of goroutines mapping events and updating metrics. Events are distributed between them by metric name.").Default("1").Int()
 		dumpFSMPath          = kingpin.Flag("debug.dump-fsm", "The path to dump internal FSM generated for glob matching as Dot file.").Default("").String()
 		checkConfig          = kingpin.Flag("check-config", "Check configuration and exit.").Default("false").Bool()
 		dogstatsdTagsEnabled = kingpin.Flag("statsd.parse-dogstatsd-tags", "Parse DogStatsd style tags. Enabled by default.").Default("true").Bool()
@@ -292,215 +133,116 @@ func main() {
 		parser.EnableSignalFXParsing()
 	}
 
-	cacheOption := mapper.WithCacheType(*cacheType)
-
-	if *statsdListenUDP == "" && *statsdListenTCP == "" && *statsdListenUnixgram == "" {
-		level.Error(logger).Log("At least one of UDP/TCP/Unixgram listeners must be specified.")
-		os.Exit(1)
-	}
-
-	level.Info(logger).Log("msg", "Starting StatsD -> Prometheus Exporter", "version", version.Info())
-	level.Info(logger).Log("msg", "Build context", "context", version.BuildContext())
-	level.Info(logger).Log("msg", "Accepting StatsD Traffic", "udp", *statsdListenUDP, "tcp", *statsdListenTCP, "unixgram", *statsdListenUnixgram)
-	level.Info(logger).Log("msg", "Accepting Prometheus Requests", "addr", *listenAddress)
-
-	events := make(chan event.Events, *eventQueueSize)
-	defer close(events)
-	eventQueue := event.NewEventQueue(events, *eventFlushThreshold, *eventFlushInterval, eventsFlushed)
-
-	if *statsdListenUDP != "" {
-		udpListenAddr, err := address.UDPAddrFromString(*statsdListenUDP)
-		if err != nil {
-			level.Error(logger).Log("msg", "invalid UDP listen address", "address", *statsdListenUDP, "error", err)
-			os.Exit(1)
-		}
-		uconn, err := net.ListenUDP("udp", udpListenAddr)
+	var listenerConfigs []listener.ListenerConfig
+	listenerConfigs = append(listenerConfigs, flagListeners(listener.TypeUDP, *statsdListenUDP)...)
+	listenerConfigs = append(listenerConfigs, flagListeners(listener.TypeTCP, *statsdListenTCP)...)
+	listenerConfigs = append(listenerConfigs, flagListeners(listener.TypeUnixgram, *statsdListenUnixgram)...)
+	listenerConfigs = append(listenerConfigs, flagListeners(listener.TypeUnix, *statsdListenUnix)...)
+	listenerConfigs = append(listenerConfigs, flagListeners(listener.TypeGraphiteUDP, *graphiteListenUDP)...)
+	listenerConfigs = append(listenerConfigs, flagListeners(listener.TypeGraphiteTCP, *graphiteListenTCP)...)
+	listenerConfigs = append(listenerConfigs, flagListeners(listener.TypeInfluxUDP, *influxdbListenUDP)...)
+	listenerConfigs = append(listenerConfigs, flagListeners(listener.TypeInfluxTCP, *influxdbListenTCP)...)
+	if *listenersConfig != "" {
+		cfg, err := listener.LoadConfig(*listenersConfig)
 		if err != nil {
-			level.Error(logger).Log("msg", "failed to start UDP listener", "error", err)
+			level.Error(logger).Log("msg", "error loading listeners config", "error", err)
 			os.Exit(1)
 		}
-
-		if *readBuffer != 0 {
-			err = uconn.SetReadBuffer(*readBuffer)
-			if err != nil {
-				level.Error(logger).Log("msg", "error setting UDP read buffer", "error", err)
-				os.Exit(1)
-			}
-		}
-
-		ul := &listener.StatsDUDPListener{
-			Conn:            uconn,
-			EventHandler:    eventQueue,
-			Logger:          logger,
-			LineParser:      parser,
-			UDPPackets:      udpPackets,
-			LinesReceived:   linesReceived,
-			EventsFlushed:   eventsFlushed,
-			SampleErrors:    *sampleErrors,
-			SamplesReceived: samplesReceived,
-			TagErrors:       tagErrors,
-			TagsReceived:    tagsReceived,
-		}
-
-		go ul.Listen()
+		listenerConfigs = append(listenerConfigs, cfg.Listeners...)
 	}
 
-	if *statsdListenTCP != "" {
-		tcpListenAddr, err := address.TCPAddrFromString(*statsdListenTCP)
-		if err != nil {
-			level.Error(logger).Log("msg", "invalid TCP listen address", "address", *statsdListenUDP, "error", err)
-			os.Exit(1)
-		}
-		tconn, err := net.ListenTCP("tcp", tcpListenAddr)
+	userNames := make(map[uint32]string, len(*unixUserNames))
+	for uid, name := range *unixUserNames {
+		id, err := strconv.ParseUint(uid, 10, 32)
 		if err != nil {
-			level.Error(logger).Log("msg", err)
+			level.Error(logger).Log("msg", "invalid uid in user name mapping", "uid", uid, "error", err)
 			os.Exit(1)
 		}
-		defer tconn.Close()
-
-		tl := &listener.StatsDTCPListener{
-			Conn:            tconn,
-			EventHandler:    eventQueue,
-			Logger:          logger,
-			LineParser:      parser,
-			LinesReceived:   linesReceived,
-			EventsFlushed:   eventsFlushed,
-			SampleErrors:    *sampleErrors,
-			SamplesReceived: samplesReceived,
-			TagErrors:       tagErrors,
-			TagsReceived:    tagsReceived,
-			TCPConnections:  tcpConnections,
-			TCPErrors:       tcpErrors,
-			TCPLineTooLong:  tcpLineTooLong,
-		}
-
-		go tl.Listen()
+		userNames[uint32(id)] = name
 	}
 
-	if *statsdListenUnixgram != "" {
-		var err error
-		if _, err = os.Stat(*statsdListenUnixgram); !os.IsNotExist(err) {
-			level.Error(logger).Log("msg", "Unixgram socket already exists", "socket_name", *statsdListenUnixgram)
-			os.Exit(1)
-		}
-		uxgconn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{
-			Net:  "unixgram",
-			Name: *statsdListenUnixgram,
-		})
-		if err != nil {
-			level.Error(logger).Log("msg", "failed to listen on Unixgram socket", "error", err)
-			os.Exit(1)
-		}
-
-		defer uxgconn.Close()
-
-		if *readBuffer != 0 {
-			err = uxgconn.SetReadBuffer(*readBuffer)
-			if err != nil {
-				level.Error(logger).Log("msg", "error setting Unixgram read buffer", "error", err)
-				os.Exit(1)
-			}
-		}
-
-		ul := &listener.StatsDUnixgramListener{
-			Conn:            uxgconn,
-			EventHandler:    eventQueue,
-			Logger:          logger,
-			LineParser:      parser,
-			UnixgramPackets: unixgramPackets,
-			LinesReceived:   linesReceived,
-			EventsFlushed:   eventsFlushed,
-			SampleErrors:    *sampleErrors,
-			SamplesReceived: samplesReceived,
-			TagErrors:       tagErrors,
-			TagsReceived:    tagsReceived,
-		}
-
-		go ul.Listen()
-
-		// if it's an abstract unix domain socket, it won't exist on fs
-		// so we can't chmod it either
-		if _, err := os.Stat(*statsdListenUnixgram); !os.IsNotExist(err) {
-			defer os.Remove(*statsdListenUnixgram)
-
-			// convert the string to octet
-			perm, err := strconv.ParseInt("0"+string(*statsdUnixSocketMode), 8, 32)
-			if err != nil {
-				level.Warn(logger).Log("Bad permission %s: %v, ignoring\n", *statsdUnixSocketMode, err)
-			} else {
-				err = os.Chmod(*statsdListenUnixgram, os.FileMode(perm))
-				if err != nil {
-					level.Warn(logger).Log("Failed to change unixgram socket permission: %v", err)
-				}
-			}
-		}
-
+	cfg := server.Config{
+		ListenAddress:       *listenAddress,
+		MetricsEndpoint:     *metricsEndpoint,
+		EnableLifecycle:     *enableLifecycle,
+		HTTPPushPath:        *httpPushPath,
+		InfluxDBWritePath:   *influxdbWritePath,
+		Listeners:           listenerConfigs,
+		LineParser:          parser,
+		ReadBuffer:          *readBuffer,
+		UDPSockets:          *udpSockets,
+		UDPReaders:          *udpReaders,
+		ReadBatchSize:       *readBatchSize,
+		ParserWorkers:       *parserWorkers,
+		PacketQueueSize:     *packetQueueSize,
+		UnixSocketMode:      *statsdUnixSocketMode,
+		UnixPeerLabels:      *unixPeerLabels,
+		UnixUserNames:       userNames,
+		TCPTLSClientLabel:   *tcpTLSClientLabel,
+		MappingConfig:       *mappingConfig,
+		CacheSize:           *cacheSize,
+		CacheType:           *cacheType,
+		DumpFSMPath:         *dumpFSMPath,
+		EventQueueSize:      *eventQueueSize,
+		EventFlushThreshold: *eventFlushThreshold,
+		EventFlushInterval:  *eventFlushInterval,
+		EventQueueOverflow:  event.OverflowPolicy(*eventQueueOverflow),
+		EventShards:         *eventShards,
+		ScrapeWindow:        *scrapeWindow,
+		Logger:              logger,
 	}
-
-	mapper := &mapper.MetricMapper{MappingsCount: mappingsCount}
-	if *mappingConfig != "" {
-		err := mapper.InitFromFile(*mappingConfig, *cacheSize, cacheOption)
+	if *tenantsConfig != "" {
+		tenants, err := server.LoadTenantsConfig(*tenantsConfig)
 		if err != nil {
-			level.Error(logger).Log("msg", "error loading config", "error", err)
+			level.Error(logger).Log("msg", "error loading tenants config", "error", err)
 			os.Exit(1)
 		}
-		if *dumpFSMPath != "" {
-			err := dumpFSM(mapper, *dumpFSMPath, logger)
-			if err != nil {
-				level.Error(logger).Log("msg", "error dumping FSM", "error", err)
-				// Failure to dump the FSM is an error (the user asked for it and it
-				// didn't happen) but not fatal (the exporter is fully functional
-				// afterwards).
-			}
-		}
-	} else {
-		mapper.InitCache(*cacheSize, cacheOption)
+		cfg.Tenants = tenants
+	}
+	// The TLS settings apply to all StatsD TCP listeners, including those of
+	// the listeners config.
+	cfg.TCPTLSConfigFile = *tcpTLSConfigFile
+	cfg.TCPTLS = listener.TLSSettings{
+		CertFile:       *tcpTLSCertFile,
+		KeyFile:        *tcpTLSKeyFile,
+		ClientCAFile:   *tcpTLSClientCAFile,
+		ClientAuthType: *tcpTLSClientAuthType,
 	}
 
-	exporter := exporter.NewExporter(mapper, logger, eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	level.Info(logger).Log("msg", "Starting StatsD -> Prometheus Exporter", "version", version.Info())
+	level.Info(logger).Log("msg", "Build context", "context", version.BuildContext())
+
+	srv, err := server.New(cfg)
+	if err != nil {
+		level.Error(logger).Log("msg", "error creating server", "error", err)
+		os.Exit(1)
+	}
 
 	if *checkConfig {
 		level.Info(logger).Log("msg", "Configuration check successful, exiting")
 		return
 	}
 
-	mux := http.NewServeMux()
-	mux.Handle(*metricsEndpoint, promhttp.Handler())
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-			<head><title>StatsD Exporter</title></head>
-			<body>
-			<h1>StatsD Exporter</h1>
-			<p><a href="` + *metricsEndpoint + `">Metrics</a></p>
-			</body>
-			</html>`))
-	})
-	if *enableLifecycle {
-		mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
-			if r.Method == http.MethodPut || r.Method == http.MethodPost {
-				if *mappingConfig == "" {
-					level.Warn(logger).Log("msg", "Received lifecycle api reload but no mapping config to reload")
-					return
-				}
-				level.Info(logger).Log("msg", "Received lifecycle api reload, attempting reload")
-				reloadConfig(*mappingConfig, mapper, *cacheSize, logger, cacheOption)
-			}
-		})
-		mux.HandleFunc("/-/quit", func(w http.ResponseWriter, r *http.Request) {
-			if r.Method == http.MethodPut || r.Method == http.MethodPost {
-				level.Info(logger).Log("msg", "Received lifecycle api quit, exiting")
-				os.Exit(0)
-			}
-		})
+	if err := srv.Start(context.Background()); err != nil {
+		level.Error(logger).Log("msg", "error starting server", "error", err)
+		os.Exit(1)
 	}
 
-	go serveHTTP(mux, *listenAddress, logger)
-
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	go sighupConfigReloader(*mappingConfig, mapper, *cacheSize, logger, cacheOption)
-	go exporter.Listen(events)
+	go sighupConfigReloader(srv, logger)
 
-	<-signals
+	select {
+	case s := <-signals:
+		level.Info(logger).Log("msg", "Received signal, shutting down", "signal", s)
+	case <-srv.Quit():
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		level.Warn(logger).Log("msg", "Error shutting down", "error", err)
+	}
+	level.Info(logger).Log("msg", "Shutdown complete")
 }
@@ -14,6 +14,7 @@
 package event
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
@@ -44,7 +45,10 @@ type GaugeEvent struct {
 	GMetricName string
 	GValue      float64
 	GRelative   bool
-	GLabels     map[string]string
+	// GTimestamp is the time of the sample as sent by the client. It is zero
+	// if the client did not send one.
+	GTimestamp time.Time
+	GLabels    map[string]string
 }
 
 func (g *GaugeEvent) MetricName() string            { return g.GMetricName }
@@ -63,8 +67,111 @@ func (o *ObserverEvent) Value() float64                { return o.OValue }
 func (o *ObserverEvent) Labels() map[string]string     { return o.OLabels }
 func (o *ObserverEvent) MetricType() mapper.MetricType { return mapper.MetricTypeObserver }
 
+// SetEvent records a member of a StatsD set. Sets count distinct values,
+// so the member is kept as the raw string sent by the client.
+type SetEvent struct {
+	SMetricName string
+	SValue      string
+	SLabels     map[string]string
+}
+
+func (s *SetEvent) MetricName() string            { return s.SMetricName }
+func (s *SetEvent) Value() float64                { return 1 }
+func (s *SetEvent) Labels() map[string]string     { return s.SLabels }
+func (s *SetEvent) MetricType() mapper.MetricType { return mapper.MetricTypeSet }
+
+// DogStatsDEvent is an event sent with the DogStatsD `_e{title,text}`
+// datagram. Each occurrence counts once towards a counter named after the
+// mapping, or the configured default event metric name.
+type DogStatsDEvent struct {
+	ETitle          string
+	EText           string
+	ETimestamp      int64
+	EHostname       string
+	EAggregationKey string
+	EPriority       string
+	ESourceTypeName string
+	EAlertType      string
+	ELabels         map[string]string
+}
+
+func (e *DogStatsDEvent) MetricName() string            { return e.ETitle }
+func (e *DogStatsDEvent) Value() float64                { return 1 }
+func (e *DogStatsDEvent) Labels() map[string]string     { return e.ELabels }
+func (e *DogStatsDEvent) MetricType() mapper.MetricType { return mapper.MetricTypeEvent }
+
+// ServiceCheckEvent is a DogStatsD service check. Its value is the status
+// reported by the check: 0 (OK), 1 (warning), 2 (critical) or 3 (unknown).
+type ServiceCheckEvent struct {
+	SCName      string
+	SCStatus    int
+	SCTimestamp int64
+	SCHostname  string
+	SCMessage   string
+	SCLabels    map[string]string
+}
+
+func (s *ServiceCheckEvent) MetricName() string            { return s.SCName }
+func (s *ServiceCheckEvent) Value() float64                { return float64(s.SCStatus) }
+func (s *ServiceCheckEvent) Labels() map[string]string     { return s.SCLabels }
+func (s *ServiceCheckEvent) MetricType() mapper.MetricType { return mapper.MetricTypeServiceCheck }
+
 type Events []Event
 
+// WithLabels returns a copy of the event with the given labels, leaving the
+// labels of the event as they are.
+func WithLabels(e Event, labels map[string]string) Event {
+	switch e := e.(type) {
+	case *CounterEvent:
+		c := *e
+		c.CLabels = labels
+		return &c
+	case *GaugeEvent:
+		c := *e
+		c.GLabels = labels
+		return &c
+	case *ObserverEvent:
+		c := *e
+		c.OLabels = labels
+		return &c
+	case *SetEvent:
+		c := *e
+		c.SLabels = labels
+		return &c
+	case *DogStatsDEvent:
+		c := *e
+		c.ELabels = labels
+		return &c
+	case *ServiceCheckEvent:
+		c := *e
+		c.SCLabels = labels
+		return &c
+	}
+	panic(fmt.Sprintf("event: unknown event type %T", e))
+}
+
+// OverflowPolicy decides what an EventQueue does with a batch of events when
+// its channel is full.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock waits until the channel has room for the batch.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropNewest drops the batch that does not fit.
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+	// OverflowDropOldest drops the oldest batches in the channel to make room.
+	// An unbuffered channel has no batches to drop, so it falls back to
+	// OverflowDropNewest.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+)
+
+// Reasons of the dropped events counter.
+const (
+	DropReasonQueueFull = "queue_full"
+	DropReasonEvicted   = "evicted"
+	DropReasonShutdown  = "shutdown"
+)
+
 type EventQueue struct {
 	C              chan Events
 	q              Events
@@ -73,13 +180,35 @@ type EventQueue struct {
 	flushThreshold int
 	flushInterval  time.Duration
 	eventsFlushed  prometheus.Counter
+	overflow       OverflowPolicy
+	eventsDropped  *prometheus.CounterVec
+	closed         bool
+	done           chan struct{}
+}
+
+type EventQueueOption func(*EventQueue)
+
+// WithOverflowPolicy sets the policy for flushes into a full channel. The
+// default is OverflowBlock.
+func WithOverflowPolicy(policy OverflowPolicy) EventQueueOption {
+	return func(eq *EventQueue) {
+		eq.overflow = policy
+	}
+}
+
+// WithEventsDropped sets the counter of events dropped by the overflow
+// policy. It must have a single reason label.
+func WithEventsDropped(eventsDropped *prometheus.CounterVec) EventQueueOption {
+	return func(eq *EventQueue) {
+		eq.eventsDropped = eventsDropped
+	}
 }
 
 type EventHandler interface {
 	Queue(event Events)
 }
 
-func NewEventQueue(c chan Events, flushThreshold int, flushInterval time.Duration, eventsFlushed prometheus.Counter) *EventQueue {
+func NewEventQueue(c chan Events, flushThreshold int, flushInterval time.Duration, eventsFlushed prometheus.Counter, options ...EventQueueOption) *EventQueue {
 	ticker := clock.NewTicker(flushInterval)
 	eq := &EventQueue{
 		C:              c,
@@ -88,11 +217,25 @@ func NewEventQueue(c chan Events, flushThreshold int, flushInterval time.Duratio
 		flushTicker:    ticker,
 		q:              make([]Event, 0, flushThreshold),
 		eventsFlushed:  eventsFlushed,
+		overflow:       OverflowBlock,
+		done:           make(chan struct{}),
+	}
+	for _, option := range options {
+		option(eq)
+	}
+	if eq.overflow == OverflowDropOldest && cap(c) == 0 {
+		// Evicting from an unbuffered channel never makes room, so the
+		// flush would spin until the exporter happens to receive.
+		eq.overflow = OverflowDropNewest
 	}
 	go func() {
 		for {
-			<-ticker.C
-			eq.Flush()
+			select {
+			case <-ticker.C:
+				eq.Flush()
+			case <-eq.done:
+				return
+			}
 		}
 	}()
 	return eq
@@ -102,6 +245,10 @@ func (eq *EventQueue) Queue(events Events) {
 	eq.m.Lock()
 	defer eq.m.Unlock()
 
+	if eq.closed {
+		eq.drop(DropReasonShutdown, len(events))
+		return
+	}
 	for _, e := range events {
 		eq.q = append(eq.q, e)
 		if len(eq.q) >= eq.flushThreshold {
@@ -113,13 +260,65 @@ func (eq *EventQueue) Queue(events Events) {
 func (eq *EventQueue) Flush() {
 	eq.m.Lock()
 	defer eq.m.Unlock()
+	if eq.closed {
+		return
+	}
 	eq.FlushUnlocked()
 }
 
+// Close stops flushing on the flush interval and flushes the queued events
+// for the last time. Events queued afterwards are dropped, so that the
+// channel can be closed once the listeners are stopped.
+func (eq *EventQueue) Close() {
+	eq.m.Lock()
+	defer eq.m.Unlock()
+	if eq.closed {
+		return
+	}
+	eq.closed = true
+	eq.flushTicker.Stop()
+	close(eq.done)
+	if len(eq.q) > 0 {
+		eq.FlushUnlocked()
+	}
+}
+
 func (eq *EventQueue) FlushUnlocked() {
-	eq.C <- eq.q
+	switch eq.overflow {
+	case OverflowDropNewest:
+		select {
+		case eq.C <- eq.q:
+			eq.eventsFlushed.Inc()
+		default:
+			eq.drop(DropReasonQueueFull, len(eq.q))
+		}
+	case OverflowDropOldest:
+		// The exporter may drain the channel concurrently, so an evicted
+		// batch does not guarantee room for this one.
+		for sent := false; !sent; {
+			select {
+			case eq.C <- eq.q:
+				eq.eventsFlushed.Inc()
+				sent = true
+			default:
+				select {
+				case old := <-eq.C:
+					eq.drop(DropReasonEvicted, len(old))
+				default:
+				}
+			}
+		}
+	default:
+		eq.C <- eq.q
+		eq.eventsFlushed.Inc()
+	}
 	eq.q = make([]Event, 0, cap(eq.q))
-	eq.eventsFlushed.Inc()
+}
+
+func (eq *EventQueue) drop(reason string, n int) {
+	if eq.eventsDropped != nil && n > 0 {
+		eq.eventsDropped.WithLabelValues(reason).Add(float64(n))
+	}
 }
 
 func (eq *EventQueue) Len() int {
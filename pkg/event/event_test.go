@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/statsd_exporter/pkg/clock"
 )
 
@@ -86,3 +87,136 @@ func TestEventIntervalFlush(t *testing.T) {
 	}
 
 }
+
+func TestEventQueueOverflow(t *testing.T) {
+	batch := func(name string) Events {
+		return Events{&CounterEvent{CMetricName: name}, &CounterEvent{CMetricName: name}}
+	}
+
+	scenarios := []struct {
+		policy  OverflowPolicy
+		want    string
+		dropped map[string]float64
+	}{
+		{
+			policy:  OverflowDropNewest,
+			want:    "first",
+			dropped: map[string]float64{DropReasonQueueFull: 4},
+		}, {
+			policy:  OverflowDropOldest,
+			want:    "third",
+			dropped: map[string]float64{DropReasonEvicted: 4},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(string(s.policy), func(t *testing.T) {
+			eventsDropped := prometheus.NewCounterVec(
+				prometheus.CounterOpts{Name: "events_dropped"},
+				[]string{"reason"},
+			)
+			c := make(chan Events, 1)
+			eq := NewEventQueue(c, 2, time.Second*1000, eventsFlushed,
+				WithOverflowPolicy(s.policy), WithEventsDropped(eventsDropped))
+
+			// The first batch fills the channel, the others overflow it.
+			eq.Queue(batch("first"))
+			eq.Queue(append(batch("second"), batch("third")...))
+
+			if len(c) != 1 {
+				t.Fatalf("Expected 1 batch in the event channel, got %d", len(c))
+			}
+			if got := (<-c)[0].MetricName(); got != s.want {
+				t.Fatalf("Expected the %s batch in the event channel, got %s", s.want, got)
+			}
+			for _, reason := range []string{DropReasonQueueFull, DropReasonEvicted} {
+				var m dto.Metric
+				eventsDropped.WithLabelValues(reason).Write(&m)
+				if got := m.GetCounter().GetValue(); got != s.dropped[reason] {
+					t.Fatalf("Expected %v events dropped as %s, got %v", s.dropped[reason], reason, got)
+				}
+			}
+		})
+	}
+}
+
+func TestEventQueueDropOldestUnbuffered(t *testing.T) {
+	eventsDropped := prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "events_dropped"},
+		[]string{"reason"},
+	)
+	c := make(chan Events)
+	eq := NewEventQueue(c, 1, time.Second*1000, eventsFlushed,
+		WithOverflowPolicy(OverflowDropOldest), WithEventsDropped(eventsDropped))
+	defer eq.Close()
+
+	// Nobody receives, so the event is dropped instead of waiting for room.
+	done := make(chan struct{})
+	go func() {
+		eq.Queue(Events{&CounterEvent{CMetricName: "foo"}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out queueing into an unbuffered channel")
+	}
+
+	var m dto.Metric
+	eventsDropped.WithLabelValues(DropReasonQueueFull).Write(&m)
+	if got := m.GetCounter().GetValue(); got != 1 {
+		t.Fatalf("Expected 1 event dropped as %s, got %v", DropReasonQueueFull, got)
+	}
+}
+
+func TestEventQueueClose(t *testing.T) {
+	eventsDropped := prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "events_dropped"},
+		[]string{"reason"},
+	)
+	c := make(chan Events, 10)
+	eq := NewEventQueue(c, 1000, time.Second*1000, eventsFlushed, WithEventsDropped(eventsDropped))
+	eq.Queue(make(Events, 3))
+
+	// Closing flushes the queued events, and events queued afterwards are
+	// dropped.
+	eq.Close()
+	eq.Queue(make(Events, 2))
+	eq.Flush()
+
+	if len(c) != 1 {
+		t.Fatalf("Expected 1 batch in the event channel, got %d", len(c))
+	}
+	if batch := <-c; len(batch) != 3 {
+		t.Fatalf("Expected 3 events in the batch, got %d", len(batch))
+	}
+	var m dto.Metric
+	eventsDropped.WithLabelValues(DropReasonShutdown).Write(&m)
+	if got := m.GetCounter().GetValue(); got != 2 {
+		t.Fatalf("Expected 2 events dropped on shutdown, got %v", got)
+	}
+}
+
+func TestWithLabels(t *testing.T) {
+	labels := map[string]string{"tenant": "a", "env": "prod"}
+	events := Events{
+		&CounterEvent{CMetricName: "c", CValue: 1, CLabels: labels},
+		&GaugeEvent{GMetricName: "g", GValue: 1, GRelative: true, GLabels: labels},
+		&ObserverEvent{OMetricName: "o", OValue: 1, OLabels: labels},
+	}
+	for _, e := range events {
+		c := WithLabels(e, map[string]string{"env": "prod"})
+		if c == e {
+			t.Fatalf("%s: expected a copy of the event", e.MetricName())
+		}
+		if c.MetricName() != e.MetricName() || c.Value() != e.Value() || c.MetricType() != e.MetricType() {
+			t.Fatalf("%s: expected the copy to keep name, value and type", e.MetricName())
+		}
+		if _, ok := c.Labels()["tenant"]; ok {
+			t.Fatalf("%s: expected the copy to have the new labels, got %v", e.MetricName(), c.Labels())
+		}
+		if e.Labels()["tenant"] != "a" {
+			t.Fatalf("%s: expected the original labels to be unchanged, got %v", e.MetricName(), e.Labels())
+		}
+	}
+}
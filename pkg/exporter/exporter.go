@@ -15,20 +15,26 @@ package exporter
 
 import (
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/statsd_exporter/pkg/clock"
 	"github.com/prometheus/statsd_exporter/pkg/event"
 	"github.com/prometheus/statsd_exporter/pkg/mapper"
 	"github.com/prometheus/statsd_exporter/pkg/registry"
+	"github.com/prometheus/statsd_exporter/pkg/relabel"
 )
 
 const (
 	defaultHelp = "Metric autogenerated by statsd_exporter."
 	regErrF     = "Failed to update metric"
+
+	serviceCheckLastSeenHelp = "Time the service check was last reported, in seconds since the epoch."
 )
 
 type Exporter struct {
@@ -41,11 +47,51 @@ type Exporter struct {
 	EventStats            *prometheus.CounterVec
 	ConflictingEventStats *prometheus.CounterVec
 	MetricsCount          *prometheus.GaugeVec
+	// Shards is the number of goroutines handling events. Events are
+	// assigned to them by metric name, so that the events of a metric are
+	// always handled in order. Values below 2 handle all events in the
+	// goroutine calling Listen.
+	Shards int
 }
 
-// Listen handles all events sent to the given channel sequentially. It
-// terminates when the channel is closed.
+// Listen handles all events sent to the given channel. It terminates when the
+// channel is closed and all events have been handled.
 func (b *Exporter) Listen(e <-chan event.Events) {
+	handle := b.handleEvents
+
+	if b.Shards > 1 {
+		shards := make([]chan event.Events, b.Shards)
+		var wg sync.WaitGroup
+		for i := range shards {
+			shards[i] = make(chan event.Events, cap(e))
+			wg.Add(1)
+			go func(c <-chan event.Events) {
+				defer wg.Done()
+				for events := range c {
+					b.handleEvents(events)
+				}
+			}(shards[i])
+		}
+		defer func() {
+			for _, c := range shards {
+				close(c)
+			}
+			wg.Wait()
+		}()
+
+		handle = func(events event.Events) {
+			batches := make([]event.Events, len(shards))
+			for _, event := range events {
+				i := shardOf(event.MetricName(), len(shards))
+				batches[i] = append(batches[i], event)
+			}
+			for i, batch := range batches {
+				if len(batch) > 0 {
+					shards[i] <- batch
+				}
+			}
+		}
+	}
 
 	removeStaleMetricsTicker := clock.NewTicker(time.Second)
 
@@ -53,23 +99,60 @@ func (b *Exporter) Listen(e <-chan event.Events) {
 		select {
 		case <-removeStaleMetricsTicker.C:
 			b.Registry.RemoveStaleMetrics()
+			b.Registry.RollSetWindows()
 		case events, ok := <-e:
 			if !ok {
 				level.Debug(b.Logger).Log("msg", "Channel is closed. Break out of Exporter.Listener.")
 				removeStaleMetricsTicker.Stop()
 				return
 			}
-			for _, event := range events {
-				b.handleEvent(event)
-			}
+			handle(events)
 		}
 	}
 }
 
+// relabelMetric applies the relabeling rules of a mapping and then the global
+// ones to the labels of a metric, with its name in the __name__ label. It
+// returns the new name, or false if a rule dropped the metric. Labels starting
+// with __ are removed afterwards.
+func relabelMetric(metricName string, labels prometheus.Labels, mappingCfgs, globalCfgs []*relabel.Config) (string, bool) {
+	labels[model.MetricNameLabel] = metricName
+	if !relabel.Process(labels, mappingCfgs...) || !relabel.Process(labels, globalCfgs...) {
+		return "", false
+	}
+	metricName = labels[model.MetricNameLabel]
+	for name := range labels {
+		if strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			delete(labels, name)
+		}
+	}
+	if metricName == "" {
+		return "", true
+	}
+	return mapper.EscapeMetricName(metricName), true
+}
+
+// shardOf returns the shard that handles the events of a metric, by its FNV-1a
+// hash.
+func shardOf(metricName string, shards int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(metricName); i++ {
+		h ^= uint32(metricName[i])
+		h *= 16777619
+	}
+	return int(h % uint32(shards))
+}
+
+func (b *Exporter) handleEvents(events event.Events) {
+	for _, event := range events {
+		b.handleEvent(event)
+	}
+}
+
 // handleEvent processes a single Event according to the configured mapping.
 func (b *Exporter) handleEvent(thisEvent event.Event) {
 
-	mapping, labels, present := b.Mapper.GetMapping(thisEvent.MetricName(), thisEvent.MetricType())
+	mapping, labels, present := b.Mapper.GetMappingWithLabels(thisEvent.MetricName(), thisEvent.MetricType(), thisEvent.Labels())
 	if mapping == nil {
 		mapping = &mapper.MetricMapping{}
 		if b.Mapper.Defaults.Ttl != 0 {
@@ -89,7 +172,12 @@ func (b *Exporter) handleEvent(thisEvent event.Event) {
 		help = mapping.HelpText
 	}
 
-	prometheusLabels := thisEvent.Labels()
+	// The mapping and relabeling change the labels, so they work on a copy
+	// that leaves the event as it was received.
+	prometheusLabels := make(prometheus.Labels, len(thisEvent.Labels())+len(labels))
+	for label, value := range thisEvent.Labels() {
+		prometheusLabels[label] = value
+	}
 	if present {
 		if mapping.Name == "" {
 			level.Debug(b.Logger).Log("msg", "The mapping generates an empty metric name", "metric_name", thisEvent.MetricName(), "match", mapping.Match)
@@ -103,7 +191,38 @@ func (b *Exporter) handleEvent(thisEvent event.Event) {
 		b.EventsActions.WithLabelValues(string(mapping.Action)).Inc()
 	} else {
 		b.EventsUnmapped.Inc()
-		metricName = mapper.EscapeMetricName(thisEvent.MetricName())
+		switch thisEvent.MetricType() {
+		case mapper.MetricTypeEvent:
+			// Event titles are free text, so unmapped events share one counter.
+			metricName = b.Mapper.Defaults.EventMetricName
+			if metricName == "" {
+				metricName = mapper.DefaultEventMetricName
+			}
+		case mapper.MetricTypeServiceCheck:
+			// Unmapped service checks share one set of gauges, told apart by
+			// the check label. It replaces a client tag of the same name.
+			metricName = b.Mapper.Defaults.ServiceCheckMetricName
+			if metricName == "" {
+				metricName = mapper.DefaultServiceCheckMetricName
+			}
+			prometheusLabels["check"] = thisEvent.MetricName()
+		default:
+			metricName = mapper.EscapeMetricName(thisEvent.MetricName())
+		}
+	}
+
+	if len(mapping.RelabelConfigs) > 0 || len(b.Mapper.RelabelConfigs) > 0 {
+		var keep bool
+		metricName, keep = relabelMetric(metricName, prometheusLabels, mapping.RelabelConfigs, b.Mapper.RelabelConfigs)
+		if !keep {
+			b.EventsActions.WithLabelValues("relabel_drop").Inc()
+			return
+		}
+		if metricName == "" {
+			level.Debug(b.Logger).Log("msg", "Relabeling removed the metric name", "metric_name", thisEvent.MetricName())
+			b.ErrorEventStats.WithLabelValues("empty_metric_name").Inc()
+			return
+		}
 	}
 
 	switch ev := thisEvent.(type) {
@@ -122,7 +241,7 @@ func (b *Exporter) handleEvent(thisEvent event.Event) {
 			b.EventStats.WithLabelValues("counter").Inc()
 		} else {
 			level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
-			b.ConflictingEventStats.WithLabelValues("counter").Inc()
+			b.countRegistryError("counter", err)
 		}
 
 	case *event.GaugeEvent:
@@ -134,10 +253,11 @@ func (b *Exporter) handleEvent(thisEvent event.Event) {
 			} else {
 				gauge.Set(thisEvent.Value())
 			}
+			gauge.SetTimestamp(ev.GTimestamp)
 			b.EventStats.WithLabelValues("gauge").Inc()
 		} else {
 			level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
-			b.ConflictingEventStats.WithLabelValues("gauge").Inc()
+			b.countRegistryError("gauge", err)
 		}
 
 	case *event.ObserverEvent:
@@ -157,7 +277,7 @@ func (b *Exporter) handleEvent(thisEvent event.Event) {
 				b.EventStats.WithLabelValues("observer").Inc()
 			} else {
 				level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
-				b.ConflictingEventStats.WithLabelValues("observer").Inc()
+				b.countRegistryError("observer", err)
 			}
 
 		case mapper.ObserverTypeDefault, mapper.ObserverTypeSummary:
@@ -167,7 +287,7 @@ func (b *Exporter) handleEvent(thisEvent event.Event) {
 				b.EventStats.WithLabelValues("observer").Inc()
 			} else {
 				level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
-				b.ConflictingEventStats.WithLabelValues("observer").Inc()
+				b.countRegistryError("observer", err)
 			}
 
 		default:
@@ -175,16 +295,69 @@ func (b *Exporter) handleEvent(thisEvent event.Event) {
 			os.Exit(1)
 		}
 
+	case *event.SetEvent:
+		set, err := b.Registry.GetSet(metricName, prometheusLabels, help, mapping, b.MetricsCount)
+		if err == nil {
+			set.Add(ev.SValue)
+			b.EventStats.WithLabelValues("set").Inc()
+		} else {
+			level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
+			b.countRegistryError("set", err)
+		}
+
+	case *event.DogStatsDEvent:
+		counter, err := b.Registry.GetCounter(metricName, prometheusLabels, help, mapping, b.MetricsCount)
+		if err == nil {
+			counter.Inc()
+			b.EventStats.WithLabelValues("event").Inc()
+		} else {
+			level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName, "error", err)
+			b.countRegistryError("event", err)
+		}
+
+	case *event.ServiceCheckEvent:
+		status, err := b.Registry.GetGauge(metricName+"_status", prometheusLabels, help, mapping, b.MetricsCount)
+		if err != nil {
+			level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName+"_status", "error", err)
+			b.countRegistryError("service_check", err)
+			return
+		}
+		lastSeen, err := b.Registry.GetGauge(metricName+"_last_seen_timestamp_seconds", prometheusLabels, serviceCheckLastSeenHelp, mapping, b.MetricsCount)
+		if err != nil {
+			level.Debug(b.Logger).Log("msg", regErrF, "metric", metricName+"_last_seen_timestamp_seconds", "error", err)
+			b.countRegistryError("service_check", err)
+			return
+		}
+		status.Set(thisEvent.Value())
+		if ev.SCTimestamp != 0 {
+			lastSeen.Set(float64(ev.SCTimestamp))
+		} else {
+			lastSeen.Set(float64(clock.Now().UnixNano()) / 1e9)
+		}
+		b.EventStats.WithLabelValues("service_check").Inc()
+
 	default:
 		level.Debug(b.Logger).Log("msg", "Unsupported event type")
 		b.EventStats.WithLabelValues("illegal").Inc()
 	}
 }
 
-func NewExporter(mapper *mapper.MetricMapper, logger log.Logger, eventsActions *prometheus.CounterVec, eventsUnmapped prometheus.Counter, errorEventStats *prometheus.CounterVec, eventStats *prometheus.CounterVec, conflictingEventStats *prometheus.CounterVec, metricsCount *prometheus.GaugeVec) *Exporter {
+// countRegistryError counts an event the registry did not accept, as an error
+// if the series limit was reached and as a conflict otherwise.
+func (b *Exporter) countRegistryError(metricType string, err error) {
+	if err == registry.ErrSeriesLimit {
+		b.ErrorEventStats.WithLabelValues("series_limit").Inc()
+		return
+	}
+	b.ConflictingEventStats.WithLabelValues(metricType).Inc()
+}
+
+// NewExporter creates an exporter whose metrics are registered with reg, or
+// with the default registerer if reg is nil.
+func NewExporter(reg prometheus.Registerer, mapper *mapper.MetricMapper, logger log.Logger, eventsActions *prometheus.CounterVec, eventsUnmapped prometheus.Counter, errorEventStats *prometheus.CounterVec, eventStats *prometheus.CounterVec, conflictingEventStats *prometheus.CounterVec, metricsCount *prometheus.GaugeVec) *Exporter {
 	return &Exporter{
 		Mapper:                mapper,
-		Registry:              registry.NewRegistry(mapper),
+		Registry:              registry.NewRegistry(reg, mapper),
 		Logger:                logger,
 		EventsActions:         eventsActions,
 		EventsUnmapped:        eventsUnmapped,
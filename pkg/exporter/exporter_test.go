@@ -155,6 +155,7 @@ var (
 // TestNegativeCounter validates when we send a negative
 // number to a counter that we no longer panic the Exporter Listener.
 func TestNegativeCounter(t *testing.T) {
+	reg := prometheus.NewRegistry()
 	defer func() {
 		if e := recover(); e != nil {
 			err := e.(error)
@@ -184,7 +185,7 @@ func TestNegativeCounter(t *testing.T) {
 	testMapper := mapper.MetricMapper{}
 	testMapper.InitCache(0)
 
-	ex := NewExporter(&testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex := NewExporter(reg, &testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 	ex.Listen(events)
 
 	updated := getTelemetryCounterValue(errorCounter)
@@ -197,6 +198,7 @@ func TestNegativeCounter(t *testing.T) {
 // and record metrics with the same metric name but inconsistent label
 // sets e.g foo{a="1"} and foo{b="1"}
 func TestInconsistentLabelSets(t *testing.T) {
+	reg := prometheus.NewRegistry()
 	firstLabelSet := make(map[string]string)
 	secondLabelSet := make(map[string]string)
 	metricNames := [4]string{"counter_test", "gauge_test", "histogram_test", "summary_test"}
@@ -265,12 +267,12 @@ mappings:
 		t.Fatalf("Config load error: %s %s", config, err)
 	}
 
-	ex := NewExporter(testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 	ex.Listen(events)
 
-	metrics, err := prometheus.DefaultGatherer.Gather()
+	metrics, err := reg.Gather()
 	if err != nil {
-		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
+		t.Fatalf("Cannot gather: %v", err)
 	}
 
 	for _, metricName := range metricNames {
@@ -289,6 +291,7 @@ mappings:
 // TestLabelParsing verifies that labels getting parsed out of metric
 // names are being properly created.
 func TestLabelParsing(t *testing.T) {
+	reg := prometheus.NewRegistry()
 	codes := [2]string{"200", "300"}
 
 	events := make(chan event.Events)
@@ -323,12 +326,12 @@ mappings:
 		t.Fatalf("Config load error: %s %s", config, err)
 	}
 
-	ex := NewExporter(testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 	ex.Listen(events)
 
-	metrics, err := prometheus.DefaultGatherer.Gather()
+	metrics, err := reg.Gather()
 	if err != nil {
-		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
+		t.Fatalf("Cannot gather: %v", err)
 	}
 
 	labels := make(map[string]string)
@@ -341,9 +344,98 @@ mappings:
 	}
 }
 
+// TestRelabeling checks that the relabeling rules of the mappings and the
+// global ones are applied to the mapped labels and metric names.
+func TestRelabeling(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	events := make(chan event.Events, 1)
+	received := event.Events{
+		&event.CounterEvent{
+			CMetricName: "requests.200",
+			CValue:      1,
+			CLabels:     map[string]string{"host": "a", "pod": "a-1"},
+		},
+		&event.CounterEvent{
+			CMetricName: "requests.404",
+			CValue:      2,
+			CLabels:     map[string]string{"host": "b", "pod": "b-1"},
+		},
+		&event.CounterEvent{
+			CMetricName: "debug.requests",
+			CValue:      3,
+		},
+		&event.GaugeEvent{
+			GMetricName: "queue_length",
+			GValue:      4,
+			GLabels:     map[string]string{"env": "prod"},
+		},
+	}
+	events <- received
+	close(events)
+
+	config := `
+mappings:
+- match: requests.*
+  name: requests_total
+  labels:
+    code: $1
+  relabel_configs:
+  - regex: pod
+    action: labeldrop
+  - source_labels: [code]
+    regex: "(.).."
+    target_label: class
+    replacement: ${1}xx
+relabel_configs:
+- source_labels: [__name__]
+  regex: "debug_.*"
+  action: drop
+- source_labels: [__name__, env]
+  regex: "(.*);prod"
+  target_label: __name__
+  replacement: prod_${1}
+`
+	testMapper := &mapper.MetricMapper{Registerer: reg}
+	if err := testMapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	prevDrops := getTelemetryCounterValue(eventsActions.WithLabelValues("relabel_drop"))
+	ex.Listen(events)
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+	if value := getFloat64(metrics, "requests_total", prometheus.Labels{"code": "200", "class": "2xx", "host": "a"}); value == nil || *value != 1 {
+		t.Fatalf("Expected the relabeled 2xx counter to be 1, got %v", value)
+	}
+	if value := getFloat64(metrics, "requests_total", prometheus.Labels{"code": "404", "class": "4xx", "host": "b"}); value == nil || *value != 2 {
+		t.Fatalf("Expected the relabeled 4xx counter to be 2, got %v", value)
+	}
+	if value := getFloat64(metrics, "prod_queue_length", prometheus.Labels{"env": "prod"}); value == nil || *value != 4 {
+		t.Fatalf("Expected the renamed gauge to be 4, got %v", value)
+	}
+	if value := getFloat64(metrics, "debug_requests", prometheus.Labels{}); value != nil {
+		t.Fatalf("Expected debug_requests to be dropped, got %v", *value)
+	}
+	if got := getTelemetryCounterValue(eventsActions.WithLabelValues("relabel_drop")) - prevDrops; got != 1 {
+		t.Fatalf("Expected 1 event dropped by relabeling, got %v", got)
+	}
+	for _, e := range received {
+		if _, ok := e.Labels()["__name__"]; ok {
+			t.Fatalf("Expected the labels of %s to be unchanged, got %v", e.MetricName(), e.Labels())
+		}
+	}
+	if labels := received[0].Labels(); len(labels) != 2 || labels["pod"] != "a-1" {
+		t.Fatalf("Expected the labels of requests.200 to be unchanged, got %v", labels)
+	}
+}
+
 // TestConflictingMetrics validates that the exporter will not register metrics
 // of different types that have overlapping names.
 func TestConflictingMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
 	scenarios := []struct {
 		name     string
 		expected []float64
@@ -538,12 +630,12 @@ mappings:
 				events <- s.in
 				close(events)
 			}()
-			ex := NewExporter(testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+			ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 			ex.Listen(events)
 
-			metrics, err := prometheus.DefaultGatherer.Gather()
+			metrics, err := reg.Gather()
 			if err != nil {
-				t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
+				t.Fatalf("Cannot gather: %v", err)
 			}
 
 			for i, e := range s.expected {
@@ -562,10 +654,133 @@ mappings:
 	}
 }
 
+// TestShardedListen checks that events are handled completely and in order
+// per metric when they are spread across several goroutines.
+func TestShardedListen(t *testing.T) {
+	events := make(chan event.Events, 16)
+	go func() {
+		for i := 0; i < 100; i++ {
+			var batch event.Events
+			for m := 0; m < 20; m++ {
+				batch = append(batch, &event.CounterEvent{
+					CMetricName: fmt.Sprintf("sharded_counter_%d", m),
+					CValue:      1,
+				})
+			}
+			// Relative and absolute gauge updates only add up if they are
+			// applied in order.
+			if i%10 == 0 {
+				batch = append(batch, &event.GaugeEvent{GMetricName: "sharded_gauge", GValue: 0})
+			} else {
+				batch = append(batch, &event.GaugeEvent{GMetricName: "sharded_gauge", GValue: 1, GRelative: true})
+			}
+			events <- batch
+		}
+		close(events)
+	}()
+
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{Registerer: reg}
+	testMapper.InitCache(0)
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Shards = 4
+	ex.Listen(events)
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+	for m := 0; m < 20; m++ {
+		name := fmt.Sprintf("sharded_counter_%d", m)
+		value := getFloat64(metrics, name, prometheus.Labels{})
+		if value == nil || *value != 100 {
+			t.Fatalf("Expected %s to be 100, got %v", name, value)
+		}
+	}
+	if value := getFloat64(metrics, "sharded_gauge", prometheus.Labels{}); value == nil || *value != 9 {
+		t.Fatalf("Expected sharded_gauge to be 9, got %v", value)
+	}
+}
+
+// TestIsolatedRegistries checks that exporters with their own registries do
+// not share metrics.
+func TestIsolatedRegistries(t *testing.T) {
+	values := []float64{1, 5}
+	regs := make([]*prometheus.Registry, len(values))
+	for i, value := range values {
+		regs[i] = prometheus.NewRegistry()
+		testMapper := &mapper.MetricMapper{Registerer: regs[i]}
+		testMapper.InitCache(1000)
+
+		events := make(chan event.Events, 1)
+		events <- event.Events{&event.CounterEvent{CMetricName: "isolated", CValue: value}}
+		close(events)
+		ex := NewExporter(regs[i], testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}
+
+	for i, value := range values {
+		metrics, err := regs[i].Gather()
+		if err != nil {
+			t.Fatalf("Cannot gather: %v", err)
+		}
+		if got := getFloat64(metrics, "isolated", prometheus.Labels{}); got == nil || *got != value {
+			t.Fatalf("Expected isolated to be %v in registry %d, got %v", value, i, got)
+		}
+		if got := getFloat64(metrics, "statsd_metric_mapper_cache_gets_total", prometheus.Labels{}); got == nil || *got != 1 {
+			t.Fatalf("Expected 1 cache get in registry %d, got %v", i, got)
+		}
+	}
+}
+
+// TestSeriesLimit checks that events which would create series beyond the
+// limit of the registry are rejected, while existing series are still updated.
+func TestSeriesLimit(t *testing.T) {
+	events := make(chan event.Events, 1)
+	events <- event.Events{
+		&event.CounterEvent{CMetricName: "limited", CValue: 1, CLabels: map[string]string{"id": "1"}},
+		&event.CounterEvent{CMetricName: "limited", CValue: 1, CLabels: map[string]string{"id": "2"}},
+		&event.GaugeEvent{GMetricName: "limited_gauge", GValue: 1},
+		&event.CounterEvent{CMetricName: "limited", CValue: 1, CLabels: map[string]string{"id": "3"}},
+		&event.CounterEvent{CMetricName: "limited", CValue: 1, CLabels: map[string]string{"id": "1"}},
+	}
+	close(events)
+
+	reg := prometheus.NewRegistry()
+	testMapper := &mapper.MetricMapper{Registerer: reg}
+	testMapper.InitCache(0)
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex.Registry.SeriesLimit = 2
+	limitHits := errorEventStats.WithLabelValues("series_limit")
+	prev := getTelemetryCounterValue(limitHits)
+	ex.Listen(events)
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+	if value := getFloat64(metrics, "limited", prometheus.Labels{"id": "1"}); value == nil || *value != 2 {
+		t.Fatalf("Expected the existing series to be updated to 2, got %v", value)
+	}
+	if value := getFloat64(metrics, "limited", prometheus.Labels{"id": "3"}); value != nil {
+		t.Fatalf("Expected no series beyond the limit, got %v", *value)
+	}
+	if value := getFloat64(metrics, "limited_gauge", prometheus.Labels{}); value != nil {
+		t.Fatalf("Expected no gauge beyond the limit, got %v", *value)
+	}
+	if got := ex.Registry.Series(); got != 2 {
+		t.Fatalf("Expected 2 series, got %d", got)
+	}
+	if got := getTelemetryCounterValue(limitHits) - prev; got != 2 {
+		t.Fatalf("Expected 2 events over the limit, got %v", got)
+	}
+}
+
 // TestEmptyStringMetric validates when a metric name ends up
 // being the empty string after applying the match replacements
 // tha we don't panic the Exporter Listener.
 func TestEmptyStringMetric(t *testing.T) {
+	reg := prometheus.NewRegistry()
 	events := make(chan event.Events)
 	go func() {
 		c := event.Events{
@@ -593,7 +808,7 @@ mappings:
 	errorCounter := errorEventStats.WithLabelValues("empty_metric_name")
 	prev := getTelemetryCounterValue(errorCounter)
 
-	ex := NewExporter(testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 	ex.Listen(events)
 
 	updated := getTelemetryCounterValue(errorCounter)
@@ -607,6 +822,7 @@ mappings:
 // It sends the same tags first with a valid value, then with an invalid one.
 // The exporter should not panic, but drop the invalid event
 func TestInvalidUtf8InDatadogTagValue(t *testing.T) {
+	reg := prometheus.NewRegistry()
 	defer func() {
 		if e := recover(); e != nil {
 			err := e.(error)
@@ -660,7 +876,7 @@ func TestInvalidUtf8InDatadogTagValue(t *testing.T) {
 	testMapper := mapper.MetricMapper{}
 	testMapper.InitCache(0)
 
-	ex := NewExporter(&testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+	ex := NewExporter(reg, &testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 	ex.Listen(events)
 }
 
@@ -668,13 +884,14 @@ func TestInvalidUtf8InDatadogTagValue(t *testing.T) {
 // which is valid, we want to make sure that the default quantile metrics are generated
 // as well as the sum/count metrics
 func TestSummaryWithQuantilesEmptyMapping(t *testing.T) {
+	reg := prometheus.NewRegistry()
 	// Start exporter with a synchronous channel
 	events := make(chan event.Events)
 	go func() {
 		testMapper := mapper.MetricMapper{}
 		testMapper.InitCache(0)
 
-		ex := NewExporter(&testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex := NewExporter(reg, &testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 		ex.Listen(events)
 	}()
 
@@ -689,7 +906,7 @@ func TestSummaryWithQuantilesEmptyMapping(t *testing.T) {
 	events <- event.Events{}
 	close(events)
 
-	metrics, err := prometheus.DefaultGatherer.Gather()
+	metrics, err := reg.Gather()
 	if err != nil {
 		t.Fatal("Gather should not fail: ", err)
 	}
@@ -713,12 +930,13 @@ func TestSummaryWithQuantilesEmptyMapping(t *testing.T) {
 }
 
 func TestHistogramUnits(t *testing.T) {
+	reg := prometheus.NewRegistry()
 	// Start exporter with a synchronous channel
 	events := make(chan event.Events)
 	go func() {
 		testMapper := mapper.MetricMapper{}
 		testMapper.InitCache(0)
-		ex := NewExporter(&testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex := NewExporter(reg, &testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 		ex.Mapper.Defaults.ObserverType = mapper.ObserverTypeHistogram
 		ex.Listen(events)
 	}()
@@ -737,9 +955,9 @@ func TestHistogramUnits(t *testing.T) {
 	close(events)
 
 	// Check histogram value
-	metrics, err := prometheus.DefaultGatherer.Gather()
+	metrics, err := reg.Gather()
 	if err != nil {
-		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
+		t.Fatalf("Cannot gather: %v", err)
 	}
 	value := getFloat64(metrics, name, prometheus.Labels{})
 	if value == nil {
@@ -750,12 +968,13 @@ func TestHistogramUnits(t *testing.T) {
 	}
 }
 func TestCounterIncrement(t *testing.T) {
+	reg := prometheus.NewRegistry()
 	// Start exporter with a synchronous channel
 	events := make(chan event.Events)
 	go func() {
 		testMapper := mapper.MetricMapper{}
 		testMapper.InitCache(0)
-		ex := NewExporter(&testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex := NewExporter(reg, &testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 		ex.Listen(events)
 	}()
 
@@ -783,9 +1002,9 @@ func TestCounterIncrement(t *testing.T) {
 	close(events)
 
 	// Check histogram value
-	metrics, err := prometheus.DefaultGatherer.Gather()
+	metrics, err := reg.Gather()
 	if err != nil {
-		t.Fatalf("Cannot gather from DefaultGatherer: %v", err)
+		t.Fatalf("Cannot gather: %v", err)
 	}
 	value := getFloat64(metrics, name, labels)
 	if value == nil {
@@ -796,6 +1015,290 @@ func TestCounterIncrement(t *testing.T) {
 	}
 }
 
+// TestDogStatsDEventCounters validates that DogStatsD events are counted
+// under the mapped name, the default event metric name, or dropped.
+func TestDogStatsDEventCounters(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	config := `
+defaults:
+  event_metric_name: test_events_total
+mappings:
+- match: "deploy.*"
+  name: "deploys_total"
+  match_metric_type: event
+  labels:
+    service: "$1"
+- match: "noise.*"
+  name: "noise"
+  match_metric_type: event
+  action: drop
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	events := make(chan event.Events)
+	go func() {
+		ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	newEvent := func(title, alertType string) *event.DogStatsDEvent {
+		return &event.DogStatsDEvent{
+			ETitle:     title,
+			EAlertType: alertType,
+			EPriority:  "normal",
+			ELabels:    map[string]string{"alert_type": alertType, "priority": "normal"},
+		}
+	}
+	events <- event.Events{
+		newEvent("deploy.api", "info"),
+		newEvent("deploy.api", "info"),
+		newEvent("noise.heartbeat", "info"),
+		newEvent("Disk almost full", "warning"),
+	}
+	events <- event.Events{}
+	close(events)
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+
+	value := getFloat64(metrics, "deploys_total", prometheus.Labels{"service": "api", "alert_type": "info", "priority": "normal"})
+	if value == nil || *value != 2 {
+		t.Fatalf("Expected 2 mapped deploy events, got %v", value)
+	}
+	value = getFloat64(metrics, "test_events_total", prometheus.Labels{"alert_type": "warning", "priority": "normal"})
+	if value == nil || *value != 1 {
+		t.Fatalf("Expected 1 unmapped event, got %v", value)
+	}
+	if value := getFloat64(metrics, "noise", prometheus.Labels{"alert_type": "info", "priority": "normal"}); value != nil {
+		t.Fatalf("Expected dropped events not to be exported, got %v", *value)
+	}
+}
+
+// TestServiceCheckGauges validates that service checks update a status gauge
+// and a last seen timestamp.
+func TestServiceCheckGauges(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	clock.ClockInstance = &clock.Clock{
+		TickerCh: make(chan time.Time),
+	}
+	clock.ClockInstance.Instant = time.Unix(1000, 0)
+
+	config := `
+mappings:
+- match: "db.*"
+  name: "db_check"
+  match_metric_type: service_check
+  labels:
+    db: "$1"
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	events := make(chan event.Events)
+	go func() {
+		ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	// The check name replaces a client tag named check, but only in the
+	// exported labels.
+	tagged := &event.ServiceCheckEvent{SCName: "web.ping", SCStatus: 0, SCTimestamp: 600, SCLabels: map[string]string{"check": "client"}}
+	events <- event.Events{
+		&event.ServiceCheckEvent{SCName: "db.main", SCStatus: 0, SCLabels: map[string]string{}},
+		&event.ServiceCheckEvent{SCName: "db.main", SCStatus: 2, SCLabels: map[string]string{}},
+		&event.ServiceCheckEvent{SCName: "cache.ping", SCStatus: 1, SCTimestamp: 500, SCLabels: map[string]string{}},
+		tagged,
+	}
+	events <- event.Events{}
+	close(events)
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+
+	scenarios := []struct {
+		name   string
+		labels prometheus.Labels
+		value  float64
+	}{
+		{name: "db_check_status", labels: prometheus.Labels{"db": "main"}, value: 2},
+		{name: "db_check_last_seen_timestamp_seconds", labels: prometheus.Labels{"db": "main"}, value: 1000},
+		{name: "statsd_service_check_status", labels: prometheus.Labels{"check": "cache.ping"}, value: 1},
+		{name: "statsd_service_check_last_seen_timestamp_seconds", labels: prometheus.Labels{"check": "cache.ping"}, value: 500},
+		{name: "statsd_service_check_last_seen_timestamp_seconds", labels: prometheus.Labels{"check": "web.ping"}, value: 600},
+	}
+	for _, s := range scenarios {
+		value := getFloat64(metrics, s.name, s.labels)
+		if value == nil {
+			t.Fatalf("Metric %s%v should be gathered", s.name, s.labels)
+		}
+		if *value != s.value {
+			t.Fatalf("Expected %s%v to be %v, got %v", s.name, s.labels, s.value, *value)
+		}
+	}
+	if tagged.Labels()["check"] != "client" {
+		t.Fatalf("Expected the event to keep its check tag, got %v", tagged.Labels())
+	}
+}
+
+// TestGaugeTimestamp validates that gauges are exposed with the timestamp
+// sent by the client, and without one once a sample without timestamp
+// arrives.
+func TestGaugeTimestamp(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	events := make(chan event.Events)
+	defer close(events)
+	go func() {
+		testMapper := mapper.MetricMapper{}
+		testMapper.InitCache(0)
+		ex := NewExporter(reg, &testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	name := "foo_timestamped_gauge"
+	labels := prometheus.Labels{"foo": "bar"}
+	events <- event.Events{
+		&event.GaugeEvent{
+			GMetricName: name,
+			GValue:      1,
+			GTimestamp:  time.Unix(1600000000, 0),
+			GLabels:     map[string]string{"foo": "bar"},
+		},
+	}
+	events <- event.Events{}
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+	metric := getMetric(metrics, name, labels)
+	if metric == nil {
+		t.Fatalf("Gauge %s should be gathered", name)
+	}
+	if metric.GetTimestampMs() != 1600000000000 {
+		t.Fatalf("Expected timestamp 1600000000000, got %d", metric.GetTimestampMs())
+	}
+
+	events <- event.Events{
+		&event.GaugeEvent{
+			GMetricName: name,
+			GValue:      2,
+			GLabels:     map[string]string{"foo": "bar"},
+		},
+	}
+	events <- event.Events{}
+
+	metrics, err = reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+	metric = getMetric(metrics, name, labels)
+	if metric == nil {
+		t.Fatalf("Gauge %s should be gathered", name)
+	}
+	if metric.TimestampMs != nil {
+		t.Fatalf("Expected no timestamp, got %d", metric.GetTimestampMs())
+	}
+	if metric.GetGauge().GetValue() != 2 {
+		t.Fatalf("Expected value 2, got %v", metric.GetGauge().GetValue())
+	}
+}
+
+// TestSetDistinctValues validates that sets count distinct members and start
+// over when their window elapses.
+func TestSetDistinctValues(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	// Mock a time.NewTicker
+	tickerCh := make(chan time.Time)
+	clock.ClockInstance = &clock.Clock{
+		TickerCh: tickerCh,
+	}
+	clock.ClockInstance.Instant = time.Unix(0, 0)
+
+	config := `
+mappings:
+- match: users.*
+  name: users
+  match_metric_type: set
+  set_options:
+    window: 10s
+  labels:
+    site: $1
+`
+	testMapper := &mapper.MetricMapper{}
+	err := testMapper.InitFromYAMLString(config, 0)
+	if err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	events := make(chan event.Events)
+	defer close(events)
+	go func() {
+		ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex.Listen(events)
+	}()
+
+	labels := prometheus.Labels{"site": "web"}
+	ev := event.Events{}
+	for _, member := range []string{"alice", "bob", "alice", "carol", "bob"} {
+		ev = append(ev, &event.SetEvent{
+			SMetricName: "users.web",
+			SValue:      member,
+			SLabels:     map[string]string{},
+		})
+	}
+	events <- ev
+	events <- event.Events{}
+
+	metrics, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+	value := getFloat64(metrics, "users", labels)
+	if value == nil {
+		t.Fatal("Set `users` should be gathered")
+	}
+	if *value != 3 {
+		t.Fatalf("Expected 3 distinct members, got %v", *value)
+	}
+
+	// Move past the window and let the exporter roll it.
+	clock.ClockInstance.Instant = time.Unix(11, 0)
+	clock.ClockInstance.TickerCh <- time.Unix(11, 0)
+	events <- event.Events{}
+
+	metrics, err = reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+	value = getFloat64(metrics, "users", labels)
+	if value == nil || *value != 0 {
+		t.Fatalf("Expected set `users` to be reset after its window, got %v", value)
+	}
+
+	events <- event.Events{ev[0]}
+	events <- event.Events{}
+
+	metrics, err = reg.Gather()
+	if err != nil {
+		t.Fatalf("Cannot gather: %v", err)
+	}
+	value = getFloat64(metrics, "users", labels)
+	if value == nil || *value != 1 {
+		t.Fatalf("Expected 1 distinct member in the new window, got %v", value)
+	}
+}
+
 type statsDPacketHandler interface {
 	HandlePacket(packet []byte)
 	SetEventHandler(eh event.EventHandler)
@@ -841,6 +1344,7 @@ func (ml *mockStatsDTCPListener) HandlePacket(packet []byte) {
 // foobar metric without mapping should expire with default ttl of 1s
 // bazqux metric should expire with ttl of 2s
 func TestTtlExpiration(t *testing.T) {
+	reg := prometheus.NewRegistry()
 	// Mock a time.NewTicker
 	tickerCh := make(chan time.Time)
 	clock.ClockInstance = &clock.Clock{
@@ -864,7 +1368,7 @@ mappings:
 	events := make(chan event.Events)
 	defer close(events)
 	go func() {
-		ex := NewExporter(testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
+		ex := NewExporter(reg, testMapper, log.NewNopLogger(), eventsActions, eventsUnmapped, errorEventStats, eventStats, conflictingEventStats, metricsCount)
 		ex.Listen(events)
 	}()
 
@@ -893,7 +1397,7 @@ mappings:
 	events <- event.Events{}
 
 	// Check values
-	metrics, err = prometheus.DefaultGatherer.Gather()
+	metrics, err = reg.Gather()
 	if err != nil {
 		t.Fatal("Gather should not fail")
 	}
@@ -915,7 +1419,7 @@ mappings:
 	events <- event.Events{}
 
 	// Check values
-	metrics, err = prometheus.DefaultGatherer.Gather()
+	metrics, err = reg.Gather()
 	if err != nil {
 		t.Fatal("Gather should not fail")
 	}
@@ -937,7 +1441,7 @@ mappings:
 	events <- event.Events{}
 
 	// Check values
-	metrics, err = prometheus.DefaultGatherer.Gather()
+	metrics, err = reg.Gather()
 	if err != nil {
 		t.Fatal("Gather should not fail")
 	}
@@ -952,7 +1456,7 @@ mappings:
 }
 
 func TestHashLabelNames(t *testing.T) {
-	r := registry.NewRegistry(nil)
+	r := registry.NewRegistry(prometheus.NewRegistry(), nil)
 	// Validate value hash changes and name has doesn't when just the value changes.
 	hash1, _ := r.HashLabels(map[string]string{
 		"label": "value1",
@@ -985,27 +1489,7 @@ func TestHashLabelNames(t *testing.T) {
 // getFloat64 search for metric by name in array of MetricFamily and then search a value by labels.
 // Method returns a value or nil if metric is not found.
 func getFloat64(metrics []*dto.MetricFamily, name string, labels prometheus.Labels) *float64 {
-	var metricFamily *dto.MetricFamily
-	for _, m := range metrics {
-		if *m.Name == name {
-			metricFamily = m
-			break
-		}
-	}
-	if metricFamily == nil {
-		return nil
-	}
-
-	var metric *dto.Metric
-	labelStr := fmt.Sprintf("%v", labels)
-	for _, m := range metricFamily.Metric {
-		l := labelPairsAsLabels(m.GetLabel())
-		ls := fmt.Sprintf("%v", l)
-		if labelStr == ls {
-			metric = m
-			break
-		}
-	}
+	metric := getMetric(metrics, name, labels)
 	if metric == nil {
 		return nil
 	}
@@ -1034,6 +1518,29 @@ func getFloat64(metrics []*dto.MetricFamily, name string, labels prometheus.Labe
 	panic(fmt.Errorf("collected a non-gauge/counter/histogram/summary/untyped metric: %s", metric))
 }
 
+func getMetric(metrics []*dto.MetricFamily, name string, labels prometheus.Labels) *dto.Metric {
+	var metricFamily *dto.MetricFamily
+	for _, m := range metrics {
+		if *m.Name == name {
+			metricFamily = m
+			break
+		}
+	}
+	if metricFamily == nil {
+		return nil
+	}
+
+	labelStr := fmt.Sprintf("%v", labels)
+	for _, m := range metricFamily.Metric {
+		l := labelPairsAsLabels(m.GetLabel())
+		ls := fmt.Sprintf("%v", l)
+		if labelStr == ls {
+			return m
+		}
+	}
+	return nil
+}
+
 func labelPairsAsLabels(pairs []*dto.LabelPair) (labels prometheus.Labels) {
 	labels = prometheus.Labels{}
 	for _, pair := range pairs {
@@ -1113,7 +1620,7 @@ func BenchmarkHashNameAndLabels(b *testing.B) {
 		},
 	}
 
-	r := registry.NewRegistry(nil)
+	r := registry.NewRegistry(prometheus.NewRegistry(), nil)
 	for _, s := range scenarios {
 		b.Run(s.name, func(b *testing.B) {
 			for n := 0; n < b.N; n++ {
@@ -0,0 +1,177 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hyperloglog implements a HyperLogLog cardinality estimator with a
+// bounded memory footprint.
+//
+// Small sets are counted exactly. Once the number of distinct hashes exceeds a
+// fraction of the register count, the sketch switches to the dense HyperLogLog
+// representation, which uses 2^precision bytes regardless of the number of
+// values inserted.
+package hyperloglog
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+const (
+	// MinPrecision is the smallest supported precision.
+	MinPrecision = 4
+	// MaxPrecision is the largest supported precision.
+	MaxPrecision = 16
+	// DefaultPrecision results in 4KiB of registers and a standard error of
+	// about 1.6%.
+	DefaultPrecision = 12
+
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+// Sketch estimates the number of distinct values inserted into it.
+// It is not safe for concurrent use.
+type Sketch struct {
+	precision uint8
+	// sparse holds the exact set of hashes while the sketch is small.
+	sparse map[uint64]struct{}
+	// registers is nil until the sketch is converted to the dense representation.
+	registers []uint8
+	// estimate caches the dense estimate until a register changes.
+	estimate      uint64
+	estimateValid bool
+}
+
+// New returns an empty sketch with the given precision.
+func New(precision uint8) (*Sketch, error) {
+	if precision < MinPrecision || precision > MaxPrecision {
+		return nil, fmt.Errorf("precision must be between %d and %d, got %d", MinPrecision, MaxPrecision, precision)
+	}
+	return &Sketch{
+		precision: precision,
+		sparse:    map[uint64]struct{}{},
+	}, nil
+}
+
+// Insert adds a value to the sketch.
+func (s *Sketch) Insert(value string) {
+	s.InsertHash(hash(value))
+}
+
+// InsertHash adds an already hashed value to the sketch. The hash must be
+// uniformly distributed over all 64 bits.
+func (s *Sketch) InsertHash(h uint64) {
+	if s.registers == nil {
+		s.sparse[h] = struct{}{}
+		if len(s.sparse) > s.sparseLimit() {
+			s.toDense()
+		}
+		return
+	}
+	if s.insertDense(h) {
+		s.estimateValid = false
+	}
+}
+
+// Estimate returns the estimated number of distinct values in the sketch.
+func (s *Sketch) Estimate() uint64 {
+	if s.registers == nil {
+		return uint64(len(s.sparse))
+	}
+	if s.estimateValid {
+		return s.estimate
+	}
+
+	m := float64(len(s.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range s.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha(len(s.registers)) * m * m / sum
+
+	// Use linear counting for small cardinalities, where the raw estimate is
+	// known to be biased.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	s.estimate = uint64(estimate + 0.5)
+	s.estimateValid = true
+	return s.estimate
+}
+
+// Reset removes all values from the sketch and releases the dense registers.
+func (s *Sketch) Reset() {
+	s.registers = nil
+	s.sparse = map[uint64]struct{}{}
+	s.estimateValid = false
+}
+
+func (s *Sketch) sparseLimit() int {
+	return (1 << s.precision) / 16
+}
+
+func (s *Sketch) toDense() {
+	s.registers = make([]uint8, 1<<s.precision)
+	for h := range s.sparse {
+		s.insertDense(h)
+	}
+	s.sparse = nil
+	s.estimateValid = false
+}
+
+// insertDense updates the register for h and reports whether it changed.
+func (s *Sketch) insertDense(h uint64) bool {
+	idx := h >> (64 - s.precision)
+	// Set a guard bit so that the rank is bounded for an all-zero remainder.
+	w := h<<s.precision | 1<<(s.precision-1)
+	rank := uint8(bits.LeadingZeros64(w) + 1)
+	if rank > s.registers[idx] {
+		s.registers[idx] = rank
+		return true
+	}
+	return false
+}
+
+func alpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	default:
+		return 0.7213 / (1 + 1.079/float64(m))
+	}
+}
+
+// hash returns a 64 bit hash of the value. FNV-1a alone does not spread short
+// inputs well across the high bits used for register selection, so the result
+// is passed through the MurmurHash3 finalizer.
+func hash(value string) uint64 {
+	x := uint64(offset64)
+	for i := 0; i < len(value); i++ {
+		x ^= uint64(value[i])
+		x *= prime64
+	}
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
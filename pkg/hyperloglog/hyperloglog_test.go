@@ -0,0 +1,102 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hyperloglog
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	scenarios := []struct {
+		precision uint8
+		distinct  int
+		// maximum relative error accepted
+		tolerance float64
+	}{
+		{precision: DefaultPrecision, distinct: 0, tolerance: 0},
+		{precision: DefaultPrecision, distinct: 100, tolerance: 0},
+		{precision: DefaultPrecision, distinct: 10000, tolerance: 0.05},
+		{precision: DefaultPrecision, distinct: 1000000, tolerance: 0.05},
+		{precision: MinPrecision, distinct: 1000, tolerance: 0.5},
+		{precision: MaxPrecision, distinct: 100000, tolerance: 0.02},
+	}
+
+	for _, s := range scenarios {
+		sketch, err := New(s.precision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Insert every value twice to check that duplicates are not counted.
+		for i := 0; i < s.distinct; i++ {
+			sketch.Insert("user" + strconv.Itoa(i))
+			sketch.Insert("user" + strconv.Itoa(i))
+		}
+
+		estimate := float64(sketch.Estimate())
+		if s.distinct == 0 {
+			if estimate != 0 {
+				t.Fatalf("precision %d: expected estimate 0, got %v", s.precision, estimate)
+			}
+			continue
+		}
+		relErr := math.Abs(estimate-float64(s.distinct)) / float64(s.distinct)
+		if relErr > s.tolerance {
+			t.Fatalf("precision %d: estimate %v for %d distinct values exceeds tolerance %v", s.precision, estimate, s.distinct, s.tolerance)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	sketch, err := New(DefaultPrecision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		sketch.Insert(strconv.Itoa(i))
+	}
+	sketch.Reset()
+	if e := sketch.Estimate(); e != 0 {
+		t.Fatalf("expected empty sketch after reset, got estimate %d", e)
+	}
+	sketch.Insert("a")
+	if e := sketch.Estimate(); e != 1 {
+		t.Fatalf("expected estimate 1 after reset and insert, got %d", e)
+	}
+}
+
+func TestInvalidPrecision(t *testing.T) {
+	for _, p := range []uint8{0, MinPrecision - 1, MaxPrecision + 1} {
+		if _, err := New(p); err == nil {
+			t.Fatalf("expected error for precision %d", p)
+		}
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	sketch, err := New(DefaultPrecision)
+	if err != nil {
+		b.Fatal(err)
+	}
+	values := make([]string, 10000)
+	for i := range values {
+		values[i] = "user" + strconv.Itoa(i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		sketch.Insert(values[n%len(values)])
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package line
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+)
+
+const dogStatsDEventPrefix = "_e{"
+
+// parseDogStatsDEvent parses a DogStatsD event datagram:
+//
+//	_e{<title length>,<text length>}:<title>|<text>|d:<timestamp>|h:<hostname>|k:<aggregation key>|p:<priority>|s:<source type name>|t:<alert type>|#<tags>
+//
+// All fields after the text are optional. See
+// https://docs.datadoghq.com/developers/dogstatsd/datagram_shell/#events
+func (p *Parser) parseDogStatsDEvent(line string, tagErrors prometheus.Counter, tagsReceived prometheus.Counter, logger log.Logger) (event.Event, error) {
+	header := strings.IndexByte(line, '}')
+	if header < 0 || header+1 >= len(line) || line[header+1] != ':' {
+		return nil, fmt.Errorf("missing event header")
+	}
+	lengths := strings.SplitN(line[len(dogStatsDEventPrefix):header], ",", 2)
+	if len(lengths) != 2 {
+		return nil, fmt.Errorf("invalid event header %q", line[:header+1])
+	}
+	titleLen, err := strconv.Atoi(lengths[0])
+	if err != nil || titleLen <= 0 {
+		return nil, fmt.Errorf("invalid event title length %q", lengths[0])
+	}
+	textLen, err := strconv.Atoi(lengths[1])
+	if err != nil || textLen < 0 {
+		return nil, fmt.Errorf("invalid event text length %q", lengths[1])
+	}
+
+	body := line[header+2:]
+	if len(body) < titleLen+1+textLen || body[titleLen] != '|' {
+		return nil, fmt.Errorf("event title and text do not match the announced lengths")
+	}
+
+	e := &event.DogStatsDEvent{
+		ETitle:     body[:titleLen],
+		EText:      strings.Replace(body[titleLen+1:titleLen+1+textLen], "\\n", "\n", -1),
+		EPriority:  "normal",
+		EAlertType: "info",
+		ELabels:    map[string]string{},
+	}
+
+	rest := body[titleLen+1+textLen:]
+	if rest != "" {
+		if rest[0] != '|' {
+			return nil, fmt.Errorf("event text does not match the announced length")
+		}
+		rest = rest[1:]
+	}
+
+	for _, field := range strings.Split(rest, "|") {
+		if field == "" {
+			continue
+		}
+		if field[0] == '#' {
+			p.ParseDogStatsDTags(field[1:], e.ELabels, tagErrors, logger)
+			continue
+		}
+		if len(field) < 2 || field[1] != ':' {
+			return nil, fmt.Errorf("invalid event field %q", field)
+		}
+		value := field[2:]
+		switch field[0] {
+		case 'd':
+			e.ETimestamp, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid event timestamp %q", value)
+			}
+		case 'h':
+			e.EHostname = value
+		case 'k':
+			e.EAggregationKey = value
+		case 'p':
+			if value != "normal" && value != "low" {
+				return nil, fmt.Errorf("invalid event priority %q", value)
+			}
+			e.EPriority = value
+		case 's':
+			e.ESourceTypeName = value
+		case 't':
+			switch value {
+			case "error", "warning", "info", "success":
+				e.EAlertType = value
+			default:
+				return nil, fmt.Errorf("invalid event alert type %q", value)
+			}
+		default:
+			level.Debug(logger).Log("msg", "Ignoring unknown event field", "field", field)
+		}
+	}
+
+	if len(e.ELabels) > 0 {
+		tagsReceived.Inc()
+	}
+
+	e.ELabels["alert_type"] = e.EAlertType
+	e.ELabels["priority"] = e.EPriority
+	if e.ESourceTypeName != "" {
+		e.ELabels["source"] = e.ESourceTypeName
+	}
+	if e.EAggregationKey != "" {
+		e.ELabels["aggregation_key"] = e.EAggregationKey
+	}
+
+	return e, nil
+}
+
+const dogStatsDServiceCheckPrefix = "_sc|"
+
+// parseDogStatsDServiceCheck parses a DogStatsD service check datagram:
+//
+//	_sc|<name>|<status>|d:<timestamp>|h:<hostname>|#<tags>|m:<message>
+//
+// All fields after the status are optional. The message must come last and
+// may itself contain `|`. See
+// https://docs.datadoghq.com/developers/dogstatsd/datagram_shell/#service-checks
+func (p *Parser) parseDogStatsDServiceCheck(line string, tagErrors prometheus.Counter, tagsReceived prometheus.Counter, logger log.Logger) (event.Event, error) {
+	elements := strings.SplitN(line[len(dogStatsDServiceCheckPrefix):], "|", 3)
+	if len(elements) < 2 || elements[0] == "" {
+		return nil, fmt.Errorf("missing service check name or status")
+	}
+
+	status, err := strconv.Atoi(elements[1])
+	if err != nil || status < 0 || status > 3 {
+		return nil, fmt.Errorf("invalid service check status %q", elements[1])
+	}
+
+	sc := &event.ServiceCheckEvent{
+		SCName:   elements[0],
+		SCStatus: status,
+		SCLabels: map[string]string{},
+	}
+
+	if len(elements) == 3 {
+		rest := elements[2]
+		for rest != "" {
+			var field string
+			if strings.HasPrefix(rest, "m:") {
+				sc.SCMessage = strings.Replace(rest[2:], "\\n", "\n", -1)
+				break
+			}
+			if i := strings.IndexByte(rest, '|'); i >= 0 {
+				field, rest = rest[:i], rest[i+1:]
+			} else {
+				field, rest = rest, ""
+			}
+			if field == "" {
+				continue
+			}
+			if field[0] == '#' {
+				p.ParseDogStatsDTags(field[1:], sc.SCLabels, tagErrors, logger)
+				continue
+			}
+			if len(field) < 2 || field[1] != ':' {
+				return nil, fmt.Errorf("invalid service check field %q", field)
+			}
+			value := field[2:]
+			switch field[0] {
+			case 'd':
+				sc.SCTimestamp, err = strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid service check timestamp %q", value)
+				}
+			case 'h':
+				sc.SCHostname = value
+			default:
+				level.Debug(logger).Log("msg", "Ignoring unknown service check field", "field", field)
+			}
+		}
+	}
+
+	if len(sc.SCLabels) > 0 {
+		tagsReceived.Inc()
+	}
+
+	return sc, nil
+}
+
+// isDogStatsDSample reports whether rest, the part of a sample after the
+// first `|`, is a single DogStatsD sample description rather than the
+// remainder of a StatsD multi-metric packet such as `1|c:2|g`. Only DogStatsD
+// tags and container IDs may contain a `:`.
+func isDogStatsDSample(rest string) bool {
+	components := strings.Split(rest, "|")
+	if strings.IndexByte(components[0], ':') >= 0 {
+		return false
+	}
+	for _, component := range components[1:] {
+		if strings.HasPrefix(component, "#") || strings.HasPrefix(component, "c:") {
+			continue
+		}
+		if strings.IndexByte(component, ':') >= 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,340 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package line
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+)
+
+func TestDogStatsDEvents(t *testing.T) {
+	type testCase struct {
+		in  string
+		out event.Events
+	}
+
+	testCases := map[string]testCase{
+		"minimal event": {
+			in: "_e{5,4}:title|text",
+			out: event.Events{
+				&event.DogStatsDEvent{
+					ETitle:     "title",
+					EText:      "text",
+					EPriority:  "normal",
+					EAlertType: "info",
+					ELabels:    map[string]string{"alert_type": "info", "priority": "normal"},
+				},
+			},
+		},
+		"event with all fields": {
+			in: "_e{6,12}:deploy|line1\\nline2|d:1600000000|h:web01|k:deploy-42|p:low|s:jenkins|t:error|#env:prod,team:infra",
+			out: event.Events{
+				&event.DogStatsDEvent{
+					ETitle:          "deploy",
+					EText:           "line1\nline2",
+					ETimestamp:      1600000000,
+					EHostname:       "web01",
+					EAggregationKey: "deploy-42",
+					EPriority:       "low",
+					ESourceTypeName: "jenkins",
+					EAlertType:      "error",
+					ELabels: map[string]string{
+						"env":             "prod",
+						"team":            "infra",
+						"alert_type":      "error",
+						"priority":        "low",
+						"source":          "jenkins",
+						"aggregation_key": "deploy-42",
+					},
+				},
+			},
+		},
+		"title and text containing separators": {
+			in: "_e{3,3}:a|b|c:d|t:success",
+			out: event.Events{
+				&event.DogStatsDEvent{
+					ETitle:     "a|b",
+					EText:      "c:d",
+					EPriority:  "normal",
+					EAlertType: "success",
+					ELabels:    map[string]string{"alert_type": "success", "priority": "normal"},
+				},
+			},
+		},
+		"empty text": {
+			in: "_e{5,0}:title|",
+			out: event.Events{
+				&event.DogStatsDEvent{
+					ETitle:     "title",
+					EPriority:  "normal",
+					EAlertType: "info",
+					ELabels:    map[string]string{"alert_type": "info", "priority": "normal"},
+				},
+			},
+		},
+		"title length too long": {
+			in: "_e{10,4}:title|text",
+		},
+		"text length too short": {
+			in: "_e{5,2}:title|text",
+		},
+		"missing lengths": {
+			in: "_e{5}:title|text",
+		},
+		"invalid priority": {
+			in: "_e{5,4}:title|text|p:urgent",
+		},
+		"invalid alert type": {
+			in: "_e{5,4}:title|text|t:fatal",
+		},
+		"invalid timestamp": {
+			in: "_e{5,4}:title|text|d:yesterday",
+		},
+	}
+
+	parser := NewParser()
+	parser.EnableDogstatsdParsing()
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			events := parser.LineToEvents(testCase.in, *nopSampleErrors, nopSamplesReceived, nopTagErrors, nopTagsReceived, nopLogger)
+
+			if len(events) != len(testCase.out) {
+				t.Fatalf("Expected %d events, got %d: %#v", len(testCase.out), len(events), events)
+			}
+			for j, expected := range testCase.out {
+				if !reflect.DeepEqual(&expected, &events[j]) {
+					t.Fatalf("Expected %#v, got %#v in scenario '%s'", expected, events[j], name)
+				}
+			}
+		})
+	}
+}
+
+func TestDogStatsDEventsDisabled(t *testing.T) {
+	parser := NewParser()
+	events := parser.LineToEvents("_e{5,4}:title|text", *nopSampleErrors, nopSamplesReceived, nopTagErrors, nopTagsReceived, nopLogger)
+	for _, e := range events {
+		if _, ok := e.(*event.DogStatsDEvent); ok {
+			t.Fatalf("Expected no DogStatsD event with DogStatsD parsing disabled, got %#v", e)
+		}
+	}
+}
+
+func TestDogStatsDServiceChecks(t *testing.T) {
+	type testCase struct {
+		in  string
+		out event.Events
+	}
+
+	testCases := map[string]testCase{
+		"minimal service check": {
+			in: "_sc|db.ping|0",
+			out: event.Events{
+				&event.ServiceCheckEvent{
+					SCName:   "db.ping",
+					SCStatus: 0,
+					SCLabels: map[string]string{},
+				},
+			},
+		},
+		"service check with all fields": {
+			in: "_sc|db.ping|2|d:1600000000|h:db01|#env:prod|m:timeout|after 5s",
+			out: event.Events{
+				&event.ServiceCheckEvent{
+					SCName:      "db.ping",
+					SCStatus:    2,
+					SCTimestamp: 1600000000,
+					SCHostname:  "db01",
+					SCMessage:   "timeout|after 5s",
+					SCLabels:    map[string]string{"env": "prod"},
+				},
+			},
+		},
+		"status out of range": {
+			in: "_sc|db.ping|4",
+		},
+		"status not a number": {
+			in: "_sc|db.ping|critical",
+		},
+		"missing status": {
+			in: "_sc|db.ping",
+		},
+		"missing name": {
+			in: "_sc||1",
+		},
+		"invalid timestamp": {
+			in: "_sc|db.ping|1|d:now",
+		},
+	}
+
+	parser := NewParser()
+	parser.EnableDogstatsdParsing()
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			events := parser.LineToEvents(testCase.in, *nopSampleErrors, nopSamplesReceived, nopTagErrors, nopTagsReceived, nopLogger)
+
+			if len(events) != len(testCase.out) {
+				t.Fatalf("Expected %d events, got %d: %#v", len(testCase.out), len(events), events)
+			}
+			for j, expected := range testCase.out {
+				if !reflect.DeepEqual(&expected, &events[j]) {
+					t.Fatalf("Expected %#v, got %#v in scenario '%s'", expected, events[j], name)
+				}
+			}
+		})
+	}
+}
+
+func TestDogStatsDDatagrams(t *testing.T) {
+	type testCase struct {
+		in  string
+		out event.Events
+	}
+
+	testCases := map[string]testCase{
+		"multiple values with tags": {
+			in: "foo:1:2:3|d|#tag:v",
+			out: event.Events{
+				&event.ObserverEvent{OMetricName: "foo", OValue: 1, OLabels: map[string]string{"tag": "v"}},
+				&event.ObserverEvent{OMetricName: "foo", OValue: 2, OLabels: map[string]string{"tag": "v"}},
+				&event.ObserverEvent{OMetricName: "foo", OValue: 3, OLabels: map[string]string{"tag": "v"}},
+			},
+		},
+		"multiple values with sampling": {
+			in: "foo:1:2|c|@0.5|#tag:v",
+			out: event.Events{
+				&event.CounterEvent{CMetricName: "foo", CValue: 2, CLabels: map[string]string{"tag": "v"}},
+				&event.CounterEvent{CMetricName: "foo", CValue: 4, CLabels: map[string]string{"tag": "v"}},
+			},
+		},
+		"multiple values without tags": {
+			in: "foo:1:2|g|T1600000000",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "foo", GValue: 1, GTimestamp: time.Unix(1600000000, 0), GLabels: map[string]string{}},
+				&event.GaugeEvent{GMetricName: "foo", GValue: 2, GTimestamp: time.Unix(1600000000, 0), GLabels: map[string]string{}},
+			},
+		},
+		"container id": {
+			in: "foo:1|c|#tag:v|c:abc123",
+			out: event.Events{
+				&event.CounterEvent{CMetricName: "foo", CValue: 1, CLabels: map[string]string{"tag": "v", "container_id": "abc123"}},
+			},
+		},
+		"gauge with timestamp": {
+			in: "foo:5|g|#tag:v|T1600000000",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "foo", GValue: 5, GTimestamp: time.Unix(1600000000, 0), GLabels: map[string]string{"tag": "v"}},
+			},
+		},
+		"counter ignores timestamp": {
+			in: "foo:5|c|T1600000000",
+			out: event.Events{
+				&event.CounterEvent{CMetricName: "foo", CValue: 5, CLabels: map[string]string{}},
+			},
+		},
+		"all fields": {
+			in: "foo:1:2|ms|@1|#tag:v|c:abc|T1600000000",
+			out: event.Events{
+				&event.ObserverEvent{OMetricName: "foo", OValue: 0.001, OLabels: map[string]string{"tag": "v", "container_id": "abc"}},
+				&event.ObserverEvent{OMetricName: "foo", OValue: 0.002, OLabels: map[string]string{"tag": "v", "container_id": "abc"}},
+			},
+		},
+		"statsd multi-metric": {
+			in: "foo:1|c:2|g",
+			out: event.Events{
+				&event.CounterEvent{CMetricName: "foo", CValue: 1, CLabels: map[string]string{}},
+				&event.GaugeEvent{GMetricName: "foo", GValue: 2, GLabels: map[string]string{}},
+			},
+		},
+		"statsd multi-metric with sampling": {
+			in: "foo:1|c|@0.5:2|g",
+			out: event.Events{
+				&event.CounterEvent{CMetricName: "foo", CValue: 2, CLabels: map[string]string{}},
+				&event.GaugeEvent{GMetricName: "foo", GValue: 2, GLabels: map[string]string{}},
+			},
+		},
+		"invalid timestamp": {
+			in: "foo:1|g|Tyesterday",
+		},
+		"invalid container id": {
+			in: "foo:1|g|cabc",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "foo", GValue: 1, GLabels: map[string]string{}},
+			},
+		},
+	}
+
+	parser := NewParser()
+	parser.EnableDogstatsdParsing()
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			events := parser.LineToEvents(testCase.in, *nopSampleErrors, nopSamplesReceived, nopTagErrors, nopTagsReceived, nopLogger)
+
+			if len(events) != len(testCase.out) {
+				t.Fatalf("Expected %d events, got %d: %#v", len(testCase.out), len(events), events)
+			}
+			for j, expected := range testCase.out {
+				if !reflect.DeepEqual(&expected, &events[j]) {
+					t.Fatalf("Expected %#v, got %#v in scenario '%s'", expected, events[j], name)
+				}
+			}
+		})
+	}
+}
+
+// TestDogStatsDDatagramsDisabled checks that container IDs and timestamps are
+// unknown components without DogStatsD parsing, which keep the sample.
+func TestDogStatsDDatagramsDisabled(t *testing.T) {
+	testCases := map[string]struct {
+		in  string
+		out event.Events
+	}{
+		"container id and timestamp": {
+			in: "foo:5|g|c:abc|T1600000000",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "foo", GValue: 5, GLabels: map[string]string{}},
+			},
+		},
+		"invalid container id": {
+			in: "foo:1|c|cbar",
+			out: event.Events{
+				&event.CounterEvent{CMetricName: "foo", CValue: 1, CLabels: map[string]string{}},
+			},
+		},
+		"invalid timestamp": {
+			in: "foo:1|g|Tx",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "foo", GValue: 1, GLabels: map[string]string{}},
+			},
+		},
+	}
+
+	parser := NewParser()
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			events := parser.LineToEvents(testCase.in, *nopSampleErrors, nopSamplesReceived, nopTagErrors, nopTagsReceived, nopLogger)
+
+			if !reflect.DeepEqual(events, testCase.out) {
+				t.Fatalf("Expected %#v, got %#v", testCase.out, events)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package line
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// GraphiteLineToEvents parses a line of the Graphite plaintext protocol:
+//
+//	<path>[;<tag>=<value>...] <value> [<timestamp>]
+//
+// Every line results in a gauge event. Graphite 1.1 tags are turned into
+// labels. A missing timestamp, or -1, means the sample has no timestamp.
+// See https://graphite.readthedocs.io/en/latest/feeding-carbon.html
+func (p *Parser) GraphiteLineToEvents(line string, sampleErrors prometheus.CounterVec, samplesReceived prometheus.Counter, tagErrors prometheus.Counter, tagsReceived prometheus.Counter, logger log.Logger) event.Events {
+	events := event.Events{}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return events
+	}
+	samplesReceived.Inc()
+
+	elements := strings.Fields(line)
+	if len(elements) < 2 || len(elements) > 3 || !utf8.ValidString(line) {
+		sampleErrors.WithLabelValues("malformed_line").Inc()
+		level.Debug(logger).Log("msg", "Bad line from Graphite", "line", line)
+		return events
+	}
+
+	labels := map[string]string{}
+	metric := parseGraphiteTags(elements[0], labels, tagErrors, logger)
+	if metric == "" {
+		sampleErrors.WithLabelValues("malformed_line").Inc()
+		level.Debug(logger).Log("msg", "Empty metric name", "line", line)
+		return events
+	}
+	if len(labels) > 0 {
+		tagsReceived.Inc()
+	}
+
+	value, err := strconv.ParseFloat(elements[1], 64)
+	if err != nil {
+		sampleErrors.WithLabelValues("malformed_value").Inc()
+		level.Debug(logger).Log("msg", "Bad value", "value", elements[1], "line", line)
+		return events
+	}
+
+	var timestamp time.Time
+	if len(elements) == 3 && elements[2] != "-1" {
+		ts, err := strconv.ParseFloat(elements[2], 64)
+		if err != nil || ts < 0 {
+			sampleErrors.WithLabelValues("malformed_timestamp").Inc()
+			level.Debug(logger).Log("msg", "Bad timestamp", "timestamp", elements[2], "line", line)
+			return events
+		}
+		sec, frac := math.Modf(ts)
+		timestamp = time.Unix(int64(sec), int64(frac*1e9))
+	}
+
+	return append(events, &event.GaugeEvent{
+		GMetricName: metric,
+		GValue:      value,
+		GTimestamp:  timestamp,
+		GLabels:     labels,
+	})
+}
+
+// parseGraphiteTags splits a Graphite 1.1 tagged series name into the metric
+// name and its tags.
+func parseGraphiteTags(name string, labels map[string]string, tagErrors prometheus.Counter, logger log.Logger) string {
+	elements := strings.Split(name, ";")
+	for _, tag := range elements[1:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			tagErrors.Inc()
+			level.Debug(logger).Log("msg", "Malformed Graphite tag", "tag", tag, "name", name)
+			continue
+		}
+		labels[mapper.EscapeMetricName(kv[0])] = kv[1]
+	}
+	return elements[0]
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package line
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+)
+
+func TestGraphiteLineToEvents(t *testing.T) {
+	type testCase struct {
+		in  string
+		out event.Events
+	}
+
+	testCases := map[string]testCase{
+		"empty": {},
+		"simple line": {
+			in: "servers.web01.cpu.load 0.52 1600000000",
+			out: event.Events{
+				&event.GaugeEvent{
+					GMetricName: "servers.web01.cpu.load",
+					GValue:      0.52,
+					GTimestamp:  time.Unix(1600000000, 0),
+					GLabels:     map[string]string{},
+				},
+			},
+		},
+		"fractional timestamp": {
+			in: "foo 1 1600000000.5",
+			out: event.Events{
+				&event.GaugeEvent{
+					GMetricName: "foo",
+					GValue:      1,
+					GTimestamp:  time.Unix(1600000000, 500000000),
+					GLabels:     map[string]string{},
+				},
+			},
+		},
+		"missing timestamp": {
+			in: "foo 1",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "foo", GValue: 1, GLabels: map[string]string{}},
+			},
+		},
+		"timestamp -1": {
+			in: "foo 1 -1",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "foo", GValue: 1, GLabels: map[string]string{}},
+			},
+		},
+		"tabs and trailing whitespace": {
+			in: "foo\t2\t1600000000\r",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "foo", GValue: 2, GTimestamp: time.Unix(1600000000, 0), GLabels: map[string]string{}},
+			},
+		},
+		"tagged series": {
+			in: "disk.used;datacenter=dc1;rack.id=a1 42 1600000000",
+			out: event.Events{
+				&event.GaugeEvent{
+					GMetricName: "disk.used",
+					GValue:      42,
+					GTimestamp:  time.Unix(1600000000, 0),
+					GLabels:     map[string]string{"datacenter": "dc1", "rack_id": "a1"},
+				},
+			},
+		},
+		"malformed tag is skipped": {
+			in: "disk.used;datacenter;rack=a1 42",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "disk.used", GValue: 42, GLabels: map[string]string{"rack": "a1"}},
+			},
+		},
+		"missing value": {
+			in: "foo",
+		},
+		"too many fields": {
+			in: "foo 1 2 3",
+		},
+		"bad value": {
+			in: "foo one 1600000000",
+		},
+		"bad timestamp": {
+			in: "foo 1 yesterday",
+		},
+		"empty metric name": {
+			in: ";tag=value 1",
+		},
+		"invalid utf8": {
+			in: "invalid\xc3\x28utf8 1",
+		},
+	}
+
+	parser := NewParser()
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			events := parser.GraphiteLineToEvents(testCase.in, *nopSampleErrors, nopSamplesReceived, nopTagErrors, nopTagsReceived, nopLogger)
+
+			if len(events) != len(testCase.out) {
+				t.Fatalf("Expected %d events, got %d: %#v", len(testCase.out), len(events), events)
+			}
+			for j, expected := range testCase.out {
+				if !reflect.DeepEqual(&expected, &events[j]) {
+					t.Fatalf("Expected %#v, got %#v in scenario '%s'", expected, events[j], name)
+				}
+			}
+		})
+	}
+}
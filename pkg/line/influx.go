@@ -0,0 +1,217 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package line
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// InfluxPrecision returns the duration of one timestamp unit for an InfluxDB
+// precision such as "ns", "ms" or "s". An empty precision means nanoseconds.
+func InfluxPrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ", "µs":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	default:
+		return 0, fmt.Errorf("invalid precision %q", precision)
+	}
+}
+
+var errMalformedInfluxLine = errors.New("malformed line")
+
+// InfluxLineToEvents parses a line of the InfluxDB line protocol:
+//
+//	<measurement>[,<tag>=<value>...] <field>=<value>[,<field>=<value>...] [<timestamp>]
+//
+// Every numeric or boolean field results in a gauge event named
+// <measurement>_<field>, with the tags as labels. String fields cannot be
+// represented and are skipped. The timestamp is interpreted in units of
+// precision. See
+// https://docs.influxdata.com/influxdb/v1.8/write_protocols/line_protocol_reference/
+//
+// An error is returned if the whole line had to be rejected. Errors in
+// individual fields only count towards sampleErrors.
+func (p *Parser) InfluxLineToEvents(line string, precision time.Duration, sampleErrors prometheus.CounterVec, samplesReceived prometheus.Counter, tagErrors prometheus.Counter, tagsReceived prometheus.Counter, logger log.Logger) (event.Events, error) {
+	events := event.Events{}
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return events, nil
+	}
+
+	if !utf8.ValidString(line) {
+		samplesReceived.Inc()
+		sampleErrors.WithLabelValues("malformed_line").Inc()
+		level.Debug(logger).Log("msg", "Bad line from InfluxDB", "line", line)
+		return events, errMalformedInfluxLine
+	}
+
+	keyEnd := indexUnescaped(line, ' ', false)
+	if keyEnd < 0 {
+		samplesReceived.Inc()
+		sampleErrors.WithLabelValues("malformed_line").Inc()
+		level.Debug(logger).Log("msg", "Bad line from InfluxDB", "line", line)
+		return events, errMalformedInfluxLine
+	}
+	key, rest := line[:keyEnd], strings.TrimLeft(line[keyEnd+1:], " ")
+
+	fieldsEnd := indexUnescaped(rest, ' ', true)
+	fieldSet, timestampStr := rest, ""
+	if fieldsEnd >= 0 {
+		fieldSet, timestampStr = rest[:fieldsEnd], strings.TrimSpace(rest[fieldsEnd+1:])
+	}
+
+	keyParts := splitUnescaped(key, ',', false)
+	measurement := unescapeInflux(keyParts[0])
+	if measurement == "" {
+		samplesReceived.Inc()
+		sampleErrors.WithLabelValues("malformed_line").Inc()
+		level.Debug(logger).Log("msg", "Empty measurement", "line", line)
+		return events, errMalformedInfluxLine
+	}
+
+	labels := map[string]string{}
+	for _, tag := range keyParts[1:] {
+		i := indexUnescaped(tag, '=', false)
+		if i <= 0 || i == len(tag)-1 {
+			tagErrors.Inc()
+			level.Debug(logger).Log("msg", "Malformed InfluxDB tag", "tag", tag, "line", line)
+			continue
+		}
+		labels[mapper.EscapeMetricName(unescapeInflux(tag[:i]))] = unescapeInflux(tag[i+1:])
+	}
+	if len(labels) > 0 {
+		tagsReceived.Inc()
+	}
+
+	var timestamp time.Time
+	if timestampStr != "" {
+		ts, err := strconv.ParseInt(timestampStr, 10, 64)
+		if err != nil {
+			samplesReceived.Inc()
+			sampleErrors.WithLabelValues("malformed_timestamp").Inc()
+			level.Debug(logger).Log("msg", "Bad timestamp", "timestamp", timestampStr, "line", line)
+			return events, fmt.Errorf("invalid timestamp %q", timestampStr)
+		}
+		timestamp = time.Unix(0, 0).Add(time.Duration(ts) * precision)
+	}
+
+	for _, field := range splitUnescaped(fieldSet, ',', true) {
+		samplesReceived.Inc()
+		i := indexUnescaped(field, '=', false)
+		if i <= 0 || i == len(field)-1 {
+			sampleErrors.WithLabelValues("malformed_component").Inc()
+			level.Debug(logger).Log("msg", "Malformed InfluxDB field", "field", field, "line", line)
+			continue
+		}
+		fieldKey, valueStr := unescapeInflux(field[:i]), field[i+1:]
+
+		if valueStr[0] == '"' {
+			level.Debug(logger).Log("msg", "Skipping InfluxDB string field", "field", fieldKey, "line", line)
+			continue
+		}
+		value, err := parseInfluxValue(valueStr)
+		if err != nil {
+			sampleErrors.WithLabelValues("malformed_value").Inc()
+			level.Debug(logger).Log("msg", "Bad value", "value", valueStr, "line", line)
+			continue
+		}
+
+		events = append(events, &event.GaugeEvent{
+			GMetricName: measurement + "_" + fieldKey,
+			GValue:      value,
+			GTimestamp:  timestamp,
+			GLabels:     copyLabels(labels),
+		})
+	}
+	return events, nil
+}
+
+func parseInfluxValue(s string) (float64, error) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	switch s[len(s)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(v), err
+	case 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(v), err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// indexUnescaped returns the index of the first sep in s that is not escaped
+// with a backslash and, if quoted is set, not inside double quotes.
+func indexUnescaped(s string, sep byte, quoted bool) int {
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quoted && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			return i
+		}
+	}
+	return -1
+}
+
+// splitUnescaped splits s at every sep found by indexUnescaped.
+func splitUnescaped(s string, sep byte, quoted bool) []string {
+	var parts []string
+	for {
+		i := indexUnescaped(s, sep, quoted)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+var influxUnescaper = strings.NewReplacer(`\,`, `,`, `\ `, ` `, `\=`, `=`)
+
+func unescapeInflux(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	return influxUnescaper.Replace(s)
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package line
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+)
+
+func TestInfluxLineToEvents(t *testing.T) {
+	type testCase struct {
+		in        string
+		precision time.Duration
+		out       event.Events
+		err       bool
+	}
+
+	testCases := map[string]testCase{
+		"empty": {},
+		"comment": {
+			in: "# a comment",
+		},
+		"single field": {
+			in: "cpu value=0.5",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "cpu_value", GValue: 0.5, GLabels: map[string]string{}},
+			},
+		},
+		"tags, fields and timestamp": {
+			in: "cpu,host=web01,region=eu usage_user=12.5,usage_system=3i,online=true 1600000000000000000",
+			out: event.Events{
+				&event.GaugeEvent{
+					GMetricName: "cpu_usage_user",
+					GValue:      12.5,
+					GTimestamp:  time.Unix(1600000000, 0),
+					GLabels:     map[string]string{"host": "web01", "region": "eu"},
+				},
+				&event.GaugeEvent{
+					GMetricName: "cpu_usage_system",
+					GValue:      3,
+					GTimestamp:  time.Unix(1600000000, 0),
+					GLabels:     map[string]string{"host": "web01", "region": "eu"},
+				},
+				&event.GaugeEvent{
+					GMetricName: "cpu_online",
+					GValue:      1,
+					GTimestamp:  time.Unix(1600000000, 0),
+					GLabels:     map[string]string{"host": "web01", "region": "eu"},
+				},
+			},
+		},
+		"timestamp precision": {
+			in:        "cpu value=1 1600000000",
+			precision: time.Second,
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "cpu_value", GValue: 1, GTimestamp: time.Unix(1600000000, 0), GLabels: map[string]string{}},
+			},
+		},
+		"unsigned and boolean values": {
+			in: "disk free=10u,ro=F",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "disk_free", GValue: 10, GLabels: map[string]string{}},
+				&event.GaugeEvent{GMetricName: "disk_ro", GValue: 0, GLabels: map[string]string{}},
+			},
+		},
+		"string fields are skipped": {
+			in: `proc,host=a state="running, ok",count=2i`,
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "proc_count", GValue: 2, GLabels: map[string]string{"host": "a"}},
+			},
+		},
+		"string field with space": {
+			in: `proc msg="a b c",count=2i 1600000000000000000`,
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "proc_count", GValue: 2, GTimestamp: time.Unix(1600000000, 0), GLabels: map[string]string{}},
+			},
+		},
+		"escaped characters": {
+			in: `my\ measurement,tag\,key=tag\ value,tag.dots=x fi\=eld=1`,
+			out: event.Events{
+				&event.GaugeEvent{
+					GMetricName: "my measurement_fi=eld",
+					GValue:      1,
+					GLabels:     map[string]string{"tag_key": "tag value", "tag_dots": "x"},
+				},
+			},
+		},
+		"malformed tag is skipped": {
+			in: "cpu,host value=1",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "cpu_value", GValue: 1, GLabels: map[string]string{}},
+			},
+		},
+		"bad field is skipped": {
+			in: "cpu value=abc,other=2",
+			out: event.Events{
+				&event.GaugeEvent{GMetricName: "cpu_other", GValue: 2, GLabels: map[string]string{}},
+			},
+		},
+		"missing fields": {
+			in:  "cpu",
+			err: true,
+		},
+		"bad timestamp": {
+			in:  "cpu value=1 yesterday",
+			err: true,
+		},
+		"invalid utf8": {
+			in:  "cpu\xc3\x28 value=1",
+			err: true,
+		},
+	}
+
+	parser := NewParser()
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			precision := testCase.precision
+			if precision == 0 {
+				precision = time.Nanosecond
+			}
+			events, err := parser.InfluxLineToEvents(testCase.in, precision, *nopSampleErrors, nopSamplesReceived, nopTagErrors, nopTagsReceived, nopLogger)
+			if (err != nil) != testCase.err {
+				t.Fatalf("Expected error %v, got %v", testCase.err, err)
+			}
+
+			if len(events) != len(testCase.out) {
+				t.Fatalf("Expected %d events, got %d: %#v", len(testCase.out), len(events), events)
+			}
+			for j, expected := range testCase.out {
+				if !reflect.DeepEqual(&expected, &events[j]) {
+					t.Fatalf("Expected %#v, got %#v in scenario '%s'", expected, events[j], name)
+				}
+			}
+		})
+	}
+}
+
+// TestInfluxTagsReceived checks that the tags of a line are counted once, no
+// matter how many fields it has.
+func TestInfluxTagsReceived(t *testing.T) {
+	tagsReceived := prometheus.NewCounter(prometheus.CounterOpts{Name: "tags_total"})
+
+	parser := NewParser()
+	for _, in := range []string{
+		"cpu,host=web01,region=eu user=1,system=2,idle=3",
+		"cpu user=1,system=2",
+		"mem,host=web01 free=1",
+	} {
+		if _, err := parser.InfluxLineToEvents(in, time.Nanosecond, *nopSampleErrors, nopSamplesReceived, nopTagErrors, tagsReceived, nopLogger); err != nil {
+			t.Fatalf("Unexpected error for %q: %v", in, err)
+		}
+	}
+
+	var m dto.Metric
+	tagsReceived.Write(&m)
+	if got := m.GetCounter().GetValue(); got != 2 {
+		t.Fatalf("Expected 2 tagged lines, got %v", got)
+	}
+}
+
+func TestInfluxPrecision(t *testing.T) {
+	for precision, expected := range map[string]time.Duration{
+		"":   time.Nanosecond,
+		"ns": time.Nanosecond,
+		"u":  time.Microsecond,
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+	} {
+		d, err := InfluxPrecision(precision)
+		if err != nil {
+			t.Fatalf("Unexpected error for precision %q: %v", precision, err)
+		}
+		if d != expected {
+			t.Fatalf("Expected %v for precision %q, got %v", expected, precision, d)
+		}
+	}
+	if _, err := InfluxPrecision("d"); err == nil {
+		t.Fatal("Expected an error for precision \"d\"")
+	}
+}
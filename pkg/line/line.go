@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/go-kit/kit/log"
@@ -61,7 +62,7 @@ func (p *Parser) EnableSignalFXParsing() {
 	p.SignalFXTagsEnabled = true
 }
 
-func buildEvent(statType, metric string, value float64, relative bool, labels map[string]string) (event.Event, error) {
+func buildEvent(statType, metric string, value float64, member string, relative bool, timestamp time.Time, labels map[string]string) (event.Event, error) {
 	switch statType {
 	case "c":
 		return &event.CounterEvent{
@@ -74,6 +75,7 @@ func buildEvent(statType, metric string, value float64, relative bool, labels ma
 			GMetricName: metric,
 			GValue:      float64(value),
 			GRelative:   relative,
+			GTimestamp:  timestamp,
 			GLabels:     labels,
 		}, nil
 	case "ms":
@@ -89,12 +91,25 @@ func buildEvent(statType, metric string, value float64, relative bool, labels ma
 			OLabels:     labels,
 		}, nil
 	case "s":
-		return nil, fmt.Errorf("no support for StatsD sets")
+		return &event.SetEvent{
+			SMetricName: metric,
+			SValue:      member,
+			SLabels:     labels,
+		}, nil
 	default:
 		return nil, fmt.Errorf("bad stat type %s", statType)
 	}
 }
 
+// copyLabels returns a copy of labels, so that every event has its own.
+func copyLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
+
 func parseTag(component, tag string, separator rune, labels map[string]string, tagErrors prometheus.Counter, logger log.Logger) {
 	// Entirely empty tag is an error
 	if len(tag) == 0 {
@@ -203,45 +218,90 @@ func (p *Parser) parseNameAndTags(name string, labels map[string]string, tagErro
 }
 
 func (p *Parser) LineToEvents(line string, sampleErrors prometheus.CounterVec, samplesReceived prometheus.Counter, tagErrors prometheus.Counter, tagsReceived prometheus.Counter, logger log.Logger) event.Events {
+	return p.LineToEventsFunc(line, func(reason string) { sampleErrors.WithLabelValues(reason).Inc() }, samplesReceived, tagErrors, tagsReceived, logger)
+}
+
+// LineToEventsFunc works like LineToEvents, but reports every sample error by
+// calling sampleError with its reason instead of counting it.
+func (p *Parser) LineToEventsFunc(line string, sampleError func(reason string), samplesReceived prometheus.Counter, tagErrors prometheus.Counter, tagsReceived prometheus.Counter, logger log.Logger) event.Events {
 	events := event.Events{}
 	if line == "" {
 		return events
 	}
 
+	if p.DogstatsdTagsEnabled && strings.HasPrefix(line, dogStatsDEventPrefix) {
+		samplesReceived.Inc()
+		if !utf8.ValidString(line) {
+			sampleError("malformed_line")
+			level.Debug(logger).Log("msg", "Bad line from StatsD", "line", line)
+			return events
+		}
+		e, err := p.parseDogStatsDEvent(line, tagErrors, tagsReceived, logger)
+		if err != nil {
+			sampleError("malformed_event")
+			level.Debug(logger).Log("msg", "Bad DogStatsD event", "line", line, "error", err)
+			return events
+		}
+		return append(events, e)
+	}
+
+	if p.DogstatsdTagsEnabled && strings.HasPrefix(line, dogStatsDServiceCheckPrefix) {
+		samplesReceived.Inc()
+		if !utf8.ValidString(line) {
+			sampleError("malformed_line")
+			level.Debug(logger).Log("msg", "Bad line from StatsD", "line", line)
+			return events
+		}
+		sc, err := p.parseDogStatsDServiceCheck(line, tagErrors, tagsReceived, logger)
+		if err != nil {
+			sampleError("malformed_service_check")
+			level.Debug(logger).Log("msg", "Bad DogStatsD service check", "line", line, "error", err)
+			return events
+		}
+		return append(events, sc)
+	}
+
 	elements := strings.SplitN(line, ":", 2)
 	if len(elements) < 2 || len(elements[0]) == 0 || !utf8.ValidString(line) {
-		sampleErrors.WithLabelValues("malformed_line").Inc()
+		sampleError("malformed_line")
 		level.Debug(logger).Log("msg", "Bad line from StatsD", "line", line)
 		return events
 	}
 
-	labels := map[string]string{}
-	metric := p.parseNameAndTags(elements[0], labels, tagErrors, logger)
+	nameLabels := map[string]string{}
+	metric := p.parseNameAndTags(elements[0], nameLabels, tagErrors, logger)
 
-	var samples []string
-	if strings.Contains(elements[1], "|#") {
-		// using DogStatsD tags
+	// don't allow mixed tagging styles
+	if strings.Contains(elements[1], "|#") && len(nameLabels) > 0 {
+		sampleError("mixed_tagging_styles")
+		level.Debug(logger).Log("msg", "Bad line (multiple tagging styles) from StatsD", "line", line)
+		return events
+	}
 
-		// don't allow mixed tagging styles
-		if len(labels) > 0 {
-			sampleErrors.WithLabelValues("mixed_tagging_styles").Inc()
-			level.Debug(logger).Log("msg", "Bad line (multiple tagging styles) from StatsD", "line", line)
-			return events
+	var samples []string
+	if i := strings.IndexByte(elements[1], '|'); i >= 0 && isDogStatsDSample(elements[1][i+1:]) {
+		// DogStatsD packs multiple values of one metric into a single
+		// sample (`metric:1:2:3|d|#tags`), all of them sharing the type,
+		// sampling rate, tags, container ID and timestamp.
+		values, rest := elements[1][:i], elements[1][i:]
+		for _, value := range strings.Split(values, ":") {
+			samples = append(samples, value+rest)
 		}
-
-		// disable multi-metrics
-		samples = elements[1:]
 	} else {
+		// StatsD multi-metric packets (`metric:1|c:2|c`)
 		samples = strings.Split(elements[1], ":")
 	}
 
 samples:
 	for _, sample := range samples {
 		samplesReceived.Inc()
+		// Every sample gets its own labels, as later stages modify them.
+		labels := copyLabels(nameLabels)
 		components := strings.Split(sample, "|")
 		samplingFactor := 1.0
-		if len(components) < 2 || len(components) > 4 {
-			sampleErrors.WithLabelValues("malformed_component").Inc()
+		var timestamp time.Time
+		if len(components) < 2 || len(components) > 6 {
+			sampleError("malformed_component")
 			level.Debug(logger).Log("msg", "Bad component", "line", line)
 			continue
 		}
@@ -252,10 +312,19 @@ samples:
 			relative = true
 		}
 
-		value, err := strconv.ParseFloat(valueStr, 64)
-		if err != nil {
-			level.Debug(logger).Log("msg", "Bad value", "value", valueStr, "line", line)
-			sampleErrors.WithLabelValues("malformed_value").Inc()
+		// Set members are arbitrary strings, only other types carry a number.
+		var value float64
+		var err error
+		if statType != "s" {
+			value, err = strconv.ParseFloat(valueStr, 64)
+			if err != nil {
+				level.Debug(logger).Log("msg", "Bad value", "value", valueStr, "line", line)
+				sampleError("malformed_value")
+				continue
+			}
+		} else if len(valueStr) == 0 {
+			level.Debug(logger).Log("msg", "Empty set member", "line", line)
+			sampleError("malformed_value")
 			continue
 		}
 
@@ -264,36 +333,60 @@ samples:
 			for _, component := range components[2:] {
 				if len(component) == 0 {
 					level.Debug(logger).Log("msg", "Empty component", "line", line)
-					sampleErrors.WithLabelValues("malformed_component").Inc()
+					sampleError("malformed_component")
 					continue samples
 				}
 			}
 
 			for _, component := range components[2:] {
-				switch component[0] {
-				case '@':
+				// Container IDs and timestamps are DogStatsD extensions. If
+				// DogStatsD parsing is disabled, they are unknown components.
+				switch {
+				case component[0] == '@':
 
 					samplingFactor, err = strconv.ParseFloat(component[1:], 64)
 					if err != nil {
 						level.Debug(logger).Log("msg", "Invalid sampling factor", "component", component[1:], "line", line)
-						sampleErrors.WithLabelValues("invalid_sample_factor").Inc()
+						sampleError("invalid_sample_factor")
 					}
 					if samplingFactor == 0 {
 						samplingFactor = 1
 					}
 
-					if statType == "g" {
+					if statType == "g" || statType == "s" {
 						continue
 					} else if statType == "c" {
 						value /= samplingFactor
 					} else if statType == "ms" || statType == "h" || statType == "d" {
 						multiplyEvents = int(1 / samplingFactor)
 					}
-				case '#':
+				case component[0] == '#':
 					p.ParseDogStatsDTags(component[1:], labels, tagErrors, logger)
+				case component[0] == 'c' && p.DogstatsdTagsEnabled:
+					// Like an invalid sampling factor, an invalid container ID
+					// does not invalidate the value.
+					if len(component) < 2 || component[1] != ':' {
+						level.Debug(logger).Log("msg", "Invalid container ID", "component", component, "line", line)
+						sampleError("malformed_component")
+						continue
+					}
+					if len(component) > 2 {
+						labels["container_id"] = component[2:]
+					}
+				case component[0] == 'T' && p.DogstatsdTagsEnabled:
+					ts, err := strconv.ParseInt(component[1:], 10, 64)
+					if err != nil {
+						level.Debug(logger).Log("msg", "Invalid timestamp", "component", component, "line", line)
+						sampleError("malformed_timestamp")
+						continue samples
+					}
+					// Only gauges can be exposed with the client's timestamp.
+					if statType == "g" {
+						timestamp = time.Unix(ts, 0)
+					}
 				default:
 					level.Debug(logger).Log("msg", "Invalid sampling factor or tag section", "component", components[2], "line", line)
-					sampleErrors.WithLabelValues("invalid_sample_factor").Inc()
+					sampleError("invalid_sample_factor")
 					continue
 				}
 			}
@@ -304,10 +397,14 @@ samples:
 		}
 
 		for i := 0; i < multiplyEvents; i++ {
-			event, err := buildEvent(statType, metric, value, relative, labels)
+			eventLabels := labels
+			if i > 0 {
+				eventLabels = copyLabels(labels)
+			}
+			event, err := buildEvent(statType, metric, value, valueStr, relative, timestamp, eventLabels)
 			if err != nil {
 				level.Debug(logger).Log("msg", "Error building event", "line", line, "error", err)
-				sampleErrors.WithLabelValues("illegal_event").Inc()
+				sampleError("illegal_event")
 				continue
 			}
 			events = append(events, event)
@@ -131,6 +131,29 @@ func TestLineToEvents(t *testing.T) {
 				},
 			},
 		},
+		"simple set": {
+			in: "foo:user42|s",
+			out: event.Events{
+				&event.SetEvent{
+					SMetricName: "foo",
+					SValue:      "user42",
+					SLabels:     map[string]string{},
+				},
+			},
+		},
+		"set with sampling and tags": {
+			in: "foo:-1|s|@0.1|#tag1:bar",
+			out: event.Events{
+				&event.SetEvent{
+					SMetricName: "foo",
+					SValue:      "-1",
+					SLabels:     map[string]string{"tag1": "bar"},
+				},
+			},
+		},
+		"set with empty member": {
+			in: "foo:|s",
+		},
 		"distribution with sampling": {
 			in: "foo:0.01|d|@0.2|#tag1:bar,#tag2:baz",
 			out: event.Events{
@@ -510,6 +533,29 @@ func TestLineToEvents(t *testing.T) {
 	}
 }
 
+// TestLineToEventsOwnLabels checks that the events of a line do not share
+// their labels, as later stages modify them per event.
+func TestLineToEventsOwnLabels(t *testing.T) {
+	parser := NewParser()
+	parser.EnableDogstatsdParsing()
+
+	for _, line := range []string{
+		"foo:1:2:3|d|#tenant:a,env:prod",
+		"foo:1|ms|@0.5|#tenant:a",
+	} {
+		events := parser.LineToEvents(line, *nopSampleErrors, nopSamplesReceived, nopTagErrors, nopTagsReceived, nopLogger)
+		if len(events) < 2 {
+			t.Fatalf("%s: Expected several events, got %d", line, len(events))
+		}
+		delete(events[0].Labels(), "tenant")
+		for i, e := range events[1:] {
+			if e.Labels()["tenant"] != "a" {
+				t.Fatalf("%s: Expected event %d to keep its tenant tag, got %v", line, i+1, e.Labels())
+			}
+		}
+	}
+}
+
 func TestDisableParsingLineToEvents(t *testing.T) {
 	type testCase struct {
 		in  string
@@ -0,0 +1,170 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+
+	pkgLine "github.com/prometheus/statsd_exporter/pkg/line"
+)
+
+// Listener types.
+const (
+	TypeUDP         = "udp"
+	TypeTCP         = "tcp"
+	TypeUnixgram    = "unixgram"
+	TypeUnix        = "unix"
+	TypeGraphiteUDP = "graphite-udp"
+	TypeGraphiteTCP = "graphite-tcp"
+	TypeInfluxUDP   = "influxdb-udp"
+	TypeInfluxTCP   = "influxdb-tcp"
+)
+
+var listenerTypes = map[string]bool{
+	TypeUDP:         true,
+	TypeTCP:         true,
+	TypeUnixgram:    true,
+	TypeUnix:        true,
+	TypeGraphiteUDP: true,
+	TypeGraphiteTCP: true,
+	TypeInfluxUDP:   true,
+	TypeInfluxTCP:   true,
+}
+
+// Config is the content of a listeners configuration file.
+type Config struct {
+	Listeners []ListenerConfig `yaml:"listeners"`
+}
+
+// ListenerConfig configures a single listener. Unset tag dialects, read
+// buffer and batch sizes, numbers of UDP sockets, readers and parser workers
+// and packet queue sizes fall back to the command line flags.
+type ListenerConfig struct {
+	// Name is the value of the listener label of the self-metrics. It
+	// defaults to <type>://<address>.
+	Name       string `yaml:"name"`
+	Type       string `yaml:"type"`
+	Address    string `yaml:"address"`
+	ReadBuffer int    `yaml:"read_buffer"`
+	// Sockets is the number of UDP sockets bound to the address with
+	// SO_REUSEPORT, and Readers the number of goroutines reading from each.
+	Sockets int `yaml:"sockets"`
+	Readers int `yaml:"readers"`
+	// ReadBatchSize is the maximum number of packets read with a single
+	// system call by StatsD UDP and unixgram listeners.
+	ReadBatchSize int `yaml:"read_batch_size"`
+	// ParserWorkers is the number of goroutines parsing the packets of UDP
+	// and unixgram listeners, which wait in a queue of up to
+	// PacketQueueSize packets.
+	ParserWorkers      int               `yaml:"parser_workers"`
+	PacketQueueSize    int               `yaml:"packet_queue_size"`
+	Prefix             string            `yaml:"prefix"`
+	Labels             map[string]string `yaml:"labels"`
+	ParseDogStatsDTags *bool             `yaml:"parse_dogstatsd_tags"`
+	ParseInfluxDBTags  *bool             `yaml:"parse_influxdb_tags"`
+	ParseLibratoTags   *bool             `yaml:"parse_librato_tags"`
+	ParseSignalFXTags  *bool             `yaml:"parse_signalfx_tags"`
+}
+
+// ListenerName returns the name of a listener without an explicit name.
+func ListenerName(listenerType, address string) string {
+	return listenerType + "://" + address
+}
+
+// LoadConfig reads a listeners configuration file.
+func LoadConfig(fileName string) (*Config, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return nil, err
+	}
+	for i := range cfg.Listeners {
+		if err := cfg.Listeners[i].validate(); err != nil {
+			return nil, fmt.Errorf("listener %d: %v", i, err)
+		}
+	}
+	return &cfg, nil
+}
+
+func (c *ListenerConfig) validate() error {
+	if !listenerTypes[c.Type] {
+		return fmt.Errorf("invalid type %q", c.Type)
+	}
+	if c.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	if c.ReadBuffer < 0 {
+		return fmt.Errorf("read_buffer must not be negative")
+	}
+	if c.Sockets < 0 || c.Readers < 0 {
+		return fmt.Errorf("sockets and readers must not be negative")
+	}
+	if (c.Sockets > 0 || c.Readers > 0) && !isUDP(c.Type) {
+		return fmt.Errorf("sockets and readers are only supported by UDP listeners")
+	}
+	if c.ReadBatchSize < 0 {
+		return fmt.Errorf("read_batch_size must not be negative")
+	}
+	if c.ReadBatchSize > 0 && c.Type != TypeUDP && c.Type != TypeUnixgram {
+		return fmt.Errorf("read_batch_size is only supported by udp and unixgram listeners")
+	}
+	if c.ParserWorkers < 0 || c.PacketQueueSize < 0 {
+		return fmt.Errorf("parser_workers and packet_queue_size must not be negative")
+	}
+	if (c.ParserWorkers > 0 || c.PacketQueueSize > 0) && !isUDP(c.Type) && c.Type != TypeUnixgram {
+		return fmt.Errorf("parser_workers and packet_queue_size are only supported by UDP and unixgram listeners")
+	}
+	if c.Prefix != "" && !model.IsValidMetricName(model.LabelValue(c.Prefix)) {
+		return fmt.Errorf("invalid prefix %q", c.Prefix)
+	}
+	for name := range c.Labels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	if c.Name == "" {
+		c.Name = ListenerName(c.Type, c.Address)
+	}
+	return nil
+}
+
+func isUDP(listenerType string) bool {
+	return listenerType == TypeUDP || listenerType == TypeGraphiteUDP || listenerType == TypeInfluxUDP
+}
+
+// Parser returns a line parser with the tag dialects of the listener. Dialects
+// the listener does not configure are taken from defaults.
+func (c *ListenerConfig) Parser(defaults *pkgLine.Parser) *pkgLine.Parser {
+	p := *defaults
+	if c.ParseDogStatsDTags != nil {
+		p.DogstatsdTagsEnabled = *c.ParseDogStatsDTags
+	}
+	if c.ParseInfluxDBTags != nil {
+		p.InfluxdbTagsEnabled = *c.ParseInfluxDBTags
+	}
+	if c.ParseLibratoTags != nil {
+		p.LibratoTagsEnabled = *c.ParseLibratoTags
+	}
+	if c.ParseSignalFXTags != nil {
+		p.SignalFXTagsEnabled = *c.ParseSignalFXTags
+	}
+	return &p
+}
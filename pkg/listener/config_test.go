@@ -0,0 +1,222 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/line"
+)
+
+func TestLoadConfig(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		config   string
+		err      bool
+		expected []ListenerConfig
+	}{
+		{
+			name: "full listener",
+			config: `
+listeners:
+- name: team-a
+  type: udp
+  address: ":9125"
+  read_buffer: 1048576
+  prefix: team_a_
+  labels:
+    team: a
+  parse_dogstatsd_tags: false
+- type: graphite-tcp
+  address: "[::1]:2003"
+`,
+			expected: []ListenerConfig{
+				{
+					Name:               "team-a",
+					Type:               TypeUDP,
+					Address:            ":9125",
+					ReadBuffer:         1048576,
+					Prefix:             "team_a_",
+					Labels:             map[string]string{"team": "a"},
+					ParseDogStatsDTags: new(bool),
+				}, {
+					Name:    "graphite-tcp://[::1]:2003",
+					Type:    TypeGraphiteTCP,
+					Address: "[::1]:2003",
+				},
+			},
+		}, {
+			name: "invalid type",
+			config: `
+listeners:
+- type: sctp
+  address: ":9125"
+`,
+			err: true,
+		}, {
+			name: "udp sockets and readers",
+			config: `
+listeners:
+- type: udp
+  address: ":9125"
+  sockets: 4
+  readers: 2
+  read_batch_size: 32
+  parser_workers: 4
+  packet_queue_size: 1000
+`,
+			expected: []ListenerConfig{
+				{
+					Name:            "udp://:9125",
+					Type:            TypeUDP,
+					Address:         ":9125",
+					Sockets:         4,
+					Readers:         2,
+					ReadBatchSize:   32,
+					ParserWorkers:   4,
+					PacketQueueSize: 1000,
+				},
+			},
+		}, {
+			name: "sockets on a tcp listener",
+			config: `
+listeners:
+- type: tcp
+  address: ":9125"
+  sockets: 4
+`,
+			err: true,
+		}, {
+			name: "read batch size on a graphite listener",
+			config: `
+listeners:
+- type: graphite-udp
+  address: ":2003"
+  read_batch_size: 32
+`,
+			err: true,
+		}, {
+			name: "parser workers on a unix stream listener",
+			config: `
+listeners:
+- type: unix
+  address: /run/statsd.sock
+  parser_workers: 4
+`,
+			err: true,
+		}, {
+			name: "missing address",
+			config: `
+listeners:
+- type: udp
+`,
+			err: true,
+		}, {
+			name: "invalid prefix",
+			config: `
+listeners:
+- type: udp
+  address: ":9125"
+  prefix: "team-a."
+`,
+			err: true,
+		}, {
+			name: "invalid label name",
+			config: `
+listeners:
+- type: udp
+  address: ":9125"
+  labels:
+    team-name: a
+`,
+			err: true,
+		}, {
+			name: "unknown field",
+			config: `
+listeners:
+- type: udp
+  address: ":9125"
+  buffer: 10
+`,
+			err: true,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "listeners")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			f.WriteString(scenario.config)
+			f.Close()
+
+			cfg, err := LoadConfig(f.Name())
+			if scenario.err {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(cfg.Listeners, scenario.expected) {
+				t.Fatalf("Expected %#v, got %#v", scenario.expected, cfg.Listeners)
+			}
+		})
+	}
+}
+
+func TestListenerConfigParser(t *testing.T) {
+	defaults := line.NewParser()
+	defaults.EnableDogstatsdParsing()
+	defaults.EnableInfluxdbParsing()
+
+	enabled, disabled := true, false
+	cfg := ListenerConfig{ParseDogStatsDTags: &disabled, ParseSignalFXTags: &enabled}
+	expected := &line.Parser{InfluxdbTagsEnabled: true, SignalFXTagsEnabled: true}
+	if p := cfg.Parser(defaults); !reflect.DeepEqual(p, expected) {
+		t.Fatalf("Expected %#v, got %#v", expected, p)
+	}
+	if !defaults.DogstatsdTagsEnabled || defaults.SignalFXTagsEnabled {
+		t.Fatal("The default parser must not be modified")
+	}
+}
+
+func TestEventDecorator(t *testing.T) {
+	events := make(chan event.Events, 1)
+	d := &EventDecorator{
+		EventHandler: &event.UnbufferedEventHandler{C: events},
+		Prefix:       "team_a_",
+		Labels:       map[string]string{"team": "a"},
+	}
+	d.Queue(event.Events{
+		&event.CounterEvent{CMetricName: "foo", CValue: 1, CLabels: map[string]string{"team": "b", "env": "prod"}},
+		&event.ServiceCheckEvent{SCName: "db", SCLabels: map[string]string{}},
+	})
+
+	expected := event.Events{
+		&event.CounterEvent{CMetricName: "team_a_foo", CValue: 1, CLabels: map[string]string{"team": "a", "env": "prod"}},
+		&event.ServiceCheckEvent{SCName: "db", SCLabels: map[string]string{"team": "a"}},
+	}
+	if actual := <-events; !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected %#v, got %#v", expected, actual)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// ConnTracker keeps track of the open connections of a stream listener, so
+// that they can be closed when the listener stops. The zero value is ready to
+// use.
+type ConnTracker struct {
+	mtx    sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// serve runs handle for the connection c in a new goroutine. If the tracker
+// is already closed, c is closed instead. A nil tracker does not track c.
+func (t *ConnTracker) serve(c net.Conn, handle func()) {
+	if t == nil {
+		go handle()
+		return
+	}
+
+	t.mtx.Lock()
+	if t.closed {
+		t.mtx.Unlock()
+		c.Close()
+		return
+	}
+	if t.conns == nil {
+		t.conns = map[net.Conn]struct{}{}
+	}
+	t.conns[c] = struct{}{}
+	t.wg.Add(1)
+	t.mtx.Unlock()
+
+	go func() {
+		defer func() {
+			t.mtx.Lock()
+			delete(t.conns, c)
+			t.mtx.Unlock()
+			t.wg.Done()
+		}()
+		handle()
+	}()
+}
+
+// Close closes all open connections and waits until their handlers have
+// returned. Connections that are accepted afterwards are closed right away.
+func (t *ConnTracker) Close() {
+	t.mtx.Lock()
+	t.closed = true
+	for c := range t.conns {
+		c.Close()
+	}
+	t.mtx.Unlock()
+	t.wg.Wait()
+}
+
+// isClosedConnError reports whether err was returned because the connection
+// was closed locally, which happens during shutdown.
+func isClosedConnError(err error) bool {
+	// https://github.com/golang/go/issues/4373
+	return strings.HasSuffix(err.Error(), "use of closed network connection")
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"github.com/prometheus/statsd_exporter/pkg/event"
+)
+
+// EventDecorator is an event.EventHandler that prefixes metric names and
+// adds static labels before passing events on. The labels override tags of
+// the same name sent by clients. DogStatsD events and service checks are not
+// renamed.
+type EventDecorator struct {
+	EventHandler event.EventHandler
+	Prefix       string
+	Labels       map[string]string
+}
+
+func (d *EventDecorator) Queue(events event.Events) {
+	if d.Prefix != "" {
+		for _, e := range events {
+			switch ev := e.(type) {
+			case *event.CounterEvent:
+				ev.CMetricName = d.Prefix + ev.CMetricName
+			case *event.GaugeEvent:
+				ev.GMetricName = d.Prefix + ev.GMetricName
+			case *event.ObserverEvent:
+				ev.OMetricName = d.Prefix + ev.OMetricName
+			case *event.SetEvent:
+				ev.SMetricName = d.Prefix + ev.SMetricName
+			}
+		}
+	}
+	addLabels(events, d.Labels)
+	d.EventHandler.Queue(events)
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	pkgLine "github.com/prometheus/statsd_exporter/pkg/line"
+)
+
+// GraphiteUDPListener receives Graphite plaintext protocol lines over UDP.
+type GraphiteUDPListener struct {
+	Conn            *net.UDPConn
+	EventHandler    event.EventHandler
+	Logger          log.Logger
+	LineParser      *pkgLine.Parser
+	UDPPackets      prometheus.Counter
+	LinesReceived   prometheus.Counter
+	SampleErrors    prometheus.CounterVec
+	SamplesReceived prometheus.Counter
+	TagErrors       prometheus.Counter
+	TagsReceived    prometheus.Counter
+	// UDPDrops counts packets dropped by the kernel if it is set. See
+	// EnableUDPDropCounting.
+	UDPDrops *UDPDropCounter
+	// Parsers hands packets to a pool of workers instead of parsing them in
+	// the reading goroutine if it is set. Its handler must be HandlePacket.
+	Parsers *ParserPool
+}
+
+func (l *GraphiteUDPListener) SetEventHandler(eh event.EventHandler) {
+	l.EventHandler = eh
+}
+
+func (l *GraphiteUDPListener) Listen() {
+	handle := l.HandlePacket
+	if l.Parsers != nil {
+		handle = l.Parsers.Queue
+	}
+	readUDP(l.Conn, l.UDPDrops, l.Logger, handle)
+}
+
+func (l *GraphiteUDPListener) HandlePacket(packet []byte) {
+	l.UDPPackets.Inc()
+	lines := strings.Split(string(packet), "\n")
+	for _, line := range lines {
+		level.Debug(l.Logger).Log("msg", "Incoming line", "proto", "graphite-udp", "line", line)
+		l.LinesReceived.Inc()
+		l.EventHandler.Queue(l.LineParser.GraphiteLineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger))
+	}
+}
+
+// GraphiteTCPListener receives Graphite plaintext protocol lines over TCP.
+type GraphiteTCPListener struct {
+	Conn            *net.TCPListener
+	EventHandler    event.EventHandler
+	Logger          log.Logger
+	LineParser      *pkgLine.Parser
+	LinesReceived   prometheus.Counter
+	SampleErrors    prometheus.CounterVec
+	SamplesReceived prometheus.Counter
+	TagErrors       prometheus.Counter
+	TagsReceived    prometheus.Counter
+	TCPConnections  prometheus.Counter
+	TCPErrors       prometheus.Counter
+	TCPLineTooLong  prometheus.Counter
+	// Conns tracks the open connections so that they can be closed when
+	// the listener stops. Connections are not tracked if it is nil.
+	Conns *ConnTracker
+}
+
+func (l *GraphiteTCPListener) SetEventHandler(eh event.EventHandler) {
+	l.EventHandler = eh
+}
+
+func (l *GraphiteTCPListener) Listen() {
+	for {
+		c, err := l.Conn.AcceptTCP()
+		if err != nil {
+			// https://github.com/golang/go/issues/4373
+			// ignore net: errClosing error as it will occur during shutdown
+			if strings.HasSuffix(err.Error(), "use of closed network connection") {
+				return
+			}
+			level.Error(l.Logger).Log("msg", "AcceptTCP failed", "error", err)
+			os.Exit(1)
+		}
+		l.Conns.serve(c, func() { l.HandleConn(c) })
+	}
+}
+
+func (l *GraphiteTCPListener) HandleConn(c net.Conn) {
+	defer c.Close()
+
+	l.TCPConnections.Inc()
+
+	readLines(c, "graphite-tcp", l.TCPErrors, l.TCPLineTooLong, l.Logger, func(line string) {
+		l.LinesReceived.Inc()
+		l.EventHandler.Queue(l.LineParser.GraphiteLineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger))
+	})
+}
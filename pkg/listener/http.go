@@ -0,0 +1,142 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	pkgLine "github.com/prometheus/statsd_exporter/pkg/line"
+)
+
+// DefaultHTTPMaxBodySize is the default limit of the size of a request body,
+// before and after decompression.
+const DefaultHTTPMaxBodySize = 10 << 20
+
+// errBodyTooLarge is the error of http.MaxBytesReader.
+const errBodyTooLarge = "http: request body too large"
+
+// StatsDHTTPResponse is returned by the StatsDHTTPHandler for every request.
+// Reasons counts the sample errors of the request by the same reasons as the
+// sample errors metric.
+type StatsDHTTPResponse struct {
+	Lines    int            `json:"lines"`
+	Accepted int            `json:"accepted"`
+	Rejected int            `json:"rejected"`
+	Reasons  map[string]int `json:"reasons"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// StatsDHTTPHandler accepts newline separated StatsD lines in the body of POST
+// requests. Bodies may be gzip encoded. A line is rejected if it did not
+// result in any event.
+type StatsDHTTPHandler struct {
+	EventHandler    event.EventHandler
+	Logger          log.Logger
+	LineParser      *pkgLine.Parser
+	LinesReceived   prometheus.Counter
+	SampleErrors    prometheus.CounterVec
+	SamplesReceived prometheus.Counter
+	TagErrors       prometheus.Counter
+	TagsReceived    prometheus.Counter
+	// MaxBodySize limits the size of request bodies. The lines before the
+	// limit are processed, and the request fails with 413 Request Entity Too
+	// Large. It defaults to DefaultHTTPMaxBodySize.
+	MaxBodySize int64
+}
+
+func (h *StatsDHTTPHandler) SetEventHandler(eh event.EventHandler) {
+	h.EventHandler = eh
+}
+
+func (h *StatsDHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeStatsDHTTPResponse(w, http.StatusMethodNotAllowed, StatsDHTTPResponse{Error: "only POST is supported"})
+		return
+	}
+
+	maxBodySize := h.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultHTTPMaxBodySize
+	}
+	body := http.MaxBytesReader(w, r.Body, maxBodySize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			writeStatsDHTTPResponse(w, http.StatusBadRequest, StatsDHTTPResponse{Error: fmt.Sprintf("invalid gzip body: %v", err)})
+			return
+		}
+		// The decompressed body is limited as well, so that a small
+		// request cannot expand into an unlimited number of lines.
+		body = http.MaxBytesReader(w, gz, maxBodySize)
+	}
+	defer body.Close()
+
+	// Sample errors are also counted per request, so that they can be
+	// reported back to the client.
+	resp := StatsDHTTPResponse{Reasons: map[string]int{}}
+	sampleError := func(reason string) {
+		resp.Reasons[reason]++
+		h.SampleErrors.WithLabelValues(reason).Inc()
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		level.Debug(h.Logger).Log("msg", "Incoming line", "proto", "http", "line", line)
+		h.LinesReceived.Inc()
+		resp.Lines++
+		events := h.LineParser.LineToEventsFunc(line, sampleError, h.SamplesReceived, h.TagErrors, h.TagsReceived, h.Logger)
+		if len(events) == 0 {
+			resp.Rejected++
+			continue
+		}
+		resp.Accepted++
+		h.EventHandler.Queue(events)
+	}
+
+	if err := scanner.Err(); err != nil {
+		level.Debug(h.Logger).Log("msg", "Read failed", "addr", r.RemoteAddr, "error", err)
+		resp.Error = fmt.Sprintf("error reading body: %v", err)
+		code := http.StatusBadRequest
+		if err.Error() == errBodyTooLarge {
+			code = http.StatusRequestEntityTooLarge
+		}
+		writeStatsDHTTPResponse(w, code, resp)
+		return
+	}
+	writeStatsDHTTPResponse(w, http.StatusOK, resp)
+}
+
+func writeStatsDHTTPResponse(w http.ResponseWriter, code int, resp StatsDHTTPResponse) {
+	if resp.Reasons == nil {
+		resp.Reasons = map[string]int{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	pkgLine "github.com/prometheus/statsd_exporter/pkg/line"
+)
+
+// InfluxUDPListener receives InfluxDB line protocol over UDP. Timestamps are
+// expected in nanoseconds.
+type InfluxUDPListener struct {
+	Conn            *net.UDPConn
+	EventHandler    event.EventHandler
+	Logger          log.Logger
+	LineParser      *pkgLine.Parser
+	UDPPackets      prometheus.Counter
+	LinesReceived   prometheus.Counter
+	SampleErrors    prometheus.CounterVec
+	SamplesReceived prometheus.Counter
+	TagErrors       prometheus.Counter
+	TagsReceived    prometheus.Counter
+	// UDPDrops counts packets dropped by the kernel if it is set. See
+	// EnableUDPDropCounting.
+	UDPDrops *UDPDropCounter
+	// Parsers hands packets to a pool of workers instead of parsing them in
+	// the reading goroutine if it is set. Its handler must be HandlePacket.
+	Parsers *ParserPool
+}
+
+func (l *InfluxUDPListener) SetEventHandler(eh event.EventHandler) {
+	l.EventHandler = eh
+}
+
+func (l *InfluxUDPListener) Listen() {
+	handle := l.HandlePacket
+	if l.Parsers != nil {
+		handle = l.Parsers.Queue
+	}
+	readUDP(l.Conn, l.UDPDrops, l.Logger, handle)
+}
+
+func (l *InfluxUDPListener) HandlePacket(packet []byte) {
+	l.UDPPackets.Inc()
+	lines := strings.Split(string(packet), "\n")
+	for _, line := range lines {
+		level.Debug(l.Logger).Log("msg", "Incoming line", "proto", "influx-udp", "line", line)
+		l.LinesReceived.Inc()
+		events, _ := l.LineParser.InfluxLineToEvents(line, time.Nanosecond, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger)
+		l.EventHandler.Queue(events)
+	}
+}
+
+// InfluxTCPListener receives InfluxDB line protocol over TCP. Timestamps are
+// expected in nanoseconds.
+type InfluxTCPListener struct {
+	Conn            *net.TCPListener
+	EventHandler    event.EventHandler
+	Logger          log.Logger
+	LineParser      *pkgLine.Parser
+	LinesReceived   prometheus.Counter
+	SampleErrors    prometheus.CounterVec
+	SamplesReceived prometheus.Counter
+	TagErrors       prometheus.Counter
+	TagsReceived    prometheus.Counter
+	TCPConnections  prometheus.Counter
+	TCPErrors       prometheus.Counter
+	TCPLineTooLong  prometheus.Counter
+	// Conns tracks the open connections so that they can be closed when
+	// the listener stops. Connections are not tracked if it is nil.
+	Conns *ConnTracker
+}
+
+func (l *InfluxTCPListener) SetEventHandler(eh event.EventHandler) {
+	l.EventHandler = eh
+}
+
+func (l *InfluxTCPListener) Listen() {
+	for {
+		c, err := l.Conn.AcceptTCP()
+		if err != nil {
+			// https://github.com/golang/go/issues/4373
+			// ignore net: errClosing error as it will occur during shutdown
+			if strings.HasSuffix(err.Error(), "use of closed network connection") {
+				return
+			}
+			level.Error(l.Logger).Log("msg", "AcceptTCP failed", "error", err)
+			os.Exit(1)
+		}
+		l.Conns.serve(c, func() { l.HandleConn(c) })
+	}
+}
+
+func (l *InfluxTCPListener) HandleConn(c net.Conn) {
+	defer c.Close()
+
+	l.TCPConnections.Inc()
+
+	readLines(c, "influx-tcp", l.TCPErrors, l.TCPLineTooLong, l.Logger, func(line string) {
+		l.LinesReceived.Inc()
+		events, _ := l.LineParser.InfluxLineToEvents(line, time.Nanosecond, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger)
+		l.EventHandler.Queue(events)
+	})
+}
+
+// InfluxHTTPHandler implements the InfluxDB 1.x `/write` endpoint. The
+// precision query parameter sets the unit of the timestamps, and request
+// bodies may be gzip encoded. The database and retention policy are ignored.
+type InfluxHTTPHandler struct {
+	EventHandler    event.EventHandler
+	Logger          log.Logger
+	LineParser      *pkgLine.Parser
+	LinesReceived   prometheus.Counter
+	SampleErrors    prometheus.CounterVec
+	SamplesReceived prometheus.Counter
+	TagErrors       prometheus.Counter
+	TagsReceived    prometheus.Counter
+}
+
+func (h *InfluxHTTPHandler) SetEventHandler(eh event.EventHandler) {
+	h.EventHandler = eh
+}
+
+func (h *InfluxHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		influxError(w, http.StatusMethodNotAllowed, "only POST is supported")
+		return
+	}
+
+	precision, err := pkgLine.InfluxPrecision(r.URL.Query().Get("precision"))
+	if err != nil {
+		influxError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			influxError(w, http.StatusBadRequest, fmt.Sprintf("invalid gzip body: %v", err))
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	rejected := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		level.Debug(h.Logger).Log("msg", "Incoming line", "proto", "influx-http", "line", line)
+		h.LinesReceived.Inc()
+		events, err := h.LineParser.InfluxLineToEvents(line, precision, h.SampleErrors, h.SamplesReceived, h.TagErrors, h.TagsReceived, h.Logger)
+		if err != nil {
+			rejected++
+			continue
+		}
+		h.EventHandler.Queue(events)
+	}
+	if err := scanner.Err(); err != nil {
+		level.Debug(h.Logger).Log("msg", "Read failed", "addr", r.RemoteAddr, "error", err)
+		influxError(w, http.StatusBadRequest, fmt.Sprintf("error reading body: %v", err))
+		return
+	}
+
+	if rejected > 0 {
+		influxError(w, http.StatusBadRequest, fmt.Sprintf("partial write: %d lines rejected", rejected))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func influxError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", msg)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
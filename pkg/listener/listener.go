@@ -15,10 +15,12 @@ package listener
 
 import (
 	"bufio"
+	"crypto/tls"
 	"io"
 	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -39,6 +41,16 @@ type StatsDUDPListener struct {
 	SamplesReceived prometheus.Counter
 	TagErrors       prometheus.Counter
 	TagsReceived    prometheus.Counter
+	// UDPDrops counts packets dropped by the kernel if it is set. See
+	// EnableUDPDropCounting.
+	UDPDrops *UDPDropCounter
+	// BatchSize is the maximum number of packets read with a single
+	// recvmmsg call. Packets are read one by one if it is not greater than 1
+	// or BatchReadsSupported is false.
+	BatchSize int
+	// Parsers hands packets to a pool of workers instead of parsing them in
+	// the reading goroutine if it is set. Its handler must be HandlePacket.
+	Parsers *ParserPool
 }
 
 func (l *StatsDUDPListener) SetEventHandler(eh event.EventHandler) {
@@ -46,30 +58,42 @@ func (l *StatsDUDPListener) SetEventHandler(eh event.EventHandler) {
 }
 
 func (l *StatsDUDPListener) Listen() {
-	buf := make([]byte, 65535)
-	for {
-		n, _, err := l.Conn.ReadFromUDP(buf)
-		if err != nil {
-			// https://github.com/golang/go/issues/4373
-			// ignore net: errClosing error as it will occur during shutdown
-			if strings.HasSuffix(err.Error(), "use of closed network connection") {
-				return
-			}
+	handle, handleBatch := l.HandlePacket, l.HandlePackets
+	if l.Parsers != nil {
+		handle, handleBatch = l.Parsers.Queue, l.Parsers.QueueBatch
+	}
+	if l.BatchSize > 1 && BatchReadsSupported {
+		if err := readBatches(l.Conn, l.BatchSize, l.UDPDrops, handleBatch); err != nil {
 			level.Error(l.Logger).Log("error", err)
-			return
 		}
-		l.HandlePacket(buf[0:n])
+		return
 	}
+	readUDP(l.Conn, l.UDPDrops, l.Logger, handle)
 }
 
 func (l *StatsDUDPListener) HandlePacket(packet []byte) {
+	l.EventHandler.Queue(l.packetEvents(packet, nil))
+}
+
+// HandlePackets queues the events of all packets at once.
+func (l *StatsDUDPListener) HandlePackets(packets [][]byte) {
+	var events event.Events
+	for _, packet := range packets {
+		events = l.packetEvents(packet, events)
+	}
+	l.EventHandler.Queue(events)
+}
+
+// packetEvents appends the events of all lines in packet to events.
+func (l *StatsDUDPListener) packetEvents(packet []byte, events event.Events) event.Events {
 	l.UDPPackets.Inc()
 	lines := strings.Split(string(packet), "\n")
 	for _, line := range lines {
 		level.Debug(l.Logger).Log("msg", "Incoming line", "proto", "udp", "line", line)
 		l.LinesReceived.Inc()
-		l.EventHandler.Queue(l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger))
+		events = append(events, l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger)...)
 	}
+	return events
 }
 
 type StatsDTCPListener struct {
@@ -86,6 +110,17 @@ type StatsDTCPListener struct {
 	TCPConnections  prometheus.Counter
 	TCPErrors       prometheus.Counter
 	TCPLineTooLong  prometheus.Counter
+	// TLSConfig enables TLS for all accepted connections if it is set.
+	TLSConfig *tls.Config
+	// ClientIdentityLabel is the name of the label that carries the identity
+	// of the TLS client certificate. No label is added if it is empty.
+	ClientIdentityLabel string
+	// TLSHandshakeTimeout limits the time of the TLS handshake. It defaults
+	// to DefaultTLSHandshakeTimeout.
+	TLSHandshakeTimeout time.Duration
+	// Conns tracks the open connections so that they can be closed when
+	// the listener stops. Connections are not tracked if it is nil.
+	Conns *ConnTracker
 }
 
 func (l *StatsDTCPListener) SetEventHandler(eh event.EventHandler) {
@@ -104,34 +139,48 @@ func (l *StatsDTCPListener) Listen() {
 			level.Error(l.Logger).Log("msg", "AcceptTCP failed", "error", err)
 			os.Exit(1)
 		}
-		go l.HandleConn(c)
+		if l.TLSConfig != nil {
+			tc := tls.Server(c, l.TLSConfig)
+			l.Conns.serve(c, func() { l.HandleConn(tc) })
+			continue
+		}
+		l.Conns.serve(c, func() { l.HandleConn(c) })
 	}
 }
 
-func (l *StatsDTCPListener) HandleConn(c *net.TCPConn) {
+func (l *StatsDTCPListener) HandleConn(c net.Conn) {
 	defer c.Close()
 
 	l.TCPConnections.Inc()
 
-	r := bufio.NewReader(c)
-	for {
-		line, isPrefix, err := r.ReadLine()
-		if err != nil {
-			if err != io.EOF {
-				l.TCPErrors.Inc()
-				level.Debug(l.Logger).Log("msg", "Read failed", "addr", c.RemoteAddr(), "error", err)
-			}
-			break
+	var labels map[string]string
+	if tc, ok := c.(*tls.Conn); ok {
+		timeout := l.TLSHandshakeTimeout
+		if timeout <= 0 {
+			timeout = DefaultTLSHandshakeTimeout
 		}
-		level.Debug(l.Logger).Log("msg", "Incoming line", "proto", "tcp", "line", line)
-		if isPrefix {
-			l.TCPLineTooLong.Inc()
-			level.Debug(l.Logger).Log("msg", "Read failed: line too long", "addr", c.RemoteAddr())
-			break
+		// A client that never completes the handshake must not hold the
+		// connection open forever.
+		c.SetDeadline(time.Now().Add(timeout))
+		if err := tc.Handshake(); err != nil {
+			l.TCPErrors.Inc()
+			level.Debug(l.Logger).Log("msg", "TLS handshake failed", "addr", c.RemoteAddr(), "error", err)
+			return
+		}
+		c.SetDeadline(time.Time{})
+		if l.ClientIdentityLabel != "" {
+			if identity := clientIdentity(tc.ConnectionState()); identity != "" {
+				labels = map[string]string{l.ClientIdentityLabel: identity}
+			}
 		}
-		l.LinesReceived.Inc()
-		l.EventHandler.Queue(l.LineParser.LineToEvents(string(line), l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger))
 	}
+
+	readLines(c, "tcp", l.TCPErrors, l.TCPLineTooLong, l.Logger, func(line string) {
+		l.LinesReceived.Inc()
+		events := l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger)
+		addLabels(events, labels)
+		l.EventHandler.Queue(events)
+	})
 }
 
 type StatsDUnixgramListener struct {
@@ -146,6 +195,13 @@ type StatsDUnixgramListener struct {
 	SamplesReceived prometheus.Counter
 	TagErrors       prometheus.Counter
 	TagsReceived    prometheus.Counter
+	// BatchSize is the maximum number of packets read with a single
+	// recvmmsg call. Packets are read one by one if it is not greater than 1
+	// or BatchReadsSupported is false.
+	BatchSize int
+	// Parsers hands packets to a pool of workers instead of parsing them in
+	// the reading goroutine if it is set. Its handler must be HandlePacket.
+	Parsers *ParserPool
 }
 
 func (l *StatsDUnixgramListener) SetEventHandler(eh event.EventHandler) {
@@ -153,6 +209,17 @@ func (l *StatsDUnixgramListener) SetEventHandler(eh event.EventHandler) {
 }
 
 func (l *StatsDUnixgramListener) Listen() {
+	handle, handleBatch := l.HandlePacket, l.HandlePackets
+	if l.Parsers != nil {
+		handle, handleBatch = l.Parsers.Queue, l.Parsers.QueueBatch
+	}
+	if l.BatchSize > 1 && BatchReadsSupported {
+		if err := readBatches(l.Conn, l.BatchSize, nil, handleBatch); err != nil {
+			level.Error(l.Logger).Log(err)
+			os.Exit(1)
+		}
+		return
+	}
 	buf := make([]byte, 65535)
 	for {
 		n, _, err := l.Conn.ReadFromUnix(buf)
@@ -165,16 +232,72 @@ func (l *StatsDUnixgramListener) Listen() {
 			level.Error(l.Logger).Log(err)
 			os.Exit(1)
 		}
-		l.HandlePacket(buf[:n])
+		handle(buf[:n])
 	}
 }
 
 func (l *StatsDUnixgramListener) HandlePacket(packet []byte) {
+	l.EventHandler.Queue(l.packetEvents(packet, nil))
+}
+
+// HandlePackets queues the events of all packets at once.
+func (l *StatsDUnixgramListener) HandlePackets(packets [][]byte) {
+	var events event.Events
+	for _, packet := range packets {
+		events = l.packetEvents(packet, events)
+	}
+	l.EventHandler.Queue(events)
+}
+
+// packetEvents appends the events of all lines in packet to events.
+func (l *StatsDUnixgramListener) packetEvents(packet []byte, events event.Events) event.Events {
 	l.UnixgramPackets.Inc()
 	lines := strings.Split(string(packet), "\n")
 	for _, line := range lines {
 		level.Debug(l.Logger).Log("msg", "Incoming line", "proto", "unixgram", "line", line)
 		l.LinesReceived.Inc()
-		l.EventHandler.Queue(l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger))
+		events = append(events, l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger)...)
+	}
+	return events
+}
+
+// readLines calls handle for every newline separated line read from c. It
+// returns when the connection is closed or a line does not fit into the read
+// buffer.
+func readLines(c net.Conn, proto string, readErrors, lineTooLong prometheus.Counter, logger log.Logger, handle func(line string)) {
+	r := bufio.NewReader(c)
+	for {
+		line, isPrefix, err := r.ReadLine()
+		if err != nil {
+			if err != io.EOF && !isClosedConnError(err) {
+				readErrors.Inc()
+				level.Debug(logger).Log("msg", "Read failed", "addr", c.RemoteAddr(), "error", err)
+			}
+			break
+		}
+		level.Debug(logger).Log("msg", "Incoming line", "proto", proto, "line", line)
+		if isPrefix {
+			lineTooLong.Inc()
+			level.Debug(logger).Log("msg", "Read failed: line too long", "addr", c.RemoteAddr())
+			break
+		}
+		handle(string(line))
+	}
+}
+
+// addLabels sets labels on all events, overriding labels of the same name
+// that were sent by the client.
+func addLabels(events event.Events, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	for _, e := range events {
+		eventLabels := e.Labels()
+		if eventLabels == nil {
+			continue
+		}
+		for k, v := range labels {
+			eventLabels[k] = v
+		}
 	}
 }
@@ -0,0 +1,113 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package listener
+
+import (
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// BatchReadsSupported reports whether the UDP and unixgram listeners can read
+// several packets with a single system call on this platform.
+const BatchReadsSupported = true
+
+// mmsghdr is struct mmsghdr of recvmmsg(2).
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// readBatches reads up to size packets from conn with a single recvmmsg call
+// and passes them to handle, until the connection is closed. handle must not
+// keep the packets, as their buffers are reused. If drops is set, packet
+// drops reported by the kernel are counted.
+func readBatches(conn syscall.Conn, size int, drops *UDPDropCounter, handle func(packets [][]byte)) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	oobSize := 0
+	if drops != nil {
+		oobSize = udpDropsOOBSize
+	}
+	bufs := make([][]byte, size)
+	oobs := make([][]byte, size)
+	iovs := make([]unix.Iovec, size)
+	hdrs := make([]mmsghdr, size)
+	for i := range hdrs {
+		bufs[i] = make([]byte, 65535)
+		iovs[i].Base = &bufs[i][0]
+		iovs[i].SetLen(len(bufs[i]))
+		hdrs[i].hdr.Iov = &iovs[i]
+		hdrs[i].hdr.SetIovlen(1)
+		if oobSize > 0 {
+			oobs[i] = make([]byte, oobSize)
+			hdrs[i].hdr.Control = &oobs[i][0]
+		}
+	}
+	packets := make([][]byte, 0, size)
+
+	for {
+		// The kernel overwrites the control message lengths.
+		for i := range hdrs {
+			hdrs[i].hdr.SetControllen(oobSize)
+		}
+
+		var n int
+		var errno syscall.Errno
+		err := raw.Read(func(fd uintptr) bool {
+			for {
+				r, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)), 0, 0, 0)
+				switch e {
+				case unix.EINTR:
+					continue
+				case unix.EAGAIN:
+					// Wait until the socket is readable.
+					return false
+				}
+				n, errno = int(r), e
+				return true
+			}
+		})
+		if err == nil && errno != 0 {
+			err = errno
+		}
+		if err != nil {
+			// https://github.com/golang/go/issues/4373
+			// ignore net: errClosing error as it will occur during shutdown
+			if strings.HasSuffix(err.Error(), "use of closed network connection") {
+				return nil
+			}
+			return err
+		}
+
+		packets = packets[:0]
+		for i := 0; i < n; i++ {
+			if drops != nil && hdrs[i].hdr.Controllen > 0 {
+				if total, ok := parseUDPDrops(oobs[i][:hdrs[i].hdr.Controllen]); ok {
+					drops.observe(total)
+				}
+			}
+			packets = append(packets, bufs[i][:hdrs[i].len])
+		}
+		handle(packets)
+	}
+}
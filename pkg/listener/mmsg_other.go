@@ -0,0 +1,30 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package listener
+
+import (
+	"errors"
+	"syscall"
+)
+
+// BatchReadsSupported reports whether the UDP and unixgram listeners can read
+// several packets with a single system call on this platform.
+const BatchReadsSupported = false
+
+func readBatches(conn syscall.Conn, size int, drops *UDPDropCounter, handle func(packets [][]byte)) error {
+	return errors.New("batched reads are only supported on Linux")
+}
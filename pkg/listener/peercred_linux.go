@@ -0,0 +1,47 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package listener
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// PeerCredentialsSupported reports whether StatsDUnixListener can read the
+// credentials of the sending process on this platform.
+const PeerCredentialsSupported = true
+
+func readPeerCredentials(c *net.UnixConn) (peerCredentials, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return peerCredentials{}, err
+	}
+
+	var ucred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return peerCredentials{}, err
+	}
+	if credErr != nil {
+		return peerCredentials{}, credErr
+	}
+	return peerCredentials{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ParserPool decouples reading packets from a socket from parsing them.
+// Packets are copied into a bounded queue, from which a pool of workers
+// passes them on. If the queue is full, packets are dropped instead of
+// blocking the reader, so that the socket buffer keeps being drained even if
+// parsing or mapping falls behind.
+type ParserPool struct {
+	packets     chan []byte
+	handle      func(packet []byte)
+	queueLength prometheus.Gauge
+	drops       prometheus.Counter
+	wg          sync.WaitGroup
+}
+
+// NewParserPool starts workers goroutines that call handle for the packets
+// in a queue of up to queueSize packets.
+func NewParserPool(workers, queueSize int, handle func(packet []byte), queueLength prometheus.Gauge, drops prometheus.Counter) *ParserPool {
+	p := &ParserPool{
+		packets:     make(chan []byte, queueSize),
+		handle:      handle,
+		queueLength: queueLength,
+		drops:       drops,
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Queue adds a copy of packet to the queue, or drops it if the queue is full.
+func (p *ParserPool) Queue(packet []byte) {
+	buf := make([]byte, len(packet))
+	copy(buf, packet)
+	select {
+	case p.packets <- buf:
+	default:
+		p.drops.Inc()
+	}
+	p.queueLength.Set(float64(len(p.packets)))
+}
+
+// QueueBatch queues every packet of a batch.
+func (p *ParserPool) QueueBatch(packets [][]byte) {
+	for _, packet := range packets {
+		p.Queue(packet)
+	}
+}
+
+// Close waits until the workers have handled all queued packets. No packets
+// may be queued after it is called.
+func (p *ParserPool) Close() {
+	close(p.packets)
+	p.wg.Wait()
+}
+
+func (p *ParserPool) work() {
+	defer p.wg.Done()
+	for packet := range p.packets {
+		p.queueLength.Set(float64(len(p.packets)))
+		p.handle(packet)
+	}
+}
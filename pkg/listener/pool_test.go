@@ -0,0 +1,70 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestParserPool(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handled := make(chan string, 8)
+	handle := func(packet []byte) {
+		if string(packet) == "first" {
+			close(started)
+			<-release
+		}
+		handled <- string(packet)
+	}
+
+	queueLength := prometheus.NewGauge(prometheus.GaugeOpts{Name: "queue_length"})
+	drops := prometheus.NewCounter(prometheus.CounterOpts{Name: "drops"})
+	p := NewParserPool(1, 2, handle, queueLength, drops)
+
+	// The packet must be copied, as readers reuse their buffers.
+	buf := []byte("first")
+	p.Queue(buf)
+	copy(buf, "xxxxx")
+	<-started
+
+	// The only worker is busy, so two packets fit into the queue and the
+	// others are dropped without blocking.
+	p.QueueBatch([][]byte{[]byte("second"), []byte("third"), []byte("fourth"), []byte("fifth")})
+	if got := counterValue(t, drops); got != 2 {
+		t.Fatalf("Expected 2 dropped packets, got %v", got)
+	}
+	var pb dto.Metric
+	if err := queueLength.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	if got := pb.GetGauge().GetValue(); got != 2 {
+		t.Fatalf("Expected a queue length of 2, got %v", got)
+	}
+
+	// Closing the pool waits for the queued packets.
+	close(release)
+	p.Close()
+	if len(handled) != 3 {
+		t.Fatalf("Expected 3 handled packets, got %d", len(handled))
+	}
+	for _, expected := range []string{"first", "second", "third"} {
+		if got := <-handled; got != expected {
+			t.Fatalf("Expected packet %q, got %q", expected, got)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultTLSHandshakeTimeout is the time a TLS client has to complete the
+// handshake before its connection is closed.
+const DefaultTLSHandshakeTimeout = 10 * time.Second
+
+// TLSSettings configures TLS for a listener. If ClientCAFile is set and
+// ClientAuthType is not, client certificates are required and verified.
+type TLSSettings struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+func (s TLSSettings) tlsConfig() (*tls.Config, error) {
+	if s.CertFile == "" || s.KeyFile == "" {
+		return nil, fmt.Errorf("both a certificate and a key file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if s.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(s.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %q", s.ClientCAFile)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if s.ClientAuthType != "" {
+		clientAuth, ok := clientAuthTypes[s.ClientAuthType]
+		if !ok {
+			return nil, fmt.Errorf("invalid client auth type %q", s.ClientAuthType)
+		}
+		if cfg.ClientCAs == nil && (clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert) {
+			return nil, fmt.Errorf("client auth type %q requires a client CA file", s.ClientAuthType)
+		}
+		cfg.ClientAuth = clientAuth
+	}
+	return cfg, nil
+}
+
+// TLSConfigLoader loads the TLS configuration of a listener from files and
+// allows reloading it while the listener is running, so that certificates
+// can be rotated without a restart.
+type TLSConfigLoader struct {
+	// File is an optional YAML file with the TLS settings. If it is set, it
+	// is read on every load and takes precedence over Settings.
+	File     string
+	Settings TLSSettings
+
+	mtx    sync.RWMutex
+	config *tls.Config
+}
+
+// Load (re)reads the certificates. If loading fails, the previously loaded
+// configuration stays in use.
+func (l *TLSConfigLoader) Load() error {
+	settings := l.Settings
+	if l.File != "" {
+		content, err := ioutil.ReadFile(l.File)
+		if err != nil {
+			return err
+		}
+		settings = TLSSettings{}
+		if err := yaml.UnmarshalStrict(content, &settings); err != nil {
+			return err
+		}
+	}
+
+	cfg, err := settings.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	l.mtx.Lock()
+	l.config = cfg
+	l.mtx.Unlock()
+	return nil
+}
+
+// TLSConfig returns a configuration that always uses the most recently
+// loaded certificates.
+func (l *TLSConfigLoader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			l.mtx.RLock()
+			defer l.mtx.RUnlock()
+			if l.config == nil {
+				return nil, fmt.Errorf("no TLS configuration loaded")
+			}
+			return l.config, nil
+		},
+	}
+}
+
+// clientIdentity returns the common name of the verified client certificate,
+// or its first DNS, email or URI subject alternative name if the common name
+// is empty. Certificates that were not verified, e.g. with the
+// RequestClientCert client auth type, have no identity.
+func clientIdentity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
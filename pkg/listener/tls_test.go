@@ -0,0 +1,363 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/line"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pair tls.Certificate
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA
+// certificate if parent is nil.
+func newTestCert(t *testing.T, cn string, dnsNames []string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signerCert, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+	}
+}
+
+// write stores the certificate and key as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSConfigLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_exporter_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	server := newTestCert(t, "server", []string{"localhost"}, ca)
+	certFile, keyFile := server.write(t, dir, "server")
+
+	scenarios := []struct {
+		name     string
+		settings TLSSettings
+		file     string
+		err      bool
+		auth     tls.ClientAuthType
+	}{
+		{
+			name:     "server only",
+			settings: TLSSettings{CertFile: certFile, KeyFile: keyFile},
+			auth:     tls.NoClientCert,
+		}, {
+			name:     "client CA requires client certificates",
+			settings: TLSSettings{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile},
+			auth:     tls.RequireAndVerifyClientCert,
+		}, {
+			name:     "explicit client auth type",
+			settings: TLSSettings{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuthType: "VerifyClientCertIfGiven"},
+			auth:     tls.VerifyClientCertIfGiven,
+		}, {
+			name: "config file",
+			file: "cert_file: " + certFile + "\nkey_file: " + keyFile + "\nclient_ca_file: " + caFile + "\n",
+			auth: tls.RequireAndVerifyClientCert,
+		}, {
+			name:     "missing key",
+			settings: TLSSettings{CertFile: certFile},
+			err:      true,
+		}, {
+			name:     "verification without CA",
+			settings: TLSSettings{CertFile: certFile, KeyFile: keyFile, ClientAuthType: "RequireAndVerifyClientCert"},
+			err:      true,
+		}, {
+			name:     "invalid client auth type",
+			settings: TLSSettings{CertFile: certFile, KeyFile: keyFile, ClientAuthType: "Always"},
+			err:      true,
+		}, {
+			name: "unknown field in config file",
+			file: "cert_file: " + certFile + "\nkey_file: " + keyFile + "\nclient_ca: " + caFile + "\n",
+			err:  true,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			loader := &TLSConfigLoader{Settings: scenario.settings}
+			if scenario.file != "" {
+				loader.File = filepath.Join(dir, "tls.yml")
+				if err := ioutil.WriteFile(loader.File, []byte(scenario.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := loader.Load()
+			if scenario.err {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			cfg, err := loader.TLSConfig().GetConfigForClient(nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if cfg.ClientAuth != scenario.auth {
+				t.Fatalf("Expected client auth %v, got %v", scenario.auth, cfg.ClientAuth)
+			}
+		})
+	}
+}
+
+// newTestTLSListener starts a TCP listener with the given TLS configuration
+// that adds the client identity as the client label.
+func newTestTLSListener(t *testing.T, cfg *tls.Config, handshakeTimeout time.Duration) (*net.TCPListener, chan event.Events) {
+	lc, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan event.Events, 32)
+	l := &StatsDTCPListener{
+		Conn:                lc,
+		EventHandler:        &event.UnbufferedEventHandler{C: events},
+		Logger:              log.NewNopLogger(),
+		LineParser:          line.NewParser(),
+		LinesReceived:       prometheus.NewCounter(prometheus.CounterOpts{Name: "lines"}),
+		SampleErrors:        *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "sample_errors"}, []string{"reason"}),
+		SamplesReceived:     prometheus.NewCounter(prometheus.CounterOpts{Name: "samples"}),
+		TagErrors:           prometheus.NewCounter(prometheus.CounterOpts{Name: "tag_errors"}),
+		TagsReceived:        prometheus.NewCounter(prometheus.CounterOpts{Name: "tags"}),
+		TCPConnections:      prometheus.NewCounter(prometheus.CounterOpts{Name: "connections"}),
+		TCPErrors:           prometheus.NewCounter(prometheus.CounterOpts{Name: "errors"}),
+		TCPLineTooLong:      prometheus.NewCounter(prometheus.CounterOpts{Name: "line_too_long"}),
+		TLSConfig:           cfg,
+		ClientIdentityLabel: "client",
+		TLSHandshakeTimeout: handshakeTimeout,
+	}
+	go l.Listen()
+	return lc, events
+}
+
+func TestStatsDTCPListenerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_exporter_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	server := newTestCert(t, "server", []string{"localhost"}, ca)
+	certFile, keyFile := server.write(t, dir, "server")
+	client := newTestCert(t, "", []string{"client.example.com"}, ca)
+	otherCA := newTestCert(t, "other", nil, nil)
+	untrusted := newTestCert(t, "untrusted", nil, otherCA)
+
+	loader := &TLSConfigLoader{Settings: TLSSettings{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}}
+	if err := loader.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	lc, events := newTestTLSListener(t, loader.TLSConfig(), 0)
+	defer lc.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	send := func(cert *testCert) error {
+		c, err := tls.Dial("tcp", lc.Addr().String(), &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: []tls.Certificate{cert.pair},
+		})
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		_, err = c.Write([]byte("foo:1|c|#client:spoofed\n"))
+		return err
+	}
+
+	if err := send(client); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	select {
+	case evs := <-events:
+		if len(evs) != 1 {
+			t.Fatalf("Expected 1 event, got %d", len(evs))
+		}
+		if got := evs[0].Labels()["client"]; got != "client.example.com" {
+			t.Fatalf("Expected client label %q, got %q", "client.example.com", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for events")
+	}
+
+	// With TLS 1.3 the client only learns about a rejected certificate
+	// when it reads, so the write may succeed. No events must arrive either
+	// way.
+	send(untrusted)
+	select {
+	case evs := <-events:
+		t.Fatalf("Expected no events from an untrusted client, got %#v", evs)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStatsDTCPListenerTLSUnverifiedClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_exporter_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, nil)
+	server := newTestCert(t, "server", []string{"localhost"}, ca)
+	certFile, keyFile := server.write(t, dir, "server")
+	// The client certificate is requested but not verified, so anyone could
+	// claim this common name.
+	otherCA := newTestCert(t, "other", nil, nil)
+	client := newTestCert(t, "admin", nil, otherCA)
+
+	loader := &TLSConfigLoader{Settings: TLSSettings{CertFile: certFile, KeyFile: keyFile, ClientAuthType: "RequestClientCert"}}
+	if err := loader.Load(); err != nil {
+		t.Fatal(err)
+	}
+	lc, events := newTestTLSListener(t, loader.TLSConfig(), 0)
+	defer lc.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	c, err := tls.Dial("tcp", lc.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{client.pair},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("foo:1|c\n")); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	select {
+	case evs := <-events:
+		if len(evs) != 1 {
+			t.Fatalf("Expected 1 event, got %d", len(evs))
+		}
+		if got, ok := evs[0].Labels()["client"]; ok {
+			t.Fatalf("Expected no client label for an unverified certificate, got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for events")
+	}
+}
+
+func TestStatsDTCPListenerTLSHandshakeTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_exporter_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, nil)
+	server := newTestCert(t, "server", []string{"localhost"}, ca)
+	certFile, keyFile := server.write(t, dir, "server")
+
+	loader := &TLSConfigLoader{Settings: TLSSettings{CertFile: certFile, KeyFile: keyFile}}
+	if err := loader.Load(); err != nil {
+		t.Fatal(err)
+	}
+	lc, _ := newTestTLSListener(t, loader.TLSConfig(), 100*time.Millisecond)
+	defer lc.Close()
+
+	// A client that connects but never starts the handshake.
+	c, err := net.Dial("tcp", lc.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("Expected the server to close the connection after the handshake timeout")
+	}
+	if err == nil {
+		t.Fatal("Expected the connection to be closed")
+	}
+}
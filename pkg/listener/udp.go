@@ -0,0 +1,84 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// UDPDropCounter counts the packets the kernel dropped on a UDP socket
+// because its receive buffer was full. The kernel reports a running total
+// with received packets, so all readers of a socket must share one
+// UDPDropCounter. See EnableUDPDropCounting.
+type UDPDropCounter struct {
+	counter prometheus.Counter
+
+	mtx  sync.Mutex
+	last uint32
+}
+
+// NewUDPDropCounter returns a UDPDropCounter that adds drops to counter.
+func NewUDPDropCounter(counter prometheus.Counter) *UDPDropCounter {
+	return &UDPDropCounter{counter: counter}
+}
+
+// observe records the running total of drops reported by the kernel.
+// Readers may observe totals out of order, so older totals are ignored.
+func (d *UDPDropCounter) observe(total uint32) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	// The total wraps around, so it is compared by its distance.
+	delta := total - d.last
+	if delta == 0 || delta >= 1<<31 {
+		return
+	}
+	d.last = total
+	d.counter.Add(float64(delta))
+}
+
+// readUDP calls handle for every packet read from conn until the connection
+// is closed. handle must not keep the packet, as its buffer is reused. If
+// drops is set, packet drops reported by the kernel are counted.
+func readUDP(conn *net.UDPConn, drops *UDPDropCounter, logger log.Logger, handle func(packet []byte)) {
+	buf := make([]byte, 65535)
+	var oob []byte
+	if drops != nil {
+		oob = make([]byte, udpDropsOOBSize)
+	}
+	for {
+		n, oobn, _, _, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			// https://github.com/golang/go/issues/4373
+			// ignore net: errClosing error as it will occur during shutdown
+			if strings.HasSuffix(err.Error(), "use of closed network connection") {
+				return
+			}
+			level.Error(logger).Log("error", err)
+			return
+		}
+		if oobn > 0 {
+			if total, ok := parseUDPDrops(oob[:oobn]); ok {
+				drops.observe(total)
+			}
+		}
+		handle(buf[0:n])
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package listener
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var udpDropsOOBSize = unix.CmsgSpace(4)
+
+// ListenUDP opens a UDP socket on addr. If reusePort is set, the socket is
+// opened with SO_REUSEPORT, so that several sockets can be bound to the same
+// address and the kernel distributes packets between them.
+func ListenUDP(addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	if !reusePort {
+		return net.ListenUDP("udp", addr)
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// EnableUDPDropCounting makes the kernel report the number of packets it
+// dropped on conn, so that they can be counted by a UDPDropCounter.
+func EnableUDPDropCounting(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// parseUDPDrops returns the SO_RXQ_OVFL drop count from the control
+// messages of a packet.
+func parseUDPDrops(oob []byte) (uint32, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.SOL_SOCKET && msg.Header.Type == unix.SO_RXQ_OVFL && len(msg.Data) >= 4 {
+			// The count is a native endian uint32.
+			return *(*uint32)(unsafe.Pointer(&msg.Data[0])), true
+		}
+	}
+	return 0, false
+}
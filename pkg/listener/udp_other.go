@@ -0,0 +1,43 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package listener
+
+import (
+	"errors"
+	"net"
+)
+
+const udpDropsOOBSize = 0
+
+// ListenUDP opens a UDP socket on addr. Opening several sockets on the same
+// address with reusePort is only supported on Linux.
+func ListenUDP(addr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	if reusePort {
+		return nil, errors.New("SO_REUSEPORT is only supported on Linux")
+	}
+	return net.ListenUDP("udp", addr)
+}
+
+// EnableUDPDropCounting makes the kernel report the number of packets it
+// dropped on conn. It is only supported on Linux.
+func EnableUDPDropCounting(conn *net.UDPConn) error {
+	return errors.New("counting dropped packets is only supported on Linux")
+}
+
+func parseUDPDrops(oob []byte) (uint32, bool) {
+	return 0, false
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/line"
+)
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	var pb dto.Metric
+	if err := c.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetCounter().GetValue()
+}
+
+func TestUDPDropCounter(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		start    uint32
+		totals   []uint32
+		expected float64
+	}{
+		{
+			name:     "increasing totals",
+			totals:   []uint32{0, 3, 3, 10},
+			expected: 10,
+		}, {
+			name:     "out of order totals",
+			totals:   []uint32{5, 3, 8},
+			expected: 8,
+		}, {
+			name:     "wraparound",
+			start:    1<<32 - 2,
+			totals:   []uint32{1<<32 - 1, 2},
+			expected: 4,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			c := prometheus.NewCounter(prometheus.CounterOpts{Name: "drops"})
+			d := NewUDPDropCounter(c)
+			d.last = scenario.start
+			for _, total := range scenario.totals {
+				d.observe(total)
+			}
+			if got := counterValue(t, c); got != scenario.expected {
+				t.Fatalf("Expected %v drops, got %v", scenario.expected, got)
+			}
+		})
+	}
+}
+
+func TestListenUDPReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on Linux")
+	}
+
+	first, err := ListenUDP(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := ListenUDP(first.LocalAddr().(*net.UDPAddr), true)
+	if err != nil {
+		t.Fatalf("Expected a second socket on the same port, got %v", err)
+	}
+	second.Close()
+}
+
+func TestReadUDPCountsDrops(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("drop counting is only supported on Linux")
+	}
+
+	conn, err := ListenUDP(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := EnableUDPDropCounting(conn); err != nil {
+		t.Fatal(err)
+	}
+	// The kernel enforces a minimum, but it is small enough to overflow.
+	if err := conn.SetReadBuffer(1); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	packet := make([]byte, 1000)
+	for i := 0; i < 1000; i++ {
+		client.Write(packet)
+	}
+
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "drops"})
+	drops := NewUDPDropCounter(c)
+	done := make(chan struct{})
+	go func() {
+		readUDP(conn, drops, log.NewNopLogger(), func([]byte) {})
+		close(done)
+	}()
+
+	// The kernel reports the drops with the packets queued after them, so
+	// keep sending once the buffer has been drained.
+	deadline := time.Now().Add(5 * time.Second)
+	for counterValue(t, c) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected dropped packets to be counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+		client.Write(packet)
+	}
+	conn.Close()
+	<-done
+}
+
+func TestStatsDUDPListenerBatches(t *testing.T) {
+	if !BatchReadsSupported {
+		t.Skip("batched reads are not supported on this platform")
+	}
+
+	conn, err := ListenUDP(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	events := make(chan event.Events, 64)
+	l := &StatsDUDPListener{
+		Conn:            conn,
+		EventHandler:    &event.UnbufferedEventHandler{C: events},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		UDPPackets:      prometheus.NewCounter(prometheus.CounterOpts{Name: "packets"}),
+		LinesReceived:   prometheus.NewCounter(prometheus.CounterOpts{Name: "lines"}),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "sample_errors"}, []string{"reason"}),
+		SamplesReceived: prometheus.NewCounter(prometheus.CounterOpts{Name: "samples"}),
+		TagErrors:       prometheus.NewCounter(prometheus.CounterOpts{Name: "tag_errors"}),
+		TagsReceived:    prometheus.NewCounter(prometheus.CounterOpts{Name: "tags"}),
+		BatchSize:       8,
+	}
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	const packets = 20
+	for i := 0; i < packets; i++ {
+		if _, err := client.Write([]byte(fmt.Sprintf("foo%d:1|c\nbar%d:2|g", i, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// All packets are queued before reading starts, so the first read
+	// returns a full batch.
+	go l.Listen()
+	select {
+	case evs := <-events:
+		if len(evs) != 2*l.BatchSize {
+			t.Fatalf("Expected a batch of %d events, got %d", 2*l.BatchSize, len(evs))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for events")
+	}
+
+	names := map[string]bool{}
+	for len(names) < 2*(packets-l.BatchSize) {
+		select {
+		case evs := <-events:
+			for _, e := range evs {
+				names[e.MetricName()] = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out after receiving %d of %d events", len(names), 2*(packets-l.BatchSize))
+		}
+	}
+	if got := counterValue(t, l.UDPPackets); got != packets {
+		t.Fatalf("Expected %d packets, got %v", packets, got)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	pkgLine "github.com/prometheus/statsd_exporter/pkg/line"
+)
+
+// Peer credentials that StatsDUnixListener can add as labels.
+const (
+	PeerLabelPID  = "pid"
+	PeerLabelUID  = "uid"
+	PeerLabelGID  = "gid"
+	PeerLabelUser = "user"
+)
+
+// peerCredentials identifies the process on the other end of a unix socket.
+type peerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// StatsDUnixListener receives StatsD lines over a unix stream socket.
+type StatsDUnixListener struct {
+	Conn            *net.UnixListener
+	EventHandler    event.EventHandler
+	Logger          log.Logger
+	LineParser      *pkgLine.Parser
+	LinesReceived   prometheus.Counter
+	SampleErrors    prometheus.CounterVec
+	SamplesReceived prometheus.Counter
+	TagErrors       prometheus.Counter
+	TagsReceived    prometheus.Counter
+	UnixConnections prometheus.Counter
+	UnixErrors      prometheus.Counter
+	UnixLineTooLong prometheus.Counter
+	// PeerLabels lists the credentials of the sending process to add as
+	// labels, see the PeerLabel constants. Reading them is only supported on
+	// Linux.
+	PeerLabels []string
+	// UserNames maps uids to the value of the user label. Unknown uids are
+	// used as is.
+	UserNames map[uint32]string
+	// Conns tracks the open connections so that they can be closed when
+	// the listener stops. Connections are not tracked if it is nil.
+	Conns *ConnTracker
+}
+
+func (l *StatsDUnixListener) SetEventHandler(eh event.EventHandler) {
+	l.EventHandler = eh
+}
+
+func (l *StatsDUnixListener) Listen() {
+	for {
+		c, err := l.Conn.AcceptUnix()
+		if err != nil {
+			// https://github.com/golang/go/issues/4373
+			// ignore net: errClosing error as it will occur during shutdown
+			if strings.HasSuffix(err.Error(), "use of closed network connection") {
+				return
+			}
+			level.Error(l.Logger).Log("msg", "AcceptUnix failed", "error", err)
+			os.Exit(1)
+		}
+		l.Conns.serve(c, func() { l.HandleConn(c) })
+	}
+}
+
+func (l *StatsDUnixListener) HandleConn(c net.Conn) {
+	defer c.Close()
+
+	l.UnixConnections.Inc()
+
+	var labels map[string]string
+	if len(l.PeerLabels) > 0 {
+		uc, ok := c.(*net.UnixConn)
+		if !ok {
+			level.Debug(l.Logger).Log("msg", "Cannot read peer credentials of non-unix connection")
+		} else if cred, err := readPeerCredentials(uc); err != nil {
+			l.UnixErrors.Inc()
+			level.Debug(l.Logger).Log("msg", "Reading peer credentials failed", "error", err)
+		} else {
+			labels = l.peerLabels(cred)
+		}
+	}
+
+	readLines(c, "unix", l.UnixErrors, l.UnixLineTooLong, l.Logger, func(line string) {
+		l.LinesReceived.Inc()
+		events := l.LineParser.LineToEvents(line, l.SampleErrors, l.SamplesReceived, l.TagErrors, l.TagsReceived, l.Logger)
+		addLabels(events, labels)
+		l.EventHandler.Queue(events)
+	})
+}
+
+func (l *StatsDUnixListener) peerLabels(cred peerCredentials) map[string]string {
+	labels := make(map[string]string, len(l.PeerLabels))
+	for _, name := range l.PeerLabels {
+		switch name {
+		case PeerLabelPID:
+			labels[name] = strconv.FormatInt(int64(cred.PID), 10)
+		case PeerLabelUID:
+			labels[name] = strconv.FormatUint(uint64(cred.UID), 10)
+		case PeerLabelGID:
+			labels[name] = strconv.FormatUint(uint64(cred.GID), 10)
+		case PeerLabelUser:
+			if user, ok := l.UserNames[cred.UID]; ok {
+				labels[name] = user
+			} else {
+				labels[name] = strconv.FormatUint(uint64(cred.UID), 10)
+			}
+		}
+	}
+	return labels
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/line"
+)
+
+func TestStatsDUnixListenerPeerLabels(t *testing.T) {
+	if !PeerCredentialsSupported {
+		t.Skip("peer credentials are not supported on this platform")
+	}
+
+	dir, err := ioutil.TempDir("", "statsd_exporter_unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := &net.UnixAddr{Net: "unix", Name: filepath.Join(dir, "statsd.sock")}
+	lc, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lc.Close()
+
+	uid, gid, pid := os.Getuid(), os.Getgid(), os.Getpid()
+	events := make(chan event.Events, 32)
+	l := &StatsDUnixListener{
+		Conn:            lc,
+		EventHandler:    &event.UnbufferedEventHandler{C: events},
+		Logger:          log.NewNopLogger(),
+		LineParser:      line.NewParser(),
+		LinesReceived:   prometheus.NewCounter(prometheus.CounterOpts{Name: "lines"}),
+		SampleErrors:    *prometheus.NewCounterVec(prometheus.CounterOpts{Name: "sample_errors"}, []string{"reason"}),
+		SamplesReceived: prometheus.NewCounter(prometheus.CounterOpts{Name: "samples"}),
+		TagErrors:       prometheus.NewCounter(prometheus.CounterOpts{Name: "tag_errors"}),
+		TagsReceived:    prometheus.NewCounter(prometheus.CounterOpts{Name: "tags"}),
+		UnixConnections: prometheus.NewCounter(prometheus.CounterOpts{Name: "connections"}),
+		UnixErrors:      prometheus.NewCounter(prometheus.CounterOpts{Name: "errors"}),
+		UnixLineTooLong: prometheus.NewCounter(prometheus.CounterOpts{Name: "line_too_long"}),
+		PeerLabels:      []string{PeerLabelPID, PeerLabelUID, PeerLabelGID, PeerLabelUser},
+		UserNames:       map[uint32]string{uint32(uid): "alice"},
+	}
+	go l.Listen()
+
+	c, err := net.DialUnix("unix", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("foo:1|c\n")); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	expected := map[string]string{
+		"pid":  strconv.Itoa(pid),
+		"uid":  strconv.Itoa(uid),
+		"gid":  strconv.Itoa(gid),
+		"user": "alice",
+	}
+	select {
+	case evs := <-events:
+		if len(evs) != 1 {
+			t.Fatalf("Expected 1 event, got %d", len(evs))
+		}
+		if !reflect.DeepEqual(evs[0].Labels(), expected) {
+			t.Fatalf("Expected labels %v, got %v", expected, evs[0].Labels())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for events")
+	}
+}
+
+func TestPeerLabels(t *testing.T) {
+	l := &StatsDUnixListener{
+		PeerLabels: []string{PeerLabelUID, PeerLabelUser},
+		UserNames:  map[uint32]string{1000: "alice"},
+	}
+	for _, scenario := range []struct {
+		cred     peerCredentials
+		expected map[string]string
+	}{
+		{
+			cred:     peerCredentials{PID: 1, UID: 1000, GID: 1000},
+			expected: map[string]string{"uid": "1000", "user": "alice"},
+		}, {
+			cred:     peerCredentials{PID: 1, UID: 1001, GID: 1000},
+			expected: map[string]string{"uid": "1001", "user": "1001"},
+		},
+	} {
+		if labels := l.peerLabels(scenario.cred); !reflect.DeepEqual(labels, scenario.expected) {
+			t.Fatalf("Expected labels %v, got %v", scenario.expected, labels)
+		}
+	}
+}
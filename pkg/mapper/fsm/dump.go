@@ -22,20 +22,42 @@ import (
 func (f *FSM) DumpFSM(w io.Writer) {
 	idx := 0
 	states := make(map[int]*mappingState)
-	states[idx] = f.root
+	// with several separators, their start states are connected to a common
+	// start state
+	start := f.roots[f.separators[0]]
+	if len(f.separators) > 1 {
+		start = &mappingState{transitions: make(map[string]*mappingState, len(f.separators))}
+		for _, separator := range f.separators {
+			start.transitions[separator] = f.roots[separator]
+		}
+	}
+	metricTypeStates := make(map[*mappingState]bool)
+	for _, root := range f.roots {
+		for _, state := range root.transitions {
+			metricTypeStates[state] = true
+		}
+	}
+	states[idx] = start
 
 	w.Write([]byte("digraph g {\n"))
 	w.Write([]byte("rankdir=LR\n"))                                                    // make it vertical
 	w.Write([]byte("node [ label=\"\",style=filled,fillcolor=white,shape=circle ]\n")) // remove label of node
 
 	for idx < len(states) {
+		transitions := make(map[string]*mappingState, len(states[idx].transitions)+len(states[idx].patternTransitions))
 		for field, transition := range states[idx].transitions {
+			transitions[field] = transition
+		}
+		for _, transition := range states[idx].patternTransitions {
+			transitions[transition.pattern] = transition.state
+		}
+		for field, transition := range transitions {
 			states[len(states)] = transition
 			w.Write([]byte(fmt.Sprintf("%d -> %d  [label = \"%s\"];\n", idx, len(states)-1, field)))
-			if idx == 0 {
+			if metricTypeStates[transition] {
 				// color for metric types
 				w.Write([]byte(fmt.Sprintf("%d [color=\"#D6B656\",fillcolor=\"#FFF2CC\"];\n", len(states)-1)))
-			} else if transition.transitions == nil || len(transition.transitions) == 0 {
+			} else if len(transition.transitions) == 0 && len(transition.patternTransitions) == 0 {
 				// color for end state
 				w.Write([]byte(fmt.Sprintf("%d [color=\"#82B366\",fillcolor=\"#D5E8D4\"];\n", len(states)-1)))
 			}
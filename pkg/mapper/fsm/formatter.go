@@ -21,56 +21,243 @@ import (
 )
 
 var (
-	templateReplaceCaptureRE = regexp.MustCompile(`\$\{?([a-zA-Z0-9_\$]+)\}?`)
+	templateTagRE = regexp.MustCompile(`^tag\.([a-zA-Z_][a-zA-Z0-9_]*)(?::-(.*))?$`)
+	templateRefRE = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
 )
 
+// templatePart is a literal string, a reference to a capture if
+// captureIndex is not negative, or a reference to a tag with a default if tag
+// is set. The functions are applied to its value in order.
+type templatePart struct {
+	literal      string
+	captureIndex int
+	tag          string
+	tagDefault   string
+	funcs        []templateFunc
+}
+
+// TemplateFormatter formats the name or a label value of a mapping. Its
+// template refers to captures as $1, ${1} or, for named groups of regular
+// expressions, ${name}, and to tags as ${tag.name} or ${tag.name:-default}.
+// References in braces can pipe their value through template functions, as in
+// ${1 | lower | replace "-" "_"}. $$ is a literal $.
 type TemplateFormatter struct {
-	captureIndexes []int
-	captureCount   int
-	fmtString      string
+	parts []templatePart
+	tags  []string
 }
 
 // NewTemplateFormatter instantiates a TemplateFormatter
 // from given template string and the maximum amount of captures.
-func NewTemplateFormatter(template string, captureCount int) *TemplateFormatter {
-	matches := templateReplaceCaptureRE.FindAllStringSubmatch(template, -1)
-	if len(matches) == 0 {
-		// if no regex reference found, keep it as it is
-		return &TemplateFormatter{captureCount: 0, fmtString: template}
-	}
-
-	var indexes []int
-	valueFormatter := template
-	for _, match := range matches {
-		idx, err := strconv.Atoi(match[len(match)-1])
+// References to captures that do not exist are replaced with the empty string.
+func NewTemplateFormatter(template string, captureCount int) (*TemplateFormatter, error) {
+	return parseTemplate(template, func(ref string) (int, bool) {
+		idx, err := strconv.Atoi(ref)
 		if err != nil || idx > captureCount || idx < 1 {
 			// if index larger than captured count or using unsupported named capture group,
 			// replace with empty string
-			valueFormatter = strings.Replace(valueFormatter, match[0], "", -1)
-		} else {
-			valueFormatter = strings.Replace(valueFormatter, match[0], "%s", -1)
-			// note: the regex reference variable $? starts from 1
-			indexes = append(indexes, idx-1)
+			return 0, false
+		}
+		// note: the regex reference variable $? starts from 1
+		return idx - 1, true
+	})
+}
+
+// NewRegexTemplateFormatter instantiates a TemplateFormatter for the captures
+// of a regular expression with the given capture group names, as returned by
+// regexp.Regexp.SubexpNames. Like with regexp.Regexp.Expand, $0 is the whole
+// match and references to groups that do not exist are replaced with the
+// empty string. Format expects all submatches, including the whole match.
+func NewRegexTemplateFormatter(template string, captureNames []string) (*TemplateFormatter, error) {
+	return parseTemplate(template, func(ref string) (int, bool) {
+		if idx, err := strconv.Atoi(ref); err == nil {
+			return idx, idx < len(captureNames)
+		}
+		for idx, name := range captureNames {
+			if idx > 0 && name == ref {
+				return idx, true
+			}
+		}
+		return 0, false
+	})
+}
+
+// parseTemplate parses a template, with resolve returning the index of the
+// capture a reference refers to, and false if it does not exist.
+func parseTemplate(template string, resolve func(ref string) (int, bool)) (*TemplateFormatter, error) {
+	formatter := &TemplateFormatter{}
+	var literal strings.Builder
+	flushLiteral := func() {
+		if literal.Len() > 0 {
+			formatter.parts = append(formatter.parts, templatePart{captureIndex: -1, literal: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(template); {
+		if template[i] != '$' || i+1 == len(template) {
+			literal.WriteByte(template[i])
+			i++
+			continue
+		}
+		switch c := template[i+1]; {
+		case c == '$':
+			literal.WriteByte('$')
+			i += 2
+		case c == '{':
+			end := closingBrace(template, i+2)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated reference in template %q", template)
+			}
+			part, err := parseExpression(template[i+2:end], resolve)
+			if err != nil {
+				return nil, fmt.Errorf("invalid template %q: %v", template, err)
+			}
+			flushLiteral()
+			formatter.addPart(part)
+			i = end + 1
+		case isRefChar(c):
+			end := i + 1
+			for end < len(template) && isRefChar(template[end]) {
+				end++
+			}
+			flushLiteral()
+			formatter.addPart(referencePart(template[i+1:end], resolve))
+			i = end
+		default:
+			literal.WriteByte('$')
+			i++
+		}
+	}
+	flushLiteral()
+	return formatter, nil
+}
+
+func (formatter *TemplateFormatter) addPart(part templatePart) {
+	formatter.parts = append(formatter.parts, part)
+	if part.tag != "" {
+		formatter.tags = append(formatter.tags, part.tag)
+	}
+}
+
+// parseExpression parses the content of a reference in braces, a reference
+// optionally followed by template functions.
+func parseExpression(expr string, resolve func(ref string) (int, bool)) (templatePart, error) {
+	segments, err := splitUnquoted(expr, '|')
+	if err != nil {
+		return templatePart{}, err
+	}
+	ref := strings.TrimSpace(segments[0])
+	var part templatePart
+	if match := templateTagRE.FindStringSubmatch(ref); match != nil {
+		part = templatePart{captureIndex: -1, tag: match[1], tagDefault: match[2]}
+	} else if templateRefRE.MatchString(ref) {
+		part = referencePart(ref, resolve)
+	} else {
+		return templatePart{}, fmt.Errorf("invalid reference %q", ref)
+	}
+
+	for _, call := range segments[1:] {
+		f, err := parseTemplateFunc(call)
+		if err != nil {
+			return templatePart{}, err
+		}
+		part.funcs = append(part.funcs, f)
+	}
+	return part, nil
+}
+
+// referencePart returns the part for a reference to a capture. References to
+// captures that do not exist have the empty value.
+func referencePart(ref string, resolve func(ref string) (int, bool)) templatePart {
+	if idx, ok := resolve(ref); ok {
+		return templatePart{captureIndex: idx}
+	}
+	return templatePart{captureIndex: -1}
+}
+
+func isRefChar(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// closingBrace returns the index of the first } from start that is not in a
+// quoted string, or -1.
+func closingBrace(s string, start int) int {
+	inQuotes := false
+	for i := start; i < len(s); i++ {
+		switch {
+		case inQuotes && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && s[i] == '}':
+			return i
+		}
+	}
+	return -1
+}
+
+// splitUnquoted splits s at the separators that are not in quoted strings.
+func splitUnquoted(s string, sep byte) ([]string, error) {
+	var parts []string
+	inQuotes := false
+	last := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case inQuotes && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && s[i] == sep:
+			parts = append(parts, s[last:i])
+			last = i + 1
 		}
 	}
-	return &TemplateFormatter{
-		captureIndexes: indexes,
-		captureCount:   len(indexes),
-		fmtString:      valueFormatter,
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated string in %q", s)
 	}
+	return append(parts, s[last:]), nil
+}
+
+// Tags returns the names of the tags the template refers to.
+func (formatter *TemplateFormatter) Tags() []string {
+	return formatter.tags
 }
 
 // Format accepts a list containing captured strings and returns the formatted
-// string using the template stored in current TemplateFormatter.
+// string using the template stored in current TemplateFormatter. Tag
+// references are replaced with their defaults.
 func (formatter *TemplateFormatter) Format(captures []string) string {
-	if formatter.captureCount == 0 {
+	return formatter.FormatWithTags(captures, nil)
+}
+
+// FormatWithTags works like Format, but replaces tag references with the
+// values of the tags.
+func (formatter *TemplateFormatter) FormatWithTags(captures []string, tags map[string]string) string {
+	parts := formatter.parts
+	switch {
+	case len(parts) == 0:
+		return ""
+	case len(parts) == 1 && parts[0].captureIndex < 0 && parts[0].tag == "" && len(parts[0].funcs) == 0:
 		// no label substitution, keep as it is
-		return formatter.fmtString
+		return parts[0].literal
 	}
-	indexes := formatter.captureIndexes
-	vargs := make([]interface{}, formatter.captureCount)
-	for i, idx := range indexes {
-		vargs[i] = captures[idx]
+	var b strings.Builder
+	for _, part := range parts {
+		var value string
+		switch {
+		case part.captureIndex >= 0:
+			value = captures[part.captureIndex]
+		case part.tag != "":
+			if value = tags[part.tag]; value == "" {
+				value = part.tagDefault
+			}
+		default:
+			value = part.literal
+		}
+		for _, f := range part.funcs {
+			value = f(value)
+		}
+		b.WriteString(value)
 	}
-	return fmt.Sprintf(formatter.fmtString, vargs...)
+	return b.String()
 }
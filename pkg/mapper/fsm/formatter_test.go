@@ -0,0 +1,126 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTemplateFormatter(t *testing.T) {
+	captures := []string{"a", "b"}
+
+	scenarios := []struct {
+		template string
+		tags     map[string]string
+		out      string
+		tagNames []string
+	}{
+		{template: "", out: ""},
+		{template: "plain", out: "plain"},
+		{template: "$1.$2", out: "a.b"},
+		{template: "${1}x${2}", out: "axb"},
+		{template: "$1_total", out: ""},
+		{template: "${1}_${2}_total", out: "a_b_total"},
+		{template: "$$", out: "$"},
+		{template: "$$1", out: "$1"},
+		{template: "$$$1", out: "$a"},
+		{template: "cost$", out: "cost$"},
+		{template: "a$-b", out: "a$-b"},
+		{template: "x$3", out: "x"},
+		{template: "${0}_${3}_x", out: "__x"},
+		{template: "$name", out: ""},
+		{template: "${tag.env}", out: "", tagNames: []string{"env"}},
+		{template: "${tag.env}", tags: map[string]string{"env": "prod"}, out: "prod", tagNames: []string{"env"}},
+		{template: "${tag.env:-dev}", out: "dev", tagNames: []string{"env"}},
+		{template: "${tag.env:-dev}", tags: map[string]string{"env": ""}, out: "dev", tagNames: []string{"env"}},
+		{template: "${tag.env:-dev}", tags: map[string]string{"env": "prod"}, out: "prod", tagNames: []string{"env"}},
+		{template: "${tag.env:-}", tags: map[string]string{"region": "eu"}, out: "", tagNames: []string{"env"}},
+		{template: "${tag.env:-a:-b}", out: "a:-b", tagNames: []string{"env"}},
+		{template: "$1.${tag.env:-dev}.${tag.region}", tags: map[string]string{"region": "eu"}, out: "a.dev.eu", tagNames: []string{"env", "region"}},
+		{template: "${ 1 }", out: "a"},
+	}
+
+	for _, s := range scenarios {
+		formatter, err := NewTemplateFormatter(s.template, len(captures))
+		if err != nil {
+			t.Fatalf("%q: Unexpected error: %v", s.template, err)
+		}
+		if got := formatter.FormatWithTags(captures, s.tags); got != s.out {
+			t.Fatalf("%q with tags %v: Expected %q, got %q", s.template, s.tags, s.out, got)
+		}
+		if got := formatter.Tags(); !reflect.DeepEqual(got, s.tagNames) {
+			t.Fatalf("%q: Expected tags %v, got %v", s.template, s.tagNames, got)
+		}
+	}
+}
+
+func TestTemplateFormatterFormatUsesDefaults(t *testing.T) {
+	formatter, err := NewTemplateFormatter("${1}_${tag.env:-dev}", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatter.Format([]string{"a"}); got != "a_dev" {
+		t.Fatalf("Expected %q, got %q", "a_dev", got)
+	}
+}
+
+func TestRegexTemplateFormatter(t *testing.T) {
+	captureNames := []string{"", "first", ""}
+	captures := []string{"whole", "x", "y"}
+
+	scenarios := []struct {
+		template string
+		out      string
+	}{
+		{template: "$0", out: "whole"},
+		{template: "$1_$2", out: "y"},
+		{template: "${1}_$2", out: "x_y"},
+		{template: "${first}_${2}", out: "x_y"},
+		{template: "$first", out: "x"},
+		{template: "$3", out: ""},
+		{template: "${other}x", out: "x"},
+		{template: "$$first", out: "$first"},
+		{template: "${first | upper}", out: "X"},
+	}
+
+	for _, s := range scenarios {
+		formatter, err := NewRegexTemplateFormatter(s.template, captureNames)
+		if err != nil {
+			t.Fatalf("%q: Unexpected error: %v", s.template, err)
+		}
+		if got := formatter.Format(captures); got != s.out {
+			t.Fatalf("%q: Expected %q, got %q", s.template, s.out, got)
+		}
+	}
+}
+
+func TestTemplateFormatterErrors(t *testing.T) {
+	for _, template := range []string{
+		"${",
+		"${1",
+		"x_${tag.env",
+		"${tag.env:-dev",
+		"${}",
+		"${a-b}",
+		"${tag.}",
+		"${tag.1env}",
+		`${1 | default "}"`,
+		`${1 | default "a}`,
+	} {
+		if _, err := NewTemplateFormatter(template, 1); err == nil {
+			t.Fatalf("%q: Expected an error", template)
+		}
+	}
+}
@@ -14,6 +14,7 @@
 package fsm
 
 import (
+	"math"
 	"regexp"
 	"strings"
 
@@ -21,213 +22,404 @@ import (
 )
 
 type mappingState struct {
-	transitions        map[string]*mappingState
+	transitions map[string]*mappingState
+	// patternTransitions are the transitions of fields with partial
+	// wildcards, such as req_*_ms, in the order they were added.
+	patternTransitions []*patternTransition
 	minRemainingLength int
 	maxRemainingLength int
 	// result* members are nil unless there's a metric ends with this state
 	Result         interface{}
 	ResultPriority int
+	// moreResults are the results of later matches that end in this state.
+	// They are only returned if the search rejects the earlier results.
+	moreResults []stateResult
 }
 
-type fsmBacktrackStackCursor struct {
-	fieldIndex     int
-	captureIndex   int
-	currentCapture string
-	state          *mappingState
-	prev           *fsmBacktrackStackCursor
-	next           *fsmBacktrackStackCursor
+type stateResult struct {
+	result   interface{}
+	priority int
 }
 
+// accepted returns the first result of the state that accept returns true
+// for, or the first result if accept is nil.
+func (s *mappingState) accepted(accept func(result interface{}) bool) (interface{}, int, bool) {
+	if s.Result == nil {
+		return nil, 0, false
+	}
+	if accept == nil || accept(s.Result) {
+		return s.Result, s.ResultPriority, true
+	}
+	for _, r := range s.moreResults {
+		if accept(r.result) {
+			return r.result, r.priority, true
+		}
+	}
+	return nil, 0, false
+}
+
+// patternTransition is a transition for the fields that match a pattern
+// with partial wildcards, each of which captures.
+type patternTransition struct {
+	pattern string
+	regex   *regexp.Regexp
+	state   *mappingState
+}
+
+// fits reports whether a match could end in the state with the given number of
+// fields left after it.
+func (s *mappingState) fits(fieldsLeft int) bool {
+	return fieldsLeft >= s.minRemainingLength && fieldsLeft <= s.maxRemainingLength
+}
+
+// DefaultSeparator is the separator of the fields of metric names that
+// AddState uses.
+const DefaultSeparator = "."
+
 type FSM struct {
-	root               *mappingState
-	metricTypes        []string
-	statesCount        int
-	BacktrackingNeeded bool
-	OrderingDisabled   bool
+	// roots are the start states of the matches for each separator, which
+	// lead to a state for each metric type.
+	roots                  map[string]*mappingState
+	separators             []string
+	metricTypes            []string
+	maxPossibleTransitions int
+	statesCount            int
+	BacktrackingNeeded     bool
+	OrderingDisabled       bool
 }
 
 // NewFSM creates a new FSM instance
 func NewFSM(metricTypes []string, maxPossibleTransitions int, orderingDisabled bool) *FSM {
 	fsm := FSM{}
+	fsm.roots = make(map[string]*mappingState, 1)
+	fsm.OrderingDisabled = orderingDisabled
+	fsm.metricTypes = metricTypes
+	fsm.maxPossibleTransitions = maxPossibleTransitions
+	fsm.statesCount = 0
+	fsm.root(DefaultSeparator)
+	return &fsm
+}
+
+// root returns the start state of the matches with the given separator,
+// adding it if needed.
+func (f *FSM) root(separator string) *mappingState {
+	if root, ok := f.roots[separator]; ok {
+		return root
+	}
 	root := &mappingState{}
-	root.transitions = make(map[string]*mappingState, len(metricTypes))
+	root.transitions = make(map[string]*mappingState, len(f.metricTypes))
 
-	for _, field := range metricTypes {
+	for _, field := range f.metricTypes {
 		state := &mappingState{}
-		(*state).transitions = make(map[string]*mappingState, maxPossibleTransitions)
+		(*state).transitions = make(map[string]*mappingState, f.maxPossibleTransitions)
 		root.transitions[string(field)] = state
 	}
-	fsm.OrderingDisabled = orderingDisabled
-	fsm.metricTypes = metricTypes
-	fsm.statesCount = 0
-	fsm.root = root
-	return &fsm
+	f.roots[separator] = root
+	f.separators = append(f.separators, separator)
+	return root
 }
 
 // AddState adds a mapping rule into the existing FSM.
 // The maxPossibleTransitions parameter sets the expected count of transitions left.
 // The result parameter sets the generic type to be returned when fsm found a match in GetMapping.
+//
+// Besides * for a whole field, the match can use ** for zero or more fields,
+// * within a field, as in req_*_ms, and alternatives such as {get,post}.
+// Every * and ** captures; ** captures the fields it matches joined by dots.
+// Alternatives do not capture.
 func (f *FSM) AddState(match string, matchMetricType string, maxPossibleTransitions int, result interface{}) int {
-	// first split by "."
-	matchFields := strings.Split(match, ".")
+	return f.AddStateWithSeparator(match, DefaultSeparator, matchMetricType, maxPossibleTransitions, result)
+}
+
+// AddStateWithSeparator works like AddState, for a match whose fields are
+// separated by the given separator instead of dots. It matches the metrics
+// whose names are separated the same way.
+func (f *FSM) AddStateWithSeparator(match string, separator string, matchMetricType string, maxPossibleTransitions int, result interface{}) int {
 	// fill into our FSM
 	roots := []*mappingState{}
+	start := f.root(separator)
 	// first state is the metric type
 	if matchMetricType == "" {
 		// if metricType not specified, connect the start state from all three types
 		for _, metricType := range f.metricTypes {
-			roots = append(roots, f.root.transitions[string(metricType)])
+			roots = append(roots, start.transitions[string(metricType)])
 		}
 	} else {
-		roots = append(roots, f.root.transitions[matchMetricType])
+		roots = append(roots, start.transitions[matchMetricType])
 	}
 	var captureCount int
-	var finalStates []*mappingState
-	// iterating over different start state (different metric types)
-	for _, root := range roots {
-		captureCount = 0
-		// for each start state, connect from start state to end state
-		for i, field := range matchFields {
-			state, prs := root.transitions[field]
-			if !prs {
-				// create a state if it's not exist in the fsm
-				state = &mappingState{}
-				(*state).transitions = make(map[string]*mappingState, maxPossibleTransitions)
-				(*state).maxRemainingLength = len(matchFields) - i - 1
-				(*state).minRemainingLength = len(matchFields) - i - 1
-				root.transitions[field] = state
+	// iterating over the matches the alternatives expand to, and different
+	// start states (different metric types)
+	for _, expanded := range expandAlternatives(match) {
+		// first split by the separator
+		matchFields := strings.Split(expanded, separator)
+		for _, root := range roots {
+			captureCount = 0
+			// for each start state, connect from start state to end state
+			for i, field := range matchFields {
+				minLeft, maxLeft := remainingLength(matchFields[i+1:])
+				state := root.transition(field)
+				if state.transitions == nil {
+					// the state did not exist in the fsm
+					state.transitions = make(map[string]*mappingState, maxPossibleTransitions)
+					state.minRemainingLength = minLeft
+					state.maxRemainingLength = maxLeft
+				} else {
+					state.maxRemainingLength = max(maxLeft, state.maxRemainingLength)
+					state.minRemainingLength = min(minLeft, state.minRemainingLength)
+				}
 				// if this is last field, set result to currentMapping instance
 				if i == len(matchFields)-1 {
-					root.transitions[field].Result = result
+					state.addResult(result, f.statesCount)
 				}
-			} else {
-				(*state).maxRemainingLength = max(len(matchFields)-i-1, (*state).maxRemainingLength)
-				(*state).minRemainingLength = min(len(matchFields)-i-1, (*state).minRemainingLength)
-			}
-			if field == "*" {
-				captureCount++
+				if field == "**" {
+					captureCount++
+				} else {
+					captureCount += strings.Count(field, "*")
+				}
+
+				// goto next state
+				root = state
 			}
+		}
+	}
+
+	f.statesCount++
+
+	return captureCount
+}
 
-			// goto next state
-			root = state
+// addResult adds the result of a match that ends in the state. Only the first
+// result is returned by GetMapping; the others can be returned by
+// GetAcceptedMapping.
+func (s *mappingState) addResult(result interface{}, priority int) {
+	if s.Result == nil {
+		s.Result = result
+		s.ResultPriority = priority
+		return
+	}
+	// several alternatives of a match can end in the same state
+	last := s.ResultPriority
+	if len(s.moreResults) > 0 {
+		last = s.moreResults[len(s.moreResults)-1].priority
+	}
+	if last != priority {
+		s.moreResults = append(s.moreResults, stateResult{result: result, priority: priority})
+	}
+}
+
+// transition returns the state a field of a match leads to, adding it if
+// needed. New states have no transitions yet.
+func (s *mappingState) transition(field string) *mappingState {
+	if field == "*" || field == "**" || !strings.Contains(field, "*") {
+		state, prs := s.transitions[field]
+		if !prs {
+			state = &mappingState{}
+			s.transitions[field] = state
+		}
+		return state
+	}
+	for _, t := range s.patternTransitions {
+		if t.pattern == field {
+			return t.state
 		}
-		finalStates = append(finalStates, root)
 	}
+	parts := strings.Split(field, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	t := &patternTransition{
+		pattern: field,
+		regex:   regexp.MustCompile("^" + strings.Join(parts, "(.*)") + "$"),
+		state:   &mappingState{},
+	}
+	s.patternTransitions = append(s.patternTransitions, t)
+	return t.state
+}
 
-	for _, state := range finalStates {
-		state.ResultPriority = f.statesCount
+// remainingLength returns the minimum and maximum number of fields the rest
+// of a match can match.
+func remainingLength(fields []string) (int, int) {
+	minLeft := 0
+	for _, field := range fields {
+		if field != "**" {
+			minLeft++
+		}
+	}
+	if minLeft < len(fields) {
+		return minLeft, math.MaxInt32
 	}
+	return minLeft, minLeft
+}
 
-	f.statesCount++
+// expandAlternatives expands the alternatives such as {get,post} in a match
+// into the matches without alternatives they stand for.
+func expandAlternatives(match string) []string {
+	start := strings.IndexByte(match, '{')
+	if start < 0 {
+		return []string{match}
+	}
+	end := start + strings.IndexByte(match[start:], '}')
+	var expanded []string
+	for _, alternative := range strings.Split(match[start+1:end], ",") {
+		for _, rest := range expandAlternatives(match[end+1:]) {
+			expanded = append(expanded, match[:start]+alternative+rest)
+		}
+	}
+	return expanded
+}
 
-	return captureCount
+// fsmMatcher is the state of a search for the mapping of a metric.
+type fsmMatcher struct {
+	fsm           *FSM
+	separator     string
+	fields        []string
+	accept        func(result interface{}) bool
+	captures      []string
+	finalState    *mappingState
+	finalResult   interface{}
+	finalPriority int
+	finalCaptures []string
 }
 
 // GetMapping using the fsm to find matching rules according to given statsdMetric and statsdMetricType.
 // If it finds a match, the final state and the captured strings are returned;
 // if there's no match found, nil and a empty list will be returned.
+//
+// Transitions are tried in the order literal field, *, partial wildcards
+// and **. If ordering is enabled, all paths are searched for the result with
+// the highest priority, otherwise the first result is returned. The matches
+// of each separator are searched in the order the separators were added.
 func (f *FSM) GetMapping(statsdMetric string, statsdMetricType string) (*mappingState, []string) {
-	matchFields := strings.Split(statsdMetric, ".")
-	currentState := f.root.transitions[statsdMetricType]
-
-	// the cursor/pointer in the backtrack stack implemented as a double-linked list
-	var backtrackCursor *fsmBacktrackStackCursor
-	resumeFromBacktrack := false
-
-	// the return variable
-	var finalState *mappingState
-
-	captures := make([]string, len(matchFields))
-	finalCaptures := make([]string, len(matchFields))
-	// keep track of captured group so we don't need to do append() on captures
-	captureIdx := 0
-	filedsCount := len(matchFields)
-	i := 0
-	var state *mappingState
-	for { // the loop for backtracking
-		for { // the loop for a single "depth only" search
-			var present bool
-			// if we resume from backtrack, we should skip this branch in this case
-			// since the state that were saved at the end of this branch
-			if !resumeFromBacktrack {
-				if len(currentState.transitions) > 0 {
-					field := matchFields[i]
-					state, present = currentState.transitions[field]
-					fieldsLeft := filedsCount - i - 1
-					// also compare length upfront to avoid unnecessary loop or backtrack
-					if !present || fieldsLeft > state.maxRemainingLength || fieldsLeft < state.minRemainingLength {
-						state, present = currentState.transitions["*"]
-						if !present || fieldsLeft > state.maxRemainingLength || fieldsLeft < state.minRemainingLength {
-							break
-						} else {
-							captures[captureIdx] = field
-							captureIdx++
-						}
-					} else if f.BacktrackingNeeded {
-						// if backtracking is needed, also check for alternative transition, i.e. *
-						altState, present := currentState.transitions["*"]
-						if !present || fieldsLeft > altState.maxRemainingLength || fieldsLeft < altState.minRemainingLength {
-						} else {
-							// push to backtracking stack
-							newCursor := fsmBacktrackStackCursor{prev: backtrackCursor, state: altState,
-								fieldIndex:   i,
-								captureIndex: captureIdx, currentCapture: field,
-							}
-							// if this is not the first time, connect to the previous cursor
-							if backtrackCursor != nil {
-								backtrackCursor.next = &newCursor
-							}
-							backtrackCursor = &newCursor
-						}
-					}
-				} else {
-					// no more transitions for this state
-					break
-				}
-			} // backtrack will resume from here
-
-			// do we reach a final state?
-			if state.Result != nil && i == filedsCount-1 {
-				if f.OrderingDisabled {
-					finalState = state
-					return finalState, captures
-				} else if finalState == nil || finalState.ResultPriority > state.ResultPriority {
-					// if we care about ordering, try to find a result with highest prioity
-					finalState = state
-					// do a deep copy to preserve current captures
-					copy(finalCaptures, captures)
-				}
-				break
-			}
+	m := f.search(statsdMetric, statsdMetricType, nil)
+	if m == nil {
+		return nil, nil
+	}
+	return m.finalState, m.finalCaptures
+}
 
-			i++
-			if i >= filedsCount {
-				break
-			}
+// GetAcceptedMapping works like GetMapping, but skips the results that
+// accept returns false for, e.g. because the tags of the metric do not match.
+// It returns the accepted result, its priority and the captured strings, or
+// a nil result if there is none. Rejected results only make the search go on
+// if backtracking is enabled.
+func (f *FSM) GetAcceptedMapping(statsdMetric string, statsdMetricType string, accept func(result interface{}) bool) (interface{}, int, []string) {
+	m := f.search(statsdMetric, statsdMetricType, accept)
+	if m == nil {
+		return nil, 0, nil
+	}
+	return m.finalResult, m.finalPriority, m.finalCaptures
+}
+
+// search returns the matcher that found the result for the metric, or nil.
+func (f *FSM) search(statsdMetric string, statsdMetricType string, accept func(result interface{}) bool) *fsmMatcher {
+	var final *fsmMatcher
+	for _, separator := range f.separators {
+		state := f.roots[separator].transitions[statsdMetricType]
+		if state == nil || len(state.transitions) == 0 && len(state.patternTransitions) == 0 {
+			continue
+		}
+		matchFields := strings.Split(statsdMetric, separator)
+		m := &fsmMatcher{
+			fsm:       f,
+			separator: separator,
+			fields:    matchFields,
+			accept:    accept,
+			captures:  make([]string, 0, len(matchFields)),
+		}
+		m.match(state, 0)
+		if m.finalState == nil {
+			continue
+		}
+		if f.OrderingDisabled {
+			return m
+		}
+		if final == nil || final.finalPriority > m.finalPriority {
+			final = m
+		}
+	}
+	return final
+}
 
-			resumeFromBacktrack = false
-			currentState = state
+// match searches the paths from state for the fields from index i on. It
+// returns true if the search is over.
+func (m *fsmMatcher) match(state *mappingState, i int) bool {
+	fieldsCount := len(m.fields)
+	// do we reach a final state?
+	if i == fieldsCount {
+		if result, priority, ok := state.accepted(m.accept); !ok {
+			// no result, or none that was accepted
+		} else if m.fsm.OrderingDisabled {
+			m.finalState, m.finalResult, m.finalPriority = state, result, priority
+			m.finalCaptures = m.captures
+			return true
+		} else if m.finalState == nil || m.finalPriority > priority {
+			// if we care about ordering, try to find a result with highest prioity
+			m.finalState, m.finalResult, m.finalPriority = state, result, priority
+			// do a deep copy to preserve current captures
+			m.finalCaptures = append(m.finalCaptures[:0], m.captures...)
 		}
-		if backtrackCursor == nil {
-			// if we are not doing backtracking or all path has been travesaled
-			break
-		} else {
-			// pop one from stack
-			state = backtrackCursor.state
-			currentState = state
-			i = backtrackCursor.fieldIndex
-			captureIdx = backtrackCursor.captureIndex + 1
-			// put the * capture back
-			captures[captureIdx-1] = backtrackCursor.currentCapture
-			backtrackCursor = backtrackCursor.prev
-			if backtrackCursor != nil {
-				// deref for GC
-				backtrackCursor.next = nil
+	}
+
+	captureIdx := len(m.captures)
+	// try a transition, and report whether to stop the search; without
+	// backtracking only the first transition that fits is followed
+	follow := func(next *mappingState, i int, captures ...string) bool {
+		m.captures = append(m.captures, captures...)
+		if m.match(next, i) || !m.fsm.BacktrackingNeeded {
+			return true
+		}
+		m.captures = m.captures[:captureIdx]
+		return false
+	}
+
+	if i < fieldsCount {
+		field := m.fields[i]
+		fieldsLeft := fieldsCount - i - 1
+		// also compare length upfront to avoid unnecessary loop or backtrack
+		if state, present := state.transitions[field]; present && state.fits(fieldsLeft) {
+			if follow(state, i+1) {
+				return true
+			}
+		}
+		if state, present := state.transitions["*"]; present && state.fits(fieldsLeft) {
+			if follow(state, i+1, field) {
+				return true
 			}
-			resumeFromBacktrack = true
+		}
+		for _, t := range state.patternTransitions {
+			if !t.state.fits(fieldsLeft) {
+				continue
+			}
+			if groups := t.regex.FindStringSubmatch(field); groups != nil && follow(t.state, i+1, groups[1:]...) {
+				return true
+			}
+		}
+	}
+
+	// ** matches zero or more fields
+	if state, present := state.transitions["**"]; present {
+		for end := i; end <= fieldsCount; end++ {
+			if state.fits(fieldsCount-end) && follow(state, end, strings.Join(m.fields[i:end], m.separator)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsExtendedGlob reports whether a match uses **, * within a field or
+// alternatives.
+func IsExtendedGlob(match string) bool {
+	if strings.Contains(match, "{") {
+		return true
+	}
+	for _, field := range strings.Split(match, ".") {
+		if field != "*" && strings.Contains(field, "*") {
+			return true
 		}
 	}
-	return finalState, finalCaptures
+	return false
 }
 
 // TestIfNeedBacktracking tests if backtrack is needed for given list of mappings
@@ -241,6 +433,12 @@ func TestIfNeedBacktracking(mappings []string, orderingDisabled bool) bool {
 
 	// first sort rules by length
 	for _, mapping := range mappings {
+		// the analysis only covers matches with * for whole fields, the
+		// others always need backtracking
+		if IsExtendedGlob(mapping) {
+			backtrackingNeeded = true
+			continue
+		}
 		l := len(strings.Split(mapping, "."))
 		ruleByLength[l] = append(ruleByLength[l], mapping)
 
@@ -0,0 +1,130 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// templateFunc transforms a value in a template.
+type templateFunc func(string) string
+
+type templateFuncDef struct {
+	args int
+	// new returns the function for the given arguments.
+	new func(args []string) (templateFunc, error)
+}
+
+// templateFuncs are the functions that templates can apply to values.
+var templateFuncs = map[string]templateFuncDef{
+	"lower": {0, func([]string) (templateFunc, error) {
+		return strings.ToLower, nil
+	}},
+	"upper": {0, func([]string) (templateFunc, error) {
+		return strings.ToUpper, nil
+	}},
+	"replace": {2, func(args []string) (templateFunc, error) {
+		return func(s string) string { return strings.Replace(s, args[0], args[1], -1) }, nil
+	}},
+	"trimPrefix": {1, func(args []string) (templateFunc, error) {
+		return func(s string) string { return strings.TrimPrefix(s, args[0]) }, nil
+	}},
+	"trimSuffix": {1, func(args []string) (templateFunc, error) {
+		return func(s string) string { return strings.TrimSuffix(s, args[0]) }, nil
+	}},
+	"truncate": {1, func(args []string) (templateFunc, error) {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("truncate needs a non-negative length, got %q", args[0])
+		}
+		return func(s string) string {
+			// Truncate to n characters, not bytes.
+			count := 0
+			for i := range s {
+				if count == n {
+					return s[:i]
+				}
+				count++
+			}
+			return s
+		}, nil
+	}},
+	"default": {1, func(args []string) (templateFunc, error) {
+		return func(s string) string {
+			if s == "" {
+				return args[0]
+			}
+			return s
+		}, nil
+	}},
+}
+
+// parseTemplateFunc parses a function call such as replace "-" "_". The
+// arguments are quoted strings or bare words.
+func parseTemplateFunc(call string) (templateFunc, error) {
+	fields, err := splitFields(call)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing function")
+	}
+	def, ok := templateFuncs[fields[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", fields[0])
+	}
+	args := fields[1:]
+	if len(args) != def.args {
+		return nil, fmt.Errorf("function %s needs %d arguments, got %d", fields[0], def.args, len(args))
+	}
+	return def.new(args)
+}
+
+// splitFields splits s at spaces into bare words and unquoted strings.
+func splitFields(s string) ([]string, error) {
+	var fields []string
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == ' ' || s[i] == '\t':
+			i++
+		case s[i] == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("unterminated string in %q", s)
+			}
+			field, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string in %q: %v", s, err)
+			}
+			fields = append(fields, field)
+			i = end + 1
+		default:
+			end := i
+			for end < len(s) && s[end] != ' ' && s[end] != '\t' {
+				end++
+			}
+			fields = append(fields, s[i:end])
+			i = end
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	scenarios := []struct {
+		call string
+		in   string
+		out  string
+	}{
+		{call: "lower", in: "AbC", out: "abc"},
+		{call: "upper", in: "AbC", out: "ABC"},
+		{call: `replace "-" "_"`, in: "a-b-c", out: "a_b_c"},
+		{call: `replace - _`, in: "a-b", out: "a_b"},
+		{call: `replace "\"" "'"`, in: `a"b`, out: "a'b"},
+		{call: `replace " " ""`, in: "a b c", out: "abc"},
+		{call: `trimPrefix "api."`, in: "api.v1", out: "v1"},
+		{call: `trimPrefix "api."`, in: "web.v1", out: "web.v1"},
+		{call: `trimSuffix "_ms"`, in: "latency_ms", out: "latency"},
+		{call: "truncate 3", in: "héllo", out: "hél"},
+		{call: "truncate 5", in: "héllo", out: "héllo"},
+		{call: "truncate 10", in: "héllo", out: "héllo"},
+		{call: "truncate 0", in: "héllo", out: ""},
+		{call: `default "none"`, in: "", out: "none"},
+		{call: `default "none"`, in: "x", out: "x"},
+		{call: `default "none"`, in: " ", out: " "},
+		{call: "\tdefault  none ", in: "", out: "none"},
+	}
+
+	for _, s := range scenarios {
+		f, err := parseTemplateFunc(s.call)
+		if err != nil {
+			t.Fatalf("%q: Unexpected error: %v", s.call, err)
+		}
+		if got := f(s.in); got != s.out {
+			t.Fatalf("%q on %q: Expected %q, got %q", s.call, s.in, s.out, got)
+		}
+	}
+}
+
+func TestTemplateFuncErrors(t *testing.T) {
+	for _, call := range []string{
+		"",
+		"  ",
+		"unknown",
+		`"lower"x`,
+		"lower x",
+		"upper x",
+		"replace",
+		"replace a",
+		"replace a b c",
+		"trimPrefix",
+		"trimSuffix a b",
+		"truncate",
+		"truncate 1 2",
+		"truncate -1",
+		"truncate x",
+		"default",
+		"default a b",
+		`default "a`,
+		`default "a\"`,
+		`default "\q"`,
+	} {
+		if _, err := parseTemplateFunc(call); err == nil {
+			t.Fatalf("%q: Expected an error", call)
+		}
+	}
+}
+
+func TestSplitFields(t *testing.T) {
+	scenarios := []struct {
+		in  string
+		out []string
+		err bool
+	}{
+		{in: "", out: nil},
+		{in: "lower", out: []string{"lower"}},
+		{in: "  replace\t-  _ ", out: []string{"replace", "-", "_"}},
+		{in: `replace "-" "_"`, out: []string{"replace", "-", "_"}},
+		{in: `default "a b"`, out: []string{"default", "a b"}},
+		{in: `default ""`, out: []string{"default", ""}},
+		{in: `default "a\"b"`, out: []string{"default", `a"b`}},
+		{in: `default "a\\"`, out: []string{"default", `a\`}},
+		{in: `default "}" "|"`, out: []string{"default", "}", "|"}},
+		{in: `default "a"b`, out: []string{"default", "a", "b"}},
+		{in: `default "a`, err: true},
+		{in: `default "a\"`, err: true},
+		{in: `default "\q"`, err: true},
+	}
+
+	for _, s := range scenarios {
+		out, err := splitFields(s.in)
+		if (err != nil) != s.err {
+			t.Fatalf("%q: Expected error %v, got %v", s.in, s.err, err)
+		}
+		if !reflect.DeepEqual(out, s.out) {
+			t.Fatalf("%q: Expected %q, got %q", s.in, s.out, out)
+		}
+	}
+}
+
+func TestClosingBrace(t *testing.T) {
+	scenarios := []struct {
+		in    string
+		start int
+		out   int
+	}{
+		{in: "${1}", start: 2, out: 3},
+		{in: "${1}_${2}", start: 6, out: 8},
+		{in: `${1 | default "}"}`, start: 2, out: 17},
+		{in: `${1 | default "\"}"}`, start: 2, out: 19},
+		{in: `${1 | default "\\"}`, start: 2, out: 18},
+		{in: "${1", start: 2, out: -1},
+		{in: `${1 | default "}`, start: 2, out: -1},
+		{in: `${1 | default "\"}`, start: 2, out: -1},
+	}
+
+	for _, s := range scenarios {
+		if got := closingBrace(s.in, s.start); got != s.out {
+			t.Fatalf("%q from %d: Expected %d, got %d", s.in, s.start, s.out, got)
+		}
+	}
+}
+
+func TestSplitUnquoted(t *testing.T) {
+	scenarios := []struct {
+		in  string
+		out []string
+		err bool
+	}{
+		{in: "", out: []string{""}},
+		{in: "1", out: []string{"1"}},
+		{in: "1 | lower | upper", out: []string{"1 ", " lower ", " upper"}},
+		{in: "1||lower", out: []string{"1", "", "lower"}},
+		{in: `1 | default "|"`, out: []string{"1 ", ` default "|"`}},
+		{in: `1 | default "\"|" | lower`, out: []string{"1 ", ` default "\"|" `, " lower"}},
+		{in: `1 | replace "\\" "|"`, out: []string{"1 ", ` replace "\\" "|"`}},
+		{in: `1 | default "|`, err: true},
+		{in: `1 | default "\"|`, err: true},
+	}
+
+	for _, s := range scenarios {
+		out, err := splitUnquoted(s.in, '|')
+		if (err != nil) != s.err {
+			t.Fatalf("%q: Expected error %v, got %v", s.in, s.err, err)
+		}
+		if !reflect.DeepEqual(out, s.out) {
+			t.Fatalf("%q: Expected %q, got %q", s.in, s.out, out)
+		}
+	}
+}
+
+// TestTemplateFormatterFuncs checks that functions in templates are applied
+// in order, and that quoted arguments may contain } and |.
+func TestTemplateFormatterFuncs(t *testing.T) {
+	scenarios := []struct {
+		template string
+		captures []string
+		tags     map[string]string
+		out      string
+	}{
+		{template: "${1 | lower}", captures: []string{"AbC"}, out: "abc"},
+		{template: `${1 | replace "-" "_" | upper}`, captures: []string{"a-b"}, out: "A_B"},
+		{template: `${1 | upper | replace "A" "x"}`, captures: []string{"a"}, out: "x"},
+		{template: `${1 | replace "\"" "'"}`, captures: []string{`a"b`}, out: "a'b"},
+		{template: `${1 | default "}|"}_x`, captures: []string{""}, out: "}|_x"},
+		{template: `${1 | default "\"}"}`, captures: []string{""}, out: `"}`},
+		{template: "${1 | truncate 2}", captures: []string{"héllo"}, out: "hé"},
+		{template: `${tag.env | default "dev" | upper}`, out: "DEV"},
+		{template: `${tag.env:-prod | upper}`, tags: map[string]string{"env": ""}, out: "PROD"},
+		{template: `${tag.env | default "dev"}`, tags: map[string]string{"env": "qa"}, out: "qa"},
+	}
+
+	for _, s := range scenarios {
+		formatter, err := NewTemplateFormatter(s.template, len(s.captures))
+		if err != nil {
+			t.Fatalf("%q: Unexpected error: %v", s.template, err)
+		}
+		if got := formatter.FormatWithTags(s.captures, s.tags); got != s.out {
+			t.Fatalf("%q: Expected %q, got %q", s.template, s.out, got)
+		}
+	}
+
+	for _, template := range []string{
+		"${1 | }",
+		"${1 | nope}",
+		"${1 | lower x}",
+		`${1 | replace "a"}`,
+		"${1 | truncate x}",
+		`${1 | default "a\q"}`,
+	} {
+		if _, err := NewTemplateFormatter(template, 1); err == nil {
+			t.Fatalf("%q: Expected an error", template)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+type labelMatchType string
+
+const (
+	labelMatchEqual     labelMatchType = "="
+	labelMatchNotEqual  labelMatchType = "!="
+	labelMatchRegexp    labelMatchType = "=~"
+	labelMatchNotRegexp labelMatchType = "!~"
+)
+
+var labelMatcherRE = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*("(?:[^"\\]|\\.)*")\s*$`)
+
+// labelMatcher matches the value of a tag, in the syntax of Prometheus label
+// matchers, e.g. env!="dev". A missing tag has the empty value.
+type labelMatcher struct {
+	name      string
+	matchType labelMatchType
+	value     string
+	re        *regexp.Regexp
+}
+
+func parseLabelMatcher(s string) (*labelMatcher, error) {
+	parts := labelMatcherRE.FindStringSubmatch(s)
+	if parts == nil {
+		return nil, fmt.Errorf("invalid label matcher %q", s)
+	}
+	value, err := strconv.Unquote(parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid value in label matcher %q: %v", s, err)
+	}
+	m := &labelMatcher{
+		name:      parts[1],
+		matchType: labelMatchType(parts[2]),
+		value:     value,
+	}
+	if m.matchType == labelMatchRegexp || m.matchType == labelMatchNotRegexp {
+		if m.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid regex in label matcher %q: %v", s, err)
+		}
+	}
+	return m, nil
+}
+
+func (m *labelMatcher) matches(labels map[string]string) bool {
+	value := labels[m.name]
+	switch m.matchType {
+	case labelMatchEqual:
+		return value == m.value
+	case labelMatchNotEqual:
+		return value != m.value
+	case labelMatchRegexp:
+		return m.re.MatchString(value)
+	case labelMatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+// matchesLabels reports whether the tags of a metric match all label matchers
+// of the mapping.
+func (m *MetricMapping) matchesLabels(tags map[string]string) bool {
+	for _, matcher := range m.labelMatchers {
+		if !matcher.matches(tags) {
+			return false
+		}
+	}
+	return true
+}
@@ -17,22 +17,44 @@ import (
 	"fmt"
 	"io/ioutil"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/statsd_exporter/pkg/hyperloglog"
 	"github.com/prometheus/statsd_exporter/pkg/mapper/fsm"
+	"github.com/prometheus/statsd_exporter/pkg/relabel"
 	yaml "gopkg.in/yaml.v2"
 )
 
 var (
 	statsdMetricRE    = `[a-zA-Z_](-?[a-zA-Z0-9_])*`
-	templateReplaceRE = `(\$\{?\d+\}?)`
-
-	metricLineRE = regexp.MustCompile(`^(\*\.|` + statsdMetricRE + `\.)+(\*|` + statsdMetricRE + `)$`)
-	metricNameRE = regexp.MustCompile(`^([a-zA-Z_]|` + templateReplaceRE + `)([a-zA-Z0-9_]|` + templateReplaceRE + `)*$`)
+	templateReplaceRE = `(\$\{?\d+\}?|\$\{[a-zA-Z_][a-zA-Z0-9_]*\})`
+	tagReplaceRE      = `(\$\{tag\.[a-zA-Z_][a-zA-Z0-9_]*(:-[a-zA-Z0-9_]*)?\})`
+	// templateFuncRE matches references with template functions, whose
+	// syntax the template formatter checks.
+	templateFuncRE = `(\$\{[^}"|]*\|([^}"]|"([^"\\]|\\.)*")*\})`
+	templateRE     = templateReplaceRE + `|` + tagReplaceRE + `|` + templateFuncRE
+
+	// A glob field is *, **, a metric name, or a pattern with * within it
+	// and alternatives such as {get,post}.
+	globAlternativesRE = `\{(-?[a-zA-Z0-9_])*(,(-?[a-zA-Z0-9_])*)+\}`
+	globChunkRE        = `(-?[a-zA-Z0-9_]|` + globAlternativesRE + `)+`
+	globFieldRE        = `(\*\*?|` + statsdMetricRE +
+		`|\*?(` + globChunkRE + `\*)+(` + globChunkRE + `)?|\*` + globChunkRE +
+		`|(-?[a-zA-Z0-9_])*` + globAlternativesRE + `(` + globChunkRE + `)?)`
+
+	metricLineRE = globLineRE(fsm.DefaultSeparator)
+	metricNameRE = regexp.MustCompile(`^([a-zA-Z_]|` + templateRE + `)([a-zA-Z0-9_]|` + templateRE + `)*$`)
 	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]+$`)
+
+	// globSeparatorRE matches separators that cannot be confused with the
+	// content of glob fields.
+	globSeparatorRE = regexp.MustCompile(`^[^a-zA-Z0-9_*{},\s-]+$`)
 )
 
 type MetricMapper struct {
@@ -43,8 +65,22 @@ type MetricMapper struct {
 	doRegex  bool
 	cache    MetricMapperCache
 	mutex    sync.RWMutex
+	// doLabelMatch is set if any mapping has label matchers.
+	doLabelMatch bool
+	// cacheKeyTags are the sorted names of the tags the label matchers and
+	// templates of the mappings look at. Their values are part of the cache
+	// key.
+	cacheKeyTags []string
+
+	// RelabelConfigs are applied to the labels of all metrics, after those
+	// of their mapping.
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs"`
 
 	MappingsCount prometheus.Gauge
+	// Registerer registers the metrics about the mapping cache. If it is
+	// nil, they are registered with the default registerer.
+	Registerer   prometheus.Registerer
+	cacheMetrics *CacheMetrics
 }
 
 type SummaryOptions struct {
@@ -58,6 +94,11 @@ type HistogramOptions struct {
 	Buckets []float64 `yaml:"buckets"`
 }
 
+type SetOptions struct {
+	Window    time.Duration `yaml:"window"`
+	Precision uint8         `yaml:"precision"`
+}
+
 type metricObjective struct {
 	Quantile float64 `yaml:"quantile"`
 	Error    float64 `yaml:"error"`
@@ -69,6 +110,32 @@ var defaultQuantiles = []metricObjective{
 	{Quantile: 0.99, Error: 0.001},
 }
 
+// DefaultEventMetricName is the name of the counter for DogStatsD events
+// that are not matched by any mapping.
+const DefaultEventMetricName = "statsd_events_total"
+
+// DefaultServiceCheckMetricName is the prefix of the gauges for DogStatsD
+// service checks that are not matched by any mapping.
+const DefaultServiceCheckMetricName = "statsd_service_check"
+
+// DefaultSetOptions are used for sets when neither the mapping nor the
+// defaults configure them.
+var DefaultSetOptions = SetOptions{
+	Window:    time.Minute,
+	Precision: hyperloglog.DefaultPrecision,
+}
+
+// checkRelabelConfigs rejects null entries in a list of relabeling rules,
+// which YAML decodes as nil.
+func checkRelabelConfigs(cfgs []*relabel.Config) error {
+	for _, cfg := range cfgs {
+		if cfg == nil {
+			return fmt.Errorf("empty or null relabeling rule")
+		}
+	}
+	return nil
+}
+
 func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, options ...CacheOption) error {
 	var n MetricMapper
 
@@ -88,11 +155,44 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, op
 		n.Defaults.MatchType = MatchTypeGlob
 	}
 
+	if n.Defaults.GlobSeparator == "" {
+		n.Defaults.GlobSeparator = fsm.DefaultSeparator
+	}
+
+	if err := n.Defaults.SetOptions.fillDefaults(DefaultSetOptions); err != nil {
+		return err
+	}
+
+	if n.Defaults.EventMetricName == "" {
+		n.Defaults.EventMetricName = DefaultEventMetricName
+	}
+	if !model.IsValidMetricName(model.LabelValue(n.Defaults.EventMetricName)) {
+		return fmt.Errorf("invalid event metric name: %s", n.Defaults.EventMetricName)
+	}
+
+	if n.Defaults.ServiceCheckMetricName == "" {
+		n.Defaults.ServiceCheckMetricName = DefaultServiceCheckMetricName
+	}
+	if !model.IsValidMetricName(model.LabelValue(n.Defaults.ServiceCheckMetricName)) {
+		return fmt.Errorf("invalid service check metric name: %s", n.Defaults.ServiceCheckMetricName)
+	}
+
+	if err := checkRelabelConfigs(n.RelabelConfigs); err != nil {
+		return err
+	}
+
 	remainingMappingsCount := len(n.Mappings)
 
-	n.FSM = fsm.NewFSM([]string{string(MetricTypeCounter), string(MetricTypeGauge), string(MetricTypeObserver)},
+	n.FSM = fsm.NewFSM([]string{string(MetricTypeCounter), string(MetricTypeGauge), string(MetricTypeObserver), string(MetricTypeSet), string(MetricTypeEvent), string(MetricTypeServiceCheck)},
 		remainingMappingsCount, n.Defaults.GlobDisableOrdering)
 
+	globLineREs := map[string]*regexp.Regexp{fsm.DefaultSeparator: metricLineRE}
+	cacheKeyTags := map[string]bool{}
+	addCacheKeyTags := func(tags []string) {
+		for _, tag := range tags {
+			cacheKeyTags[tag] = true
+		}
+	}
 	for i := range n.Mappings {
 		remainingMappingsCount--
 
@@ -105,6 +205,20 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, op
 			}
 		}
 
+		if err := checkRelabelConfigs(currentMapping.RelabelConfigs); err != nil {
+			return fmt.Errorf("%v in %s", err, currentMapping.Match)
+		}
+
+		for _, s := range currentMapping.MatchLabels {
+			matcher, err := parseLabelMatcher(s)
+			if err != nil {
+				return err
+			}
+			currentMapping.labelMatchers = append(currentMapping.labelMatchers, matcher)
+			cacheKeyTags[matcher.name] = true
+			n.doLabelMatch = true
+		}
+
 		if currentMapping.Name == "" {
 			return fmt.Errorf("line %d: metric mapping didn't set a metric name", i)
 		}
@@ -121,28 +235,32 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, op
 			currentMapping.Action = ActionTypeMap
 		}
 
+		var newFormatter func(template string) (*fsm.TemplateFormatter, error)
+		if currentMapping.GlobSeparator == "" {
+			currentMapping.GlobSeparator = n.Defaults.GlobSeparator
+		}
+
 		if currentMapping.MatchType == MatchTypeGlob {
-			n.doFSM = true
-			if !metricLineRE.MatchString(currentMapping.Match) {
+			separator := currentMapping.GlobSeparator
+			lineRE, ok := globLineREs[separator]
+			if !ok {
+				if !globSeparatorRE.MatchString(separator) {
+					return fmt.Errorf("invalid glob separator %q in %s", separator, currentMapping.Match)
+				}
+				lineRE = globLineRE(separator)
+				globLineREs[separator] = lineRE
+			}
+			if !lineRE.MatchString(currentMapping.Match) {
 				return fmt.Errorf("invalid match: %s", currentMapping.Match)
 			}
 
-			captureCount := n.FSM.AddState(currentMapping.Match, string(currentMapping.MatchMetricType),
+			n.doFSM = true
+			captureCount := n.FSM.AddStateWithSeparator(currentMapping.Match, separator, string(currentMapping.MatchMetricType),
 				remainingMappingsCount, currentMapping)
 
-			currentMapping.nameFormatter = fsm.NewTemplateFormatter(currentMapping.Name, captureCount)
-
-			labelKeys := make([]string, len(currentMapping.Labels))
-			labelFormatters := make([]*fsm.TemplateFormatter, len(currentMapping.Labels))
-			labelIndex := 0
-			for label, valueExpr := range currentMapping.Labels {
-				labelKeys[labelIndex] = label
-				labelFormatters[labelIndex] = fsm.NewTemplateFormatter(valueExpr, captureCount)
-				labelIndex++
+			newFormatter = func(template string) (*fsm.TemplateFormatter, error) {
+				return fsm.NewTemplateFormatter(template, captureCount)
 			}
-			currentMapping.labelFormatters = labelFormatters
-			currentMapping.labelKeys = labelKeys
-
 		} else {
 			if regex, err := regexp.Compile(currentMapping.Match); err != nil {
 				return fmt.Errorf("invalid regex %s in mapping: %v", currentMapping.Match, err)
@@ -150,8 +268,35 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, op
 				currentMapping.regex = regex
 			}
 			n.doRegex = true
+
+			newFormatter = func(template string) (*fsm.TemplateFormatter, error) {
+				return fsm.NewRegexTemplateFormatter(template, currentMapping.regex.SubexpNames())
+			}
 		}
 
+		formatter, err := newFormatter(currentMapping.Name)
+		if err != nil {
+			return fmt.Errorf("invalid metric name in %s: %v", currentMapping.Match, err)
+		}
+		currentMapping.nameFormatter = formatter
+		addCacheKeyTags(formatter.Tags())
+
+		labelKeys := make([]string, len(currentMapping.Labels))
+		labelFormatters := make([]*fsm.TemplateFormatter, len(currentMapping.Labels))
+		labelIndex := 0
+		for label, valueExpr := range currentMapping.Labels {
+			formatter, err := newFormatter(valueExpr)
+			if err != nil {
+				return fmt.Errorf("invalid value of label %s in %s: %v", label, currentMapping.Match, err)
+			}
+			labelKeys[labelIndex] = label
+			labelFormatters[labelIndex] = formatter
+			addCacheKeyTags(formatter.Tags())
+			labelIndex++
+		}
+		currentMapping.labelFormatters = labelFormatters
+		currentMapping.labelKeys = labelKeys
+
 		if currentMapping.ObserverType == "" {
 			currentMapping.ObserverType = n.Defaults.ObserverType
 		}
@@ -208,6 +353,13 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, op
 			}
 		}
 
+		if currentMapping.SetOptions == nil {
+			currentMapping.SetOptions = &SetOptions{}
+		}
+		if err := currentMapping.SetOptions.fillDefaults(n.Defaults.SetOptions); err != nil {
+			return fmt.Errorf("invalid set options in %s: %v", currentMapping.Match, err)
+		}
+
 		if currentMapping.Ttl == 0 && n.Defaults.Ttl > 0 {
 			currentMapping.Ttl = n.Defaults.Ttl
 		}
@@ -219,16 +371,43 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int, op
 
 	m.Defaults = n.Defaults
 	m.Mappings = n.Mappings
+	m.RelabelConfigs = n.RelabelConfigs
+	m.doLabelMatch = n.doLabelMatch
+	m.cacheKeyTags = make([]string, 0, len(cacheKeyTags))
+	for name := range cacheKeyTags {
+		m.cacheKeyTags = append(m.cacheKeyTags, name)
+	}
+	sort.Strings(m.cacheKeyTags)
 	m.InitCache(cacheSize, options...)
 
 	if n.doFSM {
-		var mappings []string
+		// The matches of each separator are tested on their own, with their
+		// fields separated by dots as the test expects.
+		var separators []string
+		mappingsBySeparator := map[string][]string{}
 		for _, mapping := range n.Mappings {
-			if mapping.MatchType == MatchTypeGlob {
-				mappings = append(mappings, mapping.Match)
+			if mapping.MatchType != MatchTypeGlob {
+				continue
+			}
+			// A match whose label matchers fail must not end the search, so
+			// label matchers always need backtracking. Such matches are left
+			// out of the analysis, which would take them for duplicates.
+			if len(mapping.labelMatchers) > 0 {
+				n.FSM.BacktrackingNeeded = true
+				continue
+			}
+			separator := mapping.GlobSeparator
+			if _, ok := mappingsBySeparator[separator]; !ok {
+				separators = append(separators, separator)
+			}
+			match := strings.Replace(mapping.Match, separator, fsm.DefaultSeparator, -1)
+			mappingsBySeparator[separator] = append(mappingsBySeparator[separator], match)
+		}
+		for _, separator := range separators {
+			if fsm.TestIfNeedBacktracking(mappingsBySeparator[separator], n.FSM.OrderingDisabled) {
+				n.FSM.BacktrackingNeeded = true
 			}
 		}
-		n.FSM.BacktrackingNeeded = fsm.TestIfNeedBacktracking(mappings, n.FSM.OrderingDisabled)
 
 		m.FSM = n.FSM
 		m.doRegex = n.doRegex
@@ -251,8 +430,11 @@ func (m *MetricMapper) InitFromFile(fileName string, cacheSize int, options ...C
 }
 
 func (m *MetricMapper) InitCache(cacheSize int, options ...CacheOption) {
+	if m.cacheMetrics == nil {
+		m.cacheMetrics = NewCacheMetrics(m.Registerer)
+	}
 	if cacheSize == 0 {
-		m.cache = NewMetricMapperNoopCache()
+		m.cache = NewMetricMapperNoopCache(m.cacheMetrics)
 	} else {
 		o := cacheOptions{
 			cacheType: "lru",
@@ -267,9 +449,9 @@ func (m *MetricMapper) InitCache(cacheSize int, options ...CacheOption) {
 		)
 		switch o.cacheType {
 		case "lru":
-			cache, err = NewMetricMapperCache(cacheSize)
+			cache, err = NewMetricMapperCache(cacheSize, m.cacheMetrics)
 		case "random":
-			cache, err = NewMetricMapperRRCache(cacheSize)
+			cache, err = NewMetricMapperRRCache(cacheSize, m.cacheMetrics)
 		default:
 			err = fmt.Errorf("unsupported cache type %q", o.cacheType)
 		}
@@ -281,73 +463,142 @@ func (m *MetricMapper) InitCache(cacheSize int, options ...CacheOption) {
 	}
 }
 
+// GetMapping returns the mapping of a metric without tags, the labels it
+// generates and whether a mapping matched.
 func (m *MetricMapper) GetMapping(statsdMetric string, statsdMetricType MetricType) (*MetricMapping, prometheus.Labels, bool) {
+	return m.GetMappingWithLabels(statsdMetric, statsdMetricType, nil)
+}
+
+// GetMappingWithLabels works like GetMapping, and also matches the tags of
+// the metric against the label matchers of the mappings. Glob matches take
+// precedence over regex matches, except for regex mappings with label
+// matchers, which are tried in the order of the configuration.
+func (m *MetricMapper) GetMappingWithLabels(statsdMetric string, statsdMetricType MetricType, tags map[string]string) (*MetricMapping, prometheus.Labels, bool) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
-	result, cached := m.cache.Get(statsdMetric, statsdMetricType)
+	cacheKey := statsdMetric
+	if len(m.cacheKeyTags) > 0 {
+		cacheKey = m.cacheKey(statsdMetric, tags)
+	}
+	result, cached := m.cache.Get(cacheKey, statsdMetricType)
 	if cached {
 		return result.Mapping, result.Labels, result.Matched
 	}
+
 	// glob matching
+	var (
+		globMapping  *MetricMapping
+		globCaptures []string
+	)
 	if m.doFSM {
-		finalState, captures := m.FSM.GetMapping(statsdMetric, string(statsdMetricType))
-		if finalState != nil && finalState.Result != nil {
-			v := finalState.Result.(*MetricMapping)
-			result := copyMetricMapping(v)
-			result.Name = result.nameFormatter.Format(captures)
-
-			labels := prometheus.Labels{}
-			for index, formatter := range result.labelFormatters {
-				labels[result.labelKeys[index]] = formatter.Format(captures)
+		var accept func(result interface{}) bool
+		if m.doLabelMatch {
+			accept = func(result interface{}) bool {
+				return result.(*MetricMapping).matchesLabels(tags)
 			}
-
-			m.cache.AddMatch(statsdMetric, statsdMetricType, result, labels)
-
-			return result, labels, true
+		}
+		if result, _, captures := m.FSM.GetAcceptedMapping(statsdMetric, string(statsdMetricType), accept); result != nil {
+			globMapping, globCaptures = result.(*MetricMapping), captures
 		} else if !m.doRegex {
 			// if there's no regex match type, return immediately
-			m.cache.AddMiss(statsdMetric, statsdMetricType)
+			m.cache.AddMiss(cacheKey, statsdMetricType)
 			return nil, nil, false
 		}
 	}
 
-	// regex matching
-	for _, mapping := range m.Mappings {
+	// regex matching; after a glob match, only the regex mappings with label
+	// matchers before it in the configuration are left to try
+	mappings := m.Mappings
+	if globMapping != nil && !m.doLabelMatch {
+		mappings = nil
+	}
+	for i := range mappings {
+		mapping := &mappings[i]
+		if mapping == globMapping {
+			break
+		}
 		// if a rule don't have regex matching type, the regex field is unset
-		if mapping.regex == nil {
+		if mapping.regex == nil || globMapping != nil && len(mapping.labelMatchers) == 0 {
+			continue
+		}
+		if mt := mapping.MatchMetricType; mt != "" && mt != statsdMetricType {
 			continue
 		}
-		matches := mapping.regex.FindStringSubmatchIndex(statsdMetric)
+		if !mapping.matchesLabels(tags) {
+			continue
+		}
+		matches := mapping.regex.FindStringSubmatch(statsdMetric)
 		if len(matches) == 0 {
 			continue
 		}
 
-		mapping.Name = string(mapping.regex.ExpandString(
-			[]byte{},
-			mapping.Name,
-			statsdMetric,
-			matches,
-		))
+		result, labels := mapping.format(matches, tags)
 
-		if mt := mapping.MatchMetricType; mt != "" && mt != statsdMetricType {
-			continue
-		}
+		m.cache.AddMatch(cacheKey, statsdMetricType, result, labels)
 
-		labels := prometheus.Labels{}
-		for label, valueExpr := range mapping.Labels {
-			value := mapping.regex.ExpandString([]byte{}, valueExpr, statsdMetric, matches)
-			labels[label] = string(value)
-		}
+		return result, labels, true
+	}
+
+	if globMapping != nil {
+		result, labels := globMapping.format(globCaptures, tags)
 
-		m.cache.AddMatch(statsdMetric, statsdMetricType, &mapping, labels)
+		m.cache.AddMatch(cacheKey, statsdMetricType, result, labels)
 
-		return &mapping, labels, true
+		return result, labels, true
 	}
 
-	m.cache.AddMiss(statsdMetric, statsdMetricType)
+	m.cache.AddMiss(cacheKey, statsdMetricType)
 	return nil, nil, false
 }
 
+// cacheKey returns the key of a metric in the mapping cache, which includes
+// the values of the tags that label matchers and templates look at.
+func (m *MetricMapper) cacheKey(statsdMetric string, tags map[string]string) string {
+	var b strings.Builder
+	b.WriteString(statsdMetric)
+	for _, name := range m.cacheKeyTags {
+		b.WriteByte(model.SeparatorByte)
+		b.WriteString(tags[name])
+	}
+	return b.String()
+}
+
+// globLineRE returns the regular expression that validates glob matches with
+// the given separator.
+func globLineRE(separator string) *regexp.Regexp {
+	sep := regexp.QuoteMeta(separator)
+	return regexp.MustCompile(`^(` + globFieldRE + sep + `)+` + globFieldRE + `$`)
+}
+
+// fillDefaults sets unset options from d and validates the result.
+func (o *SetOptions) fillDefaults(d SetOptions) error {
+	if o.Window == 0 {
+		o.Window = d.Window
+	}
+	if o.Precision == 0 {
+		o.Precision = d.Precision
+	}
+	if o.Window < 0 {
+		return fmt.Errorf("set window must not be negative, got %s", o.Window)
+	}
+	if o.Precision < hyperloglog.MinPrecision || o.Precision > hyperloglog.MaxPrecision {
+		return fmt.Errorf("set precision must be between %d and %d, got %d", hyperloglog.MinPrecision, hyperloglog.MaxPrecision, o.Precision)
+	}
+	return nil
+}
+
+// format returns a copy of the mapping with the name, and the labels, for the
+// captures of a match and the tags of the metric.
+func (m *MetricMapping) format(captures []string, tags map[string]string) (*MetricMapping, prometheus.Labels) {
+	result := copyMetricMapping(m)
+	result.Name = m.nameFormatter.FormatWithTags(captures, tags)
+	labels := prometheus.Labels{}
+	for index, formatter := range m.labelFormatters {
+		labels[m.labelKeys[index]] = formatter.FormatWithTags(captures, tags)
+	}
+	return result, labels
+}
+
 // make a shallow copy so that we do not overwrite name
 // as multiple names can be matched by same mapping
 func copyMetricMapping(in *MetricMapping) *MetricMapping {
@@ -20,27 +20,67 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// CacheMetrics are the metrics about a mapping cache.
+type CacheMetrics struct {
+	CacheLength    prometheus.Gauge
+	CacheGetsTotal prometheus.Counter
+	CacheHitsTotal prometheus.Counter
+}
+
 var (
-	cacheLength = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "statsd_metric_mapper_cache_length",
-			Help: "The count of unique metrics currently cached.",
-		},
-	)
-	cacheGetsTotal = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_metric_mapper_cache_gets_total",
-			Help: "The count of total metric cache gets.",
-		},
-	)
-	cacheHitsTotal = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "statsd_metric_mapper_cache_hits_total",
-			Help: "The count of total metric cache hits.",
-		},
-	)
+	defaultCacheMetrics     *CacheMetrics
+	defaultCacheMetricsOnce sync.Once
 )
 
+// NewCacheMetrics creates the cache metrics and registers them with reg. If
+// reg already has them, they are shared. If reg is nil, the metrics
+// registered with the default registerer are returned.
+func NewCacheMetrics(reg prometheus.Registerer) *CacheMetrics {
+	if reg == nil {
+		defaultCacheMetricsOnce.Do(func() {
+			defaultCacheMetrics = NewCacheMetrics(prometheus.DefaultRegisterer)
+		})
+		return defaultCacheMetrics
+	}
+
+	m := &CacheMetrics{
+		CacheLength: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "statsd_metric_mapper_cache_length",
+				Help: "The count of unique metrics currently cached.",
+			},
+		),
+		CacheGetsTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_metric_mapper_cache_gets_total",
+				Help: "The count of total metric cache gets.",
+			},
+		),
+		CacheHitsTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_metric_mapper_cache_hits_total",
+				Help: "The count of total metric cache hits.",
+			},
+		),
+	}
+	m.CacheLength = register(reg, m.CacheLength).(prometheus.Gauge)
+	m.CacheGetsTotal = register(reg, m.CacheGetsTotal).(prometheus.Counter)
+	m.CacheHitsTotal = register(reg, m.CacheHitsTotal).(prometheus.Counter)
+	return m
+}
+
+// register registers c with reg, or returns the collector that is already
+// registered in its place.
+func register(reg prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
 type cacheOptions struct {
 	cacheType string
 }
@@ -67,26 +107,27 @@ type MetricMapperCache interface {
 
 type MetricMapperLRUCache struct {
 	MetricMapperCache
-	cache *lru.Cache
+	cache   *lru.Cache
+	metrics *CacheMetrics
 }
 
 type MetricMapperNoopCache struct {
 	MetricMapperCache
 }
 
-func NewMetricMapperCache(size int) (*MetricMapperLRUCache, error) {
-	cacheLength.Set(0)
+func NewMetricMapperCache(size int, metrics *CacheMetrics) (*MetricMapperLRUCache, error) {
+	metrics.CacheLength.Set(0)
 	cache, err := lru.New(size)
 	if err != nil {
 		return &MetricMapperLRUCache{}, err
 	}
-	return &MetricMapperLRUCache{cache: cache}, nil
+	return &MetricMapperLRUCache{cache: cache, metrics: metrics}, nil
 }
 
 func (m *MetricMapperLRUCache) Get(metricString string, metricType MetricType) (*MetricMapperCacheResult, bool) {
-	cacheGetsTotal.Inc()
+	m.metrics.CacheGetsTotal.Inc()
 	if result, ok := m.cache.Get(formatKey(metricString, metricType)); ok {
-		cacheHitsTotal.Inc()
+		m.metrics.CacheHitsTotal.Inc()
 		return result.(*MetricMapperCacheResult), true
 	} else {
 		return nil, false
@@ -104,15 +145,15 @@ func (m *MetricMapperLRUCache) AddMiss(metricString string, metricType MetricTyp
 }
 
 func (m *MetricMapperLRUCache) trackCacheLength() {
-	cacheLength.Set(float64(m.cache.Len()))
+	m.metrics.CacheLength.Set(float64(m.cache.Len()))
 }
 
 func formatKey(metricString string, metricType MetricType) string {
 	return string(metricType) + "." + metricString
 }
 
-func NewMetricMapperNoopCache() *MetricMapperNoopCache {
-	cacheLength.Set(0)
+func NewMetricMapperNoopCache(metrics *CacheMetrics) *MetricMapperNoopCache {
+	metrics.CacheLength.Set(0)
 	return &MetricMapperNoopCache{}
 }
 
@@ -130,16 +171,18 @@ func (m *MetricMapperNoopCache) AddMiss(metricString string, metricType MetricTy
 
 type MetricMapperRRCache struct {
 	MetricMapperCache
-	lock  sync.RWMutex
-	size  int
-	items map[string]*MetricMapperCacheResult
+	lock    sync.RWMutex
+	size    int
+	items   map[string]*MetricMapperCacheResult
+	metrics *CacheMetrics
 }
 
-func NewMetricMapperRRCache(size int) (*MetricMapperRRCache, error) {
-	cacheLength.Set(0)
+func NewMetricMapperRRCache(size int, metrics *CacheMetrics) (*MetricMapperRRCache, error) {
+	metrics.CacheLength.Set(0)
 	c := &MetricMapperRRCache{
-		items: make(map[string]*MetricMapperCacheResult, size+1),
-		size:  size,
+		items:   make(map[string]*MetricMapperCacheResult, size+1),
+		size:    size,
+		metrics: metrics,
 	}
 	return c, nil
 }
@@ -188,11 +231,5 @@ func (m *MetricMapperRRCache) trackCacheLength() {
 	m.lock.RLock()
 	length := len(m.items)
 	m.lock.RUnlock()
-	cacheLength.Set(float64(length))
-}
-
-func init() {
-	prometheus.MustRegister(cacheLength)
-	prometheus.MustRegister(cacheGetsTotal)
-	prometheus.MustRegister(cacheHitsTotal)
+	m.metrics.CacheLength.Set(float64(length))
 }
@@ -16,13 +16,17 @@ package mapper
 import "time"
 
 type mapperConfigDefaults struct {
-	ObserverType        ObserverType      `yaml:"observer_type"`
-	TimerType           ObserverType      `yaml:"timer_type,omitempty"` // DEPRECATED - field only present to preserve backwards compatibility in configs. Always empty
-	Buckets             []float64         `yaml:"buckets"`
-	Quantiles           []metricObjective `yaml:"quantiles"`
-	MatchType           MatchType         `yaml:"match_type"`
-	GlobDisableOrdering bool              `yaml:"glob_disable_ordering"`
-	Ttl                 time.Duration     `yaml:"ttl"`
+	ObserverType           ObserverType      `yaml:"observer_type"`
+	TimerType              ObserverType      `yaml:"timer_type,omitempty"` // DEPRECATED - field only present to preserve backwards compatibility in configs. Always empty
+	Buckets                []float64         `yaml:"buckets"`
+	Quantiles              []metricObjective `yaml:"quantiles"`
+	MatchType              MatchType         `yaml:"match_type"`
+	GlobDisableOrdering    bool              `yaml:"glob_disable_ordering"`
+	GlobSeparator          string            `yaml:"glob_separator"`
+	Ttl                    time.Duration     `yaml:"ttl"`
+	SetOptions             SetOptions        `yaml:"set_options"`
+	EventMetricName        string            `yaml:"event_metric_name"`
+	ServiceCheckMetricName string            `yaml:"service_check_metric_name"`
 }
 
 // UnmarshalYAML is a custom unmarshal function to allow use of deprecated config keys
@@ -40,7 +44,11 @@ func (d *mapperConfigDefaults) UnmarshalYAML(unmarshal func(interface{}) error)
 	d.Quantiles = tmp.Quantiles
 	d.MatchType = tmp.MatchType
 	d.GlobDisableOrdering = tmp.GlobDisableOrdering
+	d.GlobSeparator = tmp.GlobSeparator
 	d.Ttl = tmp.Ttl
+	d.SetOptions = tmp.SetOptions
+	d.EventMetricName = tmp.EventMetricName
+	d.ServiceCheckMetricName = tmp.ServiceCheckMetricName
 
 	// Use deprecated TimerType if necessary
 	if tmp.ObserverType == "" {
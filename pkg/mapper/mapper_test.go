@@ -14,8 +14,12 @@
 package mapper
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type mappings []struct {
@@ -29,6 +33,7 @@ type mappings []struct {
 	maxAge       time.Duration
 	ageBuckets   uint32
 	bufCap       uint32
+	setWindow    time.Duration
 }
 
 func TestMetricMapperYAML(t *testing.T) {
@@ -232,6 +237,240 @@ mappings:
 				},
 			},
 		},
+		//Config with extended globs
+		{
+			config: `
+mappings:
+- match: http.{get,head}.*
+  name: "http_reads"
+  labels:
+    path: "$1"
+- match: req_*_ms.*
+  name: "request_duration"
+  labels:
+    kind: "$1"
+    instance: "$2"
+- match: jobs.**.duration
+  name: "job_duration"
+  labels:
+    job: "$1"
+- match: "**.errors"
+  name: "errors_total"
+  labels:
+    source: "$1"
+- match: api.*
+  name: "api_requests"
+  labels:
+    endpoint: "$1"
+- match: cache.**
+  name: "cache_operations"
+  labels:
+    operation: "$1"
+- match: edge.**.{in,out}_*
+  name: "edge_traffic"
+  match_labels: ['env!="dev"']
+  labels:
+    path: "$1"
+    unit: "$2"
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "http.get.users",
+					name:         "http_reads",
+					labels: map[string]string{
+						"path": "users",
+					},
+				},
+				{
+					statsdMetric: "http.head.users",
+					name:         "http_reads",
+					labels: map[string]string{
+						"path": "users",
+					},
+				},
+				{
+					statsdMetric: "http.post.users",
+					notPresent:   true,
+				},
+				{
+					statsdMetric: "req_db_ms.primary",
+					name:         "request_duration",
+					labels: map[string]string{
+						"kind":     "db",
+						"instance": "primary",
+					},
+				},
+				{
+					statsdMetric: "jobs.duration",
+					name:         "job_duration",
+					labels: map[string]string{
+						"job": "",
+					},
+				},
+				{
+					statsdMetric: "jobs.backup.daily.duration",
+					name:         "job_duration",
+					labels: map[string]string{
+						"job": "backup.daily",
+					},
+				},
+				{
+					statsdMetric: "api.errors",
+					name:         "errors_total",
+					labels: map[string]string{
+						"source": "api",
+					},
+				},
+				{
+					statsdMetric: "api.users",
+					name:         "api_requests",
+					labels: map[string]string{
+						"endpoint": "users",
+					},
+				},
+				{
+					statsdMetric: "cache",
+					name:         "cache_operations",
+					labels: map[string]string{
+						"operation": "",
+					},
+				},
+				{
+					statsdMetric: "cache.get.hit",
+					name:         "cache_operations",
+					labels: map[string]string{
+						"operation": "get.hit",
+					},
+				},
+				{
+					statsdMetric: "edge.eu.west.in_bytes",
+					name:         "edge_traffic",
+					labels: map[string]string{
+						"path": "eu.west",
+						"unit": "bytes",
+					},
+				},
+				{
+					statsdMetric: "edge.out_packets",
+					name:         "edge_traffic",
+					labels: map[string]string{
+						"path": "",
+						"unit": "packets",
+					},
+				},
+			},
+		},
+		//Config with extended globs, disables ordering
+		{
+			config: `
+defaults:
+  glob_disable_ordering: true
+mappings:
+- match: "**.errors"
+  name: "errors_total"
+  labels:
+    source: "$1"
+- match: api.*
+  name: "api_requests"
+  labels:
+    endpoint: "$1"
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "api.errors",
+					name:         "api_requests",
+					labels: map[string]string{
+						"endpoint": "errors",
+					},
+				},
+				{
+					statsdMetric: "db.primary.errors",
+					name:         "errors_total",
+					labels: map[string]string{
+						"source": "db.primary",
+					},
+				},
+				{
+					statsdMetric: "api.users",
+					name:         "api_requests",
+					labels: map[string]string{
+						"endpoint": "users",
+					},
+				},
+			},
+		},
+		//Config with glob separators
+		{
+			config: `
+defaults:
+  glob_separator: /
+mappings:
+- match: "*.json"
+  glob_separator: .
+  name: "json_files"
+  labels:
+    file: "$1"
+- match: static/*
+  name: "static_files"
+  labels:
+    file: "$1"
+- match: api/*/requests
+  name: "api_requests"
+  labels:
+    version: "$1"
+- match: jobs::**::duration
+  glob_separator: "::"
+  name: "job_duration"
+  labels:
+    job: "$1"
+- match: edge/**
+  match_labels: ['env!="dev"']
+  name: "edge_requests"
+  labels:
+    path: "$1"
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "static/app.json",
+					name:         "json_files",
+					labels: map[string]string{
+						"file": "static/app",
+					},
+				},
+				{
+					statsdMetric: "static/app.css",
+					name:         "static_files",
+					labels: map[string]string{
+						"file": "app.css",
+					},
+				},
+				{
+					statsdMetric: "api/v1/requests",
+					name:         "api_requests",
+					labels: map[string]string{
+						"version": "v1",
+					},
+				},
+				{
+					statsdMetric: "api.v1.requests",
+					notPresent:   true,
+				},
+				{
+					statsdMetric: "jobs::backup::daily::duration",
+					name:         "job_duration",
+					labels: map[string]string{
+						"job": "backup::daily",
+					},
+				},
+				{
+					statsdMetric: "edge/eu/west",
+					name:         "edge_requests",
+					labels: map[string]string{
+						"path": "eu/west",
+					},
+				},
+			},
+		},
 		//Config with super sets, disables ordering
 		{
 			config: `
@@ -388,6 +627,183 @@ mappings:
 - match: test.*.*
   labels:
     this: "$1"
+  `,
+			configBad: true,
+		},
+		// Config with an unquoted label matcher value.
+		{
+			config: `---
+mappings:
+- match: test.*.*
+  name: "foo"
+  match_labels: ['env=dev']
+  `,
+			configBad: true,
+		},
+		// Config with an invalid label matcher regex.
+		{
+			config: `---
+mappings:
+- match: test.*.*
+  name: "foo"
+  match_labels: ['env=~"("']
+  `,
+			configBad: true,
+		},
+		// Config with an unknown template function.
+		{
+			config: `---
+mappings:
+- match: test.*
+  name: 'foo_${1 | camel}'
+  `,
+			configBad: true,
+		},
+		// Config with a template function with missing arguments.
+		{
+			config: `---
+mappings:
+- match: test.*
+  name: "foo"
+  labels:
+    path: '${1 | replace "-"}'
+  `,
+			configBad: true,
+		},
+		// Config with an invalid truncate length.
+		{
+			config: `---
+mappings:
+- match: test\.(.*)
+  match_type: regex
+  name: 'foo_${1 | truncate -1}'
+  `,
+			configBad: true,
+		},
+		// Config with an unterminated template reference.
+		{
+			config: `---
+mappings:
+- match: test.*
+  name: "foo"
+  labels:
+    path: '${1 | lower'
+  `,
+			configBad: true,
+		},
+		// Config with *** in a glob.
+		{
+			config: `---
+mappings:
+- match: "test.***"
+  name: "foo"
+  `,
+			configBad: true,
+		},
+		// Config with ** within a glob field.
+		{
+			config: `---
+mappings:
+- match: "test.a**b"
+  name: "foo"
+  `,
+			configBad: true,
+		},
+		// Config with a single glob alternative.
+		{
+			config: `---
+mappings:
+- match: "test.{a}"
+  name: "foo"
+  `,
+			configBad: true,
+		},
+		// Config with a dot in glob alternatives.
+		{
+			config: `---
+mappings:
+- match: "test.{a,b.c}"
+  name: "foo"
+  `,
+			configBad: true,
+		},
+		// Config with nested glob alternatives.
+		{
+			config: `---
+mappings:
+- match: "test.{a,{b,c}}"
+  name: "foo"
+  `,
+			configBad: true,
+		},
+		// Config with a wildcard glob separator.
+		{
+			config: `---
+mappings:
+- glob_separator: "*"
+  match: test*foo
+  name: "foo"
+  `,
+			configBad: true,
+		},
+		// Config with an alphanumeric glob separator.
+		{
+			config: `---
+mappings:
+- glob_separator: x
+  match: testxfoo
+  name: "foo"
+  `,
+			configBad: true,
+		},
+		// Config with a match without the glob separator.
+		{
+			config: `---
+mappings:
+- glob_separator: /
+  match: test.*
+  name: "foo"
+  `,
+			configBad: true,
+		},
+		// Config with an invalid relabeling rule.
+		{
+			config: `---
+mappings:
+- match: test.*.*
+  name: "foo"
+  relabel_configs:
+  - action: hashmod
+    target_label: shard
+  `,
+			configBad: true,
+		},
+		// Config with an invalid global relabeling rule.
+		{
+			config: `---
+relabel_configs:
+- action: unknown
+  `,
+			configBad: true,
+		},
+		// Config with a null global relabeling rule.
+		{
+			config: `---
+relabel_configs:
+-
+  `,
+			configBad: true,
+		},
+		// Config with a null relabeling rule in a mapping.
+		{
+			config: `---
+mappings:
+- match: test.*.*
+  name: "foo"
+  relabel_configs:
+  - action: drop
+    source_labels: [foo]
+  -
   `,
 			configBad: true,
 		},
@@ -702,6 +1118,82 @@ mappings:
 				},
 			},
 		},
+		// Config with set metric type and set options.
+		{
+			config: `---
+defaults:
+  set_options:
+    window: 30s
+mappings:
+- match: test.users.*
+  name: "test_users"
+  match_metric_type: set
+  labels:
+    site: "$1"
+- match: test.sessions.*
+  name: "test_sessions"
+  match_metric_type: set
+  set_options:
+    window: 5m
+    precision: 14
+    `,
+			mappings: mappings{
+				{
+					statsdMetric: "test.users.web",
+					name:         "test_users",
+					labels:       map[string]string{"site": "web"},
+					metricType:   MetricTypeSet,
+					setWindow:    30 * time.Second,
+				},
+				{
+					statsdMetric: "test.sessions.web",
+					name:         "test_sessions",
+					metricType:   MetricTypeSet,
+					setWindow:    5 * time.Minute,
+				},
+			},
+		},
+		// Config with invalid set precision.
+		{
+			config: `---
+mappings:
+- match: test.users.*
+  name: "test_users"
+  set_options:
+    precision: 30
+    `,
+			configBad: true,
+		},
+		// Config with event metric type.
+		{
+			config: `---
+mappings:
+- match: deploy.*
+  name: "deploys_total"
+  match_metric_type: event
+  labels:
+    service: "$1"
+    `,
+			mappings: mappings{
+				{
+					statsdMetric: "deploy.api",
+					name:         "deploys_total",
+					labels:       map[string]string{"service": "api"},
+					metricType:   MetricTypeEvent,
+				},
+			},
+		},
+		// Config with invalid event metric name.
+		{
+			config: `---
+defaults:
+  event_metric_name: "not a metric name"
+mappings:
+- match: test.*
+  name: "test"
+    `,
+			configBad: true,
+		},
 		//Config with uncompilable regex.
 		{
 			config: `---
@@ -982,6 +1474,216 @@ mappings:
 			if mapping.bufCap != 0 && mapping.bufCap != m.SummaryOptions.BufCap {
 				t.Fatalf("%d.%q: Expected max age %v, got %v", i, metric, mapping.bufCap, m.SummaryOptions.BufCap)
 			}
+			if mapping.setWindow != 0 && mapping.setWindow != m.SetOptions.Window {
+				t.Fatalf("%d.%q: Expected set window %v, got %v", i, metric, mapping.setWindow, m.SetOptions.Window)
+			}
+		}
+	}
+}
+
+// TestLabelMatchers checks that the same metric is mapped depending on its
+// tags, also when the mapping is cached.
+func TestLabelMatchers(t *testing.T) {
+	config := `---
+mappings:
+- match: http.request
+  name: "payments_requests"
+  match_labels: ['service="payments"']
+- match: "*.request"
+  name: "${1}_dev_requests"
+  match_labels: ['env=~"dev|test"', 'service!="payments"']
+- match: http.request
+  name: "requests"
+- match: http.request
+  name: "late_requests"
+  match_labels: ['service="late"']
+- match: api\.(.*)
+  match_type: regex
+  name: "api_${1}"
+  match_labels: ['region !~ "eu-.*"']
+- match: db\..*
+  match_type: regex
+  name: "dev_db"
+  match_labels: ['env="dev"']
+- match: db.*
+  name: "db_${1}"
+- match: db\.(.*)
+  match_type: regex
+  name: "late_db_${1}"
+  match_labels: ['env="test"']
+`
+	scenarios := []struct {
+		statsdMetric string
+		tags         map[string]string
+		name         string
+	}{
+		{statsdMetric: "http.request", tags: map[string]string{"service": "payments"}, name: "payments_requests"},
+		{statsdMetric: "http.request", tags: map[string]string{"service": "orders"}, name: "requests"},
+		{statsdMetric: "http.request", tags: map[string]string{"service": "orders", "env": "test"}, name: "http_dev_requests"},
+		{statsdMetric: "http.request", name: "requests"},
+		// Mappings with label matchers after a matching one are not used.
+		{statsdMetric: "http.request", tags: map[string]string{"service": "late"}, name: "requests"},
+		{statsdMetric: "api.users", tags: map[string]string{"region": "us-east-1"}, name: "api_users"},
+		// Not mapped.
+		{statsdMetric: "api.users", tags: map[string]string{"region": "eu-west-1"}},
+		{statsdMetric: "api.users", name: "api_users"},
+		// A regex mapping with label matchers before a glob mapping takes
+		// precedence, one after it does not.
+		{statsdMetric: "db.query", tags: map[string]string{"env": "dev"}, name: "dev_db"},
+		{statsdMetric: "db.query", tags: map[string]string{"env": "test"}, name: "db_query"},
+		{statsdMetric: "db.query", name: "db_query"},
+	}
+
+	for _, disableOrdering := range []bool{false, true} {
+		mapper := MetricMapper{}
+		yaml := config
+		if disableOrdering {
+			yaml = strings.Replace(config, "---\n", "---\ndefaults:\n  glob_disable_ordering: true\n", 1)
+		}
+		if err := mapper.InitFromYAMLString(yaml, 1000); err != nil {
+			t.Fatalf("Config load error: %s %s", yaml, err)
+		}
+		// The second round is served from the cache.
+		for round := 0; round < 2; round++ {
+			for _, s := range scenarios {
+				if disableOrdering && s.name == "http_dev_requests" {
+					// Without ordering, the first glob match found wins.
+					continue
+				}
+				m, _, present := mapper.GetMappingWithLabels(s.statsdMetric, MetricTypeCounter, s.tags)
+				if s.name == "" {
+					if present {
+						t.Fatalf("%v %d. %s %v: Expected no mapping, got %s", disableOrdering, round, s.statsdMetric, s.tags, m.Name)
+					}
+					continue
+				}
+				if !present || m.Name != s.name {
+					t.Fatalf("%v %d. %s %v: Expected %s, got %v", disableOrdering, round, s.statsdMetric, s.tags, s.name, m)
+				}
+			}
+		}
+	}
+}
+
+// TestTagTemplates checks that name and label templates of glob and regex
+// mappings are expanded with tag values and defaults, also when the mapping
+// is cached.
+func TestTagTemplates(t *testing.T) {
+	config := `---
+mappings:
+- match: http.*
+  name: "${tag.service}_${1}_total"
+  labels:
+    team: "${tag.owner:-unknown}"
+    owner_site: "${tag.owner}-${tag.site:-none}"
+- match: api\.(.*)
+  match_type: regex
+  name: "api_${1}_${tag.version:-v1}"
+  labels:
+    client: "${tag.client}"
+`
+	scenarios := []struct {
+		statsdMetric string
+		tags         map[string]string
+		name         string
+		labels       prometheus.Labels
+	}{
+		{
+			statsdMetric: "http.requests",
+			tags:         map[string]string{"service": "payments", "owner": "a", "site": "x"},
+			name:         "payments_requests_total",
+			labels:       prometheus.Labels{"team": "a", "owner_site": "a-x"},
+		}, {
+			statsdMetric: "http.requests",
+			tags:         map[string]string{"service": "orders", "owner": ""},
+			name:         "orders_requests_total",
+			labels:       prometheus.Labels{"team": "unknown", "owner_site": "-none"},
+		}, {
+			statsdMetric: "api.users",
+			tags:         map[string]string{"version": "v2", "client": "$1"},
+			name:         "api_users_v2",
+			labels:       prometheus.Labels{"client": "$1"},
+		}, {
+			statsdMetric: "api.users",
+			name:         "api_users_v1",
+			labels:       prometheus.Labels{"client": ""},
+		},
+	}
+
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString(config, 1000); err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+	// The second round is served from the cache.
+	for round := 0; round < 2; round++ {
+		for _, s := range scenarios {
+			m, labels, present := mapper.GetMappingWithLabels(s.statsdMetric, MetricTypeCounter, s.tags)
+			if !present || m.Name != s.name {
+				t.Fatalf("%d. %s %v: Expected %s, got %v", round, s.statsdMetric, s.tags, s.name, m)
+			}
+			if !reflect.DeepEqual(labels, s.labels) {
+				t.Fatalf("%d. %s %v: Expected labels %v, got %v", round, s.statsdMetric, s.tags, s.labels, labels)
+			}
+		}
+	}
+}
+
+// TestTemplateFunctions checks named capture groups and template functions
+// in the templates of glob and regex mappings.
+func TestTemplateFunctions(t *testing.T) {
+	config := `---
+mappings:
+- match: (?P<service>[a-z]+)\.(?P<method>[a-zA-Z]+)\.(.*)
+  match_type: regex
+  name: "${service}_requests_total"
+  labels:
+    method: '${method | lower}'
+    path: '${3 | trimPrefix "api-" | replace "-" "_"}'
+    missing: '${unknown | default "none"}'
+- match: job.*.*
+  name: 'job_${1 | trimSuffix "_test" | truncate 6}'
+  labels:
+    state: '${2 | upper}'
+    env: '${tag.env | upper | default "PROD"}'
+    price: '$$${2}'
+`
+	scenarios := []struct {
+		statsdMetric string
+		tags         map[string]string
+		name         string
+		labels       prometheus.Labels
+	}{
+		{
+			statsdMetric: "shop.GET.api-user-list",
+			name:         "shop_requests_total",
+			labels:       prometheus.Labels{"method": "get", "path": "user_list", "missing": "none"},
+		}, {
+			statsdMetric: "shop.get.cart",
+			name:         "shop_requests_total",
+			labels:       prometheus.Labels{"method": "get", "path": "cart", "missing": "none"},
+		}, {
+			statsdMetric: "job.backup_test.done",
+			name:         "job_backup",
+			labels:       prometheus.Labels{"state": "DONE", "env": "PROD", "price": "$done"},
+		}, {
+			statsdMetric: "job.compaction.failed",
+			tags:         map[string]string{"env": "dev"},
+			name:         "job_compac",
+			labels:       prometheus.Labels{"state": "FAILED", "env": "DEV", "price": "$failed"},
+		},
+	}
+
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+	for _, s := range scenarios {
+		m, labels, present := mapper.GetMappingWithLabels(s.statsdMetric, MetricTypeCounter, s.tags)
+		if !present || m.Name != s.name {
+			t.Fatalf("%s: Expected %s, got %v", s.statsdMetric, s.name, m)
+		}
+		if !reflect.DeepEqual(labels, s.labels) {
+			t.Fatalf("%s: Expected labels %v, got %v", s.statsdMetric, s.labels, labels)
 		}
 	}
 }
@@ -20,6 +20,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/prometheus/statsd_exporter/pkg/mapper/fsm"
+	"github.com/prometheus/statsd_exporter/pkg/relabel"
 )
 
 type MetricMapping struct {
@@ -35,12 +36,21 @@ type MetricMapping struct {
 	LegacyBuckets    []float64         `yaml:"buckets"`
 	LegacyQuantiles  []metricObjective `yaml:"quantiles"`
 	MatchType        MatchType         `yaml:"match_type"`
+	GlobSeparator    string            `yaml:"glob_separator"`
 	HelpText         string            `yaml:"help"`
 	Action           ActionType        `yaml:"action"`
 	MatchMetricType  MetricType        `yaml:"match_metric_type"`
 	Ttl              time.Duration     `yaml:"ttl"`
 	SummaryOptions   *SummaryOptions   `yaml:"summary_options"`
 	HistogramOptions *HistogramOptions `yaml:"histogram_options"`
+	SetOptions       *SetOptions       `yaml:"set_options"`
+	// MatchLabels are label matchers, such as env!="dev", that the tags of
+	// a metric must match in addition to its name.
+	MatchLabels   []string `yaml:"match_labels"`
+	labelMatchers []*labelMatcher
+	// RelabelConfigs are applied to the labels of the mapped metrics, with
+	// the metric name in the __name__ label.
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs"`
 }
 
 // UnmarshalYAML is a custom unmarshal function to allow use of deprecated config keys
@@ -60,12 +70,16 @@ func (m *MetricMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	m.LegacyBuckets = tmp.LegacyBuckets
 	m.LegacyQuantiles = tmp.LegacyQuantiles
 	m.MatchType = tmp.MatchType
+	m.GlobSeparator = tmp.GlobSeparator
 	m.HelpText = tmp.HelpText
 	m.Action = tmp.Action
 	m.MatchMetricType = tmp.MatchMetricType
 	m.Ttl = tmp.Ttl
 	m.SummaryOptions = tmp.SummaryOptions
 	m.HistogramOptions = tmp.HistogramOptions
+	m.SetOptions = tmp.SetOptions
+	m.MatchLabels = tmp.MatchLabels
+	m.RelabelConfigs = tmp.RelabelConfigs
 
 	// Use deprecated TimerType if necessary
 	if tmp.ObserverType == "" {
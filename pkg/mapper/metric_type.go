@@ -18,10 +18,13 @@ import "fmt"
 type MetricType string
 
 const (
-	MetricTypeCounter  MetricType = "counter"
-	MetricTypeGauge    MetricType = "gauge"
-	MetricTypeObserver MetricType = "observer"
-	MetricTypeTimer    MetricType = "timer" // DEPRECATED
+	MetricTypeCounter      MetricType = "counter"
+	MetricTypeGauge        MetricType = "gauge"
+	MetricTypeObserver     MetricType = "observer"
+	MetricTypeSet          MetricType = "set"
+	MetricTypeEvent        MetricType = "event"
+	MetricTypeServiceCheck MetricType = "service_check"
+	MetricTypeTimer        MetricType = "timer" // DEPRECATED
 )
 
 func (m *MetricType) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -39,6 +42,12 @@ func (m *MetricType) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		*m = MetricTypeObserver
 	case MetricTypeTimer:
 		*m = MetricTypeObserver
+	case MetricTypeSet:
+		*m = MetricTypeSet
+	case MetricTypeEvent:
+		*m = MetricTypeEvent
+	case MetricTypeServiceCheck:
+		*m = MetricTypeServiceCheck
 	default:
 		return fmt.Errorf("invalid metric type '%s'", v)
 	}
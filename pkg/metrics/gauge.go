@@ -0,0 +1,109 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TimestampedGaugeVec is a GaugeVec whose gauges can be exposed with the
+// timestamp sent by the client. Gauges without a timestamp are exposed as
+// usual.
+type TimestampedGaugeVec struct {
+	*prometheus.GaugeVec
+
+	mtx        sync.Mutex
+	timestamps map[prometheus.Metric]time.Time
+}
+
+// NewTimestampedGaugeVec creates a new TimestampedGaugeVec based on the
+// provided GaugeOpts and partitioned by the given label names.
+func NewTimestampedGaugeVec(opts prometheus.GaugeOpts, labelNames []string) *TimestampedGaugeVec {
+	return &TimestampedGaugeVec{
+		GaugeVec:   prometheus.NewGaugeVec(opts, labelNames),
+		timestamps: map[prometheus.Metric]time.Time{},
+	}
+}
+
+// GetMetricWith returns the gauge for the given labels, creating it if
+// necessary.
+func (v *TimestampedGaugeVec) GetMetricWith(labels prometheus.Labels) (*TimestampedGauge, error) {
+	g, err := v.GaugeVec.GetMetricWith(labels)
+	if err != nil {
+		return nil, err
+	}
+	return &TimestampedGauge{Gauge: g, vec: v}, nil
+}
+
+// Delete removes the gauge with the given labels and its timestamp.
+func (v *TimestampedGaugeVec) Delete(labels prometheus.Labels) bool {
+	if g, err := v.GaugeVec.GetMetricWith(labels); err == nil {
+		v.mtx.Lock()
+		delete(v.timestamps, g)
+		v.mtx.Unlock()
+	}
+	return v.GaugeVec.Delete(labels)
+}
+
+// Collect implements prometheus.Collector.
+func (v *TimestampedGaugeVec) Collect(ch chan<- prometheus.Metric) {
+	v.mtx.Lock()
+	if len(v.timestamps) == 0 {
+		v.mtx.Unlock()
+		v.GaugeVec.Collect(ch)
+		return
+	}
+	timestamps := make(map[prometheus.Metric]time.Time, len(v.timestamps))
+	for m, t := range v.timestamps {
+		timestamps[m] = t
+	}
+	v.mtx.Unlock()
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		v.GaugeVec.Collect(metrics)
+		close(metrics)
+	}()
+	for m := range metrics {
+		if t, ok := timestamps[m]; ok {
+			m = prometheus.NewMetricWithTimestamp(t, m)
+		}
+		ch <- m
+	}
+}
+
+func (v *TimestampedGaugeVec) setTimestamp(g prometheus.Gauge, t time.Time) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if t.IsZero() {
+		delete(v.timestamps, g)
+	} else {
+		v.timestamps[g] = t
+	}
+}
+
+// TimestampedGauge is a gauge in a TimestampedGaugeVec.
+type TimestampedGauge struct {
+	prometheus.Gauge
+	vec *TimestampedGaugeVec
+}
+
+// SetTimestamp sets the timestamp the gauge is exposed with. A zero time
+// exposes the gauge without a timestamp.
+func (g *TimestampedGauge) SetTimestamp(t time.Time) {
+	g.vec.setTimestamp(g.Gauge, t)
+}
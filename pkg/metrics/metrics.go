@@ -26,6 +26,7 @@ const (
 	GaugeMetricType
 	SummaryMetricType
 	HistogramMetricType
+	SetMetricType
 )
 
 type NameHash uint64
@@ -0,0 +1,80 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/hyperloglog"
+)
+
+// SetGauge counts the distinct members of a StatsD set seen in the current
+// window and exposes the estimate through a gauge. It is safe for concurrent
+// use.
+type SetGauge struct {
+	Gauge       prometheus.Gauge
+	Window      time.Duration
+	mtx         sync.Mutex
+	sketch      *hyperloglog.Sketch
+	windowStart time.Time
+}
+
+// NewSetGauge returns a SetGauge reporting to g. A zero window never resets
+// the count.
+func NewSetGauge(g prometheus.Gauge, window time.Duration, precision uint8) (*SetGauge, error) {
+	sketch, err := hyperloglog.New(precision)
+	if err != nil {
+		return nil, err
+	}
+	return &SetGauge{
+		Gauge:       g,
+		Window:      window,
+		sketch:      sketch,
+		windowStart: clock.Now(),
+	}, nil
+}
+
+// Add records a member of the set and updates the gauge.
+func (s *SetGauge) Add(member string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.roll()
+	s.sketch.Insert(member)
+	s.Gauge.Set(float64(s.sketch.Estimate()))
+}
+
+// Roll starts a new window and resets the gauge to zero if the current window
+// has elapsed.
+func (s *SetGauge) Roll() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.roll()
+}
+
+func (s *SetGauge) roll() {
+	if s.Window == 0 {
+		return
+	}
+	now := clock.Now()
+	if now.Sub(s.windowStart) < s.Window {
+		return
+	}
+	s.sketch.Reset()
+	s.windowStart = now
+	s.Gauge.Set(0)
+}
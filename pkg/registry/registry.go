@@ -15,10 +15,14 @@ package registry
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"hash"
 	"hash/fnv"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -39,47 +43,119 @@ func (u uncheckedCollector) Collect(c chan<- prometheus.Metric) {
 	u.c.Collect(c)
 }
 
+// registryShards is the number of parts the registry is split into. Every
+// part has its own lock, so that different metrics can be updated
+// concurrently.
+const registryShards = 64
+
+// ErrSeriesLimit is returned when an event would create a new series in a
+// registry that already holds SeriesLimit series.
+var ErrSeriesLimit = errors.New("series limit reached")
+
+type registryShard struct {
+	mtx     sync.Mutex
+	metrics map[string]metrics.Metric
+	// series is the number of series in the registry, shared by all parts.
+	series *int64
+}
+
+// Registry keeps track of the metrics created from events. It is safe for
+// concurrent use.
 type Registry struct {
-	Metrics map[string]metrics.Metric
-	Mapper  *mapper.MetricMapper
-	// The below value and label variables are allocated in the registry struct
-	// so that we don't have to allocate them every time have to compute a label
-	// hash.
-	ValueBuf, NameBuf bytes.Buffer
-	Hasher            hash.Hash64
+	Mapper *mapper.MetricMapper
+	// Registerer registers the metric vectors created from events.
+	Registerer prometheus.Registerer
+	// SeriesLimit is the maximum number of series. Events that would create
+	// more are rejected with ErrSeriesLimit. The limit is checked before a
+	// series is created, so concurrent events of different metrics can
+	// exceed it by a few series. Zero means no limit.
+	SeriesLimit int
+
+	shards [registryShards]registryShard
+	series int64
+	// Label hashers are pooled so that we don't have to allocate buffers
+	// every time we have to compute a label hash.
+	hashers sync.Pool
 }
 
-func NewRegistry(mapper *mapper.MetricMapper) *Registry {
-	return &Registry{
-		Metrics: make(map[string]metrics.Metric),
-		Mapper:  mapper,
-		Hasher:  fnv.New64a(),
-	}
+// labelHasher holds the buffers for hashing a label set.
+type labelHasher struct {
+	valueBuf, nameBuf bytes.Buffer
+	hasher            hash.Hash64
 }
 
-func (r *Registry) MetricConflicts(metricName string, metricType metrics.MetricType) bool {
-	vector, hasMetrics := r.Metrics[metricName]
-	if !hasMetrics {
-		// No metrics.Metric with this name exists
-		return false
+// NewRegistry creates a registry that registers the metrics it creates with
+// reg, or with the default registerer if reg is nil.
+func NewRegistry(reg prometheus.Registerer, mapper *mapper.MetricMapper) *Registry {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	r := &Registry{
+		Mapper:     mapper,
+		Registerer: reg,
+		hashers: sync.Pool{
+			New: func() interface{} {
+				return &labelHasher{hasher: fnv.New64a()}
+			},
+		},
+	}
+	for i := range r.shards {
+		r.shards[i].metrics = make(map[string]metrics.Metric)
+		r.shards[i].series = &r.series
+	}
+	return r
+}
+
+// Series returns the number of series in the registry.
+func (r *Registry) Series() int {
+	return int(atomic.LoadInt64(&r.series))
+}
+
+// checkSeriesLimit returns ErrSeriesLimit if no more series can be created.
+func (r *Registry) checkSeriesLimit() error {
+	if r.SeriesLimit > 0 && r.Series() >= r.SeriesLimit {
+		return ErrSeriesLimit
 	}
+	return nil
+}
 
-	if vector.MetricType == metricType {
-		// We've found a copy of this metrics.Metric with this type, but different
-		// labels, so it's safe to create a new one.
-		return false
+// shard returns the part of the registry that holds metricName. The _sum,
+// _count and _bucket series of a name are in the same part as the name
+// itself, so that conflicts with histograms and summaries are checked under
+// one lock.
+func (r *Registry) shard(metricName string) *registryShard {
+	for {
+		base := strings.TrimSuffix(metricName, "_sum")
+		base = strings.TrimSuffix(base, "_count")
+		base = strings.TrimSuffix(base, "_bucket")
+		if base == metricName {
+			break
+		}
+		metricName = base
+	}
+	// FNV-1a, inlined to avoid allocating.
+	h := uint32(2166136261)
+	for i := 0; i < len(metricName); i++ {
+		h ^= uint32(metricName[i])
+		h *= 16777619
 	}
+	return &r.shards[h%registryShards]
+}
 
-	// The metrics.Metric exists, but it's of a different type than we're trying to
-	// create.
-	return true
+// MetricConflicts reports whether a metric of a different type is registered
+// with the given name.
+func (r *Registry) MetricConflicts(metricName string, metricType metrics.MetricType) bool {
+	s := r.shard(metricName)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.metricConflicts(metricName, metricType)
 }
 
 func (r *Registry) StoreCounter(metricName string, hash metrics.LabelHash, labels prometheus.Labels, vec *prometheus.CounterVec, c prometheus.Counter, ttl time.Duration) {
 	r.Store(metricName, hash, labels, vec, c, metrics.CounterMetricType, ttl)
 }
 
-func (r *Registry) StoreGauge(metricName string, hash metrics.LabelHash, labels prometheus.Labels, vec *prometheus.GaugeVec, g prometheus.Gauge, ttl time.Duration) {
+func (r *Registry) StoreGauge(metricName string, hash metrics.LabelHash, labels prometheus.Labels, vec *metrics.TimestampedGaugeVec, g *metrics.TimestampedGauge, ttl time.Duration) {
 	r.Store(metricName, hash, labels, vec, g, metrics.GaugeMetricType, ttl)
 }
 
@@ -91,14 +167,50 @@ func (r *Registry) StoreSummary(metricName string, hash metrics.LabelHash, label
 	r.Store(metricName, hash, labels, vec, o, metrics.SummaryMetricType, ttl)
 }
 
+func (r *Registry) StoreSet(metricName string, hash metrics.LabelHash, labels prometheus.Labels, vec *prometheus.GaugeVec, s *metrics.SetGauge, ttl time.Duration) {
+	r.Store(metricName, hash, labels, vec, s, metrics.SetMetricType, ttl)
+}
+
 func (r *Registry) Store(metricName string, hash metrics.LabelHash, labels prometheus.Labels, vh metrics.VectorHolder, mh metrics.MetricHolder, metricType metrics.MetricType, ttl time.Duration) {
-	metric, hasMetrics := r.Metrics[metricName]
+	s := r.shard(metricName)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.store(metricName, hash, labels, vh, mh, metricType, ttl)
+}
+
+func (r *Registry) Get(metricName string, hash metrics.LabelHash, metricType metrics.MetricType) (metrics.VectorHolder, metrics.MetricHolder) {
+	s := r.shard(metricName)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.get(metricName, hash, metricType)
+}
+
+func (s *registryShard) metricConflicts(metricName string, metricType metrics.MetricType) bool {
+	vector, hasMetrics := s.metrics[metricName]
+	if !hasMetrics {
+		// No metrics.Metric with this name exists
+		return false
+	}
+
+	if vector.MetricType == metricType {
+		// We've found a copy of this metrics.Metric with this type, but different
+		// labels, so it's safe to create a new one.
+		return false
+	}
+
+	// The metrics.Metric exists, but it's of a different type than we're trying to
+	// create.
+	return true
+}
+
+func (s *registryShard) store(metricName string, hash metrics.LabelHash, labels prometheus.Labels, vh metrics.VectorHolder, mh metrics.MetricHolder, metricType metrics.MetricType, ttl time.Duration) {
+	metric, hasMetrics := s.metrics[metricName]
 	if !hasMetrics {
 		metric.MetricType = metricType
 		metric.Vectors = make(map[metrics.NameHash]*metrics.Vector)
 		metric.Metrics = make(map[metrics.ValueHash]*metrics.RegisteredMetric)
 
-		r.Metrics[metricName] = metric
+		s.metrics[metricName] = metric
 	}
 
 	v, ok := metric.Vectors[hash.Names]
@@ -119,6 +231,7 @@ func (r *Registry) Store(metricName string, hash metrics.LabelHash, labels prome
 		}
 		metric.Metrics[hash.Values] = rm
 		v.RefCount++
+		atomic.AddInt64(s.series, 1)
 		return
 	}
 	rm.LastRegisteredAt = now
@@ -126,8 +239,8 @@ func (r *Registry) Store(metricName string, hash metrics.LabelHash, labels prome
 	rm.TTL = ttl
 }
 
-func (r *Registry) Get(metricName string, hash metrics.LabelHash, metricType metrics.MetricType) (metrics.VectorHolder, metrics.MetricHolder) {
-	metric, hasMetric := r.Metrics[metricName]
+func (s *registryShard) get(metricName string, hash metrics.LabelHash, metricType metrics.MetricType) (metrics.VectorHolder, metrics.MetricHolder) {
+	metric, hasMetric := s.metrics[metricName]
 
 	if !hasMetric {
 		return nil, nil
@@ -153,15 +266,23 @@ func (r *Registry) Get(metricName string, hash metrics.LabelHash, metricType met
 
 func (r *Registry) GetCounter(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) (prometheus.Counter, error) {
 	hash, labelNames := r.HashLabels(labels)
-	vh, mh := r.Get(metricName, hash, metrics.CounterMetricType)
+	s := r.shard(metricName)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	vh, mh := s.get(metricName, hash, metrics.CounterMetricType)
 	if mh != nil {
 		return mh.(prometheus.Counter), nil
 	}
 
-	if r.MetricConflicts(metricName, metrics.CounterMetricType) {
+	if s.metricConflicts(metricName, metrics.CounterMetricType) {
 		return nil, fmt.Errorf("metric with name %s is already registered", metricName)
 	}
 
+	if err := r.checkSeriesLimit(); err != nil {
+		return nil, err
+	}
+
 	var counterVec *prometheus.CounterVec
 	if vh == nil {
 		metricsCount.WithLabelValues("counter").Inc()
@@ -170,7 +291,7 @@ func (r *Registry) GetCounter(metricName string, labels prometheus.Labels, help
 			Help: help,
 		}, labelNames)
 
-		if err := prometheus.Register(uncheckedCollector{counterVec}); err != nil {
+		if err := r.Registerer.Register(uncheckedCollector{counterVec}); err != nil {
 			return nil, err
 		}
 	} else {
@@ -182,67 +303,83 @@ func (r *Registry) GetCounter(metricName string, labels prometheus.Labels, help
 	if counter, err = counterVec.GetMetricWith(labels); err != nil {
 		return nil, err
 	}
-	r.StoreCounter(metricName, hash, labels, counterVec, counter, mapping.Ttl)
+	s.store(metricName, hash, labels, counterVec, counter, metrics.CounterMetricType, mapping.Ttl)
 
 	return counter, nil
 }
 
-func (r *Registry) GetGauge(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) (prometheus.Gauge, error) {
+func (r *Registry) GetGauge(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) (*metrics.TimestampedGauge, error) {
 	hash, labelNames := r.HashLabels(labels)
-	vh, mh := r.Get(metricName, hash, metrics.GaugeMetricType)
+	s := r.shard(metricName)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	vh, mh := s.get(metricName, hash, metrics.GaugeMetricType)
 	if mh != nil {
-		return mh.(prometheus.Gauge), nil
+		return mh.(*metrics.TimestampedGauge), nil
 	}
 
-	if r.MetricConflicts(metricName, metrics.GaugeMetricType) {
+	if s.metricConflicts(metricName, metrics.GaugeMetricType) {
 		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
 	}
 
-	var gaugeVec *prometheus.GaugeVec
+	if err := r.checkSeriesLimit(); err != nil {
+		return nil, err
+	}
+
+	var gaugeVec *metrics.TimestampedGaugeVec
 	if vh == nil {
 		metricsCount.WithLabelValues("gauge").Inc()
-		gaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		gaugeVec = metrics.NewTimestampedGaugeVec(prometheus.GaugeOpts{
 			Name: metricName,
 			Help: help,
 		}, labelNames)
 
-		if err := prometheus.Register(uncheckedCollector{gaugeVec}); err != nil {
+		if err := r.Registerer.Register(uncheckedCollector{gaugeVec}); err != nil {
 			return nil, err
 		}
 	} else {
-		gaugeVec = vh.(*prometheus.GaugeVec)
+		gaugeVec = vh.(*metrics.TimestampedGaugeVec)
 	}
 
-	var gauge prometheus.Gauge
+	var gauge *metrics.TimestampedGauge
 	var err error
 	if gauge, err = gaugeVec.GetMetricWith(labels); err != nil {
 		return nil, err
 	}
-	r.StoreGauge(metricName, hash, labels, gaugeVec, gauge, mapping.Ttl)
+	s.store(metricName, hash, labels, gaugeVec, gauge, metrics.GaugeMetricType, mapping.Ttl)
 
 	return gauge, nil
 }
 
 func (r *Registry) GetHistogram(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) (prometheus.Observer, error) {
 	hash, labelNames := r.HashLabels(labels)
-	vh, mh := r.Get(metricName, hash, metrics.HistogramMetricType)
+	s := r.shard(metricName)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	vh, mh := s.get(metricName, hash, metrics.HistogramMetricType)
 	if mh != nil {
 		return mh.(prometheus.Observer), nil
 	}
 
-	if r.MetricConflicts(metricName, metrics.HistogramMetricType) {
+	if s.metricConflicts(metricName, metrics.HistogramMetricType) {
 		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
 	}
-	if r.MetricConflicts(metricName+"_sum", metrics.HistogramMetricType) {
+	if s.metricConflicts(metricName+"_sum", metrics.HistogramMetricType) {
 		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
 	}
-	if r.MetricConflicts(metricName+"_count", metrics.HistogramMetricType) {
+	if s.metricConflicts(metricName+"_count", metrics.HistogramMetricType) {
 		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
 	}
-	if r.MetricConflicts(metricName+"_bucket", metrics.HistogramMetricType) {
+	if s.metricConflicts(metricName+"_bucket", metrics.HistogramMetricType) {
 		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
 	}
 
+	if err := r.checkSeriesLimit(); err != nil {
+		return nil, err
+	}
+
 	var histogramVec *prometheus.HistogramVec
 	if vh == nil {
 		metricsCount.WithLabelValues("histogram").Inc()
@@ -256,7 +393,7 @@ func (r *Registry) GetHistogram(metricName string, labels prometheus.Labels, hel
 			Buckets: buckets,
 		}, labelNames)
 
-		if err := prometheus.Register(uncheckedCollector{histogramVec}); err != nil {
+		if err := r.Registerer.Register(uncheckedCollector{histogramVec}); err != nil {
 			return nil, err
 		}
 	} else {
@@ -268,28 +405,36 @@ func (r *Registry) GetHistogram(metricName string, labels prometheus.Labels, hel
 	if observer, err = histogramVec.GetMetricWith(labels); err != nil {
 		return nil, err
 	}
-	r.StoreHistogram(metricName, hash, labels, histogramVec, observer, mapping.Ttl)
+	s.store(metricName, hash, labels, histogramVec, observer, metrics.HistogramMetricType, mapping.Ttl)
 
 	return observer, nil
 }
 
 func (r *Registry) GetSummary(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) (prometheus.Observer, error) {
 	hash, labelNames := r.HashLabels(labels)
-	vh, mh := r.Get(metricName, hash, metrics.SummaryMetricType)
+	s := r.shard(metricName)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	vh, mh := s.get(metricName, hash, metrics.SummaryMetricType)
 	if mh != nil {
 		return mh.(prometheus.Observer), nil
 	}
 
-	if r.MetricConflicts(metricName, metrics.SummaryMetricType) {
+	if s.metricConflicts(metricName, metrics.SummaryMetricType) {
 		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
 	}
-	if r.MetricConflicts(metricName+"_sum", metrics.SummaryMetricType) {
+	if s.metricConflicts(metricName+"_sum", metrics.SummaryMetricType) {
 		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
 	}
-	if r.MetricConflicts(metricName+"_count", metrics.SummaryMetricType) {
+	if s.metricConflicts(metricName+"_count", metrics.SummaryMetricType) {
 		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
 	}
 
+	if err := r.checkSeriesLimit(); err != nil {
+		return nil, err
+	}
+
 	var summaryVec *prometheus.SummaryVec
 	if vh == nil {
 		metricsCount.WithLabelValues("summary").Inc()
@@ -318,7 +463,7 @@ func (r *Registry) GetSummary(metricName string, labels prometheus.Labels, help
 			BufCap:     summaryOptions.BufCap,
 		}, labelNames)
 
-		if err := prometheus.Register(uncheckedCollector{summaryVec}); err != nil {
+		if err := r.Registerer.Register(uncheckedCollector{summaryVec}); err != nil {
 			return nil, err
 		}
 	} else {
@@ -330,33 +475,115 @@ func (r *Registry) GetSummary(metricName string, labels prometheus.Labels, help
 	if observer, err = summaryVec.GetMetricWith(labels); err != nil {
 		return nil, err
 	}
-	r.StoreSummary(metricName, hash, labels, summaryVec, observer, mapping.Ttl)
+	s.store(metricName, hash, labels, summaryVec, observer, metrics.SummaryMetricType, mapping.Ttl)
 
 	return observer, nil
 }
 
+func (r *Registry) GetSet(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, metricsCount *prometheus.GaugeVec) (*metrics.SetGauge, error) {
+	hash, labelNames := r.HashLabels(labels)
+	s := r.shard(metricName)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	vh, mh := s.get(metricName, hash, metrics.SetMetricType)
+	if mh != nil {
+		return mh.(*metrics.SetGauge), nil
+	}
+
+	if s.metricConflicts(metricName, metrics.SetMetricType) {
+		return nil, fmt.Errorf("metrics.Metric with name %s is already registered", metricName)
+	}
+
+	if err := r.checkSeriesLimit(); err != nil {
+		return nil, err
+	}
+
+	var gaugeVec *prometheus.GaugeVec
+	if vh == nil {
+		metricsCount.WithLabelValues("set").Inc()
+		gaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: metricName,
+			Help: help,
+		}, labelNames)
+
+		if err := r.Registerer.Register(uncheckedCollector{gaugeVec}); err != nil {
+			return nil, err
+		}
+	} else {
+		gaugeVec = vh.(*prometheus.GaugeVec)
+	}
+
+	setOptions := r.Mapper.Defaults.SetOptions
+	if mapping.SetOptions != nil {
+		setOptions = *mapping.SetOptions
+	}
+	// In the case of no mapping file, explicitly use the default set options
+	if setOptions.Precision == 0 {
+		setOptions = mapper.DefaultSetOptions
+	}
+
+	gauge, err := gaugeVec.GetMetricWith(labels)
+	if err != nil {
+		return nil, err
+	}
+	set, err := metrics.NewSetGauge(gauge, setOptions.Window, setOptions.Precision)
+	if err != nil {
+		return nil, err
+	}
+	s.store(metricName, hash, labels, gaugeVec, set, metrics.SetMetricType, mapping.Ttl)
+
+	return set, nil
+}
+
+// RollSetWindows resets the sets whose window has elapsed, so that sets
+// without new members report zero distinct values for the new window.
+func (r *Registry) RollSetWindows() {
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mtx.Lock()
+		for _, metric := range s.metrics {
+			if metric.MetricType != metrics.SetMetricType {
+				continue
+			}
+			for _, rm := range metric.Metrics {
+				rm.Metric.(*metrics.SetGauge).Roll()
+			}
+		}
+		s.mtx.Unlock()
+	}
+}
+
 func (r *Registry) RemoveStaleMetrics() {
 	now := clock.Now()
 	// delete timeseries with expired ttl
-	for _, metric := range r.Metrics {
-		for hash, rm := range metric.Metrics {
-			if rm.TTL == 0 {
-				continue
-			}
-			if rm.LastRegisteredAt.Add(rm.TTL).Before(now) {
-				metric.Vectors[rm.VecKey].Holder.Delete(rm.Labels)
-				metric.Vectors[rm.VecKey].RefCount--
-				delete(metric.Metrics, hash)
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mtx.Lock()
+		for _, metric := range s.metrics {
+			for hash, rm := range metric.Metrics {
+				if rm.TTL == 0 {
+					continue
+				}
+				if rm.LastRegisteredAt.Add(rm.TTL).Before(now) {
+					metric.Vectors[rm.VecKey].Holder.Delete(rm.Labels)
+					metric.Vectors[rm.VecKey].RefCount--
+					delete(metric.Metrics, hash)
+					atomic.AddInt64(s.series, -1)
+				}
 			}
 		}
+		s.mtx.Unlock()
 	}
 }
 
 // Calculates a hash of both the label names and the label names and values.
 func (r *Registry) HashLabels(labels prometheus.Labels) (metrics.LabelHash, []string) {
-	r.Hasher.Reset()
-	r.NameBuf.Reset()
-	r.ValueBuf.Reset()
+	h := r.hashers.Get().(*labelHasher)
+	defer r.hashers.Put(h)
+	h.hasher.Reset()
+	h.nameBuf.Reset()
+	h.valueBuf.Reset()
 	labelNames := make([]string, 0, len(labels))
 
 	for labelName := range labels {
@@ -364,22 +591,22 @@ func (r *Registry) HashLabels(labels prometheus.Labels) (metrics.LabelHash, []st
 	}
 	sort.Strings(labelNames)
 
-	r.ValueBuf.WriteByte(model.SeparatorByte)
+	h.valueBuf.WriteByte(model.SeparatorByte)
 	for _, labelName := range labelNames {
-		r.ValueBuf.WriteString(labels[labelName])
-		r.ValueBuf.WriteByte(model.SeparatorByte)
+		h.valueBuf.WriteString(labels[labelName])
+		h.valueBuf.WriteByte(model.SeparatorByte)
 
-		r.NameBuf.WriteString(labelName)
-		r.NameBuf.WriteByte(model.SeparatorByte)
+		h.nameBuf.WriteString(labelName)
+		h.nameBuf.WriteByte(model.SeparatorByte)
 	}
 
 	lh := metrics.LabelHash{}
-	r.Hasher.Write(r.NameBuf.Bytes())
-	lh.Names = metrics.NameHash(r.Hasher.Sum64())
+	h.hasher.Write(h.nameBuf.Bytes())
+	lh.Names = metrics.NameHash(h.hasher.Sum64())
 
 	// Now add the values to the names we've already hashed.
-	r.Hasher.Write(r.ValueBuf.Bytes())
-	lh.Values = metrics.ValueHash(r.Hasher.Sum64())
+	h.hasher.Write(h.valueBuf.Bytes())
+	lh.Values = metrics.ValueHash(h.hasher.Sum64())
 
 	return lh, labelNames
 }
@@ -0,0 +1,270 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+func newTestRegistry() (*Registry, *prometheus.GaugeVec) {
+	metricsCount := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "metrics_total"}, []string{"type"})
+	return NewRegistry(prometheus.NewRegistry(), &mapper.MetricMapper{}), metricsCount
+}
+
+// TestRegistryConcurrentTypeConflicts creates counters and gauges of the same
+// names from many goroutines. Each name must end up with a single type.
+func TestRegistryConcurrentTypeConflicts(t *testing.T) {
+	r, metricsCount := newTestRegistry()
+	mapping := &mapper.MetricMapping{}
+
+	const names = 100
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		counters = map[string]int{}
+		gauges   = map[string]int{}
+	)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < names; i++ {
+				name := fmt.Sprintf("metric_%d", i)
+				labels := prometheus.Labels{"goroutine": fmt.Sprint(g % 2)}
+				var err error
+				if g%2 == 0 {
+					_, err = r.GetCounter(name, labels, "help", mapping, metricsCount)
+				} else {
+					_, err = r.GetGauge(name, labels, "help", mapping, metricsCount)
+				}
+				if err != nil {
+					continue
+				}
+				mtx.Lock()
+				if g%2 == 0 {
+					counters[name]++
+				} else {
+					gauges[name]++
+				}
+				mtx.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for i := 0; i < names; i++ {
+		name := fmt.Sprintf("metric_%d", i)
+		switch {
+		case counters[name] > 0 && gauges[name] > 0:
+			t.Fatalf("%s: Expected a single type, got %d counters and %d gauges", name, counters[name], gauges[name])
+		case counters[name]+gauges[name] != 4:
+			t.Fatalf("%s: Expected 4 successful calls, got %d counters and %d gauges", name, counters[name], gauges[name])
+		}
+	}
+	if got := r.Series(); got != names {
+		t.Fatalf("Expected %d series, got %d", names, got)
+	}
+}
+
+// TestRegistryHistogramConflicts checks that the series of a histogram
+// conflict with metrics of other types, which the sharding keeps in the same
+// part of the registry.
+func TestRegistryHistogramConflicts(t *testing.T) {
+	r, metricsCount := newTestRegistry()
+	mapping := &mapper.MetricMapping{HistogramOptions: &mapper.HistogramOptions{Buckets: []float64{1}}}
+
+	for i, suffix := range []string{"", "_sum", "_count", "_bucket"} {
+		name := fmt.Sprintf("histogram_%d", i)
+		if _, err := r.GetCounter(name+suffix, nil, "help", mapping, metricsCount); err != nil {
+			t.Fatalf("%s: Unexpected error: %v", name+suffix, err)
+		}
+		if _, err := r.GetHistogram(name, nil, "help", mapping, metricsCount); err == nil {
+			t.Fatalf("%s: Expected a conflict with the counter %s", name, name+suffix)
+		}
+	}
+}
+
+func TestRegistryLabelSets(t *testing.T) {
+	r, metricsCount := newTestRegistry()
+	mapping := &mapper.MetricMapping{}
+
+	a, err := r.GetCounter("requests", prometheus.Labels{"a": "1"}, "help", mapping, metricsCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetCounter("requests", prometheus.Labels{"b": "1"}, "help", mapping, metricsCount); err != nil {
+		t.Fatalf("Expected a counter with other label names, got %v", err)
+	}
+	again, err := r.GetCounter("requests", prometheus.Labels{"a": "1"}, "help", mapping, metricsCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != a {
+		t.Fatal("Expected the same counter for the same labels")
+	}
+	if got := r.Series(); got != 2 {
+		t.Fatalf("Expected 2 series, got %d", got)
+	}
+}
+
+func TestRegistrySeriesLimit(t *testing.T) {
+	r, metricsCount := newTestRegistry()
+	r.SeriesLimit = 10
+	mapping := &mapper.MetricMapping{}
+
+	// The series of one metric are created under one lock, so the limit is
+	// exact.
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		created int
+		limited int
+	)
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			_, err := r.GetCounter("limited", prometheus.Labels{"id": fmt.Sprint(g)}, "help", mapping, metricsCount)
+			mtx.Lock()
+			defer mtx.Unlock()
+			switch err {
+			case nil:
+				created++
+			case ErrSeriesLimit:
+				limited++
+			default:
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if created != 10 || limited != 40 {
+		t.Fatalf("Expected 10 series and 40 rejected, got %d and %d", created, limited)
+	}
+	if got := r.Series(); got != 10 {
+		t.Fatalf("Expected 10 series, got %d", got)
+	}
+	if _, err := r.GetGauge("other", nil, "help", mapping, metricsCount); err != ErrSeriesLimit {
+		t.Fatalf("Expected the limit to apply to all metrics, got %v", err)
+	}
+
+	// Existing series can still be updated.
+	ids := 0
+	for g := 0; g < 50; g++ {
+		if _, err := r.GetCounter("limited", prometheus.Labels{"id": fmt.Sprint(g)}, "help", mapping, metricsCount); err == nil {
+			ids++
+		}
+	}
+	if ids != 10 {
+		t.Fatalf("Expected the 10 existing series to be returned, got %d", ids)
+	}
+}
+
+func TestRegistryRemoveStaleMetrics(t *testing.T) {
+	defer func() { clock.ClockInstance = nil }()
+	clock.ClockInstance = &clock.Clock{Instant: time.Unix(0, 0)}
+
+	r, metricsCount := newTestRegistry()
+	r.SeriesLimit = 2
+	expiring := &mapper.MetricMapping{Ttl: time.Second}
+	forever := &mapper.MetricMapping{}
+
+	stale, err := r.GetCounter("expiring", prometheus.Labels{"a": "1"}, "help", expiring, metricsCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetCounter("forever", nil, "help", forever, metricsCount); err != nil {
+		t.Fatal(err)
+	}
+
+	// Series are kept while they are updated within their TTL.
+	clock.ClockInstance.Instant = time.Unix(0, 0).Add(800 * time.Millisecond)
+	if _, err := r.GetCounter("expiring", prometheus.Labels{"a": "1"}, "help", expiring, metricsCount); err != nil {
+		t.Fatal(err)
+	}
+	clock.ClockInstance.Instant = time.Unix(1, 500*int64(time.Millisecond))
+	r.RemoveStaleMetrics()
+	if got := r.Series(); got != 2 {
+		t.Fatalf("Expected 2 series, got %d", got)
+	}
+
+	clock.ClockInstance.Instant = time.Unix(2, 0)
+	r.RemoveStaleMetrics()
+	if got := r.Series(); got != 1 {
+		t.Fatalf("Expected the expired series to be removed, got %d series", got)
+	}
+
+	// The removed series no longer counts towards the limit, and is created
+	// anew.
+	fresh, err := r.GetCounter("expiring", prometheus.Labels{"a": "1"}, "help", expiring, metricsCount)
+	if err != nil {
+		t.Fatalf("Expected the series to be created again, got %v", err)
+	}
+	if fresh == stale {
+		t.Fatal("Expected a new counter for the removed series")
+	}
+}
+
+// TestRegistryConcurrentRemoveStaleMetrics removes expired series while
+// others are created, to be run with -race.
+func TestRegistryConcurrentRemoveStaleMetrics(t *testing.T) {
+	r, metricsCount := newTestRegistry()
+	mapping := &mapper.MetricMapping{Ttl: time.Nanosecond}
+
+	done := make(chan struct{})
+	removed := make(chan struct{})
+	go func() {
+		defer close(removed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				r.RemoveStaleMetrics()
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				name := fmt.Sprintf("metric_%d", i%10)
+				if _, err := r.GetCounter(name, prometheus.Labels{"id": fmt.Sprint(i % 7)}, "help", mapping, metricsCount); err != nil {
+					t.Errorf("Unexpected error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-removed
+
+	time.Sleep(time.Millisecond)
+	r.RemoveStaleMetrics()
+	if got := r.Series(); got != 0 {
+		t.Fatalf("Expected all series to expire, got %d", got)
+	}
+}
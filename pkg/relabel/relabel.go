@@ -0,0 +1,269 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package relabel applies Prometheus relabeling rules to the labels of
+// mapped metrics. The rules have the semantics of the metric_relabel_configs
+// of Prometheus, with the metric name in the __name__ label.
+package relabel
+
+import (
+	"crypto/md5"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+var relabelTarget = regexp.MustCompile(`^(?:(?:[a-zA-Z_]|\$(?:\{\w+\}|\w+))+\w*)+$`)
+
+// Action is the action to be performed on relabeling.
+type Action string
+
+const (
+	// Replace performs a regex replacement.
+	Replace Action = "replace"
+	// Keep drops metrics whose concatenated source labels do not match the
+	// regex.
+	Keep Action = "keep"
+	// Drop drops metrics whose concatenated source labels match the regex.
+	Drop Action = "drop"
+	// HashMod sets a label to the modulus of a hash of the concatenated
+	// source labels.
+	HashMod Action = "hashmod"
+	// LabelMap copies labels whose names match the regex to the names given
+	// by the replacement.
+	LabelMap Action = "labelmap"
+	// LabelDrop drops the labels whose names match the regex.
+	LabelDrop Action = "labeldrop"
+	// LabelKeep drops the labels whose names do not match the regex.
+	LabelKeep Action = "labelkeep"
+)
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (a *Action) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch act := Action(strings.ToLower(s)); act {
+	case Replace, Keep, Drop, HashMod, LabelMap, LabelDrop, LabelKeep:
+		*a = act
+		return nil
+	}
+	return fmt.Errorf("unknown relabel action %q", s)
+}
+
+// DefaultRelabelConfig is the default relabeling rule, which the settings of
+// a rule override.
+var DefaultRelabelConfig = Config{
+	Action:      Replace,
+	Separator:   ";",
+	Regex:       MustNewRegexp("(.*)"),
+	Replacement: "$1",
+}
+
+// Config is a relabeling rule.
+type Config struct {
+	// SourceLabels are the labels whose values are concatenated with
+	// Separator and matched against Regex.
+	SourceLabels model.LabelNames `yaml:"source_labels,flow,omitempty"`
+	Separator    string           `yaml:"separator,omitempty"`
+	Regex        Regexp           `yaml:"regex,omitempty"`
+	// Modulus is the divisor of the hash of the hashmod action.
+	Modulus uint64 `yaml:"modulus,omitempty"`
+	// TargetLabel is the label the replace and hashmod actions set. The
+	// replace action expands regex groups in it.
+	TargetLabel string `yaml:"target_label,omitempty"`
+	// Replacement is the value the replace action sets, and the name the
+	// labelmap action copies labels to, after expanding regex groups.
+	Replacement string `yaml:"replacement,omitempty"`
+	Action      Action `yaml:"action,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultRelabelConfig
+	type plain Config
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Regex.Regexp == nil {
+		c.Regex = MustNewRegexp("")
+	}
+	if c.Modulus == 0 && c.Action == HashMod {
+		return fmt.Errorf("relabel configuration for hashmod requires non-zero modulus")
+	}
+	if (c.Action == Replace || c.Action == HashMod) && c.TargetLabel == "" {
+		return fmt.Errorf("relabel configuration for %s action requires 'target_label' value", c.Action)
+	}
+	if c.Action == Replace && !relabelTarget.MatchString(c.TargetLabel) {
+		return fmt.Errorf("%q is invalid 'target_label' for %s action", c.TargetLabel, c.Action)
+	}
+	if c.Action == LabelMap && !relabelTarget.MatchString(c.Replacement) {
+		return fmt.Errorf("%q is invalid 'replacement' for %s action", c.Replacement, c.Action)
+	}
+	if c.Action == HashMod && !model.LabelName(c.TargetLabel).IsValid() {
+		return fmt.Errorf("%q is invalid 'target_label' for %s action", c.TargetLabel, c.Action)
+	}
+	if c.Action == LabelDrop || c.Action == LabelKeep {
+		if c.SourceLabels != nil ||
+			c.TargetLabel != DefaultRelabelConfig.TargetLabel ||
+			c.Modulus != DefaultRelabelConfig.Modulus ||
+			c.Separator != DefaultRelabelConfig.Separator ||
+			c.Replacement != DefaultRelabelConfig.Replacement {
+			return fmt.Errorf("%s action requires only 'regex', and no other fields", c.Action)
+		}
+	}
+	return nil
+}
+
+// Regexp is a regular expression that is anchored at both ends.
+type Regexp struct {
+	*regexp.Regexp
+	original string
+}
+
+// NewRegexp compiles an anchored regular expression.
+func NewRegexp(s string) (Regexp, error) {
+	regex, err := regexp.Compile("^(?:" + s + ")$")
+	return Regexp{Regexp: regex, original: s}, err
+}
+
+// MustNewRegexp works like NewRegexp, but panics if the regular expression
+// does not compile.
+func MustNewRegexp(s string) Regexp {
+	re, err := NewRegexp(s)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	r, err := NewRegexp(s)
+	if err != nil {
+		return err
+	}
+	*re = r
+	return nil
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (re Regexp) MarshalYAML() (interface{}, error) {
+	if re.original != "" {
+		return re.original, nil
+	}
+	return nil, nil
+}
+
+// Process applies the rules to labels in order, modifying them in place. It
+// returns false if a rule dropped the metric, in which case labels are left
+// in an undefined state.
+func Process(labels prometheus.Labels, cfgs ...*Config) bool {
+	for _, cfg := range cfgs {
+		if !relabel(labels, cfg) {
+			return false
+		}
+	}
+	return true
+}
+
+func relabel(labels prometheus.Labels, cfg *Config) bool {
+	values := make([]string, 0, len(cfg.SourceLabels))
+	for _, ln := range cfg.SourceLabels {
+		values = append(values, labels[string(ln)])
+	}
+	val := strings.Join(values, cfg.Separator)
+
+	switch cfg.Action {
+	case Drop:
+		if cfg.Regex.MatchString(val) {
+			return false
+		}
+	case Keep:
+		if !cfg.Regex.MatchString(val) {
+			return false
+		}
+	case Replace:
+		indexes := cfg.Regex.FindStringSubmatchIndex(val)
+		// If there is no match no replacement must take place.
+		if indexes == nil {
+			break
+		}
+		target := model.LabelName(cfg.Regex.ExpandString([]byte{}, cfg.TargetLabel, val, indexes))
+		if !target.IsValid() {
+			delete(labels, cfg.TargetLabel)
+			break
+		}
+		res := cfg.Regex.ExpandString([]byte{}, cfg.Replacement, val, indexes)
+		setLabel(labels, string(target), string(res))
+	case HashMod:
+		mod := sum64(md5.Sum([]byte(val))) % cfg.Modulus
+		setLabel(labels, cfg.TargetLabel, fmt.Sprintf("%d", mod))
+	case LabelMap:
+		// The copies must not be matched again, so the matching labels are
+		// collected first.
+		mapped := map[string]string{}
+		for name, value := range labels {
+			if cfg.Regex.MatchString(name) {
+				mapped[cfg.Regex.ReplaceAllString(name, cfg.Replacement)] = value
+			}
+		}
+		for name, value := range mapped {
+			setLabel(labels, name, value)
+		}
+	case LabelDrop:
+		for name := range labels {
+			if cfg.Regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	case LabelKeep:
+		for name := range labels {
+			if !cfg.Regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	default:
+		panic(fmt.Errorf("relabel: unknown relabel action type %q", cfg.Action))
+	}
+	return true
+}
+
+// setLabel sets a label, or deletes it if the value is empty.
+func setLabel(labels prometheus.Labels, name, value string) {
+	if value == "" {
+		delete(labels, name)
+		return
+	}
+	labels[name] = value
+}
+
+// sum64 sums the md5 hash to an uint64.
+func sum64(hash [md5.Size]byte) uint64 {
+	var s uint64
+
+	for i, b := range hash {
+		shift := uint64((md5.Size - i - 1) * 8)
+
+		s |= uint64(b) << shift
+	}
+	return s
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package relabel
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestProcess(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		config string
+		input  prometheus.Labels
+		output prometheus.Labels
+	}{
+		{
+			name: "replace",
+			config: `
+- source_labels: [a]
+  regex: "f(.*)"
+  target_label: d
+  replacement: "ch${1}-ch${1}"
+`,
+			input:  prometheus.Labels{"a": "foo", "b": "bar"},
+			output: prometheus.Labels{"a": "foo", "b": "bar", "d": "choo-choo"},
+		}, {
+			name: "replace without match",
+			config: `
+- source_labels: [a]
+  regex: "x(.*)"
+  target_label: d
+`,
+			input:  prometheus.Labels{"a": "foo"},
+			output: prometheus.Labels{"a": "foo"},
+		}, {
+			name: "replace the metric name",
+			config: `
+- source_labels: [__name__, b]
+  regex: "(.*);(.*)"
+  target_label: __name__
+  replacement: "${1}_${2}"
+`,
+			input:  prometheus.Labels{"__name__": "requests", "b": "bar"},
+			output: prometheus.Labels{"__name__": "requests_bar", "b": "bar"},
+		}, {
+			name: "replace with an empty value deletes",
+			config: `
+- source_labels: [missing]
+  target_label: a
+`,
+			input:  prometheus.Labels{"a": "foo"},
+			output: prometheus.Labels{},
+		}, {
+			name: "drop",
+			config: `
+- source_labels: [a]
+  regex: "f.*"
+  action: drop
+`,
+			input:  prometheus.Labels{"a": "foo"},
+			output: nil,
+		}, {
+			name: "keep",
+			config: `
+- source_labels: [a]
+  regex: "b.*"
+  action: keep
+`,
+			input:  prometheus.Labels{"a": "foo"},
+			output: nil,
+		}, {
+			name: "keep match",
+			config: `
+- source_labels: [a]
+  regex: "f.*"
+  action: Keep
+`,
+			input:  prometheus.Labels{"a": "foo"},
+			output: prometheus.Labels{"a": "foo"},
+		}, {
+			name: "hashmod",
+			config: `
+- source_labels: [c]
+  target_label: d
+  modulus: 1000
+  action: hashmod
+`,
+			input:  prometheus.Labels{"c": "baz"},
+			output: prometheus.Labels{"c": "baz", "d": "976"},
+		}, {
+			name: "labelmap",
+			config: `
+- regex: "tag_(.+)"
+  replacement: "${1}"
+  action: labelmap
+`,
+			input:  prometheus.Labels{"tag_a": "foo", "b": "bar"},
+			output: prometheus.Labels{"tag_a": "foo", "a": "foo", "b": "bar"},
+		}, {
+			name: "labeldrop",
+			config: `
+- regex: "tag_.+"
+  action: labeldrop
+`,
+			input:  prometheus.Labels{"tag_a": "foo", "b": "bar"},
+			output: prometheus.Labels{"b": "bar"},
+		}, {
+			name: "labelkeep",
+			config: `
+- regex: "__name__|b"
+  action: labelkeep
+`,
+			input:  prometheus.Labels{"__name__": "requests", "a": "foo", "b": "bar"},
+			output: prometheus.Labels{"__name__": "requests", "b": "bar"},
+		}, {
+			name: "rules apply in order",
+			config: `
+- source_labels: [a]
+  target_label: b
+- regex: a
+  action: labeldrop
+`,
+			input:  prometheus.Labels{"a": "foo"},
+			output: prometheus.Labels{"b": "foo"},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			var cfgs []*Config
+			if err := yaml.UnmarshalStrict([]byte(s.config), &cfgs); err != nil {
+				t.Fatal(err)
+			}
+			keep := Process(s.input, cfgs...)
+			if s.output == nil {
+				if keep {
+					t.Fatalf("Expected the metric to be dropped, got %v", s.input)
+				}
+				return
+			}
+			if !keep {
+				t.Fatal("Expected the metric to be kept")
+			}
+			if !reflect.DeepEqual(s.input, s.output) {
+				t.Fatalf("Expected %v, got %v", s.output, s.input)
+			}
+		})
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	configs := []string{
+		"action: unknown",
+		"action: hashmod\ntarget_label: a",
+		"action: replace",
+		"target_label: \"0a\"",
+		"action: labelmap\nreplacement: \"0a\"",
+		"action: labeldrop\nregex: a\ntarget_label: b",
+		"regex: \"(\"",
+	}
+	for _, config := range configs {
+		var cfg Config
+		if err := yaml.UnmarshalStrict([]byte(config), &cfg); err == nil {
+			t.Errorf("Expected an error for %q", config)
+		}
+	}
+}
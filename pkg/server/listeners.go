@@ -0,0 +1,401 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/statsd_exporter/pkg/address"
+	"github.com/prometheus/statsd_exporter/pkg/listener"
+)
+
+// startListener opens the socket of a listener and starts accepting metrics
+// on it. The returned function closes the socket and waits until the packets
+// already read from it are handled, or, for stream sockets, closes the open
+// connections and waits for their handlers.
+func (s *Server) startListener(cfg listener.ListenerConfig) (func(), error) {
+	m := s.metrics
+	eventHandler := s.eventHandler(cfg.Name)
+	if cfg.Prefix != "" || len(cfg.Labels) > 0 {
+		eventHandler = &listener.EventDecorator{
+			EventHandler: eventHandler,
+			Prefix:       cfg.Prefix,
+			Labels:       cfg.Labels,
+		}
+	}
+	parser := cfg.Parser(s.cfg.LineParser)
+	readBuffer := cfg.ReadBuffer
+	if readBuffer == 0 {
+		readBuffer = s.cfg.ReadBuffer
+	}
+	readBatchSize := cfg.ReadBatchSize
+	if readBatchSize == 0 {
+		readBatchSize = s.cfg.ReadBatchSize
+	}
+	logger := log.With(s.logger, "listener", cfg.Name)
+
+	// All sockets of a listener share one pool of parsers, which is started
+	// with the packet handler of the first one.
+	parserWorkers := cfg.ParserWorkers
+	if parserWorkers == 0 {
+		parserWorkers = s.cfg.ParserWorkers
+	}
+	packetQueueSize := cfg.PacketQueueSize
+	if packetQueueSize == 0 {
+		packetQueueSize = s.cfg.PacketQueueSize
+	}
+	var pool *listener.ParserPool
+	parsers := func(handle func(packet []byte)) *listener.ParserPool {
+		if parserWorkers == 0 {
+			return nil
+		}
+		if pool == nil {
+			pool = listener.NewParserPool(parserWorkers, packetQueueSize, handle,
+				m.packetQueueLength.WithLabelValues(cfg.Name), m.packetQueueDrops.WithLabelValues(cfg.Name))
+		}
+		return pool
+	}
+
+	var (
+		lines      = m.linesReceived.WithLabelValues(cfg.Name)
+		sampleErrs = *m.sampleErrors.MustCurryWith(prometheus.Labels{"listener": cfg.Name})
+		samples    = m.samplesReceived.WithLabelValues(cfg.Name)
+		tagErrs    = m.tagErrors.WithLabelValues(cfg.Name)
+		tags       = m.tagsReceived.WithLabelValues(cfg.Name)
+	)
+
+	switch cfg.Type {
+	case listener.TypeUDP, listener.TypeGraphiteUDP, listener.TypeInfluxUDP:
+		udpListenAddr, err := address.UDPAddrFromString(cfg.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UDP listen address %q: %v", cfg.Address, err)
+		}
+		sockets := cfg.Sockets
+		if sockets == 0 {
+			sockets = s.cfg.UDPSockets
+		}
+		readers := cfg.Readers
+		if readers == 0 {
+			readers = s.cfg.UDPReaders
+		}
+
+		var (
+			conns []*net.UDPConn
+			wg    sync.WaitGroup
+		)
+		closeConns := func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}
+		for i := 0; i < sockets; i++ {
+			uconn, err := listener.ListenUDP(udpListenAddr, sockets > 1)
+			if err != nil {
+				closeConns()
+				return nil, fmt.Errorf("failed to start UDP listener: %v", err)
+			}
+			conns = append(conns, uconn)
+
+			if readBuffer != 0 {
+				err = uconn.SetReadBuffer(readBuffer)
+				if err != nil {
+					closeConns()
+					return nil, fmt.Errorf("error setting UDP read buffer: %v", err)
+				}
+			}
+
+			var drops *listener.UDPDropCounter
+			if err := listener.EnableUDPDropCounting(uconn); err != nil {
+				level.Debug(logger).Log("msg", "Not counting dropped UDP packets", "error", err)
+			} else {
+				drops = listener.NewUDPDropCounter(m.udpDrops.WithLabelValues(cfg.Name, strconv.Itoa(i)))
+			}
+
+			var ul interface{ Listen() }
+			switch cfg.Type {
+			case listener.TypeUDP:
+				l := &listener.StatsDUDPListener{
+					Conn:            uconn,
+					EventHandler:    eventHandler,
+					Logger:          logger,
+					LineParser:      parser,
+					UDPPackets:      m.udpPackets.WithLabelValues(cfg.Name),
+					LinesReceived:   lines,
+					EventsFlushed:   m.eventsFlushed,
+					SampleErrors:    sampleErrs,
+					SamplesReceived: samples,
+					TagErrors:       tagErrs,
+					TagsReceived:    tags,
+					UDPDrops:        drops,
+					BatchSize:       readBatchSize,
+				}
+				l.Parsers = parsers(l.HandlePacket)
+				ul = l
+			case listener.TypeGraphiteUDP:
+				l := &listener.GraphiteUDPListener{
+					Conn:            uconn,
+					EventHandler:    eventHandler,
+					Logger:          logger,
+					LineParser:      parser,
+					UDPPackets:      m.udpPackets.WithLabelValues(cfg.Name),
+					LinesReceived:   lines,
+					SampleErrors:    sampleErrs,
+					SamplesReceived: samples,
+					TagErrors:       tagErrs,
+					TagsReceived:    tags,
+					UDPDrops:        drops,
+				}
+				l.Parsers = parsers(l.HandlePacket)
+				ul = l
+			case listener.TypeInfluxUDP:
+				l := &listener.InfluxUDPListener{
+					Conn:            uconn,
+					EventHandler:    eventHandler,
+					Logger:          logger,
+					LineParser:      parser,
+					UDPPackets:      m.udpPackets.WithLabelValues(cfg.Name),
+					LinesReceived:   lines,
+					SampleErrors:    sampleErrs,
+					SamplesReceived: samples,
+					TagErrors:       tagErrs,
+					TagsReceived:    tags,
+					UDPDrops:        drops,
+				}
+				l.Parsers = parsers(l.HandlePacket)
+				ul = l
+			}
+			// Every reader has its own buffer.
+			wg.Add(readers)
+			for r := 0; r < readers; r++ {
+				go func() {
+					defer wg.Done()
+					ul.Listen()
+				}()
+			}
+		}
+		return func() {
+			closeConns()
+			wg.Wait()
+			if pool != nil {
+				pool.Close()
+			}
+		}, nil
+
+	case listener.TypeTCP, listener.TypeGraphiteTCP, listener.TypeInfluxTCP:
+		tcpListenAddr, err := address.TCPAddrFromString(cfg.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TCP listen address %q: %v", cfg.Address, err)
+		}
+		tconn, err := net.ListenTCP("tcp", tcpListenAddr)
+		if err != nil {
+			return nil, err
+		}
+		conns := &listener.ConnTracker{}
+
+		switch cfg.Type {
+		case listener.TypeTCP:
+			tl := &listener.StatsDTCPListener{
+				Conn:            tconn,
+				EventHandler:    eventHandler,
+				Logger:          logger,
+				LineParser:      parser,
+				LinesReceived:   lines,
+				EventsFlushed:   m.eventsFlushed,
+				SampleErrors:    sampleErrs,
+				SamplesReceived: samples,
+				TagErrors:       tagErrs,
+				TagsReceived:    tags,
+				TCPConnections:  m.tcpConnections.WithLabelValues(cfg.Name),
+				TCPErrors:       m.tcpErrors.WithLabelValues(cfg.Name),
+				TCPLineTooLong:  m.tcpLineTooLong.WithLabelValues(cfg.Name),
+				Conns:           conns,
+			}
+			if s.tlsLoader != nil {
+				tl.TLSConfig = s.tlsLoader.TLSConfig()
+				tl.ClientIdentityLabel = s.cfg.TCPTLSClientLabel
+			}
+			go tl.Listen()
+		case listener.TypeGraphiteTCP:
+			gl := &listener.GraphiteTCPListener{
+				Conn:            tconn,
+				EventHandler:    eventHandler,
+				Logger:          logger,
+				LineParser:      parser,
+				LinesReceived:   lines,
+				SampleErrors:    sampleErrs,
+				SamplesReceived: samples,
+				TagErrors:       tagErrs,
+				TagsReceived:    tags,
+				TCPConnections:  m.tcpConnections.WithLabelValues(cfg.Name),
+				TCPErrors:       m.tcpErrors.WithLabelValues(cfg.Name),
+				TCPLineTooLong:  m.tcpLineTooLong.WithLabelValues(cfg.Name),
+				Conns:           conns,
+			}
+			go gl.Listen()
+		case listener.TypeInfluxTCP:
+			il := &listener.InfluxTCPListener{
+				Conn:            tconn,
+				EventHandler:    eventHandler,
+				Logger:          logger,
+				LineParser:      parser,
+				LinesReceived:   lines,
+				SampleErrors:    sampleErrs,
+				SamplesReceived: samples,
+				TagErrors:       tagErrs,
+				TagsReceived:    tags,
+				TCPConnections:  m.tcpConnections.WithLabelValues(cfg.Name),
+				TCPErrors:       m.tcpErrors.WithLabelValues(cfg.Name),
+				TCPLineTooLong:  m.tcpLineTooLong.WithLabelValues(cfg.Name),
+				Conns:           conns,
+			}
+			go il.Listen()
+		}
+		// Connections that are still open when the listener stops are
+		// closed, so that nothing is queued after the event queues closed.
+		return func() {
+			tconn.Close()
+			conns.Close()
+		}, nil
+
+	case listener.TypeUnixgram:
+		if _, err := os.Stat(cfg.Address); !os.IsNotExist(err) {
+			return nil, fmt.Errorf("unixgram socket %q already exists", cfg.Address)
+		}
+		uxgconn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{
+			Net:  "unixgram",
+			Name: cfg.Address,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on Unixgram socket: %v", err)
+		}
+
+		if readBuffer != 0 {
+			err = uxgconn.SetReadBuffer(readBuffer)
+			if err != nil {
+				uxgconn.Close()
+				return nil, fmt.Errorf("error setting Unixgram read buffer: %v", err)
+			}
+		}
+
+		ul := &listener.StatsDUnixgramListener{
+			Conn:            uxgconn,
+			EventHandler:    eventHandler,
+			Logger:          logger,
+			LineParser:      parser,
+			UnixgramPackets: m.unixgramPackets.WithLabelValues(cfg.Name),
+			LinesReceived:   lines,
+			EventsFlushed:   m.eventsFlushed,
+			SampleErrors:    sampleErrs,
+			SamplesReceived: samples,
+			TagErrors:       tagErrs,
+			TagsReceived:    tags,
+			BatchSize:       readBatchSize,
+		}
+		ul.Parsers = parsers(ul.HandlePacket)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ul.Listen()
+		}()
+		closeConn := func() {
+			uxgconn.Close()
+			<-done
+			if pool != nil {
+				pool.Close()
+			}
+		}
+
+		// if it's an abstract unix domain socket, it won't exist on fs
+		// so we can't chmod it either
+		if _, err := os.Stat(cfg.Address); !os.IsNotExist(err) {
+			chmodSocket(cfg.Address, s.cfg.UnixSocketMode, logger)
+			return func() {
+				closeConn()
+				os.Remove(cfg.Address)
+			}, nil
+		}
+		return closeConn, nil
+
+	case listener.TypeUnix:
+		if len(s.cfg.UnixPeerLabels) > 0 && !listener.PeerCredentialsSupported {
+			return nil, fmt.Errorf("peer credential labels are not supported on this platform")
+		}
+		if _, err := os.Stat(cfg.Address); !os.IsNotExist(err) {
+			return nil, fmt.Errorf("unix socket %q already exists", cfg.Address)
+		}
+		uxconn, err := net.ListenUnix("unix", &net.UnixAddr{
+			Net:  "unix",
+			Name: cfg.Address,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on unix socket: %v", err)
+		}
+
+		conns := &listener.ConnTracker{}
+		ul := &listener.StatsDUnixListener{
+			Conn:            uxconn,
+			EventHandler:    eventHandler,
+			Logger:          logger,
+			LineParser:      parser,
+			LinesReceived:   lines,
+			SampleErrors:    sampleErrs,
+			SamplesReceived: samples,
+			TagErrors:       tagErrs,
+			TagsReceived:    tags,
+			UnixConnections: m.unixConnections.WithLabelValues(cfg.Name),
+			UnixErrors:      m.unixErrors.WithLabelValues(cfg.Name),
+			UnixLineTooLong: m.unixLineTooLong.WithLabelValues(cfg.Name),
+			PeerLabels:      s.cfg.UnixPeerLabels,
+			UserNames:       s.cfg.UnixUserNames,
+			Conns:           conns,
+		}
+
+		go ul.Listen()
+
+		// if it's an abstract unix domain socket, it won't exist on fs
+		// so we can't chmod it either
+		if _, err := os.Stat(cfg.Address); !os.IsNotExist(err) {
+			chmodSocket(cfg.Address, s.cfg.UnixSocketMode, logger)
+		}
+		// net.UnixListener removes the socket file when it is closed.
+		return func() {
+			uxconn.Close()
+			conns.Close()
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid listener type %q", cfg.Type)
+}
+
+func chmodSocket(path, mode string, logger log.Logger) {
+	// convert the string to octet
+	perm, err := strconv.ParseInt("0"+mode, 8, 32)
+	if err != nil {
+		level.Warn(logger).Log("msg", "Bad socket permission, ignoring", "mode", mode, "error", err)
+		return
+	}
+	err = os.Chmod(path, os.FileMode(perm))
+	if err != nil {
+		level.Warn(logger).Log("msg", "Failed to change socket permission", "socket_name", path, "error", err)
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are the self-metrics of a server.
+type metrics struct {
+	eventStats            *prometheus.CounterVec
+	eventsFlushed         prometheus.Counter
+	eventsDropped         *prometheus.CounterVec
+	eventsUnmapped        prometheus.Counter
+	udpPackets            *prometheus.CounterVec
+	tcpConnections        *prometheus.CounterVec
+	tcpErrors             *prometheus.CounterVec
+	tcpLineTooLong        *prometheus.CounterVec
+	udpDrops              *prometheus.CounterVec
+	packetQueueLength     *prometheus.GaugeVec
+	packetQueueDrops      *prometheus.CounterVec
+	unixgramPackets       *prometheus.CounterVec
+	unixConnections       *prometheus.CounterVec
+	unixErrors            *prometheus.CounterVec
+	unixLineTooLong       *prometheus.CounterVec
+	linesReceived         *prometheus.CounterVec
+	samplesReceived       *prometheus.CounterVec
+	sampleErrors          *prometheus.CounterVec
+	tagsReceived          *prometheus.CounterVec
+	tagErrors             *prometheus.CounterVec
+	configLoads           *prometheus.CounterVec
+	mappingsCount         prometheus.Gauge
+	conflictingEventStats *prometheus.CounterVec
+	errorEventStats       *prometheus.CounterVec
+	eventsActions         *prometheus.CounterVec
+	metricsCount          *prometheus.GaugeVec
+
+	// The metrics of the tenants' pipelines, by tenant.
+	tenantEventStats            *prometheus.CounterVec
+	tenantEventsDropped         *prometheus.CounterVec
+	tenantEventsUnmapped        *prometheus.CounterVec
+	tenantMappingsCount         *prometheus.GaugeVec
+	tenantConflictingEventStats *prometheus.CounterVec
+	tenantErrorEventStats       *prometheus.CounterVec
+	tenantEventsActions         *prometheus.CounterVec
+	tenantMetricsCount          *prometheus.GaugeVec
+	tenantUnknownEvents         prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		eventStats: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_total",
+				Help: "The total number of StatsD events seen.",
+			},
+			[]string{"type"},
+		),
+		eventsFlushed: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_event_queue_flushed_total",
+				Help: "Number of times events were flushed to exporter",
+			},
+		),
+		eventsDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_dropped_total",
+				Help: "The total number of events dropped because the event queue was full.",
+			},
+			[]string{"reason"},
+		),
+		eventsUnmapped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_unmapped_total",
+				Help: "The total number of StatsD events no mapping was found for.",
+			},
+		),
+		udpPackets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_udp_packets_total",
+				Help: "The total number of StatsD packets received over UDP.",
+			},
+			[]string{"listener"},
+		),
+		tcpConnections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tcp_connections_total",
+				Help: "The total number of TCP connections handled.",
+			},
+			[]string{"listener"},
+		),
+		tcpErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tcp_connection_errors_total",
+				Help: "The number of errors encountered reading from TCP.",
+			},
+			[]string{"listener"},
+		),
+		tcpLineTooLong: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tcp_too_long_lines_total",
+				Help: "The number of lines discarded due to being too long.",
+			},
+			[]string{"listener"},
+		),
+		udpDrops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_udp_packets_dropped_total",
+				Help: "The total number of UDP packets dropped by the kernel because the receive buffer of the socket was full.",
+			},
+			[]string{"listener", "socket"},
+		),
+		packetQueueLength: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "statsd_exporter_packet_queue_length",
+				Help: "The number of received packets waiting to be parsed.",
+			},
+			[]string{"listener"},
+		),
+		packetQueueDrops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_packet_queue_dropped_total",
+				Help: "The total number of received packets dropped because the parsers could not keep up.",
+			},
+			[]string{"listener"},
+		),
+		unixgramPackets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_unixgram_packets_total",
+				Help: "The total number of StatsD packets received over Unixgram.",
+			},
+			[]string{"listener"},
+		),
+		unixConnections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_unix_connections_total",
+				Help: "The total number of unix stream socket connections handled.",
+			},
+			[]string{"listener"},
+		),
+		unixErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_unix_connection_errors_total",
+				Help: "The number of errors encountered reading from unix stream sockets.",
+			},
+			[]string{"listener"},
+		),
+		unixLineTooLong: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_unix_too_long_lines_total",
+				Help: "The number of lines received over unix stream sockets discarded due to being too long.",
+			},
+			[]string{"listener"},
+		),
+		linesReceived: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_lines_total",
+				Help: "The total number of StatsD lines received.",
+			},
+			[]string{"listener"},
+		),
+		samplesReceived: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_samples_total",
+				Help: "The total number of StatsD samples received.",
+			},
+			[]string{"listener"},
+		),
+		sampleErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_sample_errors_total",
+				Help: "The total number of errors parsing StatsD samples.",
+			},
+			[]string{"reason", "listener"},
+		),
+		tagsReceived: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tags_total",
+				Help: "The total number of DogStatsD tags processed.",
+			},
+			[]string{"listener"},
+		),
+		tagErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tag_errors_total",
+				Help: "The number of errors parsing DogStatsD tags.",
+			},
+			[]string{"listener"},
+		),
+		configLoads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_config_reloads_total",
+				Help: "The number of configuration reloads.",
+			},
+			[]string{"outcome"},
+		),
+		mappingsCount: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "statsd_exporter_loaded_mappings",
+			Help: "The current number of configured metric mappings.",
+		}),
+		conflictingEventStats: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_conflict_total",
+				Help: "The total number of StatsD events with conflicting names.",
+			},
+			[]string{"type"},
+		),
+		errorEventStats: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_error_total",
+				Help: "The total number of StatsD events discarded due to errors.",
+			},
+			[]string{"reason"},
+		),
+		eventsActions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_events_actions_total",
+				Help: "The total number of StatsD events by action.",
+			},
+			[]string{"action"},
+		),
+		metricsCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "statsd_exporter_metrics_total",
+				Help: "The total number of metrics.",
+			},
+			[]string{"type"},
+		),
+		tenantEventStats: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tenant_events_total",
+				Help: "The total number of StatsD events seen by tenant.",
+			},
+			[]string{"tenant", "type"},
+		),
+		tenantEventsDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tenant_events_dropped_total",
+				Help: "The total number of events dropped because the event queue of the tenant was full.",
+			},
+			[]string{"tenant", "reason"},
+		),
+		tenantEventsUnmapped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tenant_events_unmapped_total",
+				Help: "The total number of StatsD events no mapping was found for by tenant.",
+			},
+			[]string{"tenant"},
+		),
+		tenantMappingsCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "statsd_exporter_tenant_loaded_mappings",
+				Help: "The current number of configured metric mappings by tenant.",
+			},
+			[]string{"tenant"},
+		),
+		tenantConflictingEventStats: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tenant_events_conflict_total",
+				Help: "The total number of StatsD events with conflicting names by tenant.",
+			},
+			[]string{"tenant", "type"},
+		),
+		tenantErrorEventStats: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tenant_events_error_total",
+				Help: "The total number of StatsD events discarded due to errors by tenant.",
+			},
+			[]string{"tenant", "reason"},
+		),
+		tenantEventsActions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tenant_events_actions_total",
+				Help: "The total number of StatsD events by tenant and action.",
+			},
+			[]string{"tenant", "action"},
+		),
+		tenantMetricsCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "statsd_exporter_tenant_metrics_total",
+				Help: "The total number of metrics by tenant.",
+			},
+			[]string{"tenant", "type"},
+		),
+		tenantUnknownEvents: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "statsd_exporter_tenant_unknown_events_total",
+				Help: "The total number of events dropped because their tenant tag named an unknown tenant.",
+			},
+		),
+	}
+}
+
+func (m *metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.eventStats,
+		m.eventsFlushed,
+		m.eventsDropped,
+		m.eventsUnmapped,
+		m.udpPackets,
+		m.tcpConnections,
+		m.tcpErrors,
+		m.tcpLineTooLong,
+		m.udpDrops,
+		m.packetQueueLength,
+		m.packetQueueDrops,
+		m.unixgramPackets,
+		m.unixConnections,
+		m.unixErrors,
+		m.unixLineTooLong,
+		m.linesReceived,
+		m.samplesReceived,
+		m.sampleErrors,
+		m.tagsReceived,
+		m.tagErrors,
+		m.configLoads,
+		m.mappingsCount,
+		m.conflictingEventStats,
+		m.errorEventStats,
+		m.eventsActions,
+		m.metricsCount,
+		m.tenantEventStats,
+		m.tenantEventsDropped,
+		m.tenantEventsUnmapped,
+		m.tenantMappingsCount,
+		m.tenantConflictingEventStats,
+		m.tenantErrorEventStats,
+		m.tenantEventsActions,
+		m.tenantMetricsCount,
+	}
+}
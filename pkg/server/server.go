@@ -0,0 +1,634 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package server assembles listeners, the event queue, the mapper and the
+// exporter into a complete StatsD exporter that can be embedded into other
+// programs.
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/version"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/exporter"
+	"github.com/prometheus/statsd_exporter/pkg/line"
+	"github.com/prometheus/statsd_exporter/pkg/listener"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// Config configures a Server. The settings of the listeners apply to all
+// listeners that do not configure their own.
+type Config struct {
+	// ListenAddress is the address of the web interface. If it is empty, no
+	// web server is started and Handler can be served by the caller instead.
+	ListenAddress   string
+	MetricsEndpoint string
+	// EnableLifecycle adds the /-/reload and /-/quit endpoints.
+	EnableLifecycle bool
+	// HTTPPushPath and InfluxDBWritePath are the paths of the web interface
+	// that accept StatsD lines and InfluxDB line protocol. Empty paths
+	// disable them.
+	HTTPPushPath      string
+	InfluxDBWritePath string
+
+	Listeners       []listener.ListenerConfig
+	LineParser      *line.Parser
+	ReadBuffer      int
+	UDPSockets      int
+	UDPReaders      int
+	ReadBatchSize   int
+	ParserWorkers   int
+	PacketQueueSize int
+	UnixSocketMode  string
+	UnixPeerLabels  []string
+	UnixUserNames   map[uint32]string
+	// TCPTLSConfigFile or TCPTLS.CertFile enable TLS on the StatsD TCP
+	// listeners. The file takes precedence and is reread on every reload.
+	TCPTLSConfigFile  string
+	TCPTLS            listener.TLSSettings
+	TCPTLSClientLabel string
+
+	MappingConfig string
+	CacheSize     int
+	CacheType     string
+	DumpFSMPath   string
+
+	EventQueueSize      int
+	EventFlushThreshold int
+	EventFlushInterval  time.Duration
+	EventQueueOverflow  event.OverflowPolicy
+	EventShards         int
+	// ScrapeWindow is how long Shutdown waits for a final scrape after the
+	// remaining events have been processed.
+	ScrapeWindow time.Duration
+
+	// Tenants splits the events into pipelines with their own mappings and
+	// registries, served below the metrics endpoint. Events without a tenant
+	// are handled as without tenants.
+	Tenants *TenantsConfig
+
+	// Registerer registers the mapped metrics and the metrics about the
+	// exporter itself, and Gatherer is served on the metrics endpoint.
+	// Registerer defaults to the global registry, and Gatherer to Registerer
+	// if it is also a Gatherer.
+	Registerer prometheus.Registerer
+	Gatherer   prometheus.Gatherer
+	Logger     log.Logger
+}
+
+// DefaultConfig has the defaults of the command line flags.
+var DefaultConfig = Config{
+	ListenAddress:       ":9102",
+	MetricsEndpoint:     "/metrics",
+	UDPSockets:          1,
+	UDPReaders:          1,
+	ReadBatchSize:       1,
+	PacketQueueSize:     10000,
+	UnixSocketMode:      "755",
+	CacheSize:           1000,
+	CacheType:           "lru",
+	EventQueueSize:      10000,
+	EventFlushThreshold: 1000,
+	EventFlushInterval:  200 * time.Millisecond,
+	EventQueueOverflow:  event.OverflowBlock,
+	EventShards:         1,
+}
+
+// Server is a StatsD exporter.
+type Server struct {
+	cfg         Config
+	logger      log.Logger
+	metrics     *metrics
+	tlsLoader   *listener.TLSConfigLoader
+	mapper      *mapper.MetricMapper
+	cacheOption mapper.CacheOption
+	events      chan event.Events
+	eventQueue  *event.EventQueue
+	exporter    *exporter.Exporter
+	handler     http.Handler
+	httpServer  *http.Server
+
+	tenants         []*tenant
+	tenantsByName   map[string]*tenant
+	listenerTenants map[string]*tenant
+
+	started        bool
+	closeListeners []func()
+	exporterDone   chan struct{}
+	scrapes        chan struct{}
+	quit           chan struct{}
+	quitOnce       sync.Once
+
+	// pushMtx is held for reading by HTTP pushes in progress, so that
+	// Shutdown can wait for them before it sets stopping and closes the
+	// event queues.
+	pushMtx  sync.RWMutex
+	stopping bool
+}
+
+// New validates the configuration, loads the mapping configuration and
+// registers the metrics about the exporter. It does not open any sockets.
+func New(cfg Config) (*Server, error) {
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.DefaultRegisterer
+	}
+	if cfg.Gatherer == nil {
+		cfg.Gatherer = prometheus.DefaultGatherer
+		if g, ok := cfg.Registerer.(prometheus.Gatherer); ok {
+			cfg.Gatherer = g
+		}
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.NewNopLogger()
+	}
+	if cfg.LineParser == nil {
+		cfg.LineParser = line.NewParser()
+	}
+	if cfg.MetricsEndpoint == "" {
+		cfg.MetricsEndpoint = DefaultConfig.MetricsEndpoint
+	}
+	if cfg.EventQueueOverflow == "" {
+		cfg.EventQueueOverflow = event.OverflowBlock
+	}
+
+	if len(cfg.Listeners) == 0 && cfg.InfluxDBWritePath == "" && cfg.HTTPPushPath == "" {
+		return nil, fmt.Errorf("at least one of UDP/TCP/Unixgram/Unix/HTTP/Graphite/InfluxDB listeners must be specified")
+	}
+	listenerNames := map[string]bool{}
+	for _, l := range cfg.Listeners {
+		if listenerNames[l.Name] {
+			return nil, fmt.Errorf("duplicate listener %q", l.Name)
+		}
+		listenerNames[l.Name] = true
+	}
+	if cfg.HTTPPushPath != "" {
+		listenerNames[listener.ListenerName("http", cfg.ListenAddress+cfg.HTTPPushPath)] = true
+	}
+	if cfg.InfluxDBWritePath != "" {
+		listenerNames[listener.ListenerName("http", cfg.ListenAddress+cfg.InfluxDBWritePath)] = true
+	}
+	if cfg.Tenants != nil {
+		if err := cfg.Tenants.validate(); err != nil {
+			return nil, fmt.Errorf("invalid tenants config: %v", err)
+		}
+		for _, t := range cfg.Tenants.Tenants {
+			for _, name := range t.Listeners {
+				if !listenerNames[name] {
+					return nil, fmt.Errorf("tenant %q: unknown listener %q", t.Name, name)
+				}
+			}
+		}
+	}
+	if cfg.UDPSockets < 1 || cfg.UDPReaders < 1 {
+		return nil, fmt.Errorf("the number of UDP sockets and readers must be at least 1")
+	}
+	if cfg.ParserWorkers < 0 || cfg.PacketQueueSize < 1 {
+		return nil, fmt.Errorf("the number of parser workers must not be negative and the packet queue size must be at least 1")
+	}
+	if cfg.ReadBatchSize < 1 {
+		return nil, fmt.Errorf("the read batch size must be at least 1")
+	}
+	if cfg.EventQueueOverflow == event.OverflowDropOldest && cfg.EventQueueSize < 1 {
+		return nil, fmt.Errorf("the %s event queue overflow policy needs an event queue size of at least 1", event.OverflowDropOldest)
+	}
+	if cfg.ReadBatchSize > 1 && !listener.BatchReadsSupported {
+		level.Warn(cfg.Logger).Log("msg", "Batched reads are not supported on this platform, reading packets one by one")
+	}
+
+	s := &Server{
+		cfg:          cfg,
+		logger:       cfg.Logger,
+		metrics:      newMetrics(),
+		cacheOption:  mapper.WithCacheType(cfg.CacheType),
+		events:       make(chan event.Events, cfg.EventQueueSize),
+		exporterDone: make(chan struct{}),
+		scrapes:      make(chan struct{}, 1),
+		quit:         make(chan struct{}),
+	}
+
+	if cfg.TCPTLSConfigFile != "" || cfg.TCPTLS.CertFile != "" {
+		s.tlsLoader = &listener.TLSConfigLoader{
+			File:     cfg.TCPTLSConfigFile,
+			Settings: cfg.TCPTLS,
+		}
+		if err := s.tlsLoader.Load(); err != nil {
+			return nil, fmt.Errorf("error loading TLS config: %v", err)
+		}
+	}
+
+	s.mapper = &mapper.MetricMapper{
+		MappingsCount: s.metrics.mappingsCount,
+		Registerer:    cfg.Registerer,
+	}
+	if cfg.MappingConfig != "" {
+		if err := s.mapper.InitFromFile(cfg.MappingConfig, cfg.CacheSize, s.cacheOption); err != nil {
+			return nil, fmt.Errorf("error loading config: %v", err)
+		}
+		if cfg.DumpFSMPath != "" {
+			if err := s.dumpFSM(); err != nil {
+				// Failure to dump the FSM is an error (the user asked for it and it
+				// didn't happen) but not fatal (the exporter is fully functional
+				// afterwards).
+				level.Error(s.logger).Log("msg", "error dumping FSM", "error", err)
+			}
+		}
+	} else {
+		s.mapper.InitCache(cfg.CacheSize, s.cacheOption)
+	}
+
+	if cfg.Tenants != nil {
+		s.tenantsByName = map[string]*tenant{}
+		s.listenerTenants = map[string]*tenant{}
+		for _, tenantCfg := range cfg.Tenants.Tenants {
+			t, err := s.newTenant(tenantCfg)
+			if err != nil {
+				s.closeEventQueues()
+				return nil, err
+			}
+			s.tenants = append(s.tenants, t)
+			s.tenantsByName[tenantCfg.Name] = t
+			for _, name := range tenantCfg.Listeners {
+				if other, ok := s.listenerTenants[name]; ok {
+					s.closeEventQueues()
+					return nil, fmt.Errorf("listener %q is assigned to tenants %q and %q", name, other.cfg.Name, tenantCfg.Name)
+				}
+				s.listenerTenants[name] = t
+			}
+		}
+	}
+
+	m := s.metrics
+	s.eventQueue = event.NewEventQueue(s.events, cfg.EventFlushThreshold, cfg.EventFlushInterval, m.eventsFlushed,
+		event.WithOverflowPolicy(cfg.EventQueueOverflow),
+		event.WithEventsDropped(m.eventsDropped),
+	)
+	s.exporter = exporter.NewExporter(cfg.Registerer, s.mapper, s.logger, m.eventsActions, m.eventsUnmapped, m.errorEventStats, m.eventStats, m.conflictingEventStats, m.metricsCount)
+	s.exporter.Shards = cfg.EventShards
+
+	collectors := append(m.collectors(),
+		version.NewCollector("statsd_exporter"),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "statsd_exporter_event_queue_length",
+				Help: "The number of events waiting to be flushed to the event channel.",
+			},
+			func() float64 { return float64(s.eventQueue.Len()) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "statsd_exporter_event_channel_length",
+				Help: "The number of flushed event batches waiting to be processed.",
+			},
+			func() float64 { return float64(len(s.events)) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "statsd_exporter_event_channel_capacity",
+				Help: "The maximum number of flushed event batches waiting to be processed.",
+			},
+			func() float64 { return float64(cap(s.events)) },
+		),
+	)
+	if len(s.tenants) > 0 {
+		collectors = append(collectors, m.tenantUnknownEvents)
+	}
+	for _, t := range s.tenants {
+		collectors = append(collectors, t.collectors()...)
+	}
+	for _, c := range collectors {
+		if err := cfg.Registerer.Register(c); err != nil {
+			s.closeEventQueues()
+			return nil, fmt.Errorf("error registering metrics: %v", err)
+		}
+	}
+
+	s.handler = s.newHandler()
+	return s, nil
+}
+
+// closeEventQueues closes the event queues of the server and the tenants.
+func (s *Server) closeEventQueues() {
+	if s.eventQueue != nil {
+		s.eventQueue.Close()
+	}
+	for _, t := range s.tenants {
+		t.eventQueue.Close()
+	}
+}
+
+func (s *Server) newHandler() http.Handler {
+	cfg := s.cfg
+	m := s.metrics
+
+	// Scrapes are signalled so that Shutdown can wait for a final one.
+	metricsHandler := promhttp.HandlerFor(cfg.Gatherer, promhttp.HandlerOpts{})
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.MetricsEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		metricsHandler.ServeHTTP(w, r)
+		select {
+		case s.scrapes <- struct{}{}:
+		default:
+		}
+	})
+	tenantLinks := ""
+	for _, t := range s.tenants {
+		path := cfg.MetricsEndpoint + "/" + t.cfg.Name
+		mux.Handle(path, promhttp.HandlerFor(t.registry, promhttp.HandlerOpts{}))
+		tenantLinks += `
+			<p><a href="` + path + `">Metrics of ` + t.cfg.Name + `</a></p>`
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html>
+			<head><title>StatsD Exporter</title></head>
+			<body>
+			<h1>StatsD Exporter</h1>
+			<p><a href="` + cfg.MetricsEndpoint + `">Metrics</a></p>` + tenantLinks + `
+			</body>
+			</html>`))
+	})
+	if cfg.HTTPPushPath != "" {
+		name := listener.ListenerName("http", cfg.ListenAddress+cfg.HTTPPushPath)
+		mux.Handle(cfg.HTTPPushPath, s.rejectWhenStopping(&listener.StatsDHTTPHandler{
+			EventHandler:    s.eventHandler(name),
+			Logger:          log.With(s.logger, "listener", name),
+			LineParser:      cfg.LineParser,
+			LinesReceived:   m.linesReceived.WithLabelValues(name),
+			SampleErrors:    *m.sampleErrors.MustCurryWith(prometheus.Labels{"listener": name}),
+			SamplesReceived: m.samplesReceived.WithLabelValues(name),
+			TagErrors:       m.tagErrors.WithLabelValues(name),
+			TagsReceived:    m.tagsReceived.WithLabelValues(name),
+		}))
+	}
+	if cfg.InfluxDBWritePath != "" {
+		name := listener.ListenerName("http", cfg.ListenAddress+cfg.InfluxDBWritePath)
+		mux.Handle(cfg.InfluxDBWritePath, s.rejectWhenStopping(&listener.InfluxHTTPHandler{
+			EventHandler:    s.eventHandler(name),
+			Logger:          log.With(s.logger, "listener", name),
+			LineParser:      cfg.LineParser,
+			LinesReceived:   m.linesReceived.WithLabelValues(name),
+			SampleErrors:    *m.sampleErrors.MustCurryWith(prometheus.Labels{"listener": name}),
+			SamplesReceived: m.samplesReceived.WithLabelValues(name),
+			TagErrors:       m.tagErrors.WithLabelValues(name),
+			TagsReceived:    m.tagsReceived.WithLabelValues(name),
+		}))
+	}
+	if cfg.EnableLifecycle {
+		mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut || r.Method == http.MethodPost {
+				level.Info(s.logger).Log("msg", "Received lifecycle api reload, attempting reload")
+				s.Reload()
+			}
+		})
+		mux.HandleFunc("/-/quit", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut || r.Method == http.MethodPost {
+				level.Info(s.logger).Log("msg", "Received lifecycle api quit, shutting down")
+				s.requestQuit()
+			}
+		})
+	}
+	return mux
+}
+
+// rejectWhenStopping answers pushes with 503 Service Unavailable once
+// Shutdown has started, as their events could no longer be processed.
+func (s *Server) rejectWhenStopping(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.pushMtx.RLock()
+		defer s.pushMtx.RUnlock()
+		if s.stopping {
+			http.Error(w, "The exporter is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// stopPushes makes rejectWhenStopping reject new pushes and waits for the
+// pushes in progress.
+func (s *Server) stopPushes() {
+	s.pushMtx.Lock()
+	s.stopping = true
+	s.pushMtx.Unlock()
+}
+
+// Handler returns the handler of the web interface.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Quit is closed when a shutdown was requested through the lifecycle API or
+// the web server failed. The caller is expected to call Shutdown then.
+func (s *Server) Quit() <-chan struct{} {
+	return s.quit
+}
+
+func (s *Server) requestQuit() {
+	s.quitOnce.Do(func() { close(s.quit) })
+}
+
+// Start opens the listeners and the web interface and starts processing
+// events in the background. ctx is the base context of all web requests.
+func (s *Server) Start(ctx context.Context) error {
+	for _, cfg := range s.cfg.Listeners {
+		closeListener, err := s.startListener(cfg)
+		if err != nil {
+			s.stopListeners()
+			return fmt.Errorf("failed to start listener %q: %v", cfg.Name, err)
+		}
+		s.closeListeners = append(s.closeListeners, closeListener)
+		level.Info(s.logger).Log("msg", "Accepting Traffic", "listener", cfg.Name, "type", cfg.Type, "address", cfg.Address)
+	}
+	if s.cfg.HTTPPushPath != "" {
+		level.Info(s.logger).Log("msg", "Accepting StatsD Traffic", "http", s.cfg.HTTPPushPath)
+	}
+	if s.cfg.InfluxDBWritePath != "" {
+		level.Info(s.logger).Log("msg", "Accepting InfluxDB Traffic", "http", s.cfg.InfluxDBWritePath)
+	}
+
+	if s.cfg.ListenAddress != "" {
+		l, err := net.Listen("tcp", s.cfg.ListenAddress)
+		if err != nil {
+			s.stopListeners()
+			return err
+		}
+		s.httpServer = &http.Server{
+			Handler:     s.handler,
+			BaseContext: func(net.Listener) context.Context { return ctx },
+		}
+		go func() {
+			if err := s.httpServer.Serve(l); err != http.ErrServerClosed {
+				level.Error(s.logger).Log("msg", err)
+				s.requestQuit()
+			}
+		}()
+		level.Info(s.logger).Log("msg", "Accepting Prometheus Requests", "addr", s.cfg.ListenAddress)
+	}
+
+	s.started = true
+	go func() {
+		defer close(s.exporterDone)
+		s.exporter.Listen(s.events)
+	}()
+	for _, t := range s.tenants {
+		go func(t *tenant) {
+			defer close(t.done)
+			t.exporter.Listen(t.events)
+		}(t)
+	}
+	return nil
+}
+
+func (s *Server) stopListeners() {
+	for _, closeListener := range s.closeListeners {
+		closeListener()
+	}
+	s.closeListeners = nil
+}
+
+// Reload rereads the TLS configuration of the TCP listeners and the mapping
+// configuration. If either fails to load, the previous one stays in use.
+func (s *Server) Reload() error {
+	var tlsErr error
+	if s.tlsLoader != nil {
+		if tlsErr = s.tlsLoader.Load(); tlsErr != nil {
+			level.Error(s.logger).Log("msg", "Error reloading TLS config, keeping the previous one", "error", tlsErr)
+		} else {
+			level.Info(s.logger).Log("msg", "TLS config reloaded successfully")
+		}
+	}
+
+	var mappingErr error
+	reloaded := false
+	if s.cfg.MappingConfig != "" {
+		reloaded = true
+		if err := s.mapper.InitFromFile(s.cfg.MappingConfig, s.cfg.CacheSize, s.cacheOption); err != nil {
+			level.Info(s.logger).Log("msg", "Error reloading config", "error", err)
+			mappingErr = err
+		}
+	}
+	for _, t := range s.tenants {
+		if t.cfg.MappingConfig == "" {
+			continue
+		}
+		reloaded = true
+		if err := t.mapper.InitFromFile(t.cfg.MappingConfig, s.cfg.CacheSize, s.cacheOption); err != nil {
+			level.Info(s.logger).Log("msg", "Error reloading config", "tenant", t.cfg.Name, "error", err)
+			mappingErr = err
+		}
+	}
+	if !reloaded {
+		level.Warn(s.logger).Log("msg", "No mapping config to reload")
+		return tlsErr
+	}
+	if mappingErr != nil {
+		s.metrics.configLoads.WithLabelValues("failure").Inc()
+		return mappingErr
+	}
+	level.Info(s.logger).Log("msg", "Config reloaded successfully")
+	s.metrics.configLoads.WithLabelValues("success").Inc()
+	return tlsErr
+}
+
+// Shutdown stops the listeners, closes their open connections, rejects
+// further HTTP pushes, processes the events that were already received and,
+// if a scrape window is configured, waits for one more scrape before it stops
+// the web interface. Steps that do not finish before ctx expires are
+// abandoned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !s.started {
+		s.stopPushes()
+		s.closeEventQueues()
+		return nil
+	}
+
+	// Stop accepting metrics and hand everything that was received to the
+	// exporters, which return once they have processed all of it.
+	go func() {
+		s.stopPushes()
+		s.stopListeners()
+		s.closeEventQueues()
+		close(s.events)
+		for _, t := range s.tenants {
+			close(t.events)
+		}
+	}()
+	err := waitUntil(ctx, s.exporterDone)
+	for _, t := range s.tenants {
+		if err != nil {
+			break
+		}
+		err = waitUntil(ctx, t.done)
+	}
+	if err != nil {
+		level.Warn(s.logger).Log("msg", "Timed out processing the remaining events", "events", len(s.events))
+	} else if s.cfg.ScrapeWindow > 0 {
+		// Only a scrape of the final values counts.
+		select {
+		case <-s.scrapes:
+		default:
+		}
+		timer := time.NewTimer(s.cfg.ScrapeWindow)
+		select {
+		case <-s.scrapes:
+		case <-timer.C:
+			level.Info(s.logger).Log("msg", "No final scrape before the end of the scrape window")
+		case <-ctx.Done():
+		}
+		timer.Stop()
+	}
+
+	if s.httpServer != nil {
+		if shutdownErr := s.httpServer.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
+
+// waitUntil waits for done to be closed, or returns the error of ctx if it
+// expires first.
+func waitUntil(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) dumpFSM() error {
+	f, err := os.Create(s.cfg.DumpFSMPath)
+	if err != nil {
+		return err
+	}
+	level.Info(s.logger).Log("msg", "Start dumping FSM", "file_name", s.cfg.DumpFSMPath)
+	w := bufio.NewWriter(f)
+	s.mapper.FSM.DumpFSM(w)
+	w.Flush()
+	f.Close()
+	level.Info(s.logger).Log("msg", "Finish dumping FSM")
+	return nil
+}
@@ -0,0 +1,321 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/line"
+	"github.com/prometheus/statsd_exporter/pkg/listener"
+)
+
+// metricValue returns the value of the first metric of the family name, and
+// whether it was found.
+func metricValue(t *testing.T, g prometheus.Gatherer, name string) (float64, bool) {
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name || len(mf.GetMetric()) == 0 {
+			continue
+		}
+		m := mf.GetMetric()[0]
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			return m.GetCounter().GetValue(), true
+		case dto.MetricType_GAUGE:
+			return m.GetGauge().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func TestServerShutdownProcessesQueuedEvents(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	cfg := DefaultConfig
+	cfg.ListenAddress = ""
+	cfg.HTTPPushPath = "/push"
+	// Events are only flushed on shutdown.
+	cfg.EventFlushInterval = time.Hour
+	cfg.Registerer = reg
+
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader("server_test_push:3|c\n"))
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	if _, ok := metricValue(t, reg, "server_test_push"); ok {
+		t.Fatal("Expected the event to be queued before the shutdown")
+	}
+	if got, _ := metricValue(t, reg, "statsd_exporter_event_queue_length"); got != 1 {
+		t.Fatalf("Expected 1 queued event, got %v", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := metricValue(t, reg, "server_test_push"); got != 3 {
+		t.Fatalf("Expected the queued event to be processed, got %v", got)
+	}
+	if _, ok := metricValue(t, prometheus.DefaultGatherer, "server_test_push"); ok {
+		t.Fatal("Expected no metrics in the default registry")
+	}
+	if got, _ := metricValue(t, reg, "statsd_exporter_lines_total"); got != 1 {
+		t.Fatalf("Expected 1 line in the self-metrics, got %v", got)
+	}
+}
+
+func TestServerShutdownStopsIngestion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd_exporter_server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "statsd.sock")
+
+	reg := prometheus.NewRegistry()
+	cfg := DefaultConfig
+	cfg.ListenAddress = ""
+	cfg.HTTPPushPath = "/push"
+	cfg.Listeners = []listener.ListenerConfig{{Name: "unix", Type: listener.TypeUnix, Address: socket}}
+	cfg.EventFlushInterval = time.Hour
+	cfg.Registerer = reg
+
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("server_test_stream:1|c\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Wait until the line was queued, so that it is not lost when the
+	// connection is closed.
+	for i := 0; ; i++ {
+		if got, _ := metricValue(t, reg, "statsd_exporter_event_queue_length"); got == 1 {
+			break
+		}
+		if i == 500 {
+			t.Fatal("Timed out waiting for the line to be read")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := metricValue(t, reg, "server_test_stream"); got != 1 {
+		t.Fatalf("Expected the line of the open connection to be processed, got %v", got)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the open connection to be closed, got %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader("server_test_push:3|c\n"))
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503 after the shutdown, got %d: %s", rec.Code, rec.Body)
+	}
+	if got, _ := metricValue(t, reg, "statsd_exporter_events_dropped_total"); got != 0 {
+		t.Fatalf("Expected no dropped events, got %v", got)
+	}
+}
+
+func TestServerTenants(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	cfg := DefaultConfig
+	cfg.ListenAddress = ""
+	cfg.HTTPPushPath = "/push"
+	cfg.LineParser = line.NewParser()
+	cfg.LineParser.EnableDogstatsdParsing()
+	cfg.Registerer = reg
+	cfg.Tenants = &TenantsConfig{
+		Tag: "tenant",
+		Tenants: []TenantConfig{
+			{Name: "a", Prefix: "a_", SeriesLimit: 1},
+			{Name: "b"},
+		},
+	}
+
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := []string{
+		"a_requests:1|c",
+		"a_errors:1|c",
+		"b_requests:2:3|c|#tenant:b,env:prod",
+		"unknown_requests:3|c|#tenant:c",
+		"requests:4|c",
+	}
+	req := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader(strings.Join(lines, "\n")))
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		gatherer prometheus.Gatherer
+		name     string
+		value    float64
+		found    bool
+	}{
+		{srv.tenantsByName["a"].registry, "a_requests", 1, true},
+		// Beyond the series limit of the tenant.
+		{srv.tenantsByName["a"].registry, "a_errors", 0, false},
+		// All values of the packet belong to the tagged tenant.
+		{srv.tenantsByName["b"].registry, "b_requests", 5, true},
+		{reg, "b_requests", 0, false},
+		// Events of unknown tenants are dropped.
+		{reg, "unknown_requests", 0, false},
+		{reg, "statsd_exporter_tenant_unknown_events_total", 1, true},
+		{reg, "requests", 4, true},
+		{reg, "statsd_exporter_tenant_series", 1, true},
+	}
+	for _, s := range scenarios {
+		value, found := metricValue(t, s.gatherer, s.name)
+		if found != s.found || value != s.value {
+			t.Errorf("Expected %s to be %v (found: %v), got %v (found: %v)", s.name, s.value, s.found, value, found)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics/b", nil)
+	rec = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, req)
+	if body := rec.Body.String(); !strings.Contains(body, `b_requests{env="prod"} 5`) || strings.Contains(body, "tenant=") {
+		t.Fatalf("Expected only the metrics of tenant b, got %s", body)
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	udp := listener.ListenerConfig{Name: "udp", Type: listener.TypeUDP, Address: ":9125"}
+
+	scenarios := []struct {
+		name   string
+		modify func(cfg *Config)
+	}{
+		{
+			name:   "no listeners",
+			modify: func(cfg *Config) {},
+		}, {
+			name: "duplicate listeners",
+			modify: func(cfg *Config) {
+				cfg.Listeners = []listener.ListenerConfig{udp, udp}
+			},
+		}, {
+			name: "no UDP readers",
+			modify: func(cfg *Config) {
+				cfg.Listeners = []listener.ListenerConfig{udp}
+				cfg.UDPReaders = 0
+			},
+		}, {
+			name: "missing mapping config",
+			modify: func(cfg *Config) {
+				cfg.Listeners = []listener.ListenerConfig{udp}
+				cfg.MappingConfig = "does-not-exist.yml"
+			},
+		}, {
+			name: "tenant with unknown listener",
+			modify: func(cfg *Config) {
+				cfg.Listeners = []listener.ListenerConfig{udp}
+				cfg.Tenants = &TenantsConfig{Tenants: []TenantConfig{{Name: "a", Listeners: []string{"tcp"}}}}
+			},
+		}, {
+			name: "listener of two tenants",
+			modify: func(cfg *Config) {
+				cfg.Listeners = []listener.ListenerConfig{udp}
+				cfg.Tenants = &TenantsConfig{Tenants: []TenantConfig{
+					{Name: "a", Listeners: []string{"udp"}},
+					{Name: "b", Listeners: []string{"udp"}},
+				}}
+			},
+		}, {
+			name: "invalid tenant name",
+			modify: func(cfg *Config) {
+				cfg.Listeners = []listener.ListenerConfig{udp}
+				cfg.Tenants = &TenantsConfig{Tenants: []TenantConfig{{Name: "a/b"}}}
+			},
+		}, {
+			name: "drop-oldest without an event queue",
+			modify: func(cfg *Config) {
+				cfg.Listeners = []listener.ListenerConfig{udp}
+				cfg.EventQueueSize = 0
+				cfg.EventQueueOverflow = event.OverflowDropOldest
+			},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			cfg := DefaultConfig
+			cfg.Registerer = prometheus.NewRegistry()
+			scenario.modify(&cfg)
+			if _, err := New(cfg); err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/statsd_exporter/pkg/event"
+	"github.com/prometheus/statsd_exporter/pkg/exporter"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+var tenantNameRE = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// TenantsConfig is the content of a tenants configuration file.
+type TenantsConfig struct {
+	// Tag is the name of the tag that selects the tenant of an event. It is
+	// removed from the events.
+	Tag     string         `yaml:"tag"`
+	Tenants []TenantConfig `yaml:"tenants"`
+}
+
+// TenantConfig configures a tenant. Its metrics are exposed below the metrics
+// endpoint at /<name>.
+type TenantConfig struct {
+	Name string `yaml:"name"`
+	// Listeners are the names of the listeners whose events belong to the
+	// tenant, unless the tenant tag selects another one.
+	Listeners []string `yaml:"listeners"`
+	// Prefix selects the events of other listeners whose metric names start
+	// with it. The metric names are not changed.
+	Prefix string `yaml:"prefix"`
+	// MappingConfig is the mapping configuration file of the tenant. Without
+	// one, the metrics of the tenant are not mapped.
+	MappingConfig string `yaml:"mapping_config"`
+	// SeriesLimit is the maximum number of series of the tenant. Zero means
+	// no limit.
+	SeriesLimit int `yaml:"series_limit"`
+}
+
+// LoadTenantsConfig reads a tenants configuration file.
+func LoadTenantsConfig(fileName string) (*TenantsConfig, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var cfg TenantsConfig
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *TenantsConfig) validate() error {
+	if c.Tag != "" && !model.LabelName(c.Tag).IsValid() {
+		return fmt.Errorf("invalid tag %q", c.Tag)
+	}
+	names := map[string]bool{}
+	for i, t := range c.Tenants {
+		if !tenantNameRE.MatchString(t.Name) {
+			return fmt.Errorf("tenant %d: invalid name %q", i, t.Name)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		names[t.Name] = true
+		if t.SeriesLimit < 0 {
+			return fmt.Errorf("tenant %q: series_limit must not be negative", t.Name)
+		}
+	}
+	return nil
+}
+
+// tenant is the pipeline of the events of a tenant, from its event queue to
+// its own registry.
+type tenant struct {
+	cfg        TenantConfig
+	registry   *prometheus.Registry
+	mapper     *mapper.MetricMapper
+	events     chan event.Events
+	eventQueue *event.EventQueue
+	exporter   *exporter.Exporter
+	done       chan struct{}
+}
+
+func (s *Server) newTenant(cfg TenantConfig) (*tenant, error) {
+	m := s.metrics
+	labels := prometheus.Labels{"tenant": cfg.Name}
+	t := &tenant{
+		cfg:      cfg,
+		registry: prometheus.NewRegistry(),
+		events:   make(chan event.Events, s.cfg.EventQueueSize),
+		done:     make(chan struct{}),
+	}
+
+	// The mapping cache metrics are exposed with the metrics of the tenant,
+	// as they would conflict with those of the other tenants.
+	t.mapper = &mapper.MetricMapper{
+		MappingsCount: m.tenantMappingsCount.WithLabelValues(cfg.Name),
+		Registerer:    t.registry,
+	}
+	if cfg.MappingConfig != "" {
+		if err := t.mapper.InitFromFile(cfg.MappingConfig, s.cfg.CacheSize, s.cacheOption); err != nil {
+			return nil, fmt.Errorf("error loading config of tenant %q: %v", cfg.Name, err)
+		}
+	} else {
+		t.mapper.InitCache(s.cfg.CacheSize, s.cacheOption)
+	}
+
+	t.eventQueue = event.NewEventQueue(t.events, s.cfg.EventFlushThreshold, s.cfg.EventFlushInterval, m.eventsFlushed,
+		event.WithOverflowPolicy(s.cfg.EventQueueOverflow),
+		event.WithEventsDropped(m.tenantEventsDropped.MustCurryWith(labels)),
+	)
+	t.exporter = exporter.NewExporter(t.registry, t.mapper, log.With(s.logger, "tenant", cfg.Name),
+		m.tenantEventsActions.MustCurryWith(labels),
+		m.tenantEventsUnmapped.WithLabelValues(cfg.Name),
+		m.tenantErrorEventStats.MustCurryWith(labels),
+		m.tenantEventStats.MustCurryWith(labels),
+		m.tenantConflictingEventStats.MustCurryWith(labels),
+		m.tenantMetricsCount.MustCurryWith(labels),
+	)
+	t.exporter.Shards = s.cfg.EventShards
+	t.exporter.Registry.SeriesLimit = cfg.SeriesLimit
+	return t, nil
+}
+
+// collectors returns the metrics about the tenant that are not labelled by
+// the exporter's own metric vectors.
+func (t *tenant) collectors() []prometheus.Collector {
+	labels := prometheus.Labels{"tenant": t.cfg.Name}
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "statsd_exporter_tenant_series",
+				Help:        "The current number of series of the tenant.",
+				ConstLabels: labels,
+			},
+			func() float64 { return float64(t.exporter.Registry.Series()) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "statsd_exporter_tenant_series_limit",
+				Help:        "The maximum number of series of the tenant, or zero if there is no limit.",
+				ConstLabels: labels,
+			},
+			func() float64 { return float64(t.cfg.SeriesLimit) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "statsd_exporter_tenant_event_queue_length",
+				Help:        "The number of events of the tenant waiting to be flushed to the event channel.",
+				ConstLabels: labels,
+			},
+			func() float64 { return float64(t.eventQueue.Len()) },
+		),
+	}
+}
+
+// tenantRouter is an event.EventHandler that passes the events of a listener
+// on to the event queues of their tenants. Events without a tenant go to the
+// event queue of the server.
+type tenantRouter struct {
+	server *Server
+	// tenant is the tenant of the listener, if any.
+	tenant *tenant
+}
+
+// eventHandler returns the handler of the events received by a listener.
+func (s *Server) eventHandler(listenerName string) event.EventHandler {
+	if len(s.tenants) == 0 {
+		return s.eventQueue
+	}
+	return &tenantRouter{server: s, tenant: s.listenerTenants[listenerName]}
+}
+
+// Queue selects the tenant of each event by the tenant tag, then by the
+// listener and then by the prefixes of the tenants, in the order they are
+// configured.
+func (r *tenantRouter) Queue(events event.Events) {
+	s := r.server
+	tenants := make(map[*tenant]event.Events, 1)
+	var untenanted event.Events
+	for _, e := range events {
+		t, e, ok := r.tenantOf(e)
+		if !ok {
+			continue
+		}
+		if t == nil {
+			untenanted = append(untenanted, e)
+			continue
+		}
+		tenants[t] = append(tenants[t], e)
+	}
+	if len(untenanted) > 0 {
+		s.eventQueue.Queue(untenanted)
+	}
+	for t, events := range tenants {
+		t.eventQueue.Queue(events)
+	}
+}
+
+// tenantOf returns the tenant of an event, or nil if it has none, and the
+// event without the tenant tag. It returns false if the tenant tag names an
+// unknown tenant, in which case the event is dropped.
+func (r *tenantRouter) tenantOf(e event.Event) (*tenant, event.Event, bool) {
+	s := r.server
+	if tag := s.cfg.Tenants.Tag; tag != "" {
+		if name, ok := e.Labels()[tag]; ok {
+			// The labels may be shared with other events, so the tag is
+			// removed from a copy.
+			labels := make(map[string]string, len(e.Labels())-1)
+			for k, v := range e.Labels() {
+				if k != tag {
+					labels[k] = v
+				}
+			}
+			e = event.WithLabels(e, labels)
+			t, ok := s.tenantsByName[name]
+			if !ok {
+				s.metrics.tenantUnknownEvents.Inc()
+				level.Debug(s.logger).Log("msg", "Dropping event of unknown tenant", "tenant", name, "metric", e.MetricName())
+				return nil, nil, false
+			}
+			return t, e, true
+		}
+	}
+	if r.tenant != nil {
+		return r.tenant, e, true
+	}
+	for _, t := range s.tenants {
+		if t.cfg.Prefix != "" && strings.HasPrefix(e.MetricName(), t.cfg.Prefix) {
+			return t, e, true
+		}
+	}
+	return nil, e, true
+}